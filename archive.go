@@ -0,0 +1,150 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvr
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"os"
+)
+
+// This file contains the functions that allow archives to be read and
+// written outside of recording and replaying, for tools that inspect, import
+// or convert recordings.
+
+// Reads every recording stored in the archive at the given path, in the
+// order that they were recorded.
+func ReadArchiveFile(name string) ([]*RequestResponse, error) {
+	queries, err := readArchiveFile(name)
+	if err != nil {
+		return nil, err
+	}
+	rrs := make([]*RequestResponse, len(queries))
+	for i, q := range queries {
+		rrs[i] = q.RequestResponse()
+	}
+	return rrs, nil
+}
+
+// Checks that the archive at the given path can be read in full: that it has
+// a known version, that the compressed stream is complete and passes its
+// checksums, that its index lists every entry, and that every entry can be
+// decoded. Unlike ReadArchiveFile() this carries on past entries that can't
+// be decoded, returning every recording that could be along with a
+// description of each problem found.
+func VerifyArchiveFile(name string) ([]*RequestResponse, []error) {
+	fd, err := os.Open(name)
+	if err != nil {
+		return nil, []error{err}
+	}
+	defer fd.Close()
+
+	version, err := readVersion(fd)
+	if _, ok := err.(*archiveVersionError); ok {
+		return nil, []error{err}
+	} else if err != nil {
+		return nil, []error{fmt.Errorf("reading the version: %s", err)}
+	}
+	next, err := archiveEntries(version, fd)
+	if err != nil {
+		return nil, []error{err}
+	}
+
+	// Entries that can't be decoded are left as nil so that the response
+	// bodies shared between entries can be reported by index.
+	var queries []*gobQuery
+	var problems []error
+	for index := 0; ; index++ {
+		data, err := next()
+		if err == io.EOF {
+			break
+		} else if err == io.ErrUnexpectedEOF {
+			// Archives are left like this when a recording test binary is
+			// killed before it exits.
+			problems = append(problems, fmt.Errorf(
+				"the archive is truncated after %d entries", index))
+			return verifiedRecordings(queries, problems)
+		} else if err != nil {
+			problems = append(problems, fmt.Errorf(
+				"entry %d: %s", index, err))
+			return verifiedRecordings(queries, problems)
+		}
+		q := new(gobQuery)
+		decoder := gob.NewDecoder(bytes.NewReader(data))
+		if err := decoder.Decode(q); err != nil {
+			problems = append(problems, fmt.Errorf("entry %d: %s", index, err))
+			q = nil
+		}
+		queries = append(queries, q)
+	}
+	return verifiedRecordings(queries, problems)
+}
+
+// Resolves the shared response bodies of the entries read by
+// VerifyArchiveFile() and returns those that were decoded, along with the
+// problems found.
+func verifiedRecordings(
+	queries []*gobQuery, problems []error,
+) ([]*RequestResponse, []error) {
+	problems = append(problems, resolveBodies(queries)...)
+	var rrs []*RequestResponse
+	for _, q := range queries {
+		if q != nil {
+			rrs = append(rrs, q.RequestResponse())
+		}
+	}
+	return rrs, problems
+}
+
+// Writes the given recordings into a new archive at the given path,
+// replacing any existing file. The archive is written next to the file and
+// renamed over it once complete, so the file is never left half written. The
+// UserData field is not stored.
+func WriteArchiveFile(name string, rrs []*RequestResponse) error {
+	queries := make([]*gobQuery, len(rrs))
+	for i, rr := range rrs {
+		queries[i] = newGobQuery(rr)
+	}
+	return writeArchiveFile(name, queries)
+}
+
+// Converts a RequestResponse into a gobQuery that can be stored.
+func newGobQuery(rr *RequestResponse) *gobQuery {
+	q := &gobQuery{
+		RedactedQueryParams: rr.RedactedQueryParams,
+		Partition:           rr.Partition,
+		RunID:               rr.RunID,
+		Labels:              rr.Labels,
+		Recorded:            rr.Recorded,
+		Duration:            rr.Duration,
+		Matching:            rr.matching,
+	}
+	q.Request = newGobRequest(rr.Request)
+	if q.Request != nil {
+		q.Request.Body = rr.RequestBody
+		q.Request.Error.Error = rr.RequestBodyError
+	}
+	q.Response = newGobResponse(rr.Response)
+	if q.Response != nil {
+		q.Response.Body = rr.ResponseBody
+		q.Response.Error.Error = rr.ResponseBodyError
+	}
+	q.Error.Error = rr.Error
+	q.Interim = rr.Interim
+	q.Trace = rr.Trace
+	return q
+}
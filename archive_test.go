@@ -0,0 +1,112 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvr
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/liquidgecka/testlib"
+)
+
+func TestVerifyArchiveFile(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	u, _ := url.Parse("https://example.com/")
+	rr := &RequestResponse{
+		Request:      &http.Request{Method: "GET", URL: u},
+		Response:     &http.Response{Status: "200 OK", StatusCode: 200},
+		ResponseBody: []byte(strings.Repeat("body ", 1000)),
+	}
+	name := filepath.Join(t.TempDir(), "archive.dvr")
+	T.ExpectSuccess(WriteArchiveFile(name, []*RequestResponse{rr, rr}))
+	rrs, problems := VerifyArchiveFile(name)
+	T.Equal(len(rrs), 2)
+	T.Equal(len(problems), 0)
+	data, err := ioutil.ReadFile(name)
+	T.ExpectSuccess(err)
+
+	// Truncated archives and unknown versions.
+	T.ExpectSuccess(ioutil.WriteFile(name, data[:len(data)-10], 0644))
+	_, problems = VerifyArchiveFile(name)
+	T.Equal(len(problems), 1)
+	T.ExpectSuccess(ioutil.WriteFile(name, append([]byte{0, 0, 0, 3},
+		data[4:]...), 0644))
+	_, problems = VerifyArchiveFile(name)
+	T.ExpectErrorMessage(problems[0], "archive format v3")
+
+	// Entries that can't be decoded are skipped.
+	buffer := bytes.NewBuffer([]byte{0, 0, 0, 1})
+	compressor := gzip.NewWriter(buffer)
+	writer := tar.NewWriter(compressor)
+	for i, entry := range []string{"garbage", "more garbage"} {
+		T.ExpectSuccess(writer.WriteHeader(&tar.Header{
+			Name: fmt.Sprint(i), Size: int64(len(entry))}))
+		_, err := writer.Write([]byte(entry))
+		T.ExpectSuccess(err)
+	}
+	T.ExpectSuccess(writer.Close())
+	T.ExpectSuccess(compressor.Close())
+	T.ExpectSuccess(ioutil.WriteFile(name, buffer.Bytes(), 0644))
+	rrs, problems = VerifyArchiveFile(name)
+	T.Equal(len(rrs), 0)
+	T.Equal(len(problems), 2)
+	T.Equal(strings.HasPrefix(problems[0].Error(), "entry 0: "), true)
+	T.Equal(strings.HasPrefix(problems[1].Error(), "entry 1: "), true)
+}
+
+func TestSharedResponseBodies(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	// Identical large bodies are stored once and shared when read back.
+	body := strings.Repeat("x", minSharedBody)
+	name := T.TempFile().Name()
+	T.ExpectSuccess(WriteArchiveFile(name, []*RequestResponse{
+		testQuery("GET", "http://api.example.com/a", "", 200, body).
+			RequestResponse(),
+		testQuery("GET", "http://api.example.com/b", "", 200, body).
+			RequestResponse(),
+		testQuery("GET", "http://api.example.com/c", "", 200, "small").
+			RequestResponse(),
+	}))
+	rrs, problems := VerifyArchiveFile(name)
+	T.Equal(len(problems), 0)
+	T.Equal(len(rrs), 3)
+	T.Equal(string(rrs[0].ResponseBody), body)
+	T.Equal(string(rrs[1].ResponseBody), body)
+	T.Equal(&rrs[0].ResponseBody[0], &rrs[1].ResponseBody[0])
+	T.Equal(string(rrs[2].ResponseBody), "small")
+
+	// A reference to a body that isn't in the archive is a problem.
+	q := testQuery("GET", "http://api.example.com/d", "", 200, "")
+	q.Response.BodyHash = "missing"
+	T.ExpectSuccess(writeArchiveFile(name, []*gobQuery{q}))
+	rrs, problems = VerifyArchiveFile(name)
+	T.Equal(len(rrs), 1)
+	T.Equal(len(problems), 1)
+	T.ExpectErrorMessage(problems[0], "entry 0: the response body")
+	_, err := ReadArchiveFile(name)
+	T.ExpectErrorMessage(err, "entry 0: the response body")
+}
@@ -0,0 +1,251 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// ArchiveStore is implemented by backends that keep archives somewhere other
+// than the local filesystem, such as a cloud storage bucket. Once a store is
+// registered for a URL scheme with RegisterArchiveStore() the -dvr.file flag
+// accepts URLs with that scheme, for example "s3://bucket/key". The
+// dvrs3 and dvrgcs packages provide stores for S3 and GCS, and CassetteStore
+// is registered for http:// and https:// URLs.
+//
+// Remote archives are downloaded into a local cache and only downloaded again
+// when the version of the remote archive changes. Recordings are written to
+// the cache and uploaded by Close(), which must be called once the tests have
+// finished, typically from TestMain():
+//
+//	func TestMain(m *testing.M) {
+//		code := m.Run()
+//		if err := dvr.Close(); err != nil {
+//			fmt.Println(err)
+//			code = 1
+//		}
+//		os.Exit(code)
+//	}
+type ArchiveStore interface {
+	// Returns an identifier for the current version of the archive, such as
+	// an ETag or generation number. If the archive does not exist the
+	// returned error must wrap os.ErrNotExist.
+	Version(ctx context.Context, u *url.URL) (string, error)
+
+	// Writes the archive to w, returning the version that was downloaded.
+	// If the archive does not exist the returned error must wrap
+	// os.ErrNotExist.
+	Download(ctx context.Context, u *url.URL, w io.Writer) (string, error)
+
+	// Replaces the archive with the contents of r.
+	Upload(ctx context.Context, u *url.URL, r io.Reader) error
+}
+
+var (
+	// The registered stores, keyed by URL scheme.
+	archiveStores     = map[string]ArchiveStore{}
+	archiveStoresLock sync.Mutex
+
+	// The directory that remote archives are cached in. If this is empty
+	// then the "dvr" directory in os.UserCacheDir() is used.
+	archiveCacheDir string
+)
+
+// Registers the ArchiveStore used for -dvr.file URLs with the given scheme.
+// This is normally called from the init() function of the package providing
+// the store.
+func RegisterArchiveStore(scheme string, store ArchiveStore) {
+	archiveStoresLock.Lock()
+	defer archiveStoresLock.Unlock()
+	archiveStores[scheme] = store
+}
+
+// Returns the store and parsed URL for the given archive name, or a nil
+// store if the name is a local path.
+func remoteArchive(name string) (ArchiveStore, *url.URL, error) {
+	if !strings.Contains(name, "://") {
+		return nil, nil, nil
+	}
+	u, err := url.Parse(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	archiveStoresLock.Lock()
+	store := archiveStores[u.Scheme]
+	archiveStoresLock.Unlock()
+	if store == nil {
+		return nil, nil, fmt.Errorf(
+			"dvr: no ArchiveStore is registered for %s:// archives", u.Scheme)
+	}
+	return store, u, nil
+}
+
+// Returns the path of the local copy of a remote archive.
+func archiveCachePath(u *url.URL) (string, error) {
+	dir := archiveCacheDir
+	if dir == "" {
+		cache, err := os.UserCacheDir()
+		if err != nil {
+			return "", err
+		}
+		dir = filepath.Join(cache, "dvr")
+	}
+	// Ports are kept out of the file name since ":" isn't allowed in them on
+	// Windows.
+	host := strings.ReplaceAll(u.Host, ":", "_")
+	return filepath.Join(dir, u.Scheme, host, filepath.FromSlash(u.Path)), nil
+}
+
+// Returns the local path of the archive named by -dvr.file. For remote
+// archives this downloads the archive into the cache if the cached copy is
+// missing or out of date. If the remote archive does not exist then the
+// returned path will not exist either.
+func archivePath() (string, error) {
+	if dir := segmentDir(); dir != "" {
+		return segmentPath(dir), nil
+	}
+	store, u, err := remoteArchive(fileName)
+	if err != nil || store == nil {
+		return fileName, err
+	}
+	path, err := archiveCachePath(u)
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), os.FileMode(0755)); err != nil {
+		return "", err
+	}
+
+	// Compare the remote version with the version that was cached. If the
+	// store can't be reached then the cached copy is used if there is one.
+	ctx := context.Background()
+	cached, _ := ioutil.ReadFile(path + ".version")
+	version, err := store.Version(ctx, u)
+	if errors.Is(err, os.ErrNotExist) {
+		os.Remove(path)
+		os.Remove(path + ".version")
+		return path, nil
+	} else if err != nil {
+		if _, statErr := os.Stat(path); statErr == nil {
+			return path, nil
+		}
+		return "", err
+	} else if string(cached) == version {
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+
+	// Download into a temporary file so that a failed download never
+	// leaves a partial archive in the cache.
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".download")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	version, err = store.Download(ctx, u, tmp)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	} else if err := os.Rename(tmp.Name(), path); err != nil {
+		return "", err
+	}
+	return path, ioutil.WriteFile(path+".version", []byte(version),
+		os.FileMode(0644))
+}
+
+// Uploads the local copy of a remote archive. This does nothing if the
+// archive is a local file.
+func uploadArchive(path string) error {
+	if segmentDir() != "" {
+		return nil
+	}
+	store, u, err := remoteArchive(fileName)
+	if err != nil || store == nil {
+		return err
+	}
+	fd, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	ctx := context.Background()
+	if err := store.Upload(ctx, u, fd); err != nil {
+		return err
+	}
+
+	// The cached copy is now the current version so it doesn't need to be
+	// downloaded again.
+	version, err := store.Version(ctx, u)
+	if err != nil {
+		os.Remove(path + ".version")
+		return nil
+	}
+	return ioutil.WriteFile(path+".version", []byte(version),
+		os.FileMode(0644))
+}
+
+// Finishes writing the archive being recorded and uploads it if -dvr.file
+// names a remote archive. Nothing can be recorded after this has been
+// called. A record run must call this once its tests have finished, normally
+// from TestMain, since a recording that is not closed is discarded when the
+// process exits. This keeps a run that panics, times out or is killed from
+// replacing the archive with a partial recording. When replaying with
+// -dvr.stream_bodies or -dvr.max_memory this closes the file that response
+// bodies are read from, deleting it if it is a temporary file, after which
+// they can't be replayed.
+func Close() error {
+	if err := closeSpool(); err != nil {
+		return err
+	}
+	writerLock.Lock()
+	defer writerLock.Unlock()
+	if writer == nil {
+		return nil
+	}
+
+	// Closing the pipe lets the gzipper finish writing the file. Anything
+	// still buffered for -dvr.flush_interval has to be written first, and
+	// completeToken last to tell the gzipper that the recording is whole.
+	if err := flushWriterBuffer(); err != nil {
+		return err
+	} else if err := writeEntry(fd, []byte(completeToken)); err != nil {
+		return err
+	} else if err := fd.Close(); err != nil {
+		return err
+	} else if err := writerCmd.Wait(); err != nil {
+		return err
+	} else if err := archiveFD.Close(); err != nil {
+		return err
+	}
+	writer = nil
+	writerBuffer = nil
+	fd = nil
+	writerCmd = nil
+	archiveFD = nil
+	return uploadArchive(recordPath)
+}
@@ -0,0 +1,147 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvr
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/liquidgecka/testlib"
+)
+
+// An in memory ArchiveStore.
+type memStore struct {
+	data      map[string][]byte
+	version   int
+	offline   bool
+	downloads int
+}
+
+func (m *memStore) Version(ctx context.Context, u *url.URL) (string, error) {
+	if m.offline {
+		return "", errors.New("offline")
+	} else if _, ok := m.data[u.String()]; !ok {
+		return "", os.ErrNotExist
+	}
+	return fmt.Sprint(m.version), nil
+}
+
+func (m *memStore) Download(
+	ctx context.Context, u *url.URL, w io.Writer,
+) (string, error) {
+	m.downloads++
+	_, err := w.Write(m.data[u.String()])
+	return fmt.Sprint(m.version), err
+}
+
+func (m *memStore) Upload(ctx context.Context, u *url.URL, r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	m.data[u.String()] = data
+	m.version++
+	return err
+}
+
+func TestArchiveStore(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+	defer func() {
+		fileName = "testdata/archive.dvr"
+		archiveCacheDir = ""
+		delete(archiveStores, "mem")
+	}()
+
+	store := &memStore{data: map[string][]byte{}}
+	RegisterArchiveStore("mem", store)
+	archiveCacheDir = t.TempDir()
+	cached := filepath.Join(archiveCacheDir, "mem", "bucket", "a.dvr")
+
+	// Local paths are used as they are.
+	fileName = "testdata/archive.dvr"
+	path, err := archivePath()
+	T.ExpectSuccess(err)
+	T.Equal(path, "testdata/archive.dvr")
+
+	// Unknown schemes are an error.
+	fileName = "unknown://bucket/a.dvr"
+	_, err = archivePath()
+	T.ExpectErrorMessage(err,
+		"dvr: no ArchiveStore is registered for unknown:// archives")
+
+	// A remote archive that doesn't exist yet.
+	fileName = "mem://bucket/a.dvr"
+	path, err = archivePath()
+	T.ExpectSuccess(err)
+	T.Equal(path, cached)
+	_, err = os.Stat(path)
+	T.Equal(os.IsNotExist(err), true)
+
+	// Uploading a recording.
+	T.ExpectSuccess(ioutil.WriteFile(cached, []byte("v1"), 0644))
+	T.ExpectSuccess(uploadArchive(cached))
+	T.Equal(string(store.data["mem://bucket/a.dvr"]), "v1")
+
+	// The uploaded copy is current so it is not downloaded.
+	path, err = archivePath()
+	T.ExpectSuccess(err)
+	T.Equal(store.downloads, 0)
+
+	// A new version is downloaded once.
+	store.data["mem://bucket/a.dvr"] = []byte("v2")
+	store.version++
+	for i := 0; i < 2; i++ {
+		path, err = archivePath()
+		T.ExpectSuccess(err)
+		data, err := ioutil.ReadFile(path)
+		T.ExpectSuccess(err)
+		T.Equal(string(data), "v2")
+	}
+	T.Equal(store.downloads, 1)
+
+	// The cached copy is used when the store can't be reached.
+	store.offline = true
+	path, err = archivePath()
+	T.ExpectSuccess(err)
+	T.Equal(path, cached)
+	T.ExpectSuccess(os.Remove(cached))
+	_, err = archivePath()
+	T.ExpectErrorMessage(err, "offline")
+
+	// Close does nothing when not recording.
+	T.ExpectSuccess(Close())
+	T.Equal(bytes.Equal(store.data["mem://bucket/a.dvr"], []byte("v2")), true)
+}
+
+func TestArchiveCachePath(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+	defer func() { archiveCacheDir = "" }()
+	archiveCacheDir = t.TempDir()
+
+	// Ports are not kept in the name since Windows doesn't allow them.
+	u, err := url.Parse("mem://localhost:9000/fixtures/a.dvr")
+	T.ExpectSuccess(err)
+	path, err := archiveCachePath(u)
+	T.ExpectSuccess(err)
+	T.Equal(path, filepath.Join(archiveCacheDir, "mem", "localhost_9000",
+		"fixtures", "a.dvr"))
+}
@@ -0,0 +1,146 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvr
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// Set by -dvr.auto to record when the service being tested can be
+	// reached, and replay when it can't. See chooseAutoMode().
+	autoMode bool
+
+	// Set by -dvr.auto_probe to the host:port that -dvr.auto checks. If
+	// empty the host of the first request is checked.
+	autoProbe string
+
+	// How long -dvr.auto waits to connect to the service.
+	autoProbeTimeout = 2 * time.Second
+
+	// Connects to the given address to see if it can be reached.
+	autoDial = func(addr string, timeout time.Duration) error {
+		conn, err := net.DialTimeout("tcp", addr, timeout)
+		if err == nil {
+			conn.Close()
+		}
+		return err
+	}
+
+	// Set to 1 once the choice for -dvr.auto has been made, so that later
+	// calls can check it without taking autoLock. autoMode is left as it
+	// was given so that it is never written while it may be read.
+	autoChosen uint32
+
+	// Held while the choice for -dvr.auto is made so that concurrent first
+	// calls all wait for it.
+	autoLock sync.Mutex
+)
+
+// Chooses between recording and replaying for -dvr.auto when the first
+// request is made, so that tests run on a network that can reach the service
+// refresh the archive and tests run offline use it. A TCP connection is made
+// to -dvr.auto_probe, or to the host of the request if it isn't set, and
+// recording is chosen if it succeeds. The choice is made once and then acts
+// as if -dvr.record or -dvr.replay had been given.
+func chooseAutoMode(req *http.Request) {
+	settleAutoMode(func() string {
+		if req.URL.Host == "" {
+			return ""
+		}
+		return canonicalAddr(req)
+	})
+}
+
+// ProbeAutoMode makes the choice for -dvr.auto, if it hasn't been made yet,
+// by checking whether addr can be reached. addr is either a host:port or a
+// URL, in which case the default port of its scheme is used if it has none.
+// Requests sent through NewRoundTripper() and connections made through
+// InterceptDial() do this for themselves, so this is only needed by code
+// that calls a service some other way and checks IsReplay() or
+// IsPassingThrough() first. Otherwise the choice is made by the first call
+// to either of those, probing -dvr.auto_probe or replaying if it isn't set.
+// This does nothing unless -dvr.auto is set.
+func ProbeAutoMode(addr string) {
+	settleAutoMode(func() string {
+		if !strings.Contains(addr, "://") {
+			return addr
+		}
+		u, err := url.Parse(addr)
+		if err != nil || u.Host == "" {
+			return ""
+		}
+		return canonicalAddr(&http.Request{URL: u})
+	})
+}
+
+// Returns true if -dvr.auto is set and its choice has not been made yet.
+func autoPending() bool {
+	return autoMode && atomic.LoadUint32(&autoChosen) == 0
+}
+
+// Makes the choice for -dvr.auto if it hasn't been made, probing the address
+// returned by addr. Once it has been made this only loads autoChosen.
+func settleAutoMode(addr func() string) {
+	if atomic.LoadUint32(&autoChosen) == 1 || !autoMode {
+		return
+	}
+	autoLock.Lock()
+	defer autoLock.Unlock()
+	if atomic.LoadUint32(&autoChosen) == 1 {
+		return
+	}
+	defer atomic.StoreUint32(&autoChosen, 1)
+	pickAutoMode(addr())
+}
+
+// Makes the choice for -dvr.auto by probing -dvr.auto_probe, or addr if it
+// isn't set.
+func pickAutoMode(addr string) {
+	if autoProbe != "" {
+		addr = autoProbe
+	}
+	panicIfError(checkModeFlags())
+
+	// There is no point probing if recording isn't allowed.
+	if forbidRecord {
+		fmt.Fprintf(panicOutput, "dvr: -dvr.auto is replaying since "+
+			"recording is forbidden by -dvr.forbid_record\n")
+		replay = true
+		return
+	}
+
+	if addr == "" {
+		fmt.Fprintf(panicOutput, "dvr: -dvr.auto is replaying since the "+
+			"first call has no address to probe, -dvr.auto_probe can "+
+			"name one\n")
+		replay = true
+	} else if err := autoDial(addr, autoProbeTimeout); err != nil {
+		fmt.Fprintf(panicOutput, "dvr: -dvr.auto is replaying since %s "+
+			"can not be reached: %s\n", addr, err)
+		replay = true
+	} else {
+		fmt.Fprintf(panicOutput, "dvr: -dvr.auto is recording since %s "+
+			"can be reached\n", addr)
+		record = true
+	}
+}
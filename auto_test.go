@@ -0,0 +1,234 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvr
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/liquidgecka/testlib"
+)
+
+func TestChooseAutoMode(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+	defer resetBenchmark()
+	defer func(dial func(string, time.Duration) error) {
+		autoDial = dial
+		autoMode = false
+		autoProbe = ""
+		panicOutput = ioutil.Discard
+	}(autoDial)
+	output := &bytes.Buffer{}
+	panicOutput = output
+
+	var probed []string
+	reachable := true
+	autoDial = func(addr string, timeout time.Duration) error {
+		probed = append(probed, addr)
+		if !reachable {
+			return errors.New("network is unreachable")
+		}
+		return nil
+	}
+	rt := &roundTripper{realRoundTripper: roundTripperFunc(
+		func(req *http.Request) (*http.Response, error) {
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(strings.NewReader("live")),
+			}, nil
+		})}
+	get := func(url string) string {
+		req, err := http.NewRequest("GET", url, nil)
+		T.ExpectSuccess(err)
+		resp, err := rt.RoundTrip(req)
+		T.ExpectSuccess(err)
+		body, err := ioutil.ReadAll(resp.Body)
+		T.ExpectSuccess(err)
+		return string(body)
+	}
+
+	// The host of the first request is reachable so it is recorded, and it
+	// is only checked once.
+	fileName = T.TempFile().Name()
+	RecordRequest = func(*http.Request) bool { return true }
+	autoChosen = 0
+	autoMode = true
+	T.Equal(get("https://api.example.com/items"), "live")
+	T.Equal(get("http://other.example.com/"), "live")
+	T.Equal(probed, []string{"api.example.com:443"})
+	T.Equal(IsRecording(), true)
+	T.Equal(output.String(), "dvr: -dvr.auto is recording since "+
+		"api.example.com:443 can be reached\n")
+	T.ExpectSuccess(Close())
+
+	// Offline the recording is replayed, checking -dvr.auto_probe.
+	record = false
+	isSetup = sync.Once{}
+	autoChosen = 0
+	autoMode = true
+	autoProbe = "vpn.example.com:22"
+	reachable = false
+	output.Reset()
+	rt.realRoundTripper = roundTripperFunc(
+		func(req *http.Request) (*http.Response, error) {
+			return nil, errors.New("offline")
+		})
+	T.Equal(get("https://api.example.com/items"), "live")
+	T.Equal(IsReplay(), true)
+	T.Equal(output.String(), "dvr: -dvr.auto is replaying since "+
+		"vpn.example.com:22 can not be reached: network is unreachable\n")
+
+	// It can't be combined with another mode.
+	replay = false
+	autoChosen = 0
+	autoMode = true
+	record = true
+	func() {
+		defer func() {
+			failure, ok := recover().(*dvrFailure)
+			T.Equal(ok, true)
+			T.ExpectErrorMessage(failure,
+				"-dvr.record and -dvr.auto can not be used together")
+		}()
+		chooseAutoMode(&http.Request{URL: &url.URL{}})
+	}()
+}
+
+func TestChooseAutoModeWithoutHost(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+	defer resetBenchmark()
+	defer func(dial func(string, time.Duration) error) {
+		autoDial = dial
+		autoMode = false
+		panicOutput = ioutil.Discard
+	}(autoDial)
+	output := &bytes.Buffer{}
+	panicOutput = output
+
+	var probed []string
+	var lock sync.Mutex
+	autoDial = func(addr string, timeout time.Duration) error {
+		lock.Lock()
+		defer lock.Unlock()
+		probed = append(probed, addr)
+		return errors.New("network is unreachable")
+	}
+
+	// A request without a host has nothing to probe, so it replays rather
+	// than being passed through.
+	autoChosen = 0
+	autoMode = true
+	chooseAutoMode(&http.Request{URL: &url.URL{Path: "/items"}})
+	T.Equal(len(probed), 0)
+	T.Equal(IsReplay(), true)
+	T.Equal(output.String(), "dvr: -dvr.auto is replaying since the first "+
+		"call has no address to probe, -dvr.auto_probe can name one\n")
+
+	// Connections made through InterceptDial() probe the address dialed,
+	// once however many are made at the same time.
+	replay = false
+	autoChosen = 0
+	autoMode = true
+	fileName = T.TempFile().Name()
+	T.ExpectSuccess(writeArchiveFile(fileName, nil))
+	isSetup = sync.Once{}
+	errDial := errors.New("dialed")
+	dial := InterceptDial(
+		func(context.Context, string, string) (net.Conn, error) {
+			return nil, errDial
+		})
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := dial(context.Background(), "tcp", "db:5432")
+			T.Equal(err, errDial)
+		}()
+	}
+	wg.Wait()
+	T.Equal(probed, []string{"db:5432"})
+	T.Equal(IsReplay(), true)
+}
+
+func TestChooseAutoModeBeforeRequests(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+	defer resetBenchmark()
+	defer func(dial func(string, time.Duration) error) {
+		autoDial = dial
+		autoMode = false
+		autoProbe = ""
+		panicOutput = ioutil.Discard
+	}(autoDial)
+	panicOutput = ioutil.Discard
+
+	var probed []string
+	reachable := false
+	autoDial = func(addr string, timeout time.Duration) error {
+		probed = append(probed, addr)
+		if !reachable {
+			return errors.New("network is unreachable")
+		}
+		return nil
+	}
+
+	// Calls that check the mode before any HTTP request is made, like
+	// lookups through a Resolver, make the choice themselves rather than
+	// going to the network.
+	q := testQuery("GET", "dns:///host?host=db.internal", "", 200,
+		`{"Names":["10.0.0.1"]}`)
+	isSetup = sync.Once{}
+	isSetup.Do(func() {})
+	requestList = []*RequestResponse{q.RequestResponse()}
+	autoChosen = 0
+	autoMode = true
+	autoProbe = "vpn.example.com:22"
+	r := NewResolver(&net.Resolver{
+		PreferGo: true,
+		Dial: func(context.Context, string, string) (net.Conn, error) {
+			return nil, errors.New("no network")
+		},
+	})
+	addrs, err := r.LookupHost(context.Background(), "db.internal")
+	T.ExpectSuccess(err)
+	T.Equal(addrs, []string{"10.0.0.1"})
+	T.Equal(probed, []string{"vpn.example.com:22"})
+	T.Equal(IsReplay(), true)
+
+	// ProbeAutoMode() probes the service that other clients are about to
+	// call, using the default port of a URL's scheme.
+	replay = false
+	requestList = nil
+	autoChosen = 0
+	autoProbe = ""
+	probed = nil
+	reachable = true
+	ProbeAutoMode("https://api.example.com/v1")
+	ProbeAutoMode("other.example.com:80")
+	T.Equal(probed, []string{"api.example.com:443"})
+	T.Equal(IsRecording(), true)
+}
@@ -0,0 +1,163 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvr
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// The archive sizes that the replay benchmarks are run against.
+var benchmarkSizes = []int{100, 1000, 10000}
+
+// Writes an archive with n recordings of GET /n requests into a temporary
+// directory and points -dvr.file at it.
+func benchmarkArchive(b *testing.B, n int) {
+	queries := make([]*gobQuery, n)
+	for i := range queries {
+		queries[i] = testQuery("GET",
+			fmt.Sprintf("http://api.example.com/%d", i), "", 200,
+			fmt.Sprintf(`{"id": %d}`, i))
+	}
+	fileName = filepath.Join(b.TempDir(), "archive.dvr")
+	if err := writeArchiveFile(fileName, queries); err != nil {
+		b.Fatal(err)
+	}
+}
+
+// Restores the state changed by the benchmarks.
+func resetBenchmark() {
+	record = false
+	replay = false
+	fileName = "testdata/archive.dvr"
+	RecordRequest = nil
+	isSetup = sync.Once{}
+	requestList = nil
+	requestIndexes = nil
+}
+
+func BenchmarkRecord(b *testing.B) {
+	defer resetBenchmark()
+	fileName = filepath.Join(b.TempDir(), "archive.dvr")
+	record = true
+	RecordRequest = func(*http.Request) bool { return true }
+	isSetup = sync.Once{}
+
+	body := strings.Repeat("x", 1024)
+	rt := &roundTripper{realRoundTripper: roundTripperFunc(
+		func(req *http.Request) (*http.Response, error) {
+			return &http.Response{
+				Status:     "200 OK",
+				StatusCode: 200,
+				Header:     http.Header{"Content-Type": {"text/plain"}},
+				Body:       ioutil.NopCloser(strings.NewReader(body)),
+			}, nil
+		})}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		req, err := http.NewRequest("POST", "http://api.example.com/items",
+			strings.NewReader(body))
+		if err != nil {
+			b.Fatal(err)
+		}
+		resp, err := rt.RoundTrip(req)
+		if err != nil {
+			b.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+	}
+	b.StopTimer()
+	if err := Close(); err != nil {
+		b.Fatal(err)
+	}
+}
+
+func BenchmarkReplaySetup(b *testing.B) {
+	defer resetBenchmark()
+	for _, n := range benchmarkSizes {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			benchmarkArchive(b, n)
+			rt := &roundTripper{}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				rt.replaySetup()
+			}
+		})
+	}
+}
+
+func BenchmarkReplayMatch(b *testing.B) {
+	defer resetBenchmark()
+	for _, n := range benchmarkSizes {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			benchmarkArchive(b, n)
+			replay = true
+			isSetup = sync.Once{}
+			rt := &roundTripper{realRoundTripper: roundTripperFunc(
+				func(req *http.Request) (*http.Response, error) {
+					return nil, fmt.Errorf("unmatched request %s", req.URL)
+				})}
+
+			isSetup.Do(rt.replaySetup)
+
+			// The last recording is requested so that every recording is
+			// compared with the request.
+			url := fmt.Sprintf("http://api.example.com/%d", n-1)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				req, err := http.NewRequest("GET", url, nil)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := rt.RoundTrip(req); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkReplayMatchParallel(b *testing.B) {
+	defer resetBenchmark()
+	benchmarkArchive(b, 1000)
+	replay = true
+	isSetup = sync.Once{}
+	rt := &roundTripper{}
+	isSetup.Do(rt.replaySetup)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			url := fmt.Sprintf("http://api.example.com/%d", i%1000)
+			req, err := http.NewRequest("GET", url, nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := rt.RoundTrip(req); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
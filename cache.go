@@ -0,0 +1,66 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvr
+
+import (
+	"net/http"
+	"time"
+)
+
+// Set by -dvr.cache to use the archive as a cache of responses rather than
+// recording or replaying all of them. Recordings younger than this are
+// replayed, and requests without one are made for real and recorded.
+// Recordings that are older are dropped from the archive, so they are made
+// again the next time that they are needed. This is meant to speed up
+// repeatedly running tests against slow services during development, and
+// IsRecording() and IsReplay() both report true in this mode.
+var cacheTTL time.Duration
+
+// This is the RoundTrip() call when -dvr.cache is set.
+func (r *roundTripper) cache(req *http.Request) (*http.Response, error) {
+	isSetup.Do(r.cacheSetup)
+	return r.replay(req)
+}
+
+// Sets up the caching mode. A new archive is recorded the same way that it
+// is for -dvr.record, starting with the recordings from the old one that are
+// still fresh, and those recordings are what requests are matched against.
+func (r *roundTripper) cacheSetup() {
+	closeSpool()
+	bodySpool, spooledBodies, bodyCache = nil, nil, nil
+	r.recordSetup()
+}
+
+// Returns the queries recorded less than -dvr.cache ago, which recordSetup()
+// carries into the new archive. They are moved into the current recording
+// run so that a newer recording of their partition doesn't supersede them,
+// keeping the time that they were recorded.
+func freshQueries(queries []*gobQuery) []*gobQuery {
+	var fresh []*gobQuery
+	for _, q := range latestPartitions(queries) {
+		recorded := q.Recorded
+		if recorded.IsZero() && q.RunID != 0 {
+			recorded = time.Unix(0, q.RunID)
+		}
+		if q.Request == nil || recorded.IsZero() ||
+			clockNow().Sub(recorded) >= cacheTTL {
+			continue
+		}
+		q.Recorded = recorded
+		q.RunID = runID
+		fresh = append(fresh, q)
+	}
+	return fresh
+}
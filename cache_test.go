@@ -0,0 +1,100 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvr
+
+import (
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/liquidgecka/testlib"
+)
+
+func TestCache(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+	defer resetBenchmark()
+	defer func() { cacheTTL = 0 }()
+
+	fresh := testQuery("GET", "http://x/fresh", "", 200, "cached")
+	fresh.Recorded = time.Now().Add(-time.Minute)
+	stale := testQuery("GET", "http://x/stale", "", 200, "cached")
+	stale.Recorded = time.Now().Add(-2 * time.Hour)
+	fileName = filepath.Join(T.TempDir(), "archive.dvr")
+	T.ExpectSuccess(writeArchiveFile(fileName, []*gobQuery{fresh, stale}))
+
+	cacheTTL = time.Hour
+	RecordRequest = func(*http.Request) bool { return true }
+	isSetup = sync.Once{}
+	T.Equal(IsRecording(), true)
+	T.Equal(IsReplay(), true)
+	T.Equal(IsPassingThrough(), false)
+
+	var live []string
+	rt := &roundTripper{realRoundTripper: roundTripperFunc(
+		func(req *http.Request) (*http.Response, error) {
+			live = append(live, req.URL.String())
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(strings.NewReader("live")),
+			}, nil
+		})}
+	get := func(url string) string {
+		req, err := http.NewRequest("GET", url, nil)
+		T.ExpectSuccess(err)
+		resp, err := rt.RoundTrip(req)
+		T.ExpectSuccess(err)
+		body, err := ioutil.ReadAll(resp.Body)
+		T.ExpectSuccess(err)
+		return string(body)
+	}
+
+	// Only the request without a fresh recording is made.
+	T.Equal(get("http://x/fresh"), "cached")
+	T.Equal(get("http://x/stale"), "live")
+	T.Equal(get("http://x/new"), "live")
+	T.Equal(live, []string{"http://x/stale", "http://x/new"})
+	T.ExpectSuccess(Close())
+
+	// The stale recording was replaced, and the fresh one kept the time it
+	// was recorded.
+	queries, err := readArchiveFile(fileName)
+	T.ExpectSuccess(err)
+	var urls []string
+	for _, q := range queries {
+		urls = append(urls, q.Request.URL)
+	}
+	T.Equal(urls, []string{
+		"http://x/fresh", "http://x/stale", "http://x/new"})
+	T.Equal(queries[0].Recorded.Equal(fresh.Recorded), true)
+	T.Equal(string(queries[1].Response.Body), "live")
+
+	// The new recordings are replayed on the next run.
+	live = nil
+	isSetup = sync.Once{}
+	T.Equal(get("http://x/stale"), "live")
+	T.Equal(get("http://x/new"), "live")
+	T.Equal(get("http://x/fresh"), "cached")
+	T.Equal(len(live), 0)
+	T.ExpectSuccess(Close())
+
+	// The cache can't be combined with another mode.
+	record = true
+	T.ExpectErrorMessage(checkModeFlags(), "-dvr.record and -dvr.cache")
+}
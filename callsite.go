@@ -0,0 +1,140 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvr
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+)
+
+// The import path of this package, used to skip over its own frames when
+// looking for the code that made a request.
+var packagePath = reflect.TypeOf(roundTripper{}).PkgPath()
+
+// Describes where a request came from: the running test, when it can be
+// determined, and the file:line that made the HTTP call. This is used to
+// identify the offending test when a request can not be replayed. Either
+// part may be missing, in which case an empty string is returned.
+func requestOrigin() string {
+	test, site := callOrigin()
+	switch {
+	case test != "" && site != "":
+		return fmt.Sprintf("in %s at %s", test, site)
+	case test != "":
+		return "in " + test
+	case site != "":
+		return "at " + site
+	}
+	return ""
+}
+
+// Returns the parts of requestOrigin(): the name of the running test and the
+// file:line that made the call.
+func callOrigin() (test, site string) {
+	pcs := make([]uintptr, 64)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(2, pcs)])
+
+	test, testSite := currentPartition(), ""
+	for {
+		frame, more := frames.Next()
+		switch {
+		case frame.Function == "testing.tRunner":
+			more = false
+		case isTestFile(frame.File):
+			if testSite == "" {
+				testSite = frameLocation(frame)
+			}
+			if name := testFuncName(frame.Function); name != "" && test == "" {
+				test = name
+			}
+		case site == "" && !internalFrame(frame.Function):
+			site = frameLocation(frame)
+		}
+		if !more {
+			break
+		}
+	}
+
+	// A call made from a test file is preferred over one in a helper
+	// library since that is where the user will want to look.
+	if testSite != "" {
+		site = testSite
+	}
+	return test, site
+}
+
+// Returns the name of the test function that the calling goroutine is
+// running, or an empty string if it isn't running one. Subtests are not
+// seen, their functions are closures within the test function.
+func stackTest() string {
+	pcs := make([]uintptr, 64)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(2, pcs)])
+	for {
+		frame, more := frames.Next()
+		if frame.Function == "testing.tRunner" {
+			return ""
+		} else if isTestFile(frame.File) {
+			if name := testFuncName(frame.Function); name != "" {
+				return name
+			}
+		}
+		if !more {
+			return ""
+		}
+	}
+}
+
+// Returns true if the function is part of the HTTP machinery between the
+// caller and this library rather than the code making the request.
+func internalFrame(function string) bool {
+	for _, prefix := range []string{
+		"net/http.", "net/url.", "runtime.", "testing.", packagePath,
+	} {
+		if strings.HasPrefix(function, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func isTestFile(file string) bool {
+	return strings.HasSuffix(file, "_test.go")
+}
+
+func frameLocation(frame runtime.Frame) string {
+	return fmt.Sprintf("%s:%d", filepath.Base(frame.File), frame.Line)
+}
+
+// Returns the name of the test, benchmark or fuzz function that the given
+// fully qualified function belongs to, including closures declared within
+// it. An empty string is returned for any other function.
+func testFuncName(function string) string {
+	name := function[strings.LastIndex(function, "/")+1:]
+	if i := strings.Index(name, "."); i >= 0 {
+		name = name[i+1:]
+	}
+	if i := strings.Index(name, "."); i >= 0 {
+		name = name[:i]
+	}
+	for _, prefix := range []string{"Test", "Benchmark", "Fuzz"} {
+		if strings.HasPrefix(name, prefix) {
+			return name
+		}
+	}
+	return ""
+}
@@ -0,0 +1,64 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvr
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/liquidgecka/testlib"
+)
+
+func TestRequestOrigin(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	defer func(p bool) { passThrough = p }(passThrough)
+	passThrough = true
+
+	tb := &fakeTB{}
+	AssertNoLiveCalls(tb)
+	rt := &roundTripper{realRoundTripper: roundTripperFunc(
+		func(req *http.Request) (*http.Response, error) {
+			return nil, errors.New("offline")
+		})}
+	client := &http.Client{Transport: rt}
+	t.Run("subtest", func(t *testing.T) {
+		_, err := client.Get("http://example.invalid/x")
+		T.NotEqual(err, nil)
+	})
+	tb.finish()
+
+	// The live call names the test and the line in this file that made it.
+	T.Equal(len(tb.errors), 1)
+	prefix := "dvr: request was sent to the network: " +
+		"GET http://example.invalid/x (in TestRequestOrigin at callsite_test.go:"
+	if !strings.HasPrefix(tb.errors[0], prefix) {
+		T.Fatalf("unexpected error: %s", tb.errors[0])
+	}
+}
+
+func TestTestFuncName(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	T.Equal(testFuncName("example.com/pkg.TestThing"), "TestThing")
+	T.Equal(testFuncName("example.com/pkg.TestThing.func1.2"), "TestThing")
+	T.Equal(testFuncName("example.com/pkg.BenchmarkThing"), "BenchmarkThing")
+	T.Equal(testFuncName("example.com/pkg.helper"), "")
+	T.Equal(testFuncName("example.com/pkg.(*suite).TestThing"), "")
+}
@@ -0,0 +1,206 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvr
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// This file implements a small protocol for sharing archives through a
+// central HTTP service, the "cassette server". Archives are addressed by URL
+// and the protocol is plain HTTP:
+//
+//	HEAD /path  returns the ETag of the archive, or 404 if it doesn't exist.
+//	GET  /path  returns the archive and its ETag.
+//	PUT  /path  replaces the archive.
+
+// The environment variable holding the bearer token that the default
+// CassetteStore sends to the cassette server.
+const cassetteTokenEnv = "DVR_CASSETTE_TOKEN"
+
+// Register the cassette server client for http:// and https:// archives.
+func init() {
+	RegisterArchiveStore("http", &CassetteStore{})
+	RegisterArchiveStore("https", &CassetteStore{})
+}
+
+// CassetteStore is an ArchiveStore that fetches and pushes archives from a
+// cassette server, which is registered for http:// and https:// URLs so that
+// -dvr.file can name an archive on the server directly:
+//
+//	go test -dvr.replay -dvr.file=https://cassettes.example.com/team/api.dvr
+//
+// Archives are cached locally and only downloaded again when their ETag
+// changes. If the DVR_CASSETTE_TOKEN environment variable is set then it is
+// sent as a bearer token.
+type CassetteStore struct {
+	// The client used to talk to the server. If this is nil then a client
+	// using OriginalDefaultTransport is used so that these requests are not
+	// recorded themselves.
+	Client *http.Client
+
+	// The bearer token sent to the server. If this is empty the
+	// DVR_CASSETTE_TOKEN environment variable is used.
+	Token string
+}
+
+// Sends a request to the cassette server.
+func (c *CassetteStore) do(
+	ctx context.Context, method string, u *url.URL, body io.Reader,
+) (*http.Response, error) {
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	token := c.Token
+	if token == "" {
+		token = os.Getenv(cassetteTokenEnv)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	client := c.Client
+	if client == nil {
+		client = &http.Client{Transport: OriginalDefaultTransport}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	} else if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s: %w", u, os.ErrNotExist)
+	} else if resp.StatusCode/100 != 2 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("dvr: %s %s: %s", method, u, resp.Status)
+	}
+	return resp, nil
+}
+
+// ArchiveStore
+func (c *CassetteStore) Version(ctx context.Context, u *url.URL) (string, error) {
+	resp, err := c.do(ctx, "HEAD", u, nil)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	return resp.Header.Get("ETag"), nil
+}
+
+// ArchiveStore
+func (c *CassetteStore) Download(
+	ctx context.Context, u *url.URL, w io.Writer,
+) (string, error) {
+	resp, err := c.do(ctx, "GET", u, nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		return "", err
+	}
+	return resp.Header.Get("ETag"), nil
+}
+
+// ArchiveStore
+func (c *CassetteStore) Upload(ctx context.Context, u *url.URL, r io.Reader) error {
+	resp, err := c.do(ctx, "PUT", u, r)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// CassetteServer is an http.Handler that serves the archives stored in a
+// directory using the cassette server protocol, for use with CassetteStore.
+// The path of each request is the path of the archive within Dir.
+type CassetteServer struct {
+	// The directory the archives are stored in.
+	Dir string
+
+	// If set then requests must carry this bearer token.
+	Token string
+}
+
+// http.Handler
+func (c *CassetteServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if c.Token != "" && r.Header.Get("Authorization") != "Bearer "+c.Token {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	name := filepath.Join(c.Dir, filepath.FromSlash(path.Clean("/"+r.URL.Path)))
+
+	switch r.Method {
+	case "HEAD", "GET":
+		data, err := ioutil.ReadFile(name)
+		if os.IsNotExist(err) {
+			http.NotFound(w, r)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		etag := fmt.Sprintf(`"%x"`, sha256.Sum256(data))
+		w.Header().Set("ETag", etag)
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+		if r.Method == "GET" {
+			w.Write(data)
+		}
+
+	case "PUT":
+		// Write to a temporary file first so that readers never see a
+		// partial archive.
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		tmp, err := ioutil.TempFile(filepath.Dir(name), ".upload")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer os.Remove(tmp.Name())
+		_, err = io.Copy(tmp, r.Body)
+		if closeErr := tmp.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = os.Rename(tmp.Name(), name)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvr
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/liquidgecka/testlib"
+)
+
+func TestCassetteServer(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	dir := t.TempDir()
+	server := httptest.NewServer(&CassetteServer{Dir: dir, Token: "secret"})
+	defer server.Close()
+	store := &CassetteStore{Token: "secret"}
+	ctx := context.Background()
+	u, err := url.Parse(server.URL + "/team/api.dvr")
+	T.ExpectSuccess(err)
+
+	// The archive doesn't exist yet.
+	_, err = store.Version(ctx, u)
+	T.Equal(errors.Is(err, os.ErrNotExist), true)
+	_, err = store.Download(ctx, u, &bytes.Buffer{})
+	T.Equal(errors.Is(err, os.ErrNotExist), true)
+
+	// Push an archive and fetch it back.
+	T.ExpectSuccess(store.Upload(ctx, u, bytes.NewReader([]byte("v1"))))
+	data, err := ioutil.ReadFile(filepath.Join(dir, "team", "api.dvr"))
+	T.ExpectSuccess(err)
+	T.Equal(string(data), "v1")
+	version, err := store.Version(ctx, u)
+	T.ExpectSuccess(err)
+	T.NotEqual(version, "")
+	buffer := &bytes.Buffer{}
+	downloaded, err := store.Download(ctx, u, buffer)
+	T.ExpectSuccess(err)
+	T.Equal(downloaded, version)
+	T.Equal(buffer.String(), "v1")
+
+	// A new version has a new ETag.
+	T.ExpectSuccess(store.Upload(ctx, u, bytes.NewReader([]byte("v2"))))
+	newVersion, err := store.Version(ctx, u)
+	T.ExpectSuccess(err)
+	T.NotEqual(newVersion, version)
+
+	// Unchanged archives are not sent again.
+	req, err := http.NewRequest("GET", u.String(), nil)
+	T.ExpectSuccess(err)
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Set("If-None-Match", newVersion)
+	resp, err := server.Client().Do(req)
+	T.ExpectSuccess(err)
+	T.ExpectSuccess(resp.Body.Close())
+	T.Equal(resp.StatusCode, http.StatusNotModified)
+
+	// Paths can not escape the directory.
+	escape, err := url.Parse(server.URL + "/../../outside.dvr")
+	T.ExpectSuccess(err)
+	escape.Path = "/../../outside.dvr"
+	T.ExpectSuccess(store.Upload(ctx, escape, bytes.NewReader([]byte("x"))))
+	_, err = os.Stat(filepath.Join(dir, "outside.dvr"))
+	T.ExpectSuccess(err)
+
+	// The token is required.
+	_, err = (&CassetteStore{}).Version(ctx, u)
+	T.ExpectErrorMessage(err, "401 Unauthorized")
+}
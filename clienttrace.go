@@ -0,0 +1,327 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvr
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
+	"sync"
+	"time"
+)
+
+// The httptrace events of a request when it was recorded. Each timing is the
+// time from the start of the request until the event, or zero if it did not
+// happen. A request sent on a reused connection has no DNS, connect or TLS
+// handshake timings for example.
+type RequestTrace struct {
+	DNSStart             time.Duration
+	DNSDone              time.Duration
+	ConnectStart         time.Duration
+	ConnectDone          time.Duration
+	TLSHandshakeStart    time.Duration
+	TLSHandshakeDone     time.Duration
+	GotConn              time.Duration
+	WroteRequest         time.Duration
+	GotFirstResponseByte time.Duration
+
+	// The host that was looked up, and the addresses it resolved to.
+	Host  string
+	Addrs []string
+
+	// The network and address of the connection the request was sent on.
+	Network string
+	Addr    string
+
+	// Whether the connection had been used before, and if so whether it had
+	// been idle in the connection pool.
+	Reused  bool
+	WasIdle bool
+}
+
+// Returns a deep copy of the trace.
+func (t *RequestTrace) clone() *RequestTrace {
+	if t == nil {
+		return nil
+	}
+	c := *t
+	c.Addrs = cloneStrings(t.Addrs)
+	return &c
+}
+
+// Collects the httptrace events, and the interim responses, that the
+// transport reports for a request while it is being recorded.
+type traceRecorder struct {
+	lock    sync.Mutex
+	start   time.Time
+	events  RequestTrace
+	interim []InterimResponse
+}
+
+// Returns a copy of req whose context records its httptrace events. Hooks in
+// an existing httptrace.ClientTrace are still called.
+func (r *traceRecorder) trace(req *http.Request) *http.Request {
+	r.start = time.Now()
+
+	// Sets the timing of an event unless it has already been seen, such as
+	// when connections to several addresses are attempted.
+	at := func(event *time.Duration, f func()) {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		if *event == 0 {
+			*event = time.Since(r.start)
+			if f != nil {
+				f()
+			}
+		}
+	}
+	e := &r.events
+	trace := &httptrace.ClientTrace{
+		DNSStart: func(info httptrace.DNSStartInfo) {
+			at(&e.DNSStart, func() { e.Host = info.Host })
+		},
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			at(&e.DNSDone, func() {
+				for _, addr := range info.Addrs {
+					e.Addrs = append(e.Addrs, addr.String())
+				}
+			})
+		},
+		ConnectStart: func(network, addr string) {
+			at(&e.ConnectStart, nil)
+		},
+		ConnectDone: func(network, addr string, err error) {
+			if err == nil {
+				at(&e.ConnectDone, func() {
+					e.Network, e.Addr = network, addr
+				})
+			}
+		},
+		TLSHandshakeStart: func() {
+			at(&e.TLSHandshakeStart, nil)
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			at(&e.TLSHandshakeDone, nil)
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			at(&e.GotConn, func() {
+				e.Reused, e.WasIdle = info.Reused, info.WasIdle
+				if e.Addr == "" && info.Conn != nil {
+					e.Network = info.Conn.RemoteAddr().Network()
+					e.Addr = info.Conn.RemoteAddr().String()
+				}
+			})
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			at(&e.WroteRequest, nil)
+		},
+		GotFirstResponseByte: func() {
+			at(&e.GotFirstResponseByte, nil)
+		},
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			r.lock.Lock()
+			defer r.lock.Unlock()
+			r.interim = append(r.interim, InterimResponse{
+				StatusCode: code,
+				Header:     http.Header(header).Clone(),
+			})
+			return nil
+		},
+	}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+}
+
+// Returns the events seen so far, or nil if there were none.
+func (r *traceRecorder) requestTrace() *RequestTrace {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.events.GotConn == 0 && r.events.ConnectStart == 0 &&
+		r.events.DNSStart == 0 {
+		return nil
+	}
+	return r.events.clone()
+}
+
+// Returns the interim responses received so far.
+func (r *traceRecorder) interimResponses() []InterimResponse {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return cloneInterim(r.interim)
+}
+
+// Fires the httptrace hooks of the request for the recorded events, in the
+// order the transport would, up to the first byte of the response. The
+// connection is given to GotConn as a stand in that can not be read from or
+// written to. Hooks are called immediately unless -dvr.simulate_latency is
+// set, in which case each is called at its recorded time after start. If the
+// request's context is done first then its error is returned.
+func replayTrace(
+	req *http.Request, start time.Time, rr *RequestResponse,
+) error {
+	trace := httptrace.ContextClientTrace(req.Context())
+	t := rr.Trace
+	if trace == nil || t == nil {
+		return nil
+	}
+
+	// Waits until the time of an event, returning false if the request's
+	// context is done first.
+	var err error
+	at := func(event time.Duration) bool {
+		if err == nil && simulateLatency {
+			err = waitLatency(req, event-time.Since(start))
+		}
+		return err == nil
+	}
+
+	if trace.GetConn != nil {
+		trace.GetConn(canonicalAddr(req))
+	}
+	if t.DNSStart != 0 {
+		if !at(t.DNSStart) {
+			return err
+		} else if trace.DNSStart != nil {
+			trace.DNSStart(httptrace.DNSStartInfo{Host: t.Host})
+		}
+		if !at(t.DNSDone) {
+			return err
+		} else if trace.DNSDone != nil {
+			info := httptrace.DNSDoneInfo{}
+			for _, addr := range t.Addrs {
+				info.Addrs = append(info.Addrs,
+					net.IPAddr{IP: net.ParseIP(addr)})
+			}
+			trace.DNSDone(info)
+		}
+	}
+	if t.ConnectStart != 0 {
+		if !at(t.ConnectStart) {
+			return err
+		} else if trace.ConnectStart != nil {
+			trace.ConnectStart(t.Network, t.Addr)
+		}
+		if !at(t.ConnectDone) {
+			return err
+		} else if trace.ConnectDone != nil {
+			trace.ConnectDone(t.Network, t.Addr, nil)
+		}
+	}
+	if t.TLSHandshakeStart != 0 {
+		if !at(t.TLSHandshakeStart) {
+			return err
+		} else if trace.TLSHandshakeStart != nil {
+			trace.TLSHandshakeStart()
+		}
+		if !at(t.TLSHandshakeDone) {
+			return err
+		} else if trace.TLSHandshakeDone != nil {
+			var state tls.ConnectionState
+			if rr.Response != nil && rr.Response.TLS != nil {
+				state = *rr.Response.TLS
+			}
+			trace.TLSHandshakeDone(state, nil)
+		}
+	}
+	if !at(t.GotConn) {
+		return err
+	} else if trace.GotConn != nil {
+		trace.GotConn(httptrace.GotConnInfo{
+			Conn:    &tracedConn{remote: socketAddr{t.Network, t.Addr}},
+			Reused:  t.Reused,
+			WasIdle: t.WasIdle,
+		})
+	}
+	if trace.WroteHeaders != nil {
+		trace.WroteHeaders()
+	}
+	if !at(t.WroteRequest) {
+		return err
+	} else if trace.WroteRequest != nil {
+		trace.WroteRequest(httptrace.WroteRequestInfo{})
+	}
+	if t.GotFirstResponseByte != 0 {
+		if !at(t.GotFirstResponseByte) {
+			return err
+		} else if trace.GotFirstResponseByte != nil {
+			trace.GotFirstResponseByte()
+		}
+	}
+	return nil
+}
+
+// Returns the host:port that the transport would connect to for the request,
+// as given to GetConn.
+func canonicalAddr(req *http.Request) string {
+	host, port := req.URL.Hostname(), req.URL.Port()
+	if port == "" {
+		port = "80"
+		if req.URL.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// Given to httptrace's GotConn hook when replaying, so that hooks that
+// inspect the connection's addresses see the recorded ones. Nothing can be
+// read from or written to it.
+type tracedConn struct {
+	remote socketAddr
+}
+
+var errTracedConn = errors.New("dvr: replayed requests have no connection")
+
+// net.Conn
+func (c *tracedConn) Read([]byte) (int, error) {
+	return 0, errTracedConn
+}
+
+// net.Conn
+func (c *tracedConn) Write([]byte) (int, error) {
+	return 0, errTracedConn
+}
+
+// net.Conn
+func (c *tracedConn) Close() error {
+	return nil
+}
+
+// net.Conn
+func (c *tracedConn) LocalAddr() net.Addr {
+	return socketAddr{network: c.remote.network}
+}
+
+// net.Conn
+func (c *tracedConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// net.Conn
+func (c *tracedConn) SetDeadline(time.Time) error {
+	return nil
+}
+
+// net.Conn
+func (c *tracedConn) SetReadDeadline(time.Time) error {
+	return nil
+}
+
+// net.Conn
+func (c *tracedConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
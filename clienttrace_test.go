@@ -0,0 +1,111 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvr
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"sync"
+	"testing"
+
+	"github.com/liquidgecka/testlib"
+)
+
+func TestRecordReplayTrace(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+	defer resetBenchmark()
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("ok"))
+		}))
+	defer server.Close()
+	addr := server.Listener.Addr().String()
+
+	// Returns a request whose trace hooks note the events they see.
+	var events []string
+	newRequest := func() *http.Request {
+		events = nil
+		note := func(event string) { events = append(events, event) }
+		req, err := http.NewRequest("GET", server.URL+"/", nil)
+		T.ExpectSuccess(err)
+		trace := &httptrace.ClientTrace{
+			GetConn:      func(hostPort string) { note("GetConn " + hostPort) },
+			ConnectStart: func(_, addr string) { note("ConnectStart " + addr) },
+			ConnectDone: func(_, addr string, err error) {
+				note("ConnectDone " + addr)
+			},
+			GotConn: func(info httptrace.GotConnInfo) {
+				note("GotConn " + info.Conn.RemoteAddr().String())
+			},
+			WroteHeaders: func() { note("WroteHeaders") },
+			WroteRequest: func(httptrace.WroteRequestInfo) {
+				note("WroteRequest")
+			},
+			GotFirstResponseByte: func() { note("GotFirstResponseByte") },
+		}
+		return req.WithContext(
+			httptrace.WithClientTrace(req.Context(), trace))
+	}
+	expected := []string{
+		"GetConn " + addr,
+		"ConnectStart " + addr,
+		"ConnectDone " + addr,
+		"GotConn " + addr,
+		"WroteHeaders",
+		"WroteRequest",
+		"GotFirstResponseByte",
+	}
+
+	// The events are recorded, and still reach the caller's hooks.
+	fileName = T.TempFile().Name()
+	record = true
+	RecordRequest = func(*http.Request) bool { return true }
+	isSetup = sync.Once{}
+	transport := &http.Transport{}
+	defer transport.CloseIdleConnections()
+	rt := &roundTripper{realRoundTripper: transport}
+	resp, err := rt.RoundTrip(newRequest())
+	T.ExpectSuccess(err)
+	T.ExpectSuccess(resp.Body.Close())
+	T.Equal(events, expected)
+	T.ExpectSuccess(Close())
+	rrs, err := ReadArchiveFile(fileName)
+	T.ExpectSuccess(err)
+	T.Equal(len(rrs), 1)
+	trace := rrs[0].Trace
+	T.NotEqual(trace, nil)
+	T.Equal(trace.Addr, addr)
+	T.Equal(trace.Reused, false)
+	T.Equal(trace.ConnectStart > 0, true)
+	T.Equal(trace.ConnectDone >= trace.ConnectStart, true)
+	T.Equal(trace.GotFirstResponseByte >= trace.WroteRequest, true)
+
+	// The same events are fired in order when it is replayed.
+	record = false
+	replay = true
+	isSetup = sync.Once{}
+	rt.realRoundTripper = roundTripperFunc(
+		func(req *http.Request) (*http.Response, error) {
+			return nil, errors.New("not matched")
+		})
+	resp, err = rt.RoundTrip(newRequest())
+	T.ExpectSuccess(err)
+	T.ExpectSuccess(resp.Body.Close())
+	T.Equal(events, expected)
+}
@@ -0,0 +1,89 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvr
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The clock used when shifting the times of replayed responses.
+var clockNow = time.Now
+
+// The response headers whose dates ShiftClock() moves.
+var clockHeaders = []string{"Date", "Expires", "Last-Modified"}
+
+// Moves the times in a replayed response by how long ago it was recorded.
+type clockShifter struct {
+	bodies bool
+}
+
+// Shifts the times in the response of the given recording.
+func (c *clockShifter) shift(rr *RequestResponse) error {
+	if rr.Response == nil || rr.Recorded.IsZero() {
+		return nil
+	}
+	delta := clockNow().Sub(rr.Recorded)
+	for _, name := range clockHeaders {
+		values := rr.Response.Header[name]
+		for i, value := range values {
+			if t, err := http.ParseTime(value); err == nil {
+				values[i] = t.Add(delta).UTC().Format(http.TimeFormat)
+			}
+		}
+	}
+	contentType := rr.Response.Header.Get("Content-Type")
+	if !c.bodies || !strings.Contains(contentType, "json") {
+		return nil
+	}
+	// RFC3339 timestamps are the last of the kinds NormalizeIDs() finds.
+	timestamps := idKinds[len(idKinds)-1].re
+	body := timestamps.ReplaceAllFunc(rr.ResponseBody,
+		func(b []byte) []byte {
+			return []byte(shiftTimestamp(string(b), delta))
+		})
+	setResponseBody(rr, body)
+	return nil
+}
+
+// Moves an RFC3339 timestamp by delta, keeping its time zone offset and the
+// number of digits in its fractional seconds.
+func shiftTimestamp(s string, delta time.Duration) string {
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return s
+	}
+	layout := "2006-01-02T15:04:05"
+	if dot := strings.IndexByte(s, '.'); dot >= 0 {
+		digits := strings.IndexAny(s[dot+1:], "Z+-")
+		layout += "." + strings.Repeat("0", digits)
+	}
+	return t.Add(delta).In(t.Location()).Format(layout + "Z07:00")
+}
+
+// ShiftClock moves the times in replayed responses forward by how long ago
+// they were recorded, so that a response recorded a month ago appears to
+// have been sent now. This keeps cache validation and expiry logic behaving
+// as it did when the responses were recorded live. The Date, Expires and
+// Last-Modified headers are always shifted, and if bodies is true then so
+// are RFC3339 timestamps in JSON response bodies.
+//
+// Recordings from archives written before the time of each recording was
+// stored are left alone. The returned function removes the rewriter.
+func ShiftClock(bodies bool) (remove func()) {
+	c := &clockShifter{bodies: bodies}
+	return addToChain(&rewriterChain, c.shift)
+}
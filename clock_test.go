@@ -0,0 +1,80 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvr
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/liquidgecka/testlib"
+)
+
+func TestShiftClock(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+	defer func() { clockNow = time.Now }()
+
+	recorded := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	clockNow = func() time.Time { return recorded.Add(48 * time.Hour) }
+	newRecording := func() *RequestResponse {
+		rr := &RequestResponse{
+			Recorded: recorded,
+			Response: &http.Response{
+				StatusCode: 200,
+				Header: http.Header{
+					"Content-Type":  {"application/json"},
+					"Date":          {"Mon, 01 Jan 2024 12:00:00 GMT"},
+					"Expires":       {"Mon, 01 Jan 2024 13:00:00 GMT"},
+					"Last-Modified": {"Sun, 31 Dec 2023 12:00:00 GMT"},
+					"X-Other":       {"Mon, 01 Jan 2024 12:00:00 GMT"},
+				},
+			},
+			ResponseBody: []byte(`{"created":"2024-01-01T10:00:00Z",` +
+				`"expires":"2024-01-01T14:00:00.500+02:00"}`),
+		}
+		rr.Response.ContentLength = int64(len(rr.ResponseBody))
+		return rr
+	}
+
+	// Headers are shifted, bodies only when asked.
+	remove := ShiftClock(false)
+	rr := newRecording()
+	T.ExpectSuccess(rewriteReplay(rr))
+	T.Equal(rr.Response.Header.Get("Date"), "Wed, 03 Jan 2024 12:00:00 GMT")
+	T.Equal(rr.Response.Header.Get("Expires"),
+		"Wed, 03 Jan 2024 13:00:00 GMT")
+	T.Equal(rr.Response.Header.Get("Last-Modified"),
+		"Tue, 02 Jan 2024 12:00:00 GMT")
+	T.Equal(rr.Response.Header.Get("X-Other"),
+		"Mon, 01 Jan 2024 12:00:00 GMT")
+	T.Equal(string(rr.ResponseBody), `{"created":"2024-01-01T10:00:00Z",`+
+		`"expires":"2024-01-01T14:00:00.500+02:00"}`)
+	remove()
+
+	// Timestamps keep their offset and precision.
+	defer ShiftClock(true)()
+	rr = newRecording()
+	T.ExpectSuccess(rewriteReplay(rr))
+	T.Equal(string(rr.ResponseBody), `{"created":"2024-01-03T10:00:00Z",`+
+		`"expires":"2024-01-03T14:00:00.500+02:00"}`)
+	T.Equal(rr.Response.ContentLength, int64(len(rr.ResponseBody)))
+
+	// Recordings without a time are left alone.
+	rr = newRecording()
+	rr.Recorded = time.Time{}
+	T.ExpectSuccess(rewriteReplay(rr))
+	T.Equal(rr.Response.Header.Get("Date"), "Mon, 01 Jan 2024 12:00:00 GMT")
+}
@@ -0,0 +1,238 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/orchestrate-io/dvr"
+)
+
+// The old=new pairs given with -map.
+type hostMap []string
+
+// flag.Value
+func (h *hostMap) String() string {
+	return strings.Join(*h, ",")
+}
+
+// flag.Value
+func (h *hostMap) Set(value string) error {
+	if i := strings.IndexByte(value, '='); i <= 0 || i == len(value)-1 {
+		return fmt.Errorf("expected old=new, not %q", value)
+	}
+	*h = append(*h, value)
+	return nil
+}
+
+// Matches IPv4 addresses.
+var ipv4Pattern = regexp.MustCompile(`\b(?:[0-9]{1,3}\.){3}[0-9]{1,3}\b`)
+
+// The network that replacement addresses are taken from, 198.18.0.0/15,
+// which is reserved for benchmarking by RFC 2544 and never routed.
+var replacementNet = &net.IPNet{
+	IP:   net.IPv4(198, 18, 0, 0).To4(),
+	Mask: net.CIDRMask(15, 32),
+}
+
+// Replaces host names and addresses throughout a recording.
+type anonymizer struct {
+	// The -map replacements, in the order they were given.
+	hosts []*regexp.Regexp
+	names []string
+
+	// If set then IPv4 addresses are replaced with addresses from
+	// replacementNet. The same address is always replaced with the
+	// same replacement, which are kept in addresses in the order they were
+	// assigned.
+	ips       bool
+	addresses map[string]string
+	assigned  []string
+}
+
+func init() {
+	register(&command{
+		name:  "anonymize",
+		args:  "-map old=new... [-ips] [-o output] <archive>",
+		short: "replace host names and addresses in an archive",
+		run:   runAnonymize,
+	})
+}
+
+// Replaces host names and IP addresses in the URLs, headers and text bodies
+// of every recording, so that archives can be published without revealing
+// internal infrastructure. Host names given with -map are replaced along
+// with their subdomains, and with -ips every IPv4 address other than
+// loopback addresses is replaced with an address from a network reserved
+// for benchmarking. Replacements are consistent across the archive.
+func runAnonymize(args []string) error {
+	var hosts hostMap
+	flags := newFlagSet(commands["anonymize"])
+	flags.Var(&hosts, "map", "replace the host old with new, may be repeated")
+	ips := flags.Bool("ips", false,
+		"replace IPv4 addresses with addresses from 198.18.0.0/15")
+	output := flags.String("o", "",
+		"write the new archive here rather than replacing the archive")
+	args, err := parseFlags(flags, args)
+	if err != nil {
+		return err
+	} else if len(args) != 1 {
+		flags.Usage()
+		return fmt.Errorf("expected one archive")
+	} else if len(hosts) == 0 && !*ips {
+		flags.Usage()
+		return fmt.Errorf("nothing to replace, use -map or -ips")
+	}
+	if *output == "" {
+		*output = args[0]
+	}
+
+	a := &anonymizer{ips: *ips, addresses: map[string]string{}}
+	for _, pair := range hosts {
+		i := strings.IndexByte(pair, '=')
+		a.hosts = append(a.hosts, regexp.MustCompile(
+			`(?i)(^|[^a-z0-9-])`+regexp.QuoteMeta(pair[:i])+`($|[^a-z0-9-])`))
+		a.names = append(a.names, pair[i+1:])
+	}
+
+	rrs, err := dvr.ReadArchiveFile(args[0])
+	if err != nil {
+		return err
+	}
+	changed := 0
+	for i, rr := range rrs {
+		before, err := json.Marshal(toJSON(rr))
+		if err != nil {
+			return err
+		} else if err := a.recording(rr); err != nil {
+			return fmt.Errorf("recording %d: %s", i, err)
+		}
+		after, err := json.Marshal(toJSON(rr))
+		if err != nil {
+			return err
+		} else if !bytes.Equal(before, after) {
+			changed++
+		}
+	}
+	for _, ip := range a.assigned {
+		fmt.Fprintf(stdout, "%s -> %s\n", ip, a.addresses[ip])
+	}
+	fmt.Fprintf(stdout, "anonymized %d of %d recordings\n", changed, len(rrs))
+	return dvr.WriteArchiveFile(*output, rrs)
+}
+
+// Returns the text with every host and address replaced.
+func (a *anonymizer) text(s string) string {
+	for i, re := range a.hosts {
+		// Adjacent matches share the character between them, so each
+		// replacement is repeated until nothing changes.
+		for {
+			replaced := re.ReplaceAllString(s, "${1}"+a.names[i]+"${2}")
+			if replaced == s {
+				break
+			}
+			s = replaced
+		}
+	}
+	if a.ips {
+		s = ipv4Pattern.ReplaceAllStringFunc(s, a.address)
+	}
+	return s
+}
+
+// Returns the replacement for an IPv4 address.
+func (a *anonymizer) address(s string) string {
+	ip := net.ParseIP(s)
+	if ip == nil || ip.IsLoopback() || ip.IsUnspecified() ||
+		replacementNet.Contains(ip) {
+		return s
+	} else if replacement, ok := a.addresses[s]; ok {
+		return replacement
+	}
+
+	// Addresses are assigned in order, skipping those ending in 0 or 255.
+	n := len(a.assigned)
+	replacement := net.IPv4(198, byte(18+n/(254*256)%2), byte(n/254),
+		byte(n%254+1)).String()
+	a.addresses[s] = replacement
+	a.assigned = append(a.assigned, s)
+	return replacement
+}
+
+// Replaces the hosts and addresses in every value of the header.
+func (a *anonymizer) header(h http.Header) {
+	for _, values := range h {
+		for i, v := range values {
+			values[i] = a.text(v)
+		}
+	}
+}
+
+// Returns the body with the hosts and addresses replaced, leaving bodies
+// that are not text alone.
+func (a *anonymizer) body(body []byte) []byte {
+	if len(body) == 0 || !utf8.Valid(body) {
+		return body
+	}
+	return []byte(a.text(string(body)))
+}
+
+// Replaces the hosts and addresses throughout a recording, keeping the
+// content lengths consistent with the bodies.
+func (a *anonymizer) recording(rr *dvr.RequestResponse) error {
+	if req := rr.Request; req != nil {
+		if req.URL != nil {
+			u, err := url.Parse(a.text(req.URL.String()))
+			if err != nil {
+				return err
+			}
+			req.URL = u
+		}
+		req.Host = a.text(req.Host)
+		a.header(req.Header)
+		a.header(req.Trailer)
+		rr.RequestBody = a.body(rr.RequestBody)
+		if req.ContentLength > 0 {
+			req.ContentLength = int64(len(rr.RequestBody))
+		}
+	}
+	if resp := rr.Response; resp != nil {
+		a.header(resp.Header)
+		a.header(resp.Trailer)
+		body := a.body(rr.ResponseBody)
+		if !bytes.Equal(body, rr.ResponseBody) {
+			rr.ResponseBody = body
+			if resp.ContentLength >= 0 {
+				resp.ContentLength = int64(len(body))
+			}
+			if resp.Header.Get("Content-Length") != "" {
+				resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+			}
+		}
+	}
+	if rr.Error != nil {
+		rr.Error = stringError(a.text(rr.Error.Error()))
+	}
+	return nil
+}
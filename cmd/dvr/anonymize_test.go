@@ -0,0 +1,75 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/liquidgecka/testlib"
+	"github.com/orchestrate-io/dvr"
+)
+
+func TestAnonymize(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	rr := testRecording("GET",
+		"https://api.prod.corp:8443/users?next=https://sso.prod.corp/", 302,
+		`{"node": "10.1.2.3", "peer": "10.1.2.4", "self": "10.1.2.3", `+
+			`"local": "127.0.0.1", "site": "notprod.corp"}`)
+	rr.Request.Host = "api.prod.corp:8443"
+	rr.Response.Header.Set("Location", "https://sso.prod.corp/login")
+	rr.Response.Header.Set("Content-Length", "99")
+	rr.Response.ContentLength = 99
+	failed := testRecording("GET", "http://10.1.2.4/health", 0, "")
+	failed.Response = nil
+	failed.Error = errors.New("dial tcp 10.1.2.4:80: connection refused")
+	archive := testArchive(t, rr, failed,
+		testRecording("GET", "https://api.example.com/", 200, "unchanged"))
+
+	code, out, _ := runCommand("anonymize", "-map", "prod.corp=example.test",
+		"-ips", archive)
+	T.Equal(code, 0)
+	T.Equal(out, ""+
+		"10.1.2.3 -> 198.18.0.1\n"+
+		"10.1.2.4 -> 198.18.0.2\n"+
+		"anonymized 2 of 3 recordings\n")
+
+	rrs, err := dvr.ReadArchiveFile(archive)
+	T.ExpectSuccess(err)
+	T.Equal(rrs[0].Request.URL.String(),
+		"https://api.example.test:8443/users?next=https://sso.example.test/")
+	T.Equal(rrs[0].Request.Host, "api.example.test:8443")
+	T.Equal(rrs[0].Response.Header.Get("Location"),
+		"https://sso.example.test/login")
+	body := `{"node": "198.18.0.1", "peer": "198.18.0.2", ` +
+		`"self": "198.18.0.1", "local": "127.0.0.1", "site": "notprod.corp"}`
+	T.Equal(string(rrs[0].ResponseBody), body)
+	T.Equal(rrs[0].Response.ContentLength, int64(len(body)))
+	T.Equal(rrs[0].Response.Header.Get("Content-Length"),
+		strconv.Itoa(len(body)))
+	T.Equal(rrs[1].Request.URL.Host, "198.18.0.2")
+	T.Equal(rrs[1].Error.Error(),
+		"dial tcp 198.18.0.2:80: connection refused")
+	T.Equal(string(rrs[2].ResponseBody), "unchanged")
+
+	code, _, errOut := runCommand("anonymize", "-map", "prod.corp", archive)
+	T.Equal(code, 1)
+	T.Equal(strings.Contains(errOut, `expected old=new, not "prod.corp"`),
+		true)
+}
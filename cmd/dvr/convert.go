@@ -0,0 +1,201 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/orchestrate-io/dvr"
+)
+
+// The readers for the formats that convert accepts as input. Archives are
+// read by name with ReadArchiveFile() so gob has no reader.
+var inputFormats = map[string]func(io.Reader) ([]*dvr.RequestResponse, error){
+	"gob":        nil,
+	"json":       readJSON,
+	"har":        dvr.ImportHAR,
+	"vcr":        readVCR,
+	"mitmproxy":  dvr.ImportMitmproxy,
+	"pcap":       dvr.ImportPcap,
+	"httpreplay": dvr.ImportHTTPReplay,
+}
+
+// The format used for each file extension when -from is not given.
+var formatExtensions = map[string]string{
+	".dvr":    "gob",
+	".json":   "json",
+	".har":    "har",
+	".yaml":   "vcr",
+	".yml":    "vcr",
+	".flows":  "mitmproxy",
+	".mitm":   "mitmproxy",
+	".pcap":   "pcap",
+	".replay": "httpreplay",
+}
+
+func init() {
+	register(&command{
+		name:  "convert",
+		args:  "-to json|gob|har|vcr <input> <output>",
+		short: "convert recordings between archive formats",
+		run:   runConvert,
+	})
+}
+
+// Reads the recordings from the input in one format and writes them to the
+// output in another. The input format is inferred from the file extension
+// unless -from is given, and archives (gob) can also be read from the
+// importers for mitmproxy, pcap and httpreplay files. An output of "-"
+// writes to stdout, except for gob archives.
+func runConvert(args []string) error {
+	flags := newFlagSet(commands["convert"])
+	to := flags.String("to", "", "the output format: json, gob, har or vcr")
+	from := flags.String("from", "",
+		"the input format: gob, json, har, vcr, mitmproxy, pcap or "+
+			"httpreplay (default from the file extension)")
+	name := flags.String("name", "",
+		"the recording name stored in HAR output (default the output file "+
+			"name)")
+	args, err := parseFlags(flags, args)
+	if err != nil {
+		return err
+	} else if len(args) != 2 {
+		flags.Usage()
+		return fmt.Errorf("expected an input and an output")
+	}
+	input, output := args[0], args[1]
+
+	if *from == "" {
+		*from = formatExtensions[strings.ToLower(filepath.Ext(input))]
+		if *from == "" {
+			return fmt.Errorf("can not tell the format of %s, use -from",
+				input)
+		}
+	}
+	decode, ok := inputFormats[*from]
+	if !ok {
+		return fmt.Errorf("unknown input format %q", *from)
+	}
+	switch *to {
+	case "json", "har", "vcr":
+	case "gob":
+		if output == "-" {
+			return fmt.Errorf("gob archives can not be written to stdout")
+		}
+	case "":
+		flags.Usage()
+		return fmt.Errorf("-to is required")
+	default:
+		return fmt.Errorf("unknown output format %q", *to)
+	}
+
+	var rrs []*dvr.RequestResponse
+	if decode == nil {
+		rrs, err = dvr.ReadArchiveFile(input)
+	} else {
+		var fd *os.File
+		if fd, err = os.Open(input); err != nil {
+			return err
+		}
+		rrs, err = decode(fd)
+		fd.Close()
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %s", input, err)
+	}
+
+	// Everything but gob archives is encoded into memory first so that a
+	// failure doesn't leave a partial output file.
+	buffer := &bytes.Buffer{}
+	skipped := 0
+	switch *to {
+	case "gob":
+		if err := dvr.WriteArchiveFile(output, rrs); err != nil {
+			return err
+		}
+	case "json":
+		err = writeJSON(buffer, rrs)
+	case "har":
+		if *name == "" {
+			*name = strings.TrimSuffix(filepath.Base(output),
+				filepath.Ext(output))
+		}
+		for _, rr := range rrs {
+			if rr.Response == nil {
+				skipped++
+			}
+		}
+		err = dvr.ExportPolly(buffer, *name, rrs)
+	case "vcr":
+		skipped, err = writeVCR(buffer, rrs)
+	}
+	if err != nil {
+		return err
+	} else if output == "-" {
+		_, err = buffer.WriteTo(stdout)
+		return err
+	} else if *to != "gob" {
+		if err := ioutil.WriteFile(output, buffer.Bytes(), 0644); err != nil {
+			return err
+		}
+	}
+
+	if skipped > 0 {
+		fmt.Fprintf(stderr, "skipped %d failed requests, which %s can not "+
+			"store\n", skipped, *to)
+	}
+	fmt.Fprintf(stdout, "converted %d recordings\n", len(rrs)-skipped)
+	return nil
+}
+
+// Writes the recordings as a JSON array of their edit forms.
+func writeJSON(w io.Writer, rrs []*dvr.RequestResponse) error {
+	js := make([]*jsonRecording, len(rrs))
+	for i, rr := range rrs {
+		js[i] = toJSON(rr)
+	}
+	data, err := json.MarshalIndent(js, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+// Reads a JSON array of recordings written by writeJSON.
+func readJSON(r io.Reader) ([]*dvr.RequestResponse, error) {
+	var js []*jsonRecording
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&js); err != nil {
+		return nil, err
+	}
+	rrs := make([]*dvr.RequestResponse, len(js))
+	for i, j := range js {
+		rr, err := fromJSON(j)
+		if err != nil {
+			return nil, fmt.Errorf("recording %d: %s", i, err)
+		}
+		rrs[i] = rr
+	}
+	return rrs, nil
+}
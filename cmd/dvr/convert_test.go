@@ -0,0 +1,102 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/liquidgecka/testlib"
+	"github.com/orchestrate-io/dvr"
+)
+
+func TestConvert(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	binary := testRecording("POST", "https://api.example.com/logo", 201, "")
+	binary.RequestBody = []byte("name=logo")
+	binary.ResponseBody = []byte{0xff, 0x00, 0x89}
+	failed := testRecording("GET", "https://down.example.com/", 0, "")
+	failed.Response = nil
+	failed.Error = errors.New("connection refused")
+	archive := testArchive(t,
+		testRecording("GET", "https://api.example.com/items?a=1", 200, "items"),
+		binary, failed)
+	dir := filepath.Dir(archive)
+
+	// Archives survive a round trip through JSON.
+	code, out, _ := runCommand("convert", "-to", "json", archive,
+		filepath.Join(dir, "out.json"))
+	T.Equal(code, 0)
+	T.Equal(out, "converted 3 recordings\n")
+	code, _, _ = runCommand("convert", "-to", "gob",
+		filepath.Join(dir, "out.json"), filepath.Join(dir, "json.dvr"))
+	T.Equal(code, 0)
+	rrs, err := dvr.ReadArchiveFile(filepath.Join(dir, "json.dvr"))
+	T.ExpectSuccess(err)
+	T.Equal(len(rrs), 3)
+	T.Equal(rrs[0].Request.URL.String(), "https://api.example.com/items?a=1")
+	T.Equal(string(rrs[0].ResponseBody), "items")
+	T.Equal(rrs[1].ResponseBody, []byte{0xff, 0x00, 0x89})
+	T.Equal(rrs[2].Error.Error(), "connection refused")
+
+	// And through go-vcr cassettes, which can't store failed requests.
+	code, out, errOut := runCommand("convert", "-to", "vcr", archive,
+		filepath.Join(dir, "out.yaml"))
+	T.Equal(code, 0)
+	T.Equal(out, "converted 2 recordings\n")
+	T.Equal(errOut, "skipped 1 failed requests, which vcr can not store\n")
+	data, err := ioutil.ReadFile(filepath.Join(dir, "out.yaml"))
+	T.ExpectSuccess(err)
+	T.Equal(strings.HasPrefix(string(data), "---\nversion: 2\n"), true)
+	code, _, _ = runCommand("convert", "-to", "gob",
+		filepath.Join(dir, "out.yaml"), filepath.Join(dir, "vcr.dvr"))
+	T.Equal(code, 0)
+	rrs, err = dvr.ReadArchiveFile(filepath.Join(dir, "vcr.dvr"))
+	T.ExpectSuccess(err)
+	T.Equal(len(rrs), 2)
+	T.Equal(rrs[0].Request.Method, "GET")
+	T.Equal(rrs[0].Request.Header, http.Header{"Accept": {"*/*"}})
+	T.Equal(rrs[0].Response.Status, "200 OK")
+	T.Equal(string(rrs[0].ResponseBody), "items")
+	T.Equal(string(rrs[1].RequestBody), "name=logo")
+	T.Equal(rrs[1].ResponseBody, []byte{0xff, 0x00, 0x89})
+
+	// HAR output can be written to stdout and read back.
+	code, out, _ = runCommand("convert", "-to", "har", "-name", "api",
+		archive, "-")
+	T.Equal(code, 0)
+	T.Equal(strings.Contains(out, `"_recordingName": "api"`), true)
+	ioutil.WriteFile(filepath.Join(dir, "out.har"), []byte(out), 0644)
+	code, _, _ = runCommand("convert", "-to", "gob",
+		filepath.Join(dir, "out.har"), filepath.Join(dir, "har.dvr"))
+	T.Equal(code, 0)
+	rrs, err = dvr.ReadArchiveFile(filepath.Join(dir, "har.dvr"))
+	T.ExpectSuccess(err)
+	T.Equal(len(rrs), 2)
+	T.Equal(rrs[1].Response.StatusCode, 201)
+
+	code, _, errOut = runCommand("convert", "-to", "json", "in.txt", "out")
+	T.Equal(code, 1)
+	T.Equal(strings.Contains(errOut, "can not tell the format"), true)
+	code, _, errOut = runCommand("convert", "-to", "xml", archive, "out")
+	T.Equal(code, 1)
+	T.Equal(strings.Contains(errOut, `unknown output format "xml"`), true)
+}
@@ -0,0 +1,236 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/orchestrate-io/dvr"
+)
+
+// Matches path segments that are identifiers rather than names: numbers,
+// UUIDs and long hexadecimal strings.
+var idSegment = regexp.MustCompile(
+	`^([0-9]+|[0-9a-fA-F]{8}(-[0-9a-fA-F]{4}){3}-[0-9a-fA-F]{12}|` +
+		`[0-9a-fA-F]{16,})$`)
+
+// The recordings of a single endpoint.
+type endpoint struct {
+	method string
+	url    string
+
+	// The recordings, grouped by their status.
+	statuses map[string][]*dvr.RequestResponse
+	count    int
+}
+
+func init() {
+	register(&command{
+		name:  "doc",
+		args:  "[-o file] [-max-body n] <archive>",
+		short: "write markdown documenting the requests in an archive",
+		run:   runDoc,
+	})
+}
+
+// Writes a markdown document listing every endpoint the recordings call,
+// the statuses each returned and an example request and response for each
+// status. Endpoints are the method, host and path of a request, with path
+// segments that look like identifiers replaced with "{id}".
+func runDoc(args []string) error {
+	flags := newFlagSet(commands["doc"])
+	output := flags.String("o", "", "write the document here, not stdout")
+	maxBody := flags.Int("max-body", 2000,
+		"the length that example bodies are truncated to")
+	args, err := parseFlags(flags, args)
+	if err != nil {
+		return err
+	} else if len(args) != 1 {
+		flags.Usage()
+		return fmt.Errorf("expected one archive")
+	}
+
+	rrs, err := dvr.ReadArchiveFile(args[0])
+	if err != nil {
+		return err
+	}
+	endpoints := map[string]*endpoint{}
+	var keys []string
+	for _, rr := range rrs {
+		if rr.Request == nil || rr.Request.URL == nil {
+			continue
+		}
+		method, _ := methodAndURL(rr)
+		u := *rr.Request.URL
+		u.RawQuery, u.Fragment, u.User = "", "", nil
+		segments := strings.Split(u.Path, "/")
+		for i, segment := range segments {
+			if idSegment.MatchString(segment) {
+				segments[i] = "{id}"
+			}
+		}
+		u.Path, u.RawPath = strings.Join(segments, "/"), ""
+		url := strings.Replace(u.String(), "%7Bid%7D", "{id}", -1)
+
+		key := url + " " + method
+		e := endpoints[key]
+		if e == nil {
+			e = &endpoint{
+				method:   method,
+				url:      url,
+				statuses: map[string][]*dvr.RequestResponse{},
+			}
+			endpoints[key] = e
+			keys = append(keys, key)
+		}
+		e.statuses[status(rr)] = append(e.statuses[status(rr)], rr)
+		e.count++
+	}
+	sort.Strings(keys)
+
+	buffer := &bytes.Buffer{}
+	fmt.Fprintf(buffer, "# API interactions\n\n")
+	fmt.Fprintf(buffer, "Generated from %s: %d recordings of %d endpoints.\n",
+		filepath.Base(args[0]), len(rrs), len(keys))
+	if len(keys) > 0 {
+		fmt.Fprintf(buffer, "\n| Endpoint | Statuses | Recordings |\n")
+		fmt.Fprintf(buffer, "| --- | --- | --- |\n")
+	}
+	for _, key := range keys {
+		e := endpoints[key]
+		fmt.Fprintf(buffer, "| [`%s %s`](#%s) | %s | %d |\n", e.method, e.url,
+			anchor(e.method+" "+e.url), strings.Join(e.sortedStatuses(), ", "),
+			e.count)
+	}
+	for _, key := range keys {
+		e := endpoints[key]
+		fmt.Fprintf(buffer, "\n## %s %s\n", e.method, e.url)
+		for _, s := range e.sortedStatuses() {
+			examples := e.statuses[s]
+			rr := examples[0]
+			heading := "Error"
+			if rr.Response != nil {
+				heading = statusLine(rr.Response)
+			}
+			fmt.Fprintf(buffer, "\n### %s\n\n", heading)
+			if len(examples) > 1 {
+				fmt.Fprintf(buffer, "Returned by %d recordings, for "+
+					"example:\n\n", len(examples))
+			}
+			writeExample(buffer, rr, *maxBody)
+		}
+	}
+
+	if *output == "" {
+		_, err = buffer.WriteTo(stdout)
+		return err
+	}
+	return ioutil.WriteFile(*output, buffer.Bytes(), 0644)
+}
+
+// Returns the statuses of the endpoint, in numeric order with failed
+// requests last.
+func (e *endpoint) sortedStatuses() []string {
+	statuses := make([]string, 0, len(e.statuses))
+	for s := range e.statuses {
+		statuses = append(statuses, s)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		a, errA := strconv.Atoi(statuses[i])
+		b, errB := strconv.Atoi(statuses[j])
+		if errA != nil || errB != nil {
+			return errB != nil && errA == nil
+		}
+		return a < b
+	})
+	return statuses
+}
+
+// Writes the request and response of a recording as fenced code blocks.
+func writeExample(w io.Writer, rr *dvr.RequestResponse, maxBody int) {
+	method, url := methodAndURL(rr)
+	writeBlock(w, method+" "+url, rr.Request.Header, rr.RequestBody, maxBody)
+	fmt.Fprintln(w)
+	if rr.Response == nil {
+		fmt.Fprintf(w, "The request failed: %v\n", rr.Error)
+		return
+	}
+	proto := rr.Response.Proto
+	if proto == "" {
+		proto = "HTTP/1.1"
+	}
+	writeBlock(w, proto+" "+statusLine(rr.Response), rr.Response.Header,
+		rr.ResponseBody, maxBody)
+}
+
+// Returns the status code and text of a response.
+func statusLine(resp *http.Response) string {
+	return strconv.Itoa(resp.StatusCode) + " " +
+		http.StatusText(resp.StatusCode)
+}
+
+// Writes a request or response as a fenced code block. JSON bodies are
+// indented and long bodies are truncated.
+func writeBlock(
+	w io.Writer, first string, header http.Header, body []byte, maxBody int,
+) {
+	indented := &bytes.Buffer{}
+	if json.Indent(indented, body, "", "  ") == nil {
+		body = indented.Bytes()
+	}
+	more := 0
+	if len(body) > maxBody {
+		cut := maxBody
+		for cut > 0 && !utf8.RuneStart(body[cut]) {
+			cut--
+		}
+		body, more = body[:cut], len(body)-cut
+	}
+
+	block := &bytes.Buffer{}
+	fmt.Fprintln(block, first)
+	printHeader(block, header)
+	printBody(block, body)
+	text := bytes.TrimRight(block.Bytes(), "\n")
+	if more > 0 {
+		text = append(text, fmt.Sprintf("\n[%d more bytes]", more)...)
+	}
+	fmt.Fprintf(w, "```http\n%s\n```\n", text)
+}
+
+// Returns the anchor GitHub generates for a heading.
+func anchor(heading string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(heading) {
+		switch {
+		case r == ' ':
+			b.WriteRune('-')
+		case r == '-' || r == '_' || r >= 'a' && r <= 'z' || r >= '0' && r <= '9':
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
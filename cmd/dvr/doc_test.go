@@ -0,0 +1,130 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/liquidgecka/testlib"
+)
+
+func TestDoc(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	created := testRecording("POST", "https://api.example.com/items", 201,
+		`{"id":7}`)
+	created.Request.Header.Set("Content-Type", "application/json")
+	created.RequestBody = []byte(`{"name":"x"}`)
+	failed := testRecording("GET", "https://api.example.com/items/9", 0, "")
+	failed.Response = nil
+	failed.Error = errors.New("connection refused")
+	archive := testArchive(t,
+		testRecording("GET", "https://api.example.com/items/1?a=1", 200,
+			strings.Repeat("é", 10)),
+		testRecording("GET", "https://api.example.com/items/2", 200, "two"),
+		testRecording("GET", "https://api.example.com/items/3", 404, ""),
+		failed, created)
+
+	code, out, _ := runCommand("doc", archive)
+	T.Equal(code, 0)
+	T.Equal(out, "# API interactions\n"+`
+Generated from archive.dvr: 5 recordings of 2 endpoints.
+
+| Endpoint | Statuses | Recordings |
+| --- | --- | --- |
+| [`+"`POST https://api.example.com/items`"+`](#post-httpsapiexamplecomitems) | 201 | 1 |
+| [`+"`GET https://api.example.com/items/{id}`"+`](#get-httpsapiexamplecomitemsid) | 200, 404, error | 4 |
+
+## POST https://api.example.com/items
+
+### 201 Created
+
+`+"```http"+`
+POST https://api.example.com/items
+Accept: */*
+Content-Type: application/json
+
+{
+  "name": "x"
+}
+`+"```"+`
+
+`+"```http"+`
+HTTP/1.1 201 Created
+Content-Type: text/plain
+
+{
+  "id": 7
+}
+`+"```"+`
+
+## GET https://api.example.com/items/{id}
+
+### 200 OK
+
+Returned by 2 recordings, for example:
+
+`+"```http"+`
+GET https://api.example.com/items/1?a=1
+Accept: */*
+`+"```"+`
+
+`+"```http"+`
+HTTP/1.1 200 OK
+Content-Type: text/plain
+
+éééééééééé
+`+"```"+`
+
+### 404 Not Found
+
+`+"```http"+`
+GET https://api.example.com/items/3
+Accept: */*
+`+"```"+`
+
+`+"```http"+`
+HTTP/1.1 404 Not Found
+Content-Type: text/plain
+`+"```"+`
+
+### Error
+
+`+"```http"+`
+GET https://api.example.com/items/9
+Accept: */*
+`+"```"+`
+
+The request failed: connection refused
+`)
+
+	// Long bodies are truncated without splitting characters.
+	code, out, _ = runCommand("doc", "-max-body", "5", archive)
+	T.Equal(code, 0)
+	T.Equal(strings.Contains(out, "\néé\n[16 more bytes]\n```"), true)
+
+	// Documents can also be written to a file.
+	path := filepath.Join(t.TempDir(), "api.md")
+	code, _, _ = runCommand("doc", "-o", path, archive)
+	T.Equal(code, 0)
+	data, err := ioutil.ReadFile(path)
+	T.ExpectSuccess(err)
+	T.Equal(strings.HasPrefix(string(data), "# API interactions\n"), true)
+}
@@ -0,0 +1,272 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/orchestrate-io/dvr"
+)
+
+func init() {
+	register(&command{
+		name:  "drift",
+		args:  "[flags] <archive>",
+		short: "compare the recordings with the live services",
+		run:   runDrift,
+	})
+}
+
+// The methods that are sent without -unsafe, since sending them again
+// shouldn't change anything on the live service.
+var safeMethods = map[string]bool{"GET": true, "HEAD": true, "OPTIONS": true}
+
+// Sends each recorded request to its live endpoint, as rerecord does, and
+// reports the responses that differ from the recording in status, content
+// type or the shape of a JSON body. Values in the body are not compared
+// unless -exact is given, since most change from one request to the next.
+// The archive is not modified, and the command fails if anything drifted so
+// that it can be run on a schedule.
+func runDrift(args []string) error {
+	var f filter
+	flags := newFlagSet(commands["drift"])
+	timeout := flags.Duration("timeout", 30*time.Second,
+		"the timeout for each request")
+	unsafe := flags.Bool("unsafe", false,
+		"also send requests with methods such as POST and DELETE")
+	exact := flags.Bool("exact", false,
+		"report bodies that differ at all, not only in their shape")
+	f.register(flags, "")
+	args, err := parseFlags(flags, args)
+	if err != nil {
+		return err
+	} else if len(args) != 1 {
+		flags.Usage()
+		return fmt.Errorf("expected one archive")
+	} else if err := f.compile(); err != nil {
+		return err
+	}
+
+	rrs, err := dvr.ReadArchiveFile(args[0])
+	if err != nil {
+		return err
+	}
+	checked, drifted, skipped := 0, 0, 0
+	for i, rr := range rrs {
+		if rr.Request == nil || rr.Request.URL == nil || !f.matches(rr) {
+			continue
+		} else if method, _ := methodAndURL(rr); !*unsafe && !safeMethods[method] {
+			skipped++
+			continue
+		}
+		checked++
+		messages := compareLive(rr, rerecord(rr, *timeout), *exact)
+		for _, message := range messages {
+			fmt.Fprintf(stdout, "%d %s: %s\n", i, redactedSummary(rr), message)
+		}
+		if len(messages) > 0 {
+			drifted++
+		}
+	}
+
+	if skipped > 0 {
+		fmt.Fprintf(stderr, "skipped %d requests that are not safe to "+
+			"send again, use -unsafe to include them\n", skipped)
+	}
+	if drifted > 0 {
+		return fmt.Errorf("%d of %d recordings drifted", drifted, checked)
+	}
+	fmt.Fprintf(stdout, "checked %d recordings, none drifted\n", checked)
+	return nil
+}
+
+// Returns a description of each way that the live response differs from the
+// recorded one.
+func compareLive(recorded, live *dvr.RequestResponse, exact bool) []string {
+	switch {
+	case recorded.Response == nil && live.Response == nil:
+		return nil
+	case live.Response == nil:
+		return []string{fmt.Sprintf("the request now fails: %s", live.Error)}
+	case recorded.Response == nil:
+		return []string{"the request failed when recorded but now succeeds"}
+	}
+
+	var messages []string
+	if old, now := recorded.Response.StatusCode,
+		live.Response.StatusCode; old != now {
+		messages = append(messages, fmt.Sprintf(
+			"the status was %d, now %d", old, now))
+	}
+	oldType := mediaType(recorded.Response.Header.Get("Content-Type"))
+	newType := mediaType(live.Response.Header.Get("Content-Type"))
+	if oldType != newType {
+		messages = append(messages, fmt.Sprintf(
+			"the content type was %q, now %q", oldType, newType))
+	}
+
+	oldShape, oldJSON := jsonShape(recorded.ResponseBody)
+	newShape, newJSON := jsonShape(live.ResponseBody)
+	switch {
+	case oldJSON && newJSON:
+		messages = append(messages, compareShapes(oldShape, newShape)...)
+	case oldJSON:
+		messages = append(messages, "the body is no longer JSON")
+	case newJSON:
+		messages = append(messages, "the body is now JSON")
+	}
+	if exact && !bytes.Equal(recorded.ResponseBody, live.ResponseBody) {
+		messages = append(messages, fmt.Sprintf(
+			"the body changed, %d bytes were recorded and %d returned",
+			len(recorded.ResponseBody), len(live.ResponseBody)))
+	}
+	return messages
+}
+
+// Returns the media type of a Content-Type header, without its parameters.
+func mediaType(contentType string) string {
+	if t, _, err := mime.ParseMediaType(contentType); err == nil {
+		return t
+	}
+	return strings.TrimSpace(contentType)
+}
+
+// The shape of a JSON document: the type of the value at each path, such as
+// "$.items[].id". The elements of an array share a path. Arrays with no
+// elements are given the type "empty array" so that the paths within them
+// aren't reported as removed.
+type shape map[string]string
+
+// Returns the shape of a JSON body, or false if the body isn't JSON.
+func jsonShape(body []byte) (shape, bool) {
+	if len(bytes.TrimSpace(body)) == 0 {
+		return nil, false
+	}
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		return nil, false
+	}
+	s := shape{}
+	s.add("$", v)
+	return s, true
+}
+
+// Adds the value found at path to the shape.
+func (s shape) add(path string, v interface{}) {
+	typ := "null"
+	switch v := v.(type) {
+	case map[string]interface{}:
+		typ = "object"
+		for name, field := range v {
+			s.add(path+"."+name, field)
+		}
+	case []interface{}:
+		typ = "array"
+		if len(v) == 0 {
+			typ = "empty array"
+		}
+		for _, elem := range v {
+			s.add(path+"[]", elem)
+		}
+	case string:
+		typ = "string"
+	case float64:
+		typ = "number"
+	case bool:
+		typ = "boolean"
+	}
+	// The first type other than null wins when array elements differ.
+	if old, ok := s[path]; !ok || old == "null" || old == "empty array" {
+		s[path] = typ
+	}
+}
+
+// Returns true if the path is within an array that was empty in this shape,
+// so nothing is known about it.
+func (s shape) unknown(path string) bool {
+	for i := strings.Index(path, "[]"); i >= 0; {
+		if s[path[:i]] == "empty array" {
+			return true
+		}
+		next := strings.Index(path[i+2:], "[]")
+		if next < 0 {
+			break
+		}
+		i += 2 + next
+	}
+	return false
+}
+
+// Describes the fields that were added, removed or changed type between two
+// shapes. Changes to and from null are ignored since optional fields are
+// often null.
+func compareShapes(old, now shape) []string {
+	paths := map[string]bool{}
+	for path := range old {
+		paths[path] = true
+	}
+	for path := range now {
+		paths[path] = true
+	}
+	sorted := make([]string, 0, len(paths))
+	for path := range paths {
+		sorted = append(sorted, path)
+	}
+	sort.Strings(sorted)
+
+	// Paths sort after their parents, so the paths within an added or
+	// removed value are skipped by remembering the ones reported.
+	var messages, reported []string
+	within := func(path string) bool {
+		for _, r := range reported {
+			if strings.HasPrefix(path, r+".") ||
+				strings.HasPrefix(path, r+"[]") {
+				return true
+			}
+		}
+		return false
+	}
+	for _, path := range sorted {
+		if within(path) {
+			continue
+		}
+		oldType, inOld := old[path]
+		newType, inNew := now[path]
+		switch {
+		case !inOld && !old.unknown(path):
+			messages = append(messages, fmt.Sprintf(
+				"%s was added (%s)", path, newType))
+			reported = append(reported, path)
+		case !inNew && !now.unknown(path):
+			messages = append(messages, fmt.Sprintf(
+				"%s was removed (%s)", path, oldType))
+			reported = append(reported, path)
+		case !inOld || !inNew || oldType == newType:
+		case oldType == "null" || newType == "null":
+		case strings.HasSuffix(oldType, "array") &&
+			strings.HasSuffix(newType, "array"):
+		default:
+			messages = append(messages, fmt.Sprintf(
+				"%s changed from %s to %s", path, oldType, newType))
+		}
+	}
+	return messages
+}
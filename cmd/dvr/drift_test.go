@@ -0,0 +1,81 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/liquidgecka/testlib"
+	"github.com/orchestrate-io/dvr"
+)
+
+func TestDrift(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/same":
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(`{"id": 2, "tags": [], "note": null}`))
+			case "/changed":
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(`{"id": "2", "user": {"name": "x"}}`))
+			default:
+				http.NotFound(w, r)
+			}
+		}))
+	defer server.Close()
+
+	jsonRecording := func(path, body string) *dvr.RequestResponse {
+		rr := testRecording("GET", server.URL+path, 200, body)
+		rr.Response.Header.Set("Content-Type",
+			"application/json; charset=utf-8")
+		return rr
+	}
+	same := jsonRecording("/same", `{"id": 1, "tags": ["a"], "note": "n"}`)
+	changed := jsonRecording("/changed", `{"id": 1, "owner": {"id": 1, "name": "y"}}`)
+	gone := testRecording("GET", server.URL+"/gone", 200, "text")
+	post := testRecording("POST", server.URL+"/gone", 200, "")
+	archive := testArchive(t, same, changed, gone, post)
+
+	code, out, errOut := runCommand("drift", archive)
+	T.Equal(code, 1)
+	T.Equal(out, ""+
+		"1 GET "+server.URL+"/changed 200: $.id changed from number to string\n"+
+		"1 GET "+server.URL+"/changed 200: $.owner was removed (object)\n"+
+		"1 GET "+server.URL+"/changed 200: $.user was added (object)\n"+
+		"2 GET "+server.URL+"/gone 200: the status was 200, now 404\n")
+	T.Equal(errOut, "skipped 1 requests that are not safe to send again, "+
+		"use -unsafe to include them\n"+
+		"dvr drift: 2 of 3 recordings drifted\n")
+
+	code, out, _ = runCommand("drift", "-url", "/same$", archive)
+	T.Equal(code, 0)
+	T.Equal(out, "checked 1 recordings, none drifted\n")
+
+	code, out, _ = runCommand("drift", "-url", "/same$", "-exact", archive)
+	T.Equal(code, 1)
+	T.Equal(strings.Contains(out, "the body changed"), true)
+
+	server.Close()
+	code, out, _ = runCommand("drift", "-url", "/same$", archive)
+	T.Equal(code, 1)
+	T.Equal(strings.Contains(out, "the request now fails"), true)
+}
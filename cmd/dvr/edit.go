@@ -0,0 +1,115 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/orchestrate-io/dvr"
+)
+
+// Opens the file in the user's editor, waiting for it to exit. This is a
+// variable so tests can replace it.
+var editFile = func(path string) error {
+	editor := strings.Fields(os.Getenv("EDITOR"))
+	if len(editor) == 0 {
+		editor = []string{"vi"}
+	}
+	cmd := exec.Command(editor[0], append(editor[1:], path)...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+func init() {
+	register(&command{
+		name:  "edit",
+		args:  "<archive> -index n",
+		short: "edit a recording as JSON in $EDITOR",
+		run:   runEdit,
+	})
+}
+
+// Writes a recording to a temporary JSON file, opens it in $EDITOR and then
+// stores the edited recording back into the archive. The archive is left
+// alone if the editor fails, the file is not changed or the result is not a
+// valid recording.
+func runEdit(args []string) error {
+	flags := newFlagSet(commands["edit"])
+	index := flags.Int("index", -1, "the index of the recording to edit")
+	args, err := parseFlags(flags, args)
+	if err != nil {
+		return err
+	} else if len(args) != 1 {
+		flags.Usage()
+		return fmt.Errorf("expected one archive")
+	}
+
+	rrs, err := dvr.ReadArchiveFile(args[0])
+	if err != nil {
+		return err
+	} else if *index < 0 || *index >= len(rrs) {
+		return fmt.Errorf("invalid index %d, the archive has %d recordings",
+			*index, len(rrs))
+	}
+
+	original, err := json.MarshalIndent(toJSON(rrs[*index]), "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile("", "dvr-edit-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(append(original, '\n'))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	} else if err := editFile(tmp.Name()); err != nil {
+		return fmt.Errorf("editor: %s", err)
+	}
+
+	edited, err := ioutil.ReadFile(tmp.Name())
+	if err != nil {
+		return err
+	} else if bytes.Equal(bytes.TrimSpace(edited), original) {
+		fmt.Fprintln(stdout, "no changes")
+		return nil
+	}
+	var j jsonRecording
+	decoder := json.NewDecoder(bytes.NewReader(edited))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&j); err != nil {
+		return fmt.Errorf("invalid JSON, the archive was not changed: %s", err)
+	}
+	rr, err := fromJSON(&j)
+	if err != nil {
+		return fmt.Errorf("invalid recording, the archive was not changed: %s",
+			err)
+	}
+	rrs[*index] = rr
+	fmt.Fprintf(stdout, "updated %d %s\n", *index, summary(rr))
+	return dvr.WriteArchiveFile(args[0], rrs)
+}
@@ -0,0 +1,90 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/liquidgecka/testlib"
+	"github.com/orchestrate-io/dvr"
+)
+
+func TestEdit(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+	defer func(f func(string) error) { editFile = f }(editFile)
+
+	binary := testRecording("GET", "https://api.example.com/logo", 200, "")
+	binary.ResponseBody = []byte{0xff, 0x00}
+	archive := testArchive(t,
+		testRecording("GET", "https://api.example.com/items", 200, "items"),
+		binary)
+
+	// Replaces text in the file being edited.
+	replace := func(old, new string) func(string) error {
+		return func(path string) error {
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			edited := strings.Replace(string(data), old, new, 1)
+			return ioutil.WriteFile(path, []byte(edited), 0644)
+		}
+	}
+
+	editFile = replace(`"status_code": 200`, `"status_code": 404`)
+	code, out, _ := runCommand("edit", archive, "-index", "0")
+	T.Equal(code, 0)
+	T.Equal(out, "updated 0 GET https://api.example.com/items 404\n")
+	editFile = replace(`"body": "items"`, `"body": "no such items"`)
+	code, _, _ = runCommand("edit", archive, "-index", "0")
+	T.Equal(code, 0)
+
+	rrs, err := dvr.ReadArchiveFile(archive)
+	T.ExpectSuccess(err)
+	T.Equal(rrs[0].Response.StatusCode, 404)
+	T.Equal(rrs[0].Response.Status, "404 Not Found")
+	T.Equal(string(rrs[0].ResponseBody), "no such items")
+	T.Equal(rrs[0].Response.ContentLength, int64(13))
+	T.Equal(rrs[0].Recorded.IsZero(), false)
+
+	// Binary bodies survive the round trip.
+	editFile = replace(`"status_code": 200`, `"status_code": 201`)
+	code, _, _ = runCommand("edit", archive, "-index", "1")
+	T.Equal(code, 0)
+	rrs, err = dvr.ReadArchiveFile(archive)
+	T.ExpectSuccess(err)
+	T.Equal(rrs[1].ResponseBody, []byte{0xff, 0x00})
+
+	// Unchanged and invalid edits leave the archive alone.
+	editFile = replace("", "")
+	code, out, _ = runCommand("edit", archive, "-index", "0")
+	T.Equal(code, 0)
+	T.Equal(out, "no changes\n")
+	editFile = replace(`"method": "GET"`, `"method": ""`)
+	code, _, errOut := runCommand("edit", archive, "-index", "0")
+	T.Equal(code, 1)
+	T.Equal(strings.Contains(errOut, "the request has no method"), true)
+	editFile = replace(`"status_code"`, `"code"`)
+	code, _, errOut = runCommand("edit", archive, "-index", "0")
+	T.Equal(code, 1)
+	T.Equal(strings.Contains(errOut, "invalid JSON"), true)
+
+	code, _, errOut = runCommand("edit", archive)
+	T.Equal(code, 1)
+	T.Equal(strings.Contains(errOut, "invalid index -1"), true)
+}
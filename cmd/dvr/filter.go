@@ -0,0 +1,120 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/orchestrate-io/dvr"
+)
+
+// Selects recordings by their URL, method, status and body. This is shared
+// by the commands that operate on some of the recordings in an archive.
+type filter struct {
+	url    string
+	method string
+	status string
+	body   string
+
+	urlRE  *regexp.Regexp
+	bodyRE *regexp.Regexp
+}
+
+// Adds the flags that configure the filter. prefix is prepended to each
+// flag name.
+func (f *filter) register(flags *flag.FlagSet, prefix string) {
+	flags.StringVar(&f.url, prefix+"url", "",
+		"only recordings whose URL matches this regular expression")
+	flags.StringVar(&f.method, prefix+"method", "",
+		"only recordings with this method")
+	flags.StringVar(&f.status, prefix+"status", "",
+		"only recordings with these comma separated statuses, such as "+
+			"404 or 5xx, or \"error\" for failed requests")
+	flags.StringVar(&f.body, prefix+"body", "",
+		"only recordings whose request or response body matches this "+
+			"regular expression")
+}
+
+// Compiles the filter once the flags have been parsed.
+func (f *filter) compile() (err error) {
+	if f.url != "" {
+		if f.urlRE, err = regexp.Compile(f.url); err != nil {
+			return err
+		}
+	}
+	if f.body != "" {
+		if f.bodyRE, err = regexp.Compile(f.body); err != nil {
+			return err
+		}
+	}
+	for _, s := range strings.Split(f.status, ",") {
+		if s == "" || s == "error" {
+			continue
+		} else if len(s) == 3 && strings.HasSuffix(s, "xx") && s[0] >= '1' &&
+			s[0] <= '5' {
+			continue
+		} else if _, err := strconv.Atoi(s); err != nil {
+			return fmt.Errorf("invalid status %q", s)
+		}
+	}
+	return nil
+}
+
+// Returns true if the filter has no conditions.
+func (f *filter) empty() bool {
+	return f.url == "" && f.method == "" && f.status == "" && f.body == ""
+}
+
+// Returns true if the recording matches every condition of the filter.
+func (f *filter) matches(rr *dvr.RequestResponse) bool {
+	method, url := methodAndURL(rr)
+	if f.urlRE != nil && !f.urlRE.MatchString(url) {
+		return false
+	} else if f.method != "" && !strings.EqualFold(method, f.method) {
+		return false
+	}
+	if f.status != "" && !f.matchesStatus(rr) {
+		return false
+	}
+	if f.bodyRE != nil && !f.bodyRE.Match(rr.RequestBody) &&
+		!f.bodyRE.Match(rr.ResponseBody) {
+		return false
+	}
+	return true
+}
+
+// Returns true if the status of the recording is one of those listed.
+func (f *filter) matchesStatus(rr *dvr.RequestResponse) bool {
+	for _, s := range strings.Split(f.status, ",") {
+		switch {
+		case s == "error":
+			if rr.Response == nil {
+				return true
+			}
+		case rr.Response == nil:
+		case strings.HasSuffix(s, "xx"):
+			if rr.Response.StatusCode/100 == int(s[0]-'0') {
+				return true
+			}
+		case s == strconv.Itoa(rr.Response.StatusCode):
+			return true
+		}
+	}
+	return false
+}
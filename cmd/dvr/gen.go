@@ -0,0 +1,211 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/orchestrate-io/dvr"
+)
+
+func init() {
+	register(&command{
+		name:  "gen",
+		args:  "[flags] <archive>",
+		short: "generate a Go test from the recordings",
+		run:   runGen,
+	})
+}
+
+// Writes a table driven Go test that sends each recorded request and checks
+// the status and the start of the body of the response. The test imports
+// dvr, so it replays the archive when run with -dvr.replay. It is meant as a
+// starting point for tests of a client that has none.
+func runGen(args []string) error {
+	var f filter
+	flags := newFlagSet(commands["gen"])
+	output := flags.String("o", "", "write the test here, not stdout")
+	pkg := flags.String("package", "",
+		"the package of the test, by default that of the other files "+
+			"in the directory given with -o")
+	name := flags.String("name", "TestRecorded", "the name of the test")
+	snippet := flags.Int("snippet", 40,
+		"how much of each response body to check, in bytes")
+	f.register(flags, "")
+	args, err := parseFlags(flags, args)
+	if err != nil {
+		return err
+	} else if len(args) != 1 {
+		flags.Usage()
+		return fmt.Errorf("expected one archive")
+	} else if err := f.compile(); err != nil {
+		return err
+	}
+	if *pkg == "" {
+		*pkg = packageName(*output)
+	}
+
+	rrs, err := dvr.ReadArchiveFile(args[0])
+	if err != nil {
+		return err
+	}
+	var selected []*dvr.RequestResponse
+	skipped := 0
+	for _, rr := range rrs {
+		if !f.matches(rr) {
+			continue
+		} else if rr.Request == nil || rr.Request.URL == nil ||
+			rr.Response == nil {
+			skipped++
+			continue
+		}
+		selected = append(selected, rr)
+	}
+	source, err := generateTest(args[0], *pkg, *name, *snippet, selected)
+	if err != nil {
+		return err
+	}
+	if skipped > 0 {
+		fmt.Fprintf(stderr, "skipped %d failed requests\n", skipped)
+	}
+	if *output == "" {
+		_, err = stdout.Write(source)
+		return err
+	}
+	return ioutil.WriteFile(*output, source, 0644)
+}
+
+// Returns the package of the Go files in the directory that output will be
+// written to, or a name based on the directory if there are none.
+func packageName(output string) string {
+	dir := "."
+	if output != "" {
+		dir = filepath.Dir(output)
+	}
+	names, _ := filepath.Glob(filepath.Join(dir, "*.go"))
+	for _, name := range names {
+		if name == output {
+			continue
+		}
+		file, err := parser.ParseFile(token.NewFileSet(), name, nil,
+			parser.PackageClauseOnly)
+		if err == nil {
+			return strings.TrimSuffix(file.Name.Name, "_test")
+		}
+	}
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "main"
+	}
+	pkg := strings.ToLower(nonIdentifier.ReplaceAllString(
+		filepath.Base(abs), ""))
+	if pkg == "" || pkg[0] >= '0' && pkg[0] <= '9' {
+		return "main"
+	}
+	return pkg
+}
+
+// Matches the characters that can't appear in a package name.
+var nonIdentifier = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+// Returns the formatted source of a test for the recordings.
+func generateTest(archive, pkg, name string, snippet int, rrs []*dvr.RequestResponse) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "package %s\n\n", pkg)
+	fmt.Fprintf(buf, "import (\n\"io/ioutil\"\n\"net/http\"\n\"strings\"\n"+
+		"\"testing\"\n\n_ \"github.com/orchestrate-io/dvr\"\n)\n\n")
+	fmt.Fprintf(buf, "// Generated by \"dvr gen\" from %s. Run with "+
+		"-dvr.replay -dvr.file=%s\n// to replay the recordings.\n",
+		archive, archive)
+	fmt.Fprintf(buf, "func %s(t *testing.T) {\n", name)
+	fmt.Fprintf(buf, "tests := []struct {\nname string\nmethod string\n"+
+		"url string\ncontentType string\nbody string\nstatus int\n"+
+		"snippet string\n}{\n")
+	for _, rr := range rrs {
+		method, url := methodAndURL(rr)
+		fmt.Fprintf(buf, "{\nname: %s,\nmethod: %q,\nurl: %s,\n",
+			strconv.Quote(method+" "+rr.Request.URL.Path), method,
+			strconv.Quote(url))
+		if len(rr.RequestBody) > 0 {
+			fmt.Fprintf(buf, "contentType: %s,\nbody: %s,\n",
+				strconv.Quote(rr.Request.Header.Get("Content-Type")),
+				strconv.Quote(string(rr.RequestBody)))
+		}
+		fmt.Fprintf(buf, "status: %d,\n", rr.Response.StatusCode)
+		if s := bodySnippet(rr.ResponseBody, snippet); s != "" {
+			fmt.Fprintf(buf, "snippet: %s,\n", strconv.Quote(s))
+		}
+		fmt.Fprintf(buf, "},\n")
+	}
+	fmt.Fprintf(buf, "}\n\n%s\n}\n", genTestLoop)
+	return format.Source(buf.Bytes())
+}
+
+// The loop that runs the tests in the generated table.
+const genTestLoop = `for _, test := range tests {
+	test := test
+	t.Run(test.name, func(t *testing.T) {
+		req, err := http.NewRequest(test.method, test.url,
+			strings.NewReader(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.contentType != "" {
+			req.Header.Set("Content-Type", test.contentType)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != test.status {
+			t.Errorf("got status %d, expected %d", resp.StatusCode,
+				test.status)
+		}
+		if !strings.HasPrefix(string(body), test.snippet) {
+			t.Errorf("got body %q, expected it to start with %q", body,
+				test.snippet)
+		}
+	})
+}`
+
+// Returns the start of a text body, up to max bytes and cut at a rune
+// boundary, or nothing if the body isn't text.
+func bodySnippet(body []byte, max int) string {
+	if !utf8.Valid(body) || bytes.IndexByte(body, 0) >= 0 {
+		return ""
+	}
+	if len(body) > max {
+		body = body[:max]
+		for len(body) > 0 && !utf8.Valid(body) {
+			body = body[:len(body)-1]
+		}
+	}
+	return string(body)
+}
@@ -0,0 +1,79 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/liquidgecka/testlib"
+)
+
+func TestGen(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	post := testRecording("POST", "https://api.example.com/items?x=1", 201,
+		`{"id": 1, "name": "a name long enough to be cut"}`)
+	post.Request.Header.Set("Content-Type", "application/json")
+	post.RequestBody = []byte(`{"name": "a name long enough to be cut"}`)
+	binary := testRecording("GET", "https://api.example.com/logo.png", 200,
+		"\x89PNG\x00")
+	failed := testRecording("GET", "https://down.example.com/", 0, "")
+	failed.Response = nil
+	archive := testArchive(t, post, binary, failed)
+
+	dir := t.TempDir()
+	T.ExpectSuccess(ioutil.WriteFile(filepath.Join(dir, "client.go"),
+		[]byte("package client\n"), 0644))
+	output := filepath.Join(dir, "recorded_test.go")
+	code, out, errOut := runCommand("gen", "-o", output, "-snippet", "10",
+		archive)
+	T.Equal(code, 0)
+	T.Equal(out, "")
+	T.Equal(errOut, "skipped 1 failed requests\n")
+
+	data, err := ioutil.ReadFile(output)
+	T.ExpectSuccess(err)
+	source := string(data)
+	file, err := parser.ParseFile(token.NewFileSet(), output, data, 0)
+	T.ExpectSuccess(err)
+	T.Equal(file.Name.Name, "client")
+	for _, s := range []string{
+		"func TestRecorded(t *testing.T) {",
+		`name:        "POST /items",`,
+		`url:         "https://api.example.com/items?x=1",`,
+		`contentType: "application/json",`,
+		`status:      201,`,
+		`snippet:     "{\"id\": 1, ",`,
+		`name:   "GET /logo.png",`,
+		`_ "github.com/orchestrate-io/dvr"`,
+	} {
+		T.Equal(strings.Contains(source, s), true, s)
+	}
+	T.Equal(strings.Contains(source, "PNG"), false)
+	T.Equal(strings.Contains(source, "down.example.com"), false)
+
+	code, out, _ = runCommand("gen", "-package", "other", "-name",
+		"TestItems", "-method", "POST", archive)
+	T.Equal(code, 0)
+	T.Equal(strings.HasPrefix(out, "package other\n"), true)
+	T.Equal(strings.Contains(out, "func TestItems("), true)
+	T.Equal(strings.Contains(out, "logo.png"), false)
+}
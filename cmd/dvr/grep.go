@@ -0,0 +1,58 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/orchestrate-io/dvr"
+)
+
+func init() {
+	register(&command{
+		name:  "grep",
+		args:  "[flags] <archive>",
+		short: "print the recordings that match a filter",
+		run:   runGrep,
+	})
+}
+
+// Prints every recording in the archive that matches the filter, with its
+// full headers and bodies.
+func runGrep(args []string) error {
+	var f filter
+	flags := newFlagSet(commands["grep"])
+	f.register(flags, "")
+	args, err := parseFlags(flags, args)
+	if err != nil {
+		return err
+	} else if len(args) != 1 {
+		flags.Usage()
+		return fmt.Errorf("expected one archive")
+	} else if err := f.compile(); err != nil {
+		return err
+	}
+
+	rrs, err := dvr.ReadArchiveFile(args[0])
+	if err != nil {
+		return err
+	}
+	for i, rr := range rrs {
+		if f.matches(rr) {
+			printRecording(stdout, i, rr)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/liquidgecka/testlib"
+)
+
+func TestGrep(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	charge := testRecording("POST", "https://api.stripe.com/v1/charges", 502,
+		"bad gateway")
+	charge.RequestBody = []byte("amount=100")
+	binary := testRecording("GET", "https://api.stripe.com/v1/logo", 200, "")
+	binary.ResponseBody = []byte{0xff, 0x00}
+	failed := testRecording("GET", "https://internal/", 0, "")
+	failed.Response = nil
+	archive := testArchive(t, charge, binary,
+		testRecording("GET", "https://example.com/", 503, "down"), failed)
+
+	code, out, _ := runCommand("grep", "--url", "stripe.com", "--status",
+		"5xx", archive)
+	T.Equal(code, 0)
+	T.Equal(strings.Contains(out, "=== 0 recorded 2020-01-0"), true)
+	T.Equal(strings.Contains(out,
+		"POST https://api.stripe.com/v1/charges"), true)
+	T.Equal(strings.Contains(out, "Accept: */*\n\namount=100\n\n"), true)
+	T.Equal(strings.Contains(out, "Content-Type: text/plain\n\nbad gateway\n"),
+		true)
+	T.Equal(strings.Contains(out, "=== 1"), false)
+	T.Equal(strings.Contains(out, "=== 2"), false)
+
+	// Flags may follow the archive.
+	code, out, _ = runCommand("grep", archive, "-url", "logo")
+	T.Equal(code, 0)
+	T.Equal(strings.Contains(out, "[2 bytes of binary data]"), true)
+
+	code, out, _ = runCommand("grep", archive, "-status", "error")
+	T.Equal(code, 0)
+	T.Equal(strings.Contains(out, "=== 3"), true)
+	T.Equal(strings.Count(out, "==="), 1)
+
+	code, out, _ = runCommand("grep", archive, "-method", "post",
+		"-body", "amount")
+	T.Equal(code, 0)
+	T.Equal(strings.Count(out, "==="), 1)
+
+	code, _, errOut := runCommand("grep", archive, "-status", "5x")
+	T.Equal(code, 1)
+	T.Equal(strings.Contains(errOut, `invalid status "5x"`), true)
+}
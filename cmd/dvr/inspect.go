@@ -0,0 +1,77 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/orchestrate-io/dvr"
+)
+
+func init() {
+	register(&command{
+		name:  "inspect",
+		args:  "<archive>",
+		short: "list the recordings in an archive",
+		run:   runInspect,
+	})
+}
+
+// Lists the index, method, URL, status, request and response body sizes and
+// recorded time of each recording in the archive.
+func runInspect(args []string) error {
+	flags := newFlagSet(commands["inspect"])
+	args, err := parseFlags(flags, args)
+	if err != nil {
+		return err
+	} else if len(args) != 1 {
+		flags.Usage()
+		return fmt.Errorf("expected one archive")
+	}
+
+	rrs, err := dvr.ReadArchiveFile(args[0])
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "INDEX\tMETHOD\tURL\tSTATUS\tREQUEST\tRESPONSE\tRECORDED")
+	for i, rr := range rrs {
+		method, url := methodAndURL(rr)
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%d\t%d\t%s\n", i, method, url,
+			status(rr), len(rr.RequestBody), len(rr.ResponseBody),
+			recorded(rr))
+	}
+	return w.Flush()
+}
+
+// Returns the status code of the recording, or "error" if the request
+// failed.
+func status(rr *dvr.RequestResponse) string {
+	if rr.Response == nil {
+		return "error"
+	}
+	return strconv.Itoa(rr.Response.StatusCode)
+}
+
+// Returns the time the recording was made, or "-" if it is not known.
+func recorded(rr *dvr.RequestResponse) string {
+	if rr.Recorded.IsZero() {
+		return "-"
+	}
+	return rr.Recorded.Local().Format(time.RFC3339)
+}
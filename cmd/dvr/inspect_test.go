@@ -0,0 +1,47 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/liquidgecka/testlib"
+)
+
+func TestInspect(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	post := testRecording("POST", "https://api.example.com/items", 201, "created")
+	post.RequestBody = []byte(`{"name":"x"}`)
+	failed := testRecording("", "https://down.example.com/", 0, "")
+	failed.Response = nil
+	failed.ResponseBody = nil
+	archive := testArchive(t, post, failed)
+
+	code, out, _ := runCommand("inspect", archive)
+	T.Equal(code, 0)
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	T.Equal(len(lines), 3)
+	T.Equal(strings.Fields(lines[0]), []string{"INDEX", "METHOD", "URL",
+		"STATUS", "REQUEST", "RESPONSE", "RECORDED"})
+	fields := strings.Fields(lines[1])
+	T.Equal(fields[:6], []string{"0", "POST",
+		"https://api.example.com/items", "201", "12", "7"})
+	T.Equal(strings.HasPrefix(fields[6], "2020-01-0"), true)
+	T.Equal(strings.Fields(lines[2])[:4], []string{"1", "GET",
+		"https://down.example.com/", "error"})
+}
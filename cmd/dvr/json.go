@@ -0,0 +1,284 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/orchestrate-io/dvr"
+)
+
+// The JSON form of a recording, used to edit and convert recordings. Bodies
+// that are UTF-8 text are stored as strings, and others are base64 encoded.
+type jsonRecording struct {
+	Partition string        `json:"partition,omitempty"`
+	RunID     int64         `json:"run_id,omitempty"`
+	Labels    []string      `json:"labels,omitempty"`
+	Recorded  *time.Time    `json:"recorded,omitempty"`
+	Duration  string        `json:"duration,omitempty"`
+	Request   *jsonRequest  `json:"request"`
+	Interim   []jsonInterim `json:"interim,omitempty"`
+	Response  *jsonResponse `json:"response,omitempty"`
+	Error     string        `json:"error,omitempty"`
+}
+
+// The JSON form of an informational (1xx) response.
+type jsonInterim struct {
+	StatusCode int         `json:"status_code"`
+	Header     http.Header `json:"header,omitempty"`
+}
+
+// The JSON form of a recorded request.
+type jsonRequest struct {
+	Method     string      `json:"method"`
+	URL        string      `json:"url"`
+	Proto      string      `json:"proto,omitempty"`
+	Host       string      `json:"host,omitempty"`
+	Header     http.Header `json:"header,omitempty"`
+	Trailer    http.Header `json:"trailer,omitempty"`
+	Body       string      `json:"body,omitempty"`
+	BodyBase64 string      `json:"body_base64,omitempty"`
+	BodyError  string      `json:"body_error,omitempty"`
+}
+
+// The JSON form of a recorded response.
+type jsonResponse struct {
+	Status           string      `json:"status"`
+	StatusCode       int         `json:"status_code"`
+	Proto            string      `json:"proto,omitempty"`
+	Header           http.Header `json:"header,omitempty"`
+	Trailer          http.Header `json:"trailer,omitempty"`
+	ContentLength    int64       `json:"content_length"`
+	TransferEncoding []string    `json:"transfer_encoding,omitempty"`
+	Uncompressed     bool        `json:"uncompressed,omitempty"`
+	Body             string      `json:"body,omitempty"`
+	BodyBase64       string      `json:"body_base64,omitempty"`
+	BodyError        string      `json:"body_error,omitempty"`
+}
+
+// Returns the text and base64 forms of a body, only one of which is set.
+func encodeBody(body []byte) (string, string) {
+	if utf8.Valid(body) {
+		return string(body), ""
+	}
+	return "", base64.StdEncoding.EncodeToString(body)
+}
+
+// Decodes a body from its text or base64 form.
+func decodeBody(text, encoded string) ([]byte, error) {
+	if encoded != "" {
+		if text != "" {
+			return nil, fmt.Errorf("only one of body and body_base64 " +
+				"may be set")
+		}
+		return base64.StdEncoding.DecodeString(encoded)
+	} else if text == "" {
+		return nil, nil
+	}
+	return []byte(text), nil
+}
+
+// Returns the message of an error, or an empty string if it is nil.
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// Returns an error with the given message, or nil if it is empty.
+func stringError(s string) error {
+	if s == "" {
+		return nil
+	}
+	return errors.New(s)
+}
+
+// Converts a recording into its JSON form.
+func toJSON(rr *dvr.RequestResponse) *jsonRecording {
+	j := &jsonRecording{
+		Partition: rr.Partition,
+		RunID:     rr.RunID,
+		Labels:    rr.Labels,
+		Error:     errorString(rr.Error),
+	}
+	if !rr.Recorded.IsZero() {
+		recorded := rr.Recorded.UTC()
+		j.Recorded = &recorded
+	}
+	if rr.Duration != 0 {
+		j.Duration = rr.Duration.String()
+	}
+	for _, interim := range rr.Interim {
+		j.Interim = append(j.Interim, jsonInterim{
+			StatusCode: interim.StatusCode,
+			Header:     interim.Header,
+		})
+	}
+	if req := rr.Request; req != nil {
+		method, url := methodAndURL(rr)
+		j.Request = &jsonRequest{
+			Method:    method,
+			URL:       url,
+			Proto:     req.Proto,
+			Host:      req.Host,
+			Header:    req.Header,
+			Trailer:   req.Trailer,
+			BodyError: errorString(rr.RequestBodyError),
+		}
+		j.Request.Body, j.Request.BodyBase64 = encodeBody(rr.RequestBody)
+	}
+	if resp := rr.Response; resp != nil {
+		j.Response = &jsonResponse{
+			Status:           resp.Status,
+			StatusCode:       resp.StatusCode,
+			Proto:            resp.Proto,
+			Header:           resp.Header,
+			Trailer:          resp.Trailer,
+			ContentLength:    resp.ContentLength,
+			TransferEncoding: resp.TransferEncoding,
+			Uncompressed:     resp.Uncompressed,
+			BodyError:        errorString(rr.ResponseBodyError),
+		}
+		j.Response.Body, j.Response.BodyBase64 = encodeBody(rr.ResponseBody)
+	}
+	return j
+}
+
+// Converts the JSON form back into a recording, checking that it is valid.
+// Content lengths are updated to match the bodies, and the status text to
+// match the status code.
+func fromJSON(j *jsonRecording) (*dvr.RequestResponse, error) {
+	rr := &dvr.RequestResponse{
+		Partition: j.Partition,
+		RunID:     j.RunID,
+		Labels:    j.Labels,
+		Error:     stringError(j.Error),
+	}
+	if j.Recorded != nil {
+		rr.Recorded = *j.Recorded
+	}
+	if j.Duration != "" {
+		d, err := time.ParseDuration(j.Duration)
+		if err != nil {
+			return nil, fmt.Errorf("duration: %s", err)
+		}
+		rr.Duration = d
+	}
+	for _, interim := range j.Interim {
+		if interim.StatusCode < 100 || interim.StatusCode > 199 {
+			return nil, fmt.Errorf("interim status code %d is not 1xx",
+				interim.StatusCode)
+		}
+		rr.Interim = append(rr.Interim, dvr.InterimResponse{
+			StatusCode: interim.StatusCode,
+			Header:     interim.Header,
+		})
+	}
+
+	if j.Request == nil {
+		return nil, fmt.Errorf("the recording has no request")
+	}
+	u, err := url.Parse(j.Request.URL)
+	if err != nil {
+		return nil, fmt.Errorf("request url: %s", err)
+	} else if u.Scheme == "" {
+		return nil, fmt.Errorf("request url %q is not absolute", j.Request.URL)
+	} else if j.Request.Method == "" {
+		return nil, fmt.Errorf("the request has no method")
+	}
+	proto := j.Request.Proto
+	if proto == "" {
+		proto = "HTTP/1.1"
+	}
+	major, minor, ok := http.ParseHTTPVersion(proto)
+	if !ok {
+		return nil, fmt.Errorf("invalid request proto %q", proto)
+	}
+	body, err := decodeBody(j.Request.Body, j.Request.BodyBase64)
+	if err != nil {
+		return nil, fmt.Errorf("request body: %s", err)
+	}
+	rr.Request = &http.Request{
+		Method:        strings.ToUpper(j.Request.Method),
+		URL:           u,
+		Proto:         proto,
+		ProtoMajor:    major,
+		ProtoMinor:    minor,
+		Header:        j.Request.Header,
+		Trailer:       j.Request.Trailer,
+		Host:          j.Request.Host,
+		ContentLength: int64(len(body)),
+	}
+	if rr.Request.Header == nil {
+		rr.Request.Header = http.Header{}
+	}
+	rr.RequestBody = body
+	rr.RequestBodyError = stringError(j.Request.BodyError)
+
+	if resp := j.Response; resp != nil {
+		if resp.StatusCode < 100 || resp.StatusCode > 999 {
+			return nil, fmt.Errorf("invalid status code %d", resp.StatusCode)
+		}
+		proto := resp.Proto
+		if proto == "" {
+			proto = "HTTP/1.1"
+		}
+		major, minor, ok := http.ParseHTTPVersion(proto)
+		if !ok {
+			return nil, fmt.Errorf("invalid response proto %q", proto)
+		}
+		body, err := decodeBody(resp.Body, resp.BodyBase64)
+		if err != nil {
+			return nil, fmt.Errorf("response body: %s", err)
+		}
+		status := resp.Status
+		code := strconv.Itoa(resp.StatusCode)
+		if status != code && !strings.HasPrefix(status, code+" ") {
+			status = code + " " + http.StatusText(resp.StatusCode)
+		}
+		rr.Response = &http.Response{
+			Status:           status,
+			StatusCode:       resp.StatusCode,
+			Proto:            proto,
+			ProtoMajor:       major,
+			ProtoMinor:       minor,
+			Header:           resp.Header,
+			Trailer:          resp.Trailer,
+			ContentLength:    resp.ContentLength,
+			TransferEncoding: resp.TransferEncoding,
+			Uncompressed:     resp.Uncompressed,
+		}
+		if rr.Response.Header == nil {
+			rr.Response.Header = http.Header{}
+		}
+		if rr.Response.ContentLength >= 0 {
+			rr.Response.ContentLength = int64(len(body))
+		}
+		rr.ResponseBody = body
+		rr.ResponseBodyError = stringError(resp.BodyError)
+	} else if rr.Error == nil {
+		return nil, fmt.Errorf("the recording needs a response or an error")
+	}
+	return rr, nil
+}
@@ -0,0 +1,144 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command dvr inspects and edits the archives recorded by the dvr library,
+// so that reviewing or fixing a .dvr file doesn't require writing Go code.
+//
+// Usage:
+//
+//	dvr <command> [arguments]
+//
+// Run "dvr help" for the list of commands, and "dvr <command> -h" for the
+// arguments of a command.
+//
+// Every command reads archives in either version of the archive format, and
+// those that write an archive write the current one, version 2. Version 1
+// archives store each entry in a tar file, which takes at least a kilobyte
+// per recording. Version 2 archives written before the index was added are
+// a single compressed stream that has to be read from the start, so
+// -dvr.stream_bodies copies their bodies to a temporary file rather than
+// reading them from the archive. Either kind is upgraded in place with
+//
+//	dvr convert -to gob old.dvr old.dvr
+//
+// or by recording it again. The recordings are unchanged by this. Older
+// versions of dvr can read version 2 archives that have no index, but not
+// those that have one.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// A subcommand of the dvr tool.
+type command struct {
+	// The name used to run the command, and the arguments it takes.
+	name string
+	args string
+
+	// A one line description shown by "dvr help".
+	short string
+
+	// Runs the command with the arguments that follow its name.
+	run func(args []string) error
+}
+
+var (
+	// The registered commands, keyed by name.
+	commands = map[string]*command{}
+
+	// Where commands write their output. These are variables so tests can
+	// capture it.
+	stdout io.Writer = os.Stdout
+	stderr io.Writer = os.Stderr
+)
+
+// Registers a command. This is called from the init() function of the file
+// that implements it.
+func register(c *command) {
+	commands[c.name] = c
+}
+
+// Returns a FlagSet for the given command that reports errors rather than
+// exiting, and whose usage message includes the command's arguments.
+func newFlagSet(c *command) *flag.FlagSet {
+	flags := flag.NewFlagSet(c.name, flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprintf(stderr, "usage: dvr %s %s\n", c.name, c.args)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+// Parses the flags of a command, allowing them to be given before or after
+// the positional arguments (as in "dvr rm archive.dvr -index 3"). Returns
+// the positional arguments.
+func parseFlags(flags *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := flags.Parse(args); err != nil {
+			return nil, err
+		}
+		args = flags.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// Prints the list of commands.
+func usage() {
+	fmt.Fprintf(stderr, "usage: dvr <command> [arguments]\n\nCommands:\n")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(stderr, "  %-10s %s\n", name, commands[name].short)
+	}
+}
+
+// Runs the command named by the first argument, returning the exit status.
+func run(args []string) int {
+	if len(args) == 0 || args[0] == "help" || args[0] == "-h" {
+		usage()
+		return 2
+	}
+	c := commands[args[0]]
+	if c == nil {
+		fmt.Fprintf(stderr, "dvr: unknown command %q\n", args[0])
+		usage()
+		return 2
+	}
+	if err := c.run(args[1:]); errors.Is(err, flag.ErrHelp) {
+		return 2
+	} else if err != nil {
+		fmt.Fprintf(stderr, "dvr %s: %s\n", c.name, err)
+		return 1
+	}
+	return 0
+}
+
+func main() {
+	os.Exit(run(os.Args[1:]))
+}
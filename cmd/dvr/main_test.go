@@ -0,0 +1,94 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/liquidgecka/testlib"
+	"github.com/orchestrate-io/dvr"
+)
+
+// Runs the dvr tool with the given arguments, returning its exit status and
+// what it wrote to stdout and stderr.
+func runCommand(args ...string) (int, string, string) {
+	out, errOut := &bytes.Buffer{}, &bytes.Buffer{}
+	stdout, stderr = out, errOut
+	defer func() {
+		stdout, stderr = os.Stdout, os.Stderr
+	}()
+	code := run(args)
+	return code, out.String(), errOut.String()
+}
+
+// Returns a recording of a request to the given URL.
+func testRecording(method, rawurl string, status int, body string) *dvr.RequestResponse {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		panic(err)
+	}
+	return &dvr.RequestResponse{
+		Request: &http.Request{
+			Method: method,
+			URL:    u,
+			Header: http.Header{"Accept": {"*/*"}},
+		},
+		Response: &http.Response{
+			Status:     http.StatusText(status),
+			StatusCode: status,
+			Header:     http.Header{"Content-Type": {"text/plain"}},
+		},
+		ResponseBody: []byte(body),
+		Recorded:     time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+}
+
+// Writes the recordings to an archive in a temporary directory, returning
+// its path.
+func testArchive(t *testing.T, rrs ...*dvr.RequestResponse) string {
+	name := filepath.Join(t.TempDir(), "archive.dvr")
+	if err := dvr.WriteArchiveFile(name, rrs); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func TestRun(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	code, _, errOut := runCommand()
+	T.Equal(code, 2)
+	T.Equal(strings.Contains(errOut, "inspect"), true)
+
+	code, _, errOut = runCommand("bogus")
+	T.Equal(code, 2)
+	T.Equal(strings.Contains(errOut, `unknown command "bogus"`), true)
+
+	code, _, errOut = runCommand("inspect", "-h")
+	T.Equal(code, 2)
+	T.Equal(strings.Contains(errOut, "usage: dvr inspect <archive>"), true)
+
+	code, _, errOut = runCommand("inspect", "missing.dvr")
+	T.Equal(code, 1)
+	T.Equal(strings.HasPrefix(errOut, "dvr inspect: "), true)
+}
@@ -0,0 +1,190 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/orchestrate-io/dvr"
+)
+
+func init() {
+	register(&command{
+		name:  "merge",
+		args:  "-o merged.dvr [-conflict policy] <archive>...",
+		short: "combine the recordings from several archives",
+		run:   runMerge,
+	})
+}
+
+// Identifies what a recording is a recording of, for finding the recordings
+// that conflict between archives. Partitioned recordings are identified by
+// their partition since a test's recordings replay as a group, and others
+// by their request. Recordings with different labels are variants that
+// don't conflict.
+type mergeKey struct {
+	partition string
+	method    string
+	url       string
+	body      string
+	labels    string
+}
+
+// Returns the key of a recording.
+func newMergeKey(rr *dvr.RequestResponse) mergeKey {
+	labels := strings.Join(rr.Labels, ",")
+	if rr.Partition != "" {
+		return mergeKey{partition: rr.Partition, labels: labels}
+	}
+	method, url := methodAndURL(rr)
+	return mergeKey{method: method, url: url, body: string(rr.RequestBody),
+		labels: labels}
+}
+
+// Describes the key for messages.
+func (k mergeKey) String() string {
+	s := k.method + " " + k.url
+	if k.partition != "" {
+		s = "partition " + k.partition
+	}
+	if k.labels != "" {
+		s += " [" + k.labels + "]"
+	}
+	return s
+}
+
+// Combines archives into one, in the order given. Recordings of the same
+// request, or of the same partition, that are in more than one archive
+// conflict, and are handled according to -conflict:
+//
+//	keep-newest  keeps the recordings from the archive that recorded them
+//	             most recently.
+//	keep-both    keeps every recording. Partitions are given a single run
+//	             so that all of their recordings are replayed.
+//	error        fails, listing the conflicts.
+func runMerge(args []string) error {
+	flags := newFlagSet(commands["merge"])
+	output := flags.String("o", "", "the archive to write")
+	policy := flags.String("conflict", "keep-newest",
+		"what to do with conflicting recordings: keep-newest, keep-both "+
+			"or error")
+	args, err := parseFlags(flags, args)
+	if err != nil {
+		return err
+	} else if len(args) < 2 {
+		flags.Usage()
+		return fmt.Errorf("expected at least two archives")
+	} else if *output == "" {
+		flags.Usage()
+		return fmt.Errorf("-o is required")
+	}
+	switch *policy {
+	case "keep-newest", "keep-both", "error":
+	default:
+		return fmt.Errorf("unknown conflict policy %q", *policy)
+	}
+
+	// Find the archives that have recordings of each key, and the most
+	// recent recording of the key in each.
+	inputs := make([][]*dvr.RequestResponse, len(args))
+	owners := map[mergeKey][]int{}
+	newest := map[mergeKey]map[int]time.Time{}
+	var keys []mergeKey
+	for i, name := range args {
+		if inputs[i], err = dvr.ReadArchiveFile(name); err != nil {
+			return err
+		}
+		for _, rr := range inputs[i] {
+			key := newMergeKey(rr)
+			if newest[key] == nil {
+				newest[key] = map[int]time.Time{}
+				keys = append(keys, key)
+			}
+			if _, ok := newest[key][i]; !ok {
+				owners[key] = append(owners[key], i)
+			}
+			if rr.Recorded.After(newest[key][i]) {
+				newest[key][i] = rr.Recorded
+			}
+		}
+	}
+
+	// Pick the archive to take each conflicting key from. Ties go to the
+	// later archive.
+	winners := map[mergeKey]int{}
+	conflicts := 0
+	for _, key := range keys {
+		if len(owners[key]) < 2 {
+			continue
+		}
+		conflicts++
+		names := make([]string, len(owners[key]))
+		winner := owners[key][0]
+		for j, i := range owners[key] {
+			names[j] = args[i]
+			if !newest[key][i].Before(newest[key][winner]) {
+				winner = i
+			}
+		}
+		winners[key] = winner
+		switch *policy {
+		case "keep-newest":
+			fmt.Fprintf(stdout, "conflict: %s is in %s, keeping %s\n", key,
+				strings.Join(names, ", "), args[winner])
+		case "keep-both":
+			fmt.Fprintf(stdout, "conflict: %s is in %s, keeping all\n", key,
+				strings.Join(names, ", "))
+		case "error":
+			fmt.Fprintf(stdout, "conflict: %s is in %s\n", key,
+				strings.Join(names, ", "))
+		}
+	}
+	if conflicts > 0 && *policy == "error" {
+		return fmt.Errorf("found %d conflicts", conflicts)
+	}
+
+	var merged []*dvr.RequestResponse
+	runIDs := map[mergeKey]int64{}
+	for i, rrs := range inputs {
+		for _, rr := range rrs {
+			key := newMergeKey(rr)
+			if winner, ok := winners[key]; ok && *policy == "keep-newest" &&
+				winner != i {
+				continue
+			}
+			merged = append(merged, rr)
+			if rr.RunID > runIDs[key] {
+				runIDs[key] = rr.RunID
+			}
+		}
+	}
+
+	// Only the latest run of a partition is replayed, so partitions that
+	// were combined from several archives are given a single run.
+	if *policy == "keep-both" {
+		for _, rr := range merged {
+			key := newMergeKey(rr)
+			if _, ok := winners[key]; ok && rr.Partition != "" {
+				rr.RunID = runIDs[key]
+			}
+		}
+	}
+
+	fmt.Fprintf(stdout, "merged %d recordings from %d archives\n",
+		len(merged), len(args))
+	return dvr.WriteArchiveFile(*output, merged)
+}
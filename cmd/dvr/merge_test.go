@@ -0,0 +1,105 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/liquidgecka/testlib"
+	"github.com/orchestrate-io/dvr"
+)
+
+func TestMerge(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	// Each archive has a recording of /items, and a run of TestLogin.
+	older := testRecording("GET", "https://api.example.com/items", 200, "old")
+	newer := testRecording("GET", "https://api.example.com/items", 200, "new")
+	newer.Recorded = newer.Recorded.Add(time.Hour)
+	login := func(runID int64, body string) *dvr.RequestResponse {
+		rr := testRecording("POST", "https://api.example.com/login", 200, body)
+		rr.Partition = "TestLogin"
+		rr.RunID = runID
+		rr.Recorded = time.Unix(0, runID)
+		return rr
+	}
+	a := testArchive(t, newer, login(2, "a1"), login(2, "a2"),
+		testRecording("GET", "https://api.example.com/a", 200, "a"))
+	b := testArchive(t, older, login(1, "b"),
+		testRecording("GET", "https://api.example.com/b", 200, "b"))
+	merged := filepath.Join(t.TempDir(), "merged.dvr")
+
+	bodies := func() []string {
+		rrs, err := dvr.ReadArchiveFile(merged)
+		T.ExpectSuccess(err)
+		var bodies []string
+		for _, rr := range rrs {
+			bodies = append(bodies, string(rr.ResponseBody))
+		}
+		return bodies
+	}
+
+	code, out, _ := runCommand("merge", "-o", merged, b, a)
+	T.Equal(code, 0)
+	T.Equal(out, ""+
+		"conflict: GET https://api.example.com/items is in "+b+", "+a+
+		", keeping "+a+"\n"+
+		"conflict: partition TestLogin is in "+b+", "+a+", keeping "+a+"\n"+
+		"merged 5 recordings from 2 archives\n")
+	T.Equal(bodies(), []string{"b", "new", "a1", "a2", "a"})
+
+	code, _, _ = runCommand("merge", "-o", merged, "-conflict", "keep-both",
+		a, b)
+	T.Equal(code, 0)
+	T.Equal(bodies(), []string{"new", "a1", "a2", "a", "old", "b", "b"})
+	rrs, err := dvr.ReadArchiveFile(merged)
+	T.ExpectSuccess(err)
+	T.Equal(rrs[5].RunID, int64(2))
+
+	code, out, errOut := runCommand("merge", "-o", merged, "-conflict",
+		"error", a, b)
+	T.Equal(code, 1)
+	T.Equal(strings.Count(out, "conflict: "), 2)
+	T.Equal(errOut, "dvr merge: found 2 conflicts\n")
+
+	code, _, errOut = runCommand("merge", "-o", merged, a)
+	T.Equal(code, 1)
+	T.Equal(strings.Contains(errOut, "expected at least two archives"), true)
+}
+
+func TestMergeLabels(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	// Recordings with different labels are variants, not conflicts.
+	usual := testRecording("GET", "https://api.example.com/items", 200, "ok")
+	limited := testRecording("GET", "https://api.example.com/items", 429, "")
+	limited.Labels = []string{"rate-limited"}
+	a := testArchive(t, usual)
+	b := testArchive(t, limited)
+	merged := filepath.Join(t.TempDir(), "merged.dvr")
+
+	code, out, _ := runCommand("merge", "-o", merged, "-conflict", "error",
+		a, b)
+	T.Equal(code, 0)
+	T.Equal(out, "merged 2 recordings from 2 archives\n")
+	rrs, err := dvr.ReadArchiveFile(merged)
+	T.ExpectSuccess(err)
+	T.Equal(rrs[1].Labels, []string{"rate-limited"})
+}
@@ -0,0 +1,107 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/orchestrate-io/dvr"
+)
+
+// Returns the method and URL of the recorded request. The method defaults
+// to GET as it does in net/http.
+func methodAndURL(rr *dvr.RequestResponse) (string, string) {
+	if rr.Request == nil {
+		return "-", "-"
+	}
+	method, url := rr.Request.Method, "-"
+	if method == "" {
+		method = "GET"
+	}
+	if rr.Request.URL != nil {
+		url = rr.Request.URL.String()
+	}
+	return method, url
+}
+
+// Returns a one line description of a recording.
+func summary(rr *dvr.RequestResponse) string {
+	method, url := methodAndURL(rr)
+	return method + " " + url + " " + status(rr)
+}
+
+// Writes a recording in a form similar to the HTTP wire format, with its
+// index, full headers and bodies. Bodies that are not UTF-8 text are
+// summarized rather than printed.
+func printRecording(w io.Writer, index int, rr *dvr.RequestResponse) {
+	fmt.Fprintf(w, "=== %d", index)
+	if rr.Partition != "" {
+		fmt.Fprintf(w, " (%s)", rr.Partition)
+	}
+	if len(rr.Labels) > 0 {
+		fmt.Fprintf(w, " [%s]", strings.Join(rr.Labels, ","))
+	}
+	fmt.Fprintf(w, " recorded %s\n", recorded(rr))
+
+	if req := rr.Request; req != nil {
+		method, url := methodAndURL(rr)
+		fmt.Fprintf(w, "%s %s %s\n", method, url, req.Proto)
+		printHeader(w, req.Header)
+		printBody(w, rr.RequestBody)
+	}
+
+	if resp := rr.Response; resp != nil {
+		fmt.Fprintf(w, "%s %s\n", resp.Proto, resp.Status)
+		printHeader(w, resp.Header)
+		printBody(w, rr.ResponseBody)
+	} else {
+		fmt.Fprintf(w, "error: %v\n\n", rr.Error)
+	}
+}
+
+// Writes the headers sorted by name, followed by a blank line.
+func printHeader(w io.Writer, header http.Header) {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range header[name] {
+			fmt.Fprintf(w, "%s: %s\n", name, value)
+		}
+	}
+	fmt.Fprintln(w)
+}
+
+// Writes a body followed by a blank line.
+func printBody(w io.Writer, body []byte) {
+	if len(body) == 0 {
+		return
+	} else if !utf8.Valid(body) {
+		fmt.Fprintf(w, "[%d bytes of binary data]\n\n", len(body))
+		return
+	}
+	w.Write(body)
+	if body[len(body)-1] != '\n' {
+		fmt.Fprintln(w)
+	}
+	fmt.Fprintln(w)
+}
@@ -0,0 +1,140 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/orchestrate-io/dvr"
+)
+
+func init() {
+	register(&command{
+		name:  "prune",
+		args:  "<archive> -usage usage.log [-usage usage.log...] [flags]",
+		short: "remove recordings that replay no longer uses",
+		run:   runPrune,
+	})
+}
+
+// The usage logs given with -usage.
+type usageLogs []string
+
+// flag.Value
+func (u *usageLogs) String() string {
+	return strings.Join(*u, ",")
+}
+
+// flag.Value
+func (u *usageLogs) Set(value string) error {
+	*u = append(*u, value)
+	return nil
+}
+
+// Removes the recordings that are not named in any of the usage logs written
+// by replaying with -dvr.usage_log.
+func runPrune(args []string) error {
+	var logs usageLogs
+	flags := newFlagSet(commands["prune"])
+	flags.Var(&logs, "usage",
+		"a usage log written by -dvr.usage_log, may be repeated")
+	dryRun := flags.Bool("n", false,
+		"only print the recordings that would be removed")
+	output := flags.String("o", "",
+		"write the pruned archive here rather than replacing the archive")
+	args, err := parseFlags(flags, args)
+	if err != nil {
+		return err
+	} else if len(args) != 1 {
+		flags.Usage()
+		return fmt.Errorf("expected one archive")
+	} else if len(logs) == 0 {
+		return fmt.Errorf("no usage logs given, use -usage")
+	}
+
+	rrs, err := dvr.ReadArchiveFile(args[0])
+	if err != nil {
+		return err
+	}
+	used := map[int]bool{}
+	for _, name := range logs {
+		if err := readUsageLog(name, rrs, used); err != nil {
+			return err
+		}
+	}
+	if len(used) == 0 {
+		// Pruning with an empty log would remove everything, which is
+		// never what was wanted.
+		return fmt.Errorf("the usage logs do not name any recordings")
+	}
+
+	kept := make([]*dvr.RequestResponse, 0, len(used))
+	for i, rr := range rrs {
+		if !used[i] {
+			fmt.Fprintf(stdout, "removing %d %s\n", i, summary(rr))
+			continue
+		}
+		kept = append(kept, rr)
+	}
+	if *dryRun {
+		return nil
+	}
+	if *output != "" {
+		return dvr.WriteArchiveFile(*output, kept)
+	} else if len(kept) == len(rrs) {
+		return nil
+	}
+	return dvr.WriteArchiveFile(args[0], kept)
+}
+
+// Reads a usage log, marking the index of each recording it names in used.
+// Each line is checked against the archive, since a log written while
+// replaying a different version of the archive would otherwise prune the
+// wrong recordings.
+func readUsageLog(name string, rrs []*dvr.RequestResponse, used map[int]bool) error {
+	fd, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	scanner := bufio.NewScanner(fd)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		} else if len(fields) != 3 {
+			return fmt.Errorf("%s:%d: expected an index, method and URL",
+				name, line)
+		}
+		i, err := strconv.Atoi(fields[0])
+		if err != nil || i < 0 || i >= len(rrs) {
+			return fmt.Errorf("%s:%d: invalid index %q, the archive has %d "+
+				"recordings", name, line, fields[0], len(rrs))
+		}
+		if method, url := methodAndURL(rrs[i]); method != fields[1] ||
+			url != fields[2] {
+			return fmt.Errorf("%s:%d: recording %d is %s %s, not %s %s, "+
+				"the log was written for a different archive",
+				name, line, i, method, url, fields[1], fields[2])
+		}
+		used[i] = true
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,81 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/liquidgecka/testlib"
+	"github.com/orchestrate-io/dvr"
+)
+
+func TestPrune(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	archive := testArchive(t,
+		testRecording("GET", "https://api.example.com/a", 200, "a"),
+		testRecording("POST", "https://api.example.com/b", 201, "b"),
+		testRecording("GET", "https://api.example.com/c", 200, "c"))
+	dir := t.TempDir()
+	first := filepath.Join(dir, "first.log")
+	T.ExpectSuccess(ioutil.WriteFile(first, []byte(
+		"2 GET https://api.example.com/c\n2 GET https://api.example.com/c\n"),
+		0644))
+	second := filepath.Join(dir, "second.log")
+	T.ExpectSuccess(ioutil.WriteFile(second, []byte(
+		"1 POST https://api.example.com/b\n"), 0644))
+
+	// A dry run changes nothing.
+	code, out, _ := runCommand("prune", "-n", archive, "-usage", first)
+	T.Equal(code, 0)
+	T.Equal(out, "removing 0 GET https://api.example.com/a 200\n"+
+		"removing 1 POST https://api.example.com/b 201\n")
+	rrs, err := dvr.ReadArchiveFile(archive)
+	T.ExpectSuccess(err)
+	T.Equal(len(rrs), 3)
+
+	code, out, _ = runCommand("prune", archive, "-usage", first,
+		"-usage", second)
+	T.Equal(code, 0)
+	T.Equal(out, "removing 0 GET https://api.example.com/a 200\n")
+	rrs, err = dvr.ReadArchiveFile(archive)
+	T.ExpectSuccess(err)
+	T.Equal(len(rrs), 2)
+	T.Equal(rrs[0].Request.URL.String(), "https://api.example.com/b")
+	T.Equal(rrs[1].Request.URL.String(), "https://api.example.com/c")
+
+	// The old log no longer matches the pruned archive.
+	code, _, errOut := runCommand("prune", archive, "-usage", first)
+	T.Equal(code, 1)
+	T.Equal(strings.Contains(errOut, "invalid index \"2\""), true)
+	code, _, errOut = runCommand("prune", archive, "-usage", second)
+	T.Equal(code, 1)
+	T.Equal(strings.Contains(errOut, "recording 1 is GET "+
+		"https://api.example.com/c, not POST https://api.example.com/b"), true)
+
+	empty := filepath.Join(dir, "empty.log")
+	T.ExpectSuccess(ioutil.WriteFile(empty, nil, 0644))
+	code, _, errOut = runCommand("prune", archive, "-usage", empty)
+	T.Equal(code, 1)
+	T.Equal(strings.Contains(errOut, "do not name any recordings"), true)
+
+	code, _, errOut = runCommand("prune", archive)
+	T.Equal(code, 1)
+	T.Equal(strings.Contains(errOut, "no usage logs given"), true)
+}
@@ -0,0 +1,115 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/orchestrate-io/dvr"
+)
+
+// The transport used to send requests to the live services. Importing dvr
+// wraps http.DefaultTransport, so the original is used directly.
+var liveTransport = dvr.OriginalDefaultTransport
+
+func init() {
+	register(&command{
+		name:  "rerecord",
+		args:  "[flags] <archive>",
+		short: "send the recorded requests again and record the responses",
+		run:   runRerecord,
+	})
+}
+
+// Sends each recorded request to its live endpoint and replaces the
+// recording with the new response. Requests are sent exactly as they were
+// recorded, so values that were obfuscated when recording are sent in their
+// obfuscated form, and the obfuscators configured in the tests are not
+// applied to the new responses.
+func runRerecord(args []string) error {
+	var f filter
+	flags := newFlagSet(commands["rerecord"])
+	output := flags.String("o", "",
+		"write the new archive here rather than replacing the archive")
+	timeout := flags.Duration("timeout", 30*time.Second,
+		"the timeout for each request")
+	f.register(flags, "")
+	args, err := parseFlags(flags, args)
+	if err != nil {
+		return err
+	} else if len(args) != 1 {
+		flags.Usage()
+		return fmt.Errorf("expected one archive")
+	} else if err := f.compile(); err != nil {
+		return err
+	}
+	if *output == "" {
+		*output = args[0]
+	}
+
+	rrs, err := dvr.ReadArchiveFile(args[0])
+	if err != nil {
+		return err
+	}
+	runID := time.Now().UnixNano()
+	for i, rr := range rrs {
+		if rr.Request == nil || rr.Request.URL == nil || !f.matches(rr) {
+			continue
+		}
+		rrs[i] = rerecord(rr, *timeout)
+		rrs[i].RunID = runID
+		fmt.Fprintf(stdout, "rerecorded %d %s\n", i, summary(rrs[i]))
+	}
+	return dvr.WriteArchiveFile(*output, rrs)
+}
+
+// Sends the recorded request and returns a new recording of it.
+func rerecord(rr *dvr.RequestResponse, timeout time.Duration) *dvr.RequestResponse {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	req := rr.Request.Clone(ctx)
+	req.RequestURI = ""
+	req.ContentLength = int64(len(rr.RequestBody))
+	req.Body = nil
+	if len(rr.RequestBody) > 0 {
+		req.Body = ioutil.NopCloser(bytes.NewReader(rr.RequestBody))
+	}
+
+	// The copy keeps what describes the recording rather than the response,
+	// such as its partition, labels and matching configuration. The interim
+	// responses and trace events are kept from the original recording too.
+	out := *rr
+	out.Response, out.ResponseBody, out.ResponseBodyError = nil, nil, nil
+	out.Error = nil
+	out.UserData = nil
+	out.Recorded = time.Now()
+	resp, err := liveTransport.RoundTrip(req)
+	out.Duration = time.Since(out.Recorded)
+	if err != nil {
+		out.Error = err
+		return &out
+	}
+	defer resp.Body.Close()
+	out.Response = resp
+	out.ResponseBody, out.ResponseBodyError = ioutil.ReadAll(resp.Body)
+	resp.Body = nil
+	resp.Request = nil
+	return &out
+}
@@ -0,0 +1,79 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/liquidgecka/testlib"
+	"github.com/orchestrate-io/dvr"
+)
+
+func TestRerecord(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			w.Header().Set("X-Accept", r.Header.Get("Accept"))
+			w.Write([]byte("fresh " + r.Method + " " + string(body)))
+		}))
+	defer server.Close()
+
+	post := testRecording("POST", server.URL+"/items", 200, "stale")
+	post.RequestBody = []byte("name=x")
+	post.Partition = "TestItems"
+	post.Labels = []string{"v2"}
+	post.Interim = []dvr.InterimResponse{{StatusCode: 103}}
+	other := testRecording("GET", "https://other.example.com/", 200, "kept")
+	archive := testArchive(t, post, other)
+	output := archive + ".new"
+
+	code, out, _ := runCommand("rerecord", "-url", "^"+server.URL, "-o",
+		output, archive)
+	T.Equal(code, 0)
+	T.Equal(out, "rerecorded 0 POST "+server.URL+"/items 200\n")
+
+	rrs, err := dvr.ReadArchiveFile(output)
+	T.ExpectSuccess(err)
+	T.Equal(len(rrs), 2)
+	T.Equal(string(rrs[0].ResponseBody), "fresh POST name=x")
+	T.Equal(rrs[0].Response.Header.Get("X-Accept"), "*/*")
+	T.Equal(rrs[0].Partition, "TestItems")
+	T.Equal(rrs[0].Labels, []string{"v2"})
+	T.Equal(len(rrs[0].Interim), 1)
+	T.NotEqual(rrs[0].RunID, int64(0))
+	T.Equal(string(rrs[1].ResponseBody), "kept")
+
+	// The original archive is left alone when -o is given.
+	rrs, err = dvr.ReadArchiveFile(archive)
+	T.ExpectSuccess(err)
+	T.Equal(string(rrs[0].ResponseBody), "stale")
+
+	// Failed requests are recorded as errors.
+	server.Close()
+	code, out, _ = runCommand("rerecord", "-url", "^"+server.URL, archive)
+	T.Equal(code, 0)
+	T.Equal(strings.HasSuffix(out, " error\n"), true)
+	rrs, err = dvr.ReadArchiveFile(archive)
+	T.ExpectSuccess(err)
+	T.Equal(rrs[0].Response == nil, true)
+	T.NotEqual(rrs[0].Error, nil)
+}
@@ -0,0 +1,84 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/orchestrate-io/dvr"
+)
+
+func init() {
+	register(&command{
+		name:  "rm",
+		args:  "<archive> [-index n,...] [-match-url regexp] [flags]",
+		short: "remove recordings from an archive",
+		run:   runRm,
+	})
+}
+
+// Removes the recordings selected by index or by a filter from the archive.
+func runRm(args []string) error {
+	var f filter
+	flags := newFlagSet(commands["rm"])
+	indexes := flags.String("index", "",
+		"remove the recordings with these comma separated indexes")
+	dryRun := flags.Bool("n", false,
+		"only print the recordings that would be removed")
+	f.register(flags, "match-")
+	args, err := parseFlags(flags, args)
+	if err != nil {
+		return err
+	} else if len(args) != 1 {
+		flags.Usage()
+		return fmt.Errorf("expected one archive")
+	} else if *indexes == "" && f.empty() {
+		return fmt.Errorf("no recordings selected, use -index or -match-*")
+	} else if err := f.compile(); err != nil {
+		return err
+	}
+
+	rrs, err := dvr.ReadArchiveFile(args[0])
+	if err != nil {
+		return err
+	}
+	selected := map[int]bool{}
+	for _, s := range strings.Split(*indexes, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		i, err := strconv.Atoi(s)
+		if err != nil || i < 0 || i >= len(rrs) {
+			return fmt.Errorf("invalid index %q, the archive has %d "+
+				"recordings", s, len(rrs))
+		}
+		selected[i] = true
+	}
+
+	kept := make([]*dvr.RequestResponse, 0, len(rrs))
+	for i, rr := range rrs {
+		if selected[i] || !f.empty() && f.matches(rr) {
+			fmt.Fprintf(stdout, "removing %d %s\n", i, summary(rr))
+			continue
+		}
+		kept = append(kept, rr)
+	}
+	if *dryRun || len(kept) == len(rrs) {
+		return nil
+	}
+	return dvr.WriteArchiveFile(args[0], kept)
+}
@@ -0,0 +1,66 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/liquidgecka/testlib"
+	"github.com/orchestrate-io/dvr"
+)
+
+func TestRm(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	partitioned := testRecording("GET", "https://api.example.com/c", 200, "c")
+	partitioned.Partition = "TestC"
+	partitioned.RunID = 42
+	archive := testArchive(t,
+		testRecording("GET", "https://api.example.com/a", 200, "a"),
+		testRecording("GET", "https://internal.corp/secret", 200, "x"),
+		partitioned,
+		testRecording("GET", "https://api.example.com/d", 200, "d"),
+		testRecording("GET", "https://internal.corp/other", 200, "y"))
+
+	// A dry run changes nothing.
+	code, out, _ := runCommand("rm", "-n", archive, "-index", "0")
+	T.Equal(code, 0)
+	T.Equal(out, "removing 0 GET https://api.example.com/a 200\n")
+	rrs, err := dvr.ReadArchiveFile(archive)
+	T.ExpectSuccess(err)
+	T.Equal(len(rrs), 5)
+
+	code, out, _ = runCommand("rm", archive, "--index", "3",
+		"--match-url", `internal\.corp`)
+	T.Equal(code, 0)
+	T.Equal(strings.Count(out, "removing"), 3)
+	rrs, err = dvr.ReadArchiveFile(archive)
+	T.ExpectSuccess(err)
+	T.Equal(len(rrs), 2)
+	T.Equal(rrs[0].Request.URL.String(), "https://api.example.com/a")
+	T.Equal(rrs[1].Request.URL.String(), "https://api.example.com/c")
+	T.Equal(rrs[1].Partition, "TestC")
+	T.Equal(rrs[1].RunID, int64(42))
+
+	code, _, errOut := runCommand("rm", archive, "-index", "2")
+	T.Equal(code, 1)
+	T.Equal(strings.Contains(errOut, "the archive has 2 recordings"), true)
+
+	code, _, errOut = runCommand("rm", archive)
+	T.Equal(code, 1)
+	T.Equal(strings.Contains(errOut, "no recordings selected"), true)
+}
@@ -0,0 +1,208 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+
+	"github.com/orchestrate-io/dvr"
+	"gopkg.in/yaml.v3"
+)
+
+// The rules file given to scrub. For example:
+//
+//	headers: [Authorization, X-Api-Key]
+//	query: [api_key, signature]
+//	json: ["$.access_token", "$.customer.email"]
+//	regexps:
+//	  - pattern: 'sk_live_\w+'
+//	    replacement: sk_live_REDACTED
+//	    in: [headers, bodies]
+type scrubRules struct {
+	// Request and response headers whose values are replaced.
+	Headers []string `yaml:"headers"`
+
+	// Query string parameters whose values are replaced, as done by
+	// ObfuscateQueryParams().
+	Query []string `yaml:"query"`
+
+	// JSON paths selecting values in response bodies to replace, as done by
+	// RedactJSON().
+	JSON []string `yaml:"json"`
+
+	// Regular expressions that are replaced, as done by RegexpObfuscator().
+	Regexps []scrubRegexp `yaml:"regexps"`
+}
+
+// A regular expression rule. In lists the locations searched, which are
+// "headers", "bodies" and "url". If it is empty all of them are searched.
+type scrubRegexp struct {
+	Pattern     string   `yaml:"pattern"`
+	Replacement string   `yaml:"replacement"`
+	In          []string `yaml:"in"`
+}
+
+func init() {
+	register(&command{
+		name:  "scrub",
+		args:  "-rules rules.yaml [flags] <archive>",
+		short: "apply obfuscation rules to the recordings in an archive",
+		run:   runScrub,
+	})
+}
+
+// Applies the obfuscation rules in a YAML file to every recording in the
+// archive, for cleaning up archives that were recorded before the tests
+// obfuscated them. Values are replaced with "REDACTED" unless a regexp rule
+// gives a replacement.
+func runScrub(args []string) error {
+	flags := newFlagSet(commands["scrub"])
+	rulesFile := flags.String("rules", "", "the YAML file of rules to apply")
+	output := flags.String("o", "",
+		"write the new archive here rather than replacing the archive")
+	dryRun := flags.Bool("n", false,
+		"only print the recordings that would be changed")
+	args, err := parseFlags(flags, args)
+	if err != nil {
+		return err
+	} else if len(args) != 1 {
+		flags.Usage()
+		return fmt.Errorf("expected one archive")
+	} else if *rulesFile == "" {
+		flags.Usage()
+		return fmt.Errorf("-rules is required")
+	}
+	if *output == "" {
+		*output = args[0]
+	}
+
+	obfuscators, err := loadScrubRules(*rulesFile)
+	if err != nil {
+		return fmt.Errorf("%s: %s", *rulesFile, err)
+	}
+	rrs, err := dvr.ReadArchiveFile(args[0])
+	if err != nil {
+		return err
+	}
+
+	changed := 0
+	for i, rr := range rrs {
+		if rr.Request == nil {
+			continue
+		}
+		before, err := json.Marshal(toJSON(rr))
+		if err != nil {
+			return err
+		}
+		for _, f := range obfuscators {
+			f(rr)
+		}
+		after, err := json.Marshal(toJSON(rr))
+		if err != nil {
+			return err
+		} else if !bytes.Equal(before, after) {
+			changed++
+			fmt.Fprintf(stdout, "scrubbed %d %s\n", i, summary(rr))
+		}
+	}
+	if *dryRun || changed == 0 && *output == args[0] {
+		return nil
+	}
+	return dvr.WriteArchiveFile(*output, rrs)
+}
+
+// Reads a rules file, returning the obfuscators that apply its rules.
+func loadScrubRules(path string) ([]func(*dvr.RequestResponse), error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rules scrubRules
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&rules); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	var obfuscators []func(*dvr.RequestResponse)
+	if len(rules.Headers) > 0 {
+		obfuscators = append(obfuscators, redactHeaders(rules.Headers))
+	}
+	if len(rules.Query) > 0 {
+		obfuscators = append(obfuscators,
+			dvr.ObfuscateQueryParams(rules.Query...))
+	}
+	if len(rules.JSON) > 0 {
+		for _, path := range rules.JSON {
+			if err := dvr.ValidateJSONPath(path); err != nil {
+				return nil, err
+			}
+		}
+		obfuscators = append(obfuscators, dvr.RedactJSON(rules.JSON...))
+	}
+	for _, r := range rules.Regexps {
+		if _, err := regexp.Compile(r.Pattern); err != nil {
+			return nil, err
+		}
+		where := dvr.InHeaders | dvr.InBodies | dvr.InURL
+		if len(r.In) > 0 {
+			where = 0
+		}
+		for _, in := range r.In {
+			switch in {
+			case "headers":
+				where |= dvr.InHeaders
+			case "bodies":
+				where |= dvr.InBodies
+			case "url":
+				where |= dvr.InURL
+			default:
+				return nil, fmt.Errorf("unknown location %q for %q, "+
+					"expected headers, bodies or url", in, r.Pattern)
+			}
+		}
+		obfuscators = append(obfuscators,
+			dvr.RegexpObfuscator(r.Pattern, r.Replacement, where))
+	}
+	if len(obfuscators) == 0 {
+		return nil, fmt.Errorf("no rules")
+	}
+	return obfuscators, nil
+}
+
+// Returns an obfuscator that replaces the values of the given request and
+// response headers with "REDACTED".
+func redactHeaders(names []string) func(*dvr.RequestResponse) {
+	redact := func(h http.Header) {
+		for _, name := range names {
+			name = http.CanonicalHeaderKey(name)
+			for i := range h[name] {
+				h[name][i] = "REDACTED"
+			}
+		}
+	}
+	return func(rr *dvr.RequestResponse) {
+		redact(rr.Request.Header)
+		if rr.Response != nil {
+			redact(rr.Response.Header)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/liquidgecka/testlib"
+	"github.com/orchestrate-io/dvr"
+)
+
+func TestScrub(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	login := testRecording("POST", "https://api.example.com/login?key=k1&a=1",
+		200, `{"access_token":"t0k3n","user":"bob"}`)
+	login.Request.Header.Set("Authorization", "Basic Ym9iOnB3")
+	login.RequestBody = []byte("password=sk_live_abc123")
+	login.Partition = "TestLogin"
+	archive := testArchive(t, login,
+		testRecording("GET", "https://api.example.com/items", 200, "items"))
+	dir := filepath.Dir(archive)
+
+	rules := filepath.Join(dir, "rules.yaml")
+	T.ExpectSuccess(ioutil.WriteFile(rules, []byte(`
+headers: [authorization]
+query: [key]
+json: ["$.access_token"]
+regexps:
+  - pattern: 'sk_live_\w+'
+    replacement: sk_live_X
+    in: [bodies]
+`), 0644))
+
+	// Dry runs leave the archive alone.
+	code, out, _ := runCommand("scrub", "-rules", rules, "-n", archive)
+	T.Equal(code, 0)
+	T.Equal(out, "scrubbed 0 POST "+
+		"https://api.example.com/login?key=REDACTED&a=1 200\n")
+	rrs, err := dvr.ReadArchiveFile(archive)
+	T.ExpectSuccess(err)
+	T.Equal(rrs[0].Request.Header.Get("Authorization"), "Basic Ym9iOnB3")
+
+	code, _, _ = runCommand("scrub", "-rules", rules, archive)
+	T.Equal(code, 0)
+	rrs, err = dvr.ReadArchiveFile(archive)
+	T.ExpectSuccess(err)
+	T.Equal(len(rrs), 2)
+	T.Equal(rrs[0].Request.Header.Get("Authorization"), "REDACTED")
+	T.Equal(rrs[0].Request.URL.RawQuery, "key=REDACTED&a=1")
+	T.Equal(string(rrs[0].RequestBody), "password=sk_live_X")
+	T.Equal(string(rrs[0].ResponseBody),
+		`{"access_token":"REDACTED","user":"bob"}`)
+	T.Equal(rrs[0].Partition, "TestLogin")
+	T.Equal(string(rrs[1].ResponseBody), "items")
+
+	// Bad rules are reported before anything is changed.
+	for bad, message := range map[string]string{
+		`json: ["access_token"]`:                   "must start with '$'",
+		`regexps: [{pattern: "("}]`:                "missing closing )",
+		`regexps: [{pattern: "a", in: [cookies]}]`: `unknown location "cookies"`,
+		`header: [Authorization]`:                  "field header not found",
+		``:                                         "no rules",
+	} {
+		T.ExpectSuccess(ioutil.WriteFile(rules, []byte(bad), 0644))
+		code, _, errOut := runCommand("scrub", "-rules", rules, archive)
+		T.Equal(code, 1)
+		T.Equal(strings.Contains(errOut, message), true, errOut)
+	}
+}
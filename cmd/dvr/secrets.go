@@ -0,0 +1,173 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/orchestrate-io/dvr"
+)
+
+func init() {
+	register(&command{
+		name:  "secrets",
+		args:  "<archive>...",
+		short: "scan archives for credentials and other secrets",
+		run:   runSecrets,
+	})
+}
+
+// Scans every recording in the given archives for probable secrets, printing
+// each one found along with the archive, recording and part of the recording
+// it was found in. Nothing is printed if the archives are clean, and the
+// command fails if they are not, so it can be run as a pre-commit hook with
+// the staged archives as arguments.
+func runSecrets(args []string) error {
+	flags := newFlagSet(commands["secrets"])
+	args, err := parseFlags(flags, args)
+	if err != nil {
+		return err
+	} else if len(args) == 0 {
+		flags.Usage()
+		return fmt.Errorf("expected at least one archive")
+	}
+
+	found, recordings := 0, 0
+	for _, name := range args {
+		rrs, err := dvr.ReadArchiveFile(name)
+		if err != nil {
+			return err
+		}
+		for i, rr := range rrs {
+			findings := findSecrets(rr)
+			for _, f := range findings {
+				fmt.Fprintf(stdout, "%s: %d %s: probable %s in the %s\n",
+					name, i, redactedSummary(rr), f.kind, f.where)
+			}
+			if len(findings) > 0 {
+				found += len(findings)
+				recordings++
+			}
+		}
+	}
+	if found > 0 {
+		return fmt.Errorf("found %d probable secrets in %d recordings",
+			found, recordings)
+	}
+	return nil
+}
+
+// A probable secret found in a recording.
+type secretFinding struct {
+	// Where the secret was found, such as "request body" or "response
+	// header Set-Cookie".
+	where string
+
+	// What the secret appears to be, such as "AWS access key".
+	kind string
+}
+
+// Patterns matching credentials that have a recognizable form.
+var secretPatterns = []struct {
+	kind string
+	re   *regexp.Regexp
+}{
+	{"AWS access key", regexp.MustCompile(`\b(AKIA|ASIA)[0-9A-Z]{16}\b`)},
+	{"GitHub token", regexp.MustCompile(`\bgh[pousr]_[A-Za-z0-9]{36,}\b`)},
+	{"Slack token", regexp.MustCompile(`\bxox[abposr]-[A-Za-z0-9-]{10,}`)},
+	{"Stripe key", regexp.MustCompile(`\b[sr]k_live_[A-Za-z0-9]{16,}\b`)},
+	{"Google API key", regexp.MustCompile(`\bAIza[0-9A-Za-z_-]{35}\b`)},
+	{"private key", regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----`)},
+	{"JWT", regexp.MustCompile(
+		`\beyJ[A-Za-z0-9_-]{8,}\.eyJ[A-Za-z0-9_-]{8,}\.[A-Za-z0-9_-]{8,}`)},
+}
+
+// The names of JSON fields and form or query parameters that hold secrets.
+const secretNames = `password|passwd|secret|client_secret|api_key|apikey|` +
+	`access_token|refresh_token|id_token|private_key`
+
+// Patterns matching secrets by the name they are given, whose value is the
+// second submatch.
+var (
+	secretJSONField = regexp.MustCompile(
+		`(?i)"(` + secretNames + `)"\s*:\s*"([^"]*)"`)
+	secretParam = regexp.MustCompile(
+		`(?i)(?:^|[?&])(` + secretNames + `)=([^&]*)`)
+)
+
+// Returns the probable secrets in the recording. Values that have been
+// replaced with "REDACTED" by an obfuscator are ignored.
+func findSecrets(rr *dvr.RequestResponse) []secretFinding {
+	var findings []secretFinding
+	scan := func(where, text string) {
+		for _, p := range secretPatterns {
+			for _, match := range p.re.FindAllString(text, -1) {
+				if !strings.Contains(match, "REDACTED") {
+					findings = append(findings, secretFinding{where, p.kind})
+					break
+				}
+			}
+		}
+		for _, re := range []*regexp.Regexp{secretJSONField, secretParam} {
+			for _, m := range re.FindAllStringSubmatch(text, -1) {
+				if m[2] != "" && !strings.Contains(m[2], "REDACTED") {
+					findings = append(findings, secretFinding{
+						where, strings.ToLower(m[1]) + " value"})
+				}
+			}
+		}
+	}
+	scanHeader := func(prefix string, h http.Header) {
+		names := make([]string, 0, len(h))
+		for name := range h {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			scan(prefix+" header "+name, strings.Join(h[name], "\n"))
+		}
+	}
+
+	if req := rr.Request; req != nil {
+		if req.URL != nil {
+			if _, ok := req.URL.User.Password(); ok {
+				findings = append(findings, secretFinding{"url", "password"})
+			}
+			scan("url", req.URL.RawQuery)
+		}
+		scanHeader("request", req.Header)
+		scan("request body", string(rr.RequestBody))
+	}
+	if resp := rr.Response; resp != nil {
+		scanHeader("response", resp.Header)
+		scan("response body", string(rr.ResponseBody))
+	}
+	return findings
+}
+
+// Returns the summary() of the recording with any password in its URL
+// replaced, keeping it out of output that typically ends up in CI logs.
+func redactedSummary(rr *dvr.RequestResponse) string {
+	description := summary(rr)
+	if rr.Request != nil && rr.Request.URL != nil {
+		description = strings.Replace(description,
+			rr.Request.URL.String(), rr.Request.URL.Redacted(), 1)
+	}
+	return description
+}
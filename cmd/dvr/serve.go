@@ -0,0 +1,112 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/orchestrate-io/dvr"
+)
+
+// Returns a channel that receives a value when the server should stop. This
+// is a variable so tests can replace it.
+var stopSignal = func() <-chan os.Signal {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	return c
+}
+
+func init() {
+	register(&command{
+		name:  "serve",
+		args:  "[-addr host:port] [-v] <archive>",
+		short: "serve the recordings in an archive as a mock HTTP server",
+		run:   runServe,
+	})
+}
+
+// Serves the archive with the handler from dvr.NewHandler() until the
+// process is interrupted, so that services written in other languages, or
+// curl, can be pointed at the recordings. Requests are matched on their
+// method, path, query, body and recorded headers, and requests that match
+// nothing get a 501 response.
+func runServe(args []string) error {
+	flags := newFlagSet(commands["serve"])
+	addr := flags.String("addr", ":8080", "the address to listen on")
+	verbose := flags.Bool("v", false, "print a line for each request")
+	args, err := parseFlags(flags, args)
+	if err != nil {
+		return err
+	} else if len(args) != 1 {
+		flags.Usage()
+		return fmt.Errorf("expected one archive")
+	}
+
+	handler, err := dvr.NewHandler(args[0])
+	if err != nil {
+		return err
+	}
+	if *verbose {
+		handler = logRequests(handler)
+	}
+	listener, err := net.Listen("tcp", *addr)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{Handler: handler}
+	done := make(chan error, 1)
+	go func() { done <- server.Serve(listener) }()
+	fmt.Fprintf(stdout, "serving %s on http://%s\n", args[0], listener.Addr())
+
+	select {
+	case err := <-done:
+		return err
+	case <-stopSignal():
+		return server.Shutdown(context.Background())
+	}
+}
+
+// Records the status written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+// http.ResponseWriter
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// Wraps the handler so that each request is printed along with the status
+// of its response, noting the requests that matched no recording.
+func logRequests(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(recorder, r)
+		note := ""
+		if w.Header().Get("X-Dvr-Unmatched") != "" {
+			note = " (no matching recording)"
+		}
+		fmt.Fprintf(stdout, "%s %s %d%s\n", r.Method, r.URL, recorder.status,
+			note)
+	})
+}
@@ -0,0 +1,73 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/liquidgecka/testlib"
+	"github.com/orchestrate-io/dvr"
+)
+
+func TestServe(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+	defer func(f func() <-chan os.Signal) { stopSignal = f }(stopSignal)
+
+	archive := testArchive(t,
+		testRecording("GET", "https://api.example.com/items", 200, "items"))
+
+	// The server starts and stops cleanly.
+	stop := make(chan os.Signal, 1)
+	stop <- os.Interrupt
+	stopSignal = func() <-chan os.Signal { return stop }
+	code, out, _ := runCommand("serve", "-addr", "127.0.0.1:0", archive)
+	T.Equal(code, 0)
+	T.Equal(strings.HasPrefix(out, "serving "+archive+" on http://127.0.0.1:"),
+		true)
+
+	code, _, errOut := runCommand("serve", "missing.dvr")
+	T.Equal(code, 1)
+	T.Equal(strings.Contains(errOut, "missing.dvr"), true)
+
+	// Requests are logged.
+	handler, err := dvr.NewHandler(archive)
+	T.ExpectSuccess(err)
+	buffer := &bytes.Buffer{}
+	stdout = buffer
+	defer func() { stdout = os.Stdout }()
+	server := httptest.NewServer(logRequests(handler))
+	defer server.Close()
+	for _, path := range []string{"/items", "/other"} {
+		req, err := http.NewRequest("GET", server.URL+path, nil)
+		T.ExpectSuccess(err)
+		req.Header.Set("Accept", "*/*")
+		resp, err := server.Client().Do(req)
+		T.ExpectSuccess(err)
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if path == "/items" {
+			T.Equal(string(body), "items")
+		}
+	}
+	T.Equal(buffer.String(), "GET /items 200\n"+
+		"GET /other 501 (no matching recording)\n")
+}
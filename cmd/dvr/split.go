@@ -0,0 +1,109 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/orchestrate-io/dvr"
+)
+
+func init() {
+	register(&command{
+		name:  "split",
+		args:  "-by host|test [-d dir] <archive>",
+		short: "split an archive into one archive per host or test",
+		run:   runSplit,
+	})
+}
+
+// Writes the recordings in the archive into one archive per host, or per
+// test, for moving from a single archive to smaller ones. Tests are found
+// from the partitions set with dvr.Partition(); subtests are kept in the
+// archive of their top level test, and recordings without a partition are
+// written to "unpartitioned.dvr". The original archive is left alone.
+func runSplit(args []string) error {
+	flags := newFlagSet(commands["split"])
+	by := flags.String("by", "", "how to split the archive: host or test")
+	dir := flags.String("d", "",
+		"the directory to write the archives to (default the archive's "+
+			"path without its extension)")
+	args, err := parseFlags(flags, args)
+	if err != nil {
+		return err
+	} else if len(args) != 1 {
+		flags.Usage()
+		return fmt.Errorf("expected one archive")
+	}
+
+	var group func(rr *dvr.RequestResponse) string
+	switch *by {
+	case "host":
+		group = func(rr *dvr.RequestResponse) string {
+			if rr.Request == nil || rr.Request.URL == nil ||
+				rr.Request.URL.Host == "" {
+				return "unknown"
+			}
+			return rr.Request.URL.Host
+		}
+	case "test":
+		group = func(rr *dvr.RequestResponse) string {
+			if rr.Partition == "" {
+				return "unpartitioned"
+			}
+			return strings.SplitN(rr.Partition, "/", 2)[0]
+		}
+	case "":
+		flags.Usage()
+		return fmt.Errorf("-by is required")
+	default:
+		return fmt.Errorf("unknown -by %q, expected host or test", *by)
+	}
+	if *dir == "" {
+		*dir = strings.TrimSuffix(args[0], filepath.Ext(args[0]))
+	}
+
+	rrs, err := dvr.ReadArchiveFile(args[0])
+	if err != nil {
+		return err
+	}
+	groups := map[string][]*dvr.RequestResponse{}
+	var names []string
+	for _, rr := range rrs {
+		name := group(rr)
+		if groups[name] == nil {
+			names = append(names, name)
+		}
+		groups[name] = append(groups[name], rr)
+	}
+
+	if err := os.MkdirAll(*dir, 0755); err != nil {
+		return err
+	}
+	for _, name := range names {
+		// Ports are separated with a character that is valid in file names
+		// everywhere.
+		path := filepath.Join(*dir, strings.Replace(name, ":", "_", -1)+".dvr")
+		if err := dvr.WriteArchiveFile(path, groups[name]); err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "wrote %d recordings to %s\n", len(groups[name]),
+			path)
+	}
+	return nil
+}
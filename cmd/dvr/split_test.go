@@ -0,0 +1,66 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/liquidgecka/testlib"
+	"github.com/orchestrate-io/dvr"
+)
+
+func TestSplit(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	partitioned := func(partition, rawurl string) *dvr.RequestResponse {
+		rr := testRecording("GET", rawurl, 200, partition)
+		rr.Partition = partition
+		return rr
+	}
+	archive := testArchive(t,
+		partitioned("TestClient/get", "https://api.example.com/items"),
+		partitioned("TestClient/list", "http://localhost:8080/list"),
+		partitioned("TestLogin", "https://api.example.com/login"),
+		testRecording("GET", "https://api.example.com/", 200, "root"))
+	dir := strings.TrimSuffix(archive, ".dvr")
+
+	code, out, _ := runCommand("split", "-by", "host", archive)
+	T.Equal(code, 0)
+	T.Equal(out, ""+
+		"wrote 3 recordings to "+filepath.Join(dir, "api.example.com.dvr")+"\n"+
+		"wrote 1 recordings to "+filepath.Join(dir, "localhost_8080.dvr")+"\n")
+	rrs, err := dvr.ReadArchiveFile(filepath.Join(dir, "localhost_8080.dvr"))
+	T.ExpectSuccess(err)
+	T.Equal(len(rrs), 1)
+	T.Equal(rrs[0].Partition, "TestClient/list")
+
+	tests := filepath.Join(t.TempDir(), "tests")
+	code, _, _ = runCommand("split", "-by", "test", "-d", tests, archive)
+	T.Equal(code, 0)
+	for name, count := range map[string]int{
+		"TestClient": 2, "TestLogin": 1, "unpartitioned": 1,
+	} {
+		rrs, err := dvr.ReadArchiveFile(filepath.Join(tests, name+".dvr"))
+		T.ExpectSuccess(err)
+		T.Equal(len(rrs), count)
+	}
+
+	code, _, errOut := runCommand("split", "-by", "status", archive)
+	T.Equal(code, 1)
+	T.Equal(strings.Contains(errOut, `unknown -by "status"`), true)
+}
@@ -0,0 +1,198 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/orchestrate-io/dvr"
+)
+
+// Returns the current time. This is a variable so tests can replace it.
+var now = time.Now
+
+func init() {
+	register(&command{
+		name:  "stats",
+		args:  "[-top n] <archive>",
+		short: "summarize the size, hosts, statuses and age of an archive",
+		run:   runStats,
+	})
+}
+
+// Prints a summary of the archive: the number of recordings, its size
+// before and after compression, the number of recordings for each host and
+// status, the recordings with the largest bodies and how old the
+// recordings are.
+func runStats(args []string) error {
+	flags := newFlagSet(commands["stats"])
+	top := flags.Int("top", 5, "the number of largest bodies to list")
+	args, err := parseFlags(flags, args)
+	if err != nil {
+		return err
+	} else if len(args) != 1 {
+		flags.Usage()
+		return fmt.Errorf("expected one archive")
+	}
+
+	rrs, err := dvr.ReadArchiveFile(args[0])
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(args[0])
+	if err != nil {
+		return err
+	}
+	size, err := uncompressedSize(args[0])
+	if err != nil {
+		return err
+	}
+
+	hosts := map[string]int{}
+	statuses := map[string]int{}
+	var oldest, newest *dvr.RequestResponse
+	unknown := 0
+	for _, rr := range rrs {
+		host := "-"
+		if rr.Request != nil && rr.Request.URL != nil {
+			host = rr.Request.URL.Host
+		}
+		hosts[host]++
+		statuses[status(rr)]++
+		switch {
+		case rr.Recorded.IsZero():
+			unknown++
+		case oldest == nil:
+			oldest, newest = rr, rr
+		case rr.Recorded.Before(oldest.Recorded):
+			oldest = rr
+		case rr.Recorded.After(newest.Recorded):
+			newest = rr
+		}
+	}
+
+	w := tabwriter.NewWriter(stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "recordings:\t%d\n", len(rrs))
+	fmt.Fprintf(w, "size:\t%d bytes (%d compressed)\n", size, info.Size())
+	if oldest != nil {
+		fmt.Fprintf(w, "oldest:\t%s (%s)\n", recorded(oldest), age(oldest))
+		fmt.Fprintf(w, "newest:\t%s (%s)\n", recorded(newest), age(newest))
+	}
+	if unknown > 0 {
+		fmt.Fprintf(w, "unknown age:\t%d recordings\n", unknown)
+	}
+
+	fmt.Fprintln(w, "\nHOST\tRECORDINGS")
+	for _, host := range byCount(hosts) {
+		fmt.Fprintf(w, "%s\t%d\n", host, hosts[host])
+	}
+	fmt.Fprintln(w, "\nSTATUS\tRECORDINGS")
+	for _, s := range byCount(statuses) {
+		fmt.Fprintf(w, "%s\t%d\n", s, statuses[s])
+	}
+
+	// Recordings are ranked by the larger of their two bodies.
+	largest := make([]int, len(rrs))
+	bodySize := func(i int) int {
+		if n := len(rrs[i].RequestBody); n > len(rrs[i].ResponseBody) {
+			return n
+		}
+		return len(rrs[i].ResponseBody)
+	}
+	for i := range largest {
+		largest[i] = i
+	}
+	sort.SliceStable(largest, func(a, b int) bool {
+		return bodySize(largest[a]) > bodySize(largest[b])
+	})
+	if len(largest) > *top {
+		largest = largest[:*top]
+	}
+	if len(largest) > 0 {
+		fmt.Fprintln(w, "\nINDEX\tREQUEST\tRESPONSE\tRECORDING")
+	}
+	for _, i := range largest {
+		fmt.Fprintf(w, "%d\t%d\t%d\t%s\n", i, len(rrs[i].RequestBody),
+			len(rrs[i].ResponseBody), summary(rrs[i]))
+	}
+	return w.Flush()
+}
+
+// Returns the size of the archive's entries once they are decompressed.
+func uncompressedSize(path string) (int64, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer fd.Close()
+
+	// Skip the 32 bit version that precedes the compressed blocks. Each
+	// block is a gzip member of its own, and the last is followed by the
+	// index of the entries, which isn't counted.
+	if _, err := fd.Seek(4, io.SeekStart); err != nil {
+		return 0, err
+	}
+	input := bufio.NewReader(fd)
+	reader := new(gzip.Reader)
+	size := int64(0)
+	for blocks := 0; ; blocks++ {
+		if magic, err := input.Peek(2); err == io.EOF && blocks > 0 {
+			return size, nil
+		} else if err == nil && (magic[0] != 0x1f || magic[1] != 0x8b) {
+			return size, nil
+		}
+		if err := reader.Reset(input); err != nil {
+			return 0, err
+		}
+		reader.Multistream(false)
+		n, err := io.Copy(ioutil.Discard, reader)
+		if err != nil {
+			return 0, err
+		}
+		size += n
+	}
+}
+
+// Returns the keys of the map, most common first.
+func byCount(counts map[string]int) []string {
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]] != counts[keys[j]] {
+			return counts[keys[i]] > counts[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	return keys
+}
+
+// Returns how long ago the recording was made, in days.
+func age(rr *dvr.RequestResponse) string {
+	days := int(now().Sub(rr.Recorded).Hours() / 24)
+	if days == 1 {
+		return "1 day ago"
+	}
+	return fmt.Sprintf("%d days ago", days)
+}
@@ -0,0 +1,70 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/liquidgecka/testlib"
+)
+
+func TestStats(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+	defer func(f func() time.Time) { now = f }(now)
+	now = func() time.Time {
+		return time.Date(2020, 1, 12, 3, 4, 5, 0, time.UTC)
+	}
+
+	large := testRecording("GET", "https://api.example.com/large", 200,
+		strings.Repeat("x", 1000))
+	large.Recorded = large.Recorded.Add(-24 * time.Hour)
+	failed := testRecording("GET", "https://down.example.com/", 0, "")
+	failed.Response = nil
+	failed.Recorded = time.Time{}
+	archive := testArchive(t,
+		testRecording("GET", "https://api.example.com/items", 200, "items"),
+		large,
+		testRecording("GET", "https://cdn.example.com/a.png", 404, ""),
+		failed)
+
+	code, out, _ := runCommand("stats", "-top", "2", archive)
+	T.Equal(code, 0)
+	lines := strings.Split(out, "\n")
+	T.Equal(strings.Fields(lines[0]), []string{"recordings:", "4"})
+	T.Equal(strings.HasPrefix(strings.Join(strings.Fields(lines[1]), " "),
+		"size: "), true)
+	T.Equal(strings.HasSuffix(lines[2], "(11 days ago)"), true)
+	T.Equal(strings.HasSuffix(lines[3], "(10 days ago)"), true)
+	T.Equal(strings.Fields(lines[4]), []string{"unknown", "age:", "1",
+		"recordings"})
+	T.Equal(strings.Join(lines[5:], "\n"), ""+`
+HOST              RECORDINGS
+api.example.com   2
+cdn.example.com   1
+down.example.com  1
+
+STATUS  RECORDINGS
+200     2
+404     1
+error   1
+
+INDEX  REQUEST  RESPONSE  RECORDING
+1      0        1000      GET https://api.example.com/large 200
+0      0        5         GET https://api.example.com/items 200
+`)
+}
@@ -0,0 +1,142 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/orchestrate-io/dvr"
+)
+
+func init() {
+	register(&command{
+		name:  "tail",
+		args:  "[-n count] [-v] <archive>",
+		short: "print recordings as they are added to an archive",
+		run:   runTail,
+	})
+}
+
+// Follows an archive while a test records into it, printing each recording
+// as it is written. The archive does not need to exist yet, and when a new
+// recording run replaces the archive the new run is followed. Recordings are
+// only written out as they are made when the test is run with
+// -dvr.flush_interval, otherwise they appear once the run has finished.
+func runTail(args []string) error {
+	flags := newFlagSet(commands["tail"])
+	count := flags.Int("n", 10,
+		"the number of existing recordings to print first")
+	full := flags.Bool("v", false,
+		"print the headers and bodies of each recording")
+	interval := flags.Duration("interval", 250*time.Millisecond,
+		"how often to check the archive for new recordings")
+	args, err := parseFlags(flags, args)
+	if err != nil {
+		return err
+	} else if len(args) != 1 {
+		flags.Usage()
+		return fmt.Errorf("expected one archive")
+	}
+
+	t := &tailer{path: args[0], full: *full}
+	t.skip(*count)
+	stop := stopSignal()
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for {
+		t.poll()
+		select {
+		case <-stop:
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// Tracks the recordings of an archive that have been printed.
+type tailer struct {
+	path string
+	full bool
+
+	// The number of recordings printed, or skipped, so far and the size of
+	// the archive when they were read.
+	printed int
+	size    int64
+
+	// Set while following the temporary file of a recording run, see
+	// file().
+	recording bool
+}
+
+// Returns the file that is being recorded into if a recording run is in
+// progress, otherwise the archive. dvr records into a temporary file next to
+// the archive, and renames it over the archive once it is complete. A
+// temporary file left behind by an interrupted run is ignored once the
+// archive is newer.
+func (t *tailer) file() (string, os.FileInfo) {
+	info, err := os.Stat(t.path)
+	recording := t.path + ".recording"
+	if rinfo, rerr := os.Stat(recording); rerr == nil &&
+		(err != nil || !rinfo.ModTime().Before(info.ModTime())) {
+		return recording, rinfo
+	}
+	return t.path, info
+}
+
+// Marks all but the last count recordings in the archive as printed.
+func (t *tailer) skip(count int) {
+	path, _ := t.file()
+	t.recording = path != t.path
+	rrs, _ := dvr.VerifyArchiveFile(path)
+	if len(rrs) > count {
+		t.printed = len(rrs) - count
+	}
+}
+
+// Prints the recordings added to the archive since the last call. Archives
+// are read in full each time since the recording is still being written,
+// and the entries that are complete so far are returned along with the
+// problem of it being truncated, which is ignored.
+func (t *tailer) poll() {
+	path, info := t.file()
+	if info == nil {
+		return
+	}
+	// The archive replacing the file being recorded is the same run.
+	recording := path != t.path
+	started := recording && !t.recording
+	t.recording = recording
+
+	rrs, _ := dvr.VerifyArchiveFile(path)
+	if started || info.Size() < t.size || len(rrs) < t.printed {
+		fmt.Fprintln(stdout, "--- a new recording run started")
+		t.printed = 0
+	}
+	t.size = info.Size()
+	for ; t.printed < len(rrs); t.printed++ {
+		rr := rrs[t.printed]
+		if t.full {
+			printRecording(stdout, t.printed, rr)
+			continue
+		}
+		partition := ""
+		if rr.Partition != "" {
+			partition = " (" + rr.Partition + ")"
+		}
+		fmt.Fprintf(stdout, "%d %s%s\n", t.printed, summary(rr), partition)
+	}
+}
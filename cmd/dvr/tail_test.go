@@ -0,0 +1,120 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/liquidgecka/testlib"
+	"github.com/orchestrate-io/dvr"
+)
+
+func TestTail(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+	defer func(f func() <-chan os.Signal) { stopSignal = f }(stopSignal)
+	buffer := &bytes.Buffer{}
+	stdout = buffer
+	defer func() { stdout = os.Stdout }()
+
+	items := testRecording("GET", "https://api.example.com/items", 200, "items")
+	login := testRecording("POST", "https://api.example.com/login", 200, "")
+	login.Partition = "TestLogin"
+	archive := testArchive(t, items, login, items)
+
+	// Existing recordings are printed before following the archive.
+	stop := make(chan os.Signal, 1)
+	stop <- os.Interrupt
+	stopSignal = func() <-chan os.Signal { return stop }
+	T.Equal(run([]string{"tail", "-n", "2", archive}), 0)
+	T.Equal(buffer.String(), ""+
+		"1 POST https://api.example.com/login 200 (TestLogin)\n"+
+		"2 GET https://api.example.com/items 200\n")
+
+	// Recordings are read from archives that are still being written,
+	// whose last block has not been finished and that have no index yet.
+	// The index is at the offset in the 8 bytes before its trailing magic.
+	data, err := ioutil.ReadFile(archive)
+	T.ExpectSuccess(err)
+	index := binary.BigEndian.Uint64(data[len(data)-16:])
+	reader, err := gzip.NewReader(bytes.NewReader(data[4:index]))
+	T.ExpectSuccess(err)
+	entries, err := ioutil.ReadAll(reader)
+	T.ExpectSuccess(err)
+	partial := bytes.NewBuffer(append([]byte{}, data[:4]...))
+	compressor := gzip.NewWriter(partial)
+	_, err = compressor.Write(entries)
+	T.ExpectSuccess(err)
+	T.ExpectSuccess(compressor.Flush())
+	T.ExpectSuccess(ioutil.WriteFile(archive, partial.Bytes(), 0644))
+
+	tail := &tailer{path: archive}
+	buffer.Reset()
+	tail.poll()
+	T.Equal(tail.printed, 3)
+	T.Equal(len(bytes.Split(bytes.TrimSpace(buffer.Bytes()), []byte("\n"))), 3)
+
+	// Only new recordings are printed.
+	T.ExpectSuccess(dvr.WriteArchiveFile(archive,
+		[]*dvr.RequestResponse{items, login, items, login}))
+	buffer.Reset()
+	tail.poll()
+	T.Equal(buffer.String(),
+		"3 POST https://api.example.com/login 200 (TestLogin)\n")
+
+	// And new recording runs start again.
+	T.ExpectSuccess(dvr.WriteArchiveFile(archive,
+		[]*dvr.RequestResponse{login}))
+	buffer.Reset()
+	tail.poll()
+	T.Equal(buffer.String(), "--- a new recording run started\n"+
+		"0 POST https://api.example.com/login 200 (TestLogin)\n")
+}
+
+func TestTailRecordingInProgress(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+	buffer := &bytes.Buffer{}
+	stdout = buffer
+	defer func() { stdout = os.Stdout }()
+
+	items := testRecording("GET", "https://api.example.com/items", 200, "items")
+	login := testRecording("POST", "https://api.example.com/login", 200, "")
+	archive := testArchive(t, items)
+	tail := &tailer{path: archive}
+	tail.poll()
+	T.Equal(buffer.String(), "0 GET https://api.example.com/items 200\n")
+
+	// A recording run writes to a temporary file until it is complete,
+	// which is followed instead of the archive.
+	recording := archive + ".recording"
+	T.ExpectSuccess(dvr.WriteArchiveFile(recording,
+		[]*dvr.RequestResponse{login}))
+	buffer.Reset()
+	tail.poll()
+	T.Equal(buffer.String(), "--- a new recording run started\n"+
+		"0 POST https://api.example.com/login 200\n")
+
+	// Nothing is repeated once it replaces the archive.
+	T.ExpectSuccess(os.Rename(recording, archive))
+	buffer.Reset()
+	tail.poll()
+	T.Equal(buffer.String(), "")
+}
@@ -0,0 +1,89 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/orchestrate-io/dvr"
+)
+
+func init() {
+	register(&command{
+		name:  "validate",
+		args:  "[flags] <archive>",
+		short: "check that an archive is intact and free of secrets",
+		run:   runValidate,
+	})
+}
+
+// Checks that every entry in the archive can be read, and that no recording
+// has a body larger than -max-body or a probable secret. Each problem is
+// printed, and the command fails if there are any so that it can be used to
+// check archives in CI.
+func runValidate(args []string) error {
+	flags := newFlagSet(commands["validate"])
+	maxBody := flags.Int("max-body", 1<<20,
+		"the largest body allowed in bytes, or 0 for no limit")
+	secrets := flags.Bool("secrets", true,
+		"check the recordings for probable secrets")
+	args, err := parseFlags(flags, args)
+	if err != nil {
+		return err
+	} else if len(args) != 1 {
+		flags.Usage()
+		return fmt.Errorf("expected one archive")
+	}
+
+	rrs, errs := dvr.VerifyArchiveFile(args[0])
+	problems := len(errs)
+	for _, err := range errs {
+		fmt.Fprintln(stdout, err)
+	}
+	for i, rr := range rrs {
+		var messages []string
+		if rr.Request == nil || rr.Request.URL == nil {
+			messages = append(messages, "the recording has no request")
+		} else if rr.Response == nil && rr.Error == nil {
+			messages = append(messages,
+				"the recording has no response or error")
+		}
+		if *maxBody > 0 && len(rr.RequestBody) > *maxBody {
+			messages = append(messages, fmt.Sprintf(
+				"the request body is %d bytes", len(rr.RequestBody)))
+		}
+		if *maxBody > 0 && len(rr.ResponseBody) > *maxBody {
+			messages = append(messages, fmt.Sprintf(
+				"the response body is %d bytes", len(rr.ResponseBody)))
+		}
+		if *secrets {
+			for _, f := range findSecrets(rr) {
+				messages = append(messages, fmt.Sprintf(
+					"probable %s in the %s", f.kind, f.where))
+			}
+		}
+		description := redactedSummary(rr)
+		for _, message := range messages {
+			fmt.Fprintf(stdout, "%d %s: %s\n", i, description, message)
+		}
+		problems += len(messages)
+	}
+
+	if problems > 0 {
+		return fmt.Errorf("found %d problems", problems)
+	}
+	fmt.Fprintf(stdout, "%d recordings, no problems found\n", len(rrs))
+	return nil
+}
@@ -0,0 +1,227 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/orchestrate-io/dvr"
+	"gopkg.in/yaml.v3"
+)
+
+// A go-vcr cassette. Version 2 is written by go-vcr v3, and version 1 by the
+// earlier releases, which do not store the protocol or content length.
+type vcrCassette struct {
+	Version      int               `yaml:"version"`
+	Interactions []*vcrInteraction `yaml:"interactions"`
+}
+
+// A request and its response in a go-vcr cassette.
+type vcrInteraction struct {
+	ID       int         `yaml:"id"`
+	Request  vcrRequest  `yaml:"request"`
+	Response vcrResponse `yaml:"response"`
+}
+
+// A request in a go-vcr cassette.
+type vcrRequest struct {
+	Proto            string              `yaml:"proto,omitempty"`
+	ProtoMajor       int                 `yaml:"proto_major,omitempty"`
+	ProtoMinor       int                 `yaml:"proto_minor,omitempty"`
+	ContentLength    int64               `yaml:"content_length"`
+	TransferEncoding []string            `yaml:"transfer_encoding,omitempty"`
+	Trailer          map[string][]string `yaml:"trailer,omitempty"`
+	Host             string              `yaml:"host,omitempty"`
+	RemoteAddr       string              `yaml:"remote_addr,omitempty"`
+	RequestURI       string              `yaml:"request_uri,omitempty"`
+	Body             string              `yaml:"body"`
+	Form             map[string][]string `yaml:"form,omitempty"`
+	Headers          map[string][]string `yaml:"headers"`
+	URL              string              `yaml:"url"`
+	Method           string              `yaml:"method"`
+}
+
+// A response in a go-vcr cassette.
+type vcrResponse struct {
+	Proto            string              `yaml:"proto,omitempty"`
+	ProtoMajor       int                 `yaml:"proto_major,omitempty"`
+	ProtoMinor       int                 `yaml:"proto_minor,omitempty"`
+	TransferEncoding []string            `yaml:"transfer_encoding,omitempty"`
+	Trailer          map[string][]string `yaml:"trailer,omitempty"`
+	ContentLength    int64               `yaml:"content_length"`
+	Uncompressed     bool                `yaml:"uncompressed"`
+	Body             string              `yaml:"body"`
+	Headers          map[string][]string `yaml:"headers"`
+	Status           string              `yaml:"status"`
+	Code             int                 `yaml:"code"`
+	Duration         string              `yaml:"duration"`
+}
+
+// Writes the recordings as a go-vcr cassette, returning the number of
+// recordings that were skipped because the request failed, which cassettes
+// can not represent. Bodies that are not UTF-8 text are written as !!binary
+// values.
+func writeVCR(w io.Writer, rrs []*dvr.RequestResponse) (int, error) {
+	cassette := &vcrCassette{Version: 2, Interactions: []*vcrInteraction{}}
+	skipped := 0
+	for _, rr := range rrs {
+		req, resp := rr.Request, rr.Response
+		if req == nil || req.URL == nil || resp == nil {
+			skipped++
+			continue
+		}
+		method, url := methodAndURL(rr)
+		cassette.Interactions = append(cassette.Interactions, &vcrInteraction{
+			ID: len(cassette.Interactions),
+			Request: vcrRequest{
+				Proto:         req.Proto,
+				ProtoMajor:    req.ProtoMajor,
+				ProtoMinor:    req.ProtoMinor,
+				ContentLength: int64(len(rr.RequestBody)),
+				Trailer:       req.Trailer,
+				Host:          req.Host,
+				Body:          string(rr.RequestBody),
+				Headers:       vcrHeader(req.Header),
+				URL:           url,
+				Method:        method,
+			},
+			Response: vcrResponse{
+				Proto:            resp.Proto,
+				ProtoMajor:       resp.ProtoMajor,
+				ProtoMinor:       resp.ProtoMinor,
+				TransferEncoding: resp.TransferEncoding,
+				Trailer:          resp.Trailer,
+				ContentLength:    resp.ContentLength,
+				Uncompressed:     resp.Uncompressed,
+				Body:             string(rr.ResponseBody),
+				Headers:          vcrHeader(resp.Header),
+				Status:           resp.Status,
+				Code:             resp.StatusCode,
+				Duration:         "0s",
+			},
+		})
+	}
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(4)
+	if _, err := io.WriteString(w, "---\n"); err != nil {
+		return 0, err
+	} else if err := encoder.Encode(cassette); err != nil {
+		return 0, err
+	}
+	return skipped, encoder.Close()
+}
+
+// Reads the recordings in a go-vcr cassette.
+func readVCR(r io.Reader) ([]*dvr.RequestResponse, error) {
+	var cassette vcrCassette
+	if err := yaml.NewDecoder(r).Decode(&cassette); err != nil {
+		return nil, err
+	} else if cassette.Version != 1 && cassette.Version != 2 {
+		return nil, fmt.Errorf("unsupported cassette version %d",
+			cassette.Version)
+	}
+
+	rrs := make([]*dvr.RequestResponse, 0, len(cassette.Interactions))
+	for i, in := range cassette.Interactions {
+		u, err := url.Parse(in.Request.URL)
+		if err != nil {
+			return nil, fmt.Errorf("interaction %d: %s", i, err)
+		}
+		body := []byte(in.Request.Body)
+		if len(body) == 0 && len(in.Request.Form) > 0 {
+			body = []byte(url.Values(in.Request.Form).Encode())
+		}
+		req := &http.Request{
+			Method:        strings.ToUpper(in.Request.Method),
+			URL:           u,
+			Header:        http.Header(in.Request.Headers),
+			Trailer:       http.Header(in.Request.Trailer),
+			Host:          in.Request.Host,
+			ContentLength: int64(len(body)),
+		}
+		req.Proto, req.ProtoMajor, req.ProtoMinor = vcrProto(
+			in.Request.Proto, in.Request.ProtoMajor, in.Request.ProtoMinor)
+		if req.Header == nil {
+			req.Header = http.Header{}
+		}
+
+		status := in.Response.Status
+		code := in.Response.Code
+		if code == 0 {
+			code, _ = strconv.Atoi(strings.SplitN(status, " ", 2)[0])
+		}
+		if code < 100 || code > 999 {
+			return nil, fmt.Errorf("interaction %d: invalid status code %d",
+				i, code)
+		}
+		if !strings.HasPrefix(status, strconv.Itoa(code)) {
+			status = strconv.Itoa(code) + " " + http.StatusText(code)
+		}
+		resp := &http.Response{
+			Status:           status,
+			StatusCode:       code,
+			Header:           http.Header(in.Response.Headers),
+			Trailer:          http.Header(in.Response.Trailer),
+			ContentLength:    int64(len(in.Response.Body)),
+			TransferEncoding: in.Response.TransferEncoding,
+			Uncompressed:     in.Response.Uncompressed,
+		}
+		resp.Proto, resp.ProtoMajor, resp.ProtoMinor = vcrProto(
+			in.Response.Proto, in.Response.ProtoMajor, in.Response.ProtoMinor)
+		if in.Response.ContentLength < 0 {
+			resp.ContentLength = -1
+		}
+		if resp.Header == nil {
+			resp.Header = http.Header{}
+		}
+
+		rr := &dvr.RequestResponse{Request: req, Response: resp}
+		if len(body) > 0 {
+			rr.RequestBody = body
+		}
+		if len(in.Response.Body) > 0 {
+			rr.ResponseBody = []byte(in.Response.Body)
+		}
+		rrs = append(rrs, rr)
+	}
+	return rrs, nil
+}
+
+// Returns the header as the map stored in cassettes, which is never nil
+// since go-vcr expects the headers key to be present.
+func vcrHeader(h http.Header) map[string][]string {
+	if h == nil {
+		return map[string][]string{}
+	}
+	return h
+}
+
+// Returns the protocol of a request or response, defaulting to HTTP/1.1 for
+// version 1 cassettes.
+func vcrProto(proto string, major, minor int) (string, int, int) {
+	if proto == "" {
+		return "HTTP/1.1", 1, 1
+	} else if major == 0 && minor == 0 {
+		if m, n, ok := http.ParseHTTPVersion(proto); ok {
+			return proto, m, n
+		}
+	}
+	return proto, major, minor
+}
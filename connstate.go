@@ -0,0 +1,124 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvr
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"sync"
+)
+
+// This is a gob encodable version of tls.ConnectionState. Certificates are
+// stored in their DER form since gob can only encode the public keys of the
+// types that have been registered with it, and in the past recording a
+// response from a server with an ECDSA or Ed25519 certificate failed.
+type gobConnectionState struct {
+	Version                     uint16
+	HandshakeComplete           bool
+	DidResume                   bool
+	CipherSuite                 uint16
+	NegotiatedProtocol          string
+	ServerName                  string
+	PeerCertificates            [][]byte
+	VerifiedChains              [][][]byte
+	SignedCertificateTimestamps [][]byte
+	OCSPResponse                []byte
+}
+
+// This takes a ConnectionState and returns a gob compatible
+// gobConnectionState.
+func newGobConnectionState(cs *tls.ConnectionState) *gobConnectionState {
+	if cs == nil {
+		return nil
+	}
+	g := &gobConnectionState{
+		Version:                     cs.Version,
+		HandshakeComplete:           cs.HandshakeComplete,
+		DidResume:                   cs.DidResume,
+		CipherSuite:                 cs.CipherSuite,
+		NegotiatedProtocol:          cs.NegotiatedProtocol,
+		ServerName:                  cs.ServerName,
+		PeerCertificates:            rawCertificates(cs.PeerCertificates),
+		SignedCertificateTimestamps: cs.SignedCertificateTimestamps,
+		OCSPResponse:                cs.OCSPResponse,
+	}
+	for _, chain := range cs.VerifiedChains {
+		g.VerifiedChains = append(g.VerifiedChains, rawCertificates(chain))
+	}
+	return g
+}
+
+// Returns the DER form of each certificate.
+func rawCertificates(certs []*x509.Certificate) [][]byte {
+	if certs == nil {
+		return nil
+	}
+	raw := make([][]byte, 0, len(certs))
+	for _, cert := range certs {
+		if cert != nil {
+			raw = append(raw, cert.Raw)
+		}
+	}
+	return raw
+}
+
+// Converts g back into a ConnectionState. Certificates that can not be
+// parsed are left out.
+func (g *gobConnectionState) connectionState() *tls.ConnectionState {
+	if g == nil {
+		return nil
+	}
+	cs := &tls.ConnectionState{
+		Version:                     g.Version,
+		HandshakeComplete:           g.HandshakeComplete,
+		DidResume:                   g.DidResume,
+		CipherSuite:                 g.CipherSuite,
+		NegotiatedProtocol:          g.NegotiatedProtocol,
+		ServerName:                  g.ServerName,
+		PeerCertificates:            parseCertificates(g.PeerCertificates),
+		SignedCertificateTimestamps: g.SignedCertificateTimestamps,
+		OCSPResponse:                g.OCSPResponse,
+	}
+	for _, chain := range g.VerifiedChains {
+		cs.VerifiedChains = append(cs.VerifiedChains,
+			parseCertificates(chain))
+	}
+	return cs
+}
+
+// Most of the responses in an archive come from a few servers, so each
+// certificate is only parsed once. The map is keyed by the DER form.
+var parsedCertificates sync.Map
+
+// Parses each of the given certificates, see parsedCertificates.
+func parseCertificates(raw [][]byte) []*x509.Certificate {
+	if raw == nil {
+		return nil
+	}
+	certs := make([]*x509.Certificate, 0, len(raw))
+	for _, der := range raw {
+		if cert, ok := parsedCertificates.Load(string(der)); ok {
+			certs = append(certs, cert.(*x509.Certificate))
+			continue
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			continue
+		}
+		parsedCertificates.Store(string(der), cert)
+		certs = append(certs, cert)
+	}
+	return certs
+}
@@ -0,0 +1,93 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvr
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/gob"
+	"math/big"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/liquidgecka/testlib"
+)
+
+func TestGobConnectionState(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	// A certificate with a key type that gob can't encode.
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	T.ExpectSuccess(err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "api.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(
+		rand.Reader, template, template, &key.PublicKey, key)
+	T.ExpectSuccess(err)
+	cert, err := x509.ParseCertificate(der)
+	T.ExpectSuccess(err)
+
+	q := testQuery("GET", "https://api.example.com/", "", 200, "ok")
+	q.Response = newGobResponse(&http.Response{
+		StatusCode: 200,
+		TLS: &tls.ConnectionState{
+			Version:            tls.VersionTLS13,
+			HandshakeComplete:  true,
+			CipherSuite:        tls.TLS_AES_128_GCM_SHA256,
+			NegotiatedProtocol: "h2",
+			ServerName:         "api.example.com",
+			PeerCertificates:   []*x509.Certificate{cert},
+			VerifiedChains:     [][]*x509.Certificate{{cert}},
+		},
+	})
+	buffer := &bytes.Buffer{}
+	T.ExpectSuccess(gob.NewEncoder(buffer).Encode(q))
+	decoded := new(gobQuery)
+	T.ExpectSuccess(gob.NewDecoder(buffer).Decode(decoded))
+
+	cs := decoded.RequestResponse().Response.TLS
+	T.NotEqual(cs, nil)
+	T.Equal(cs.Version, uint16(tls.VersionTLS13))
+	T.Equal(cs.HandshakeComplete, true)
+	T.Equal(cs.CipherSuite, tls.TLS_AES_128_GCM_SHA256)
+	T.Equal(cs.NegotiatedProtocol, "h2")
+	T.Equal(cs.ServerName, "api.example.com")
+	T.Equal(len(cs.PeerCertificates), 1)
+	T.Equal(cs.PeerCertificates[0].Equal(cert), true)
+	T.Equal(cs.PeerCertificates[0].Subject.CommonName, "api.example.com")
+	T.Equal(len(cs.VerifiedChains), 1)
+	T.Equal(cs.VerifiedChains[0][0].Equal(cert), true)
+
+	// Responses made without TLS have none when replayed.
+	T.Equal(testQuery("GET", "http://x/", "", 200, "").RequestResponse().
+		Response.TLS, nil)
+
+	// Archives from before ConnectionState was added still have their
+	// connection state replayed.
+	old := testQuery("GET", "https://x/", "", 200, "")
+	old.Response.TLS = &tls.ConnectionState{ServerName: "x"}
+	T.Equal(old.RequestResponse().Response.TLS.ServerName, "x")
+}
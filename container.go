@@ -0,0 +1,436 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvr
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// Archives start with a 32 bit big endian version word followed by gzip
+// compressed entries, each holding one gob encoded gobQuery. In version 1 the
+// entries are a tar file in a single gzip stream, which adds a 512 byte
+// header to every entry and pads each to a multiple of 512 bytes. Version 2
+// instead puts a 32 bit big endian length before each entry, and splits the
+// entries into blocks that are each compressed as a gzip member of their
+// own, followed by an index of where each entry is, see blockWriter. Version
+// 2 is written, both are read.
+//
+// Later versions must follow the version word with a 16 bit big endian
+// length and that many bytes naming the features that need the new version,
+// separated by commas, so that older versions of this library can say what
+// an archive they can't read requires.
+const archiveVersion = 2
+
+// Version 2 blocks are ended once they hold this many bytes of entries. Each
+// block is compressed on its own, so smaller blocks compress less well but
+// let a single entry be read with less decompressed to reach it.
+const blockSize = 256 << 10
+
+// The last 16 bytes of a version 2 archive are the 64 bit big endian offset
+// of its index followed by this.
+const indexMagic = "dvrindex"
+
+// The longest list of features read from an archive with a newer version.
+const maxFeatureList = 4096
+
+// Returned when an archive was written with a newer version of the format
+// than this version of dvr can read.
+type archiveVersionError struct {
+	version  uint32
+	features []string
+}
+
+// error
+func (e *archiveVersionError) Error() string {
+	msg := fmt.Sprintf("dvr: the archive was written by a newer version of "+
+		"dvr using archive format v%d, this version supports formats v1 to "+
+		"v%d", e.version, archiveVersion)
+	if len(e.features) > 0 {
+		msg += " and the archive requires " + strings.Join(e.features, ", ")
+	}
+	return msg + ". Please upgrade github.com/orchestrate-io/dvr."
+}
+
+// Reads the version word from the start of an archive. Newer versions are
+// reported with an *archiveVersionError naming the features they need.
+func readVersion(r io.Reader) (uint32, error) {
+	version := uint32(0)
+	if err := binary.Read(r, binary.BigEndian, &version); err != nil {
+		return 0, err
+	} else if version > archiveVersion && version < 1<<16 {
+		return 0, &archiveVersionError{
+			version:  version,
+			features: readFeatures(r),
+		}
+	} else if version != 1 && version != 2 {
+		return 0, fmt.Errorf("Unknown version: %d", version)
+	}
+	return version, nil
+}
+
+// Reads the list of features that follows the version word of an archive
+// with a newer version. Nothing is returned if it can't be read.
+func readFeatures(r io.Reader) []string {
+	var length uint16
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil
+	} else if length == 0 || length > maxFeatureList {
+		return nil
+	}
+	list := make([]byte, length)
+	if _, err := io.ReadFull(r, list); err != nil {
+		return nil
+	}
+	var features []string
+	for _, feature := range strings.Split(string(list), ",") {
+		if feature = strings.TrimSpace(feature); feature != "" {
+			features = append(features, feature)
+		}
+	}
+	return features
+}
+
+// Writes a version 2 entry holding data.
+func writeEntry(w io.Writer, data []byte) error {
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(data)))
+	if _, err := w.Write(size[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// Returns a function that reads each entry in turn from the decompressed
+// stream of an archive with the given version. It returns io.EOF after the
+// last entry, and io.ErrUnexpectedEOF if the stream ends part way through
+// one.
+func entryReader(version uint32, r io.Reader) func() ([]byte, error) {
+	if version == 1 {
+		reader := tar.NewReader(r)
+		return func() ([]byte, error) {
+			if _, err := reader.Next(); err != nil {
+				return nil, err
+			}
+			return ioutil.ReadAll(reader)
+		}
+	}
+	return func() ([]byte, error) {
+		var size [4]byte
+		if _, err := io.ReadFull(r, size[:]); err != nil {
+			return nil, err
+		}
+
+		// The length isn't trusted for an allocation up front since a
+		// corrupt one could be anything.
+		length := int64(binary.BigEndian.Uint32(size[:]))
+		data, err := ioutil.ReadAll(io.LimitReader(r, length))
+		if err != nil {
+			return nil, err
+		} else if int64(len(data)) != length {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return data, nil
+	}
+}
+
+// Returns a function that reads each entry in turn from an archive with the
+// given version, read from r after the version word. It returns io.EOF after
+// the last entry, having checked the gzip checksums and, for a version 2
+// archive with an index, that the index lists every entry. Version 2
+// archives written before the index was added are a single block with no
+// index, as is the file that a recording is written to until it is
+// complete.
+func archiveEntries(
+	version uint32, r io.Reader,
+) (func() ([]byte, error), error) {
+	if version == 1 {
+		gzipReader, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		next := entryReader(version, gzipReader)
+		return func() ([]byte, error) {
+			data, err := next()
+			if err == io.EOF {
+				// The checksum is only checked at the end of the stream,
+				// which follows the end of the tar file.
+				if _, err := io.Copy(ioutil.Discard, gzipReader); err != nil {
+					return nil, err
+				}
+				return nil, io.EOF
+			}
+			return data, err
+		}, nil
+	}
+
+	// Each block is read as a separate gzip stream since the index follows
+	// the last of them.
+	input := bufio.NewReader(r)
+	gzipReader := new(gzip.Reader)
+	var next func() ([]byte, error)
+	count := uint32(0)
+	startBlock := func() error {
+		if err := gzipReader.Reset(input); err != nil {
+			return err
+		}
+		gzipReader.Multistream(false)
+		next = entryReader(version, gzipReader)
+		return nil
+	}
+	if !atIndex(input) {
+		if err := startBlock(); err != nil {
+			return nil, err
+		}
+	}
+	return func() ([]byte, error) {
+		for next != nil {
+			data, err := next()
+			if err == nil {
+				count++
+				return data, nil
+			} else if err != io.EOF {
+				return nil, err
+			}
+			next = nil
+			if _, err := input.Peek(1); err == io.EOF {
+				return nil, io.EOF
+			} else if !atIndex(input) {
+				if err := startBlock(); err != nil {
+					return nil, err
+				}
+			}
+		}
+		return nil, checkIndex(input, count)
+	}, nil
+}
+
+// Returns true if the next bytes from r are not the start of a gzip member,
+// which is where the index of a version 2 archive starts.
+func atIndex(r *bufio.Reader) bool {
+	magic, err := r.Peek(2)
+	return err == nil && (magic[0] != 0x1f || magic[1] != 0x8b)
+}
+
+// Reads the rest of a version 2 archive from r, which has just read the last
+// block, and checks that it is an index of count entries. It returns io.EOF
+// if it is.
+func checkIndex(r io.Reader, count uint32) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	size := len(indexMagic) + 12
+	if len(data) < size || string(data[len(data)-len(indexMagic):]) !=
+		indexMagic {
+		return fmt.Errorf("the data after the last block is not an index")
+	} else if n := binary.BigEndian.Uint32(data); n != count ||
+		int64(len(data)) != indexLength(int64(n)) {
+		return fmt.Errorf("the index lists %d entries but the archive has "+
+			"%d", n, count)
+	}
+	return io.EOF
+}
+
+// Returns the length of the index of a version 2 archive with the given
+// number of entries, including its trailing offset and indexMagic.
+func indexLength(entries int64) int64 {
+	return 4 + entries*12 + 8 + int64(len(indexMagic))
+}
+
+// Where an entry is in a version 2 archive: the offset of the gzip member
+// holding its block, and the offset of its length word once the block is
+// decompressed.
+type entryLocation struct {
+	block  int64
+	offset uint32
+}
+
+// The index of a version 2 archive.
+type archiveIndex struct {
+	// The location of each entry, in order.
+	entries []entryLocation
+
+	// The offset of the index, which is where the last block ends.
+	end int64
+}
+
+// Reads the index of the version 2 archive r, which has the given size. nil
+// is returned if the archive has no index, or it is not usable, in which
+// case the archive can still be read in order with archiveEntries().
+func readIndex(r io.ReaderAt, size int64) *archiveIndex {
+	footer := make([]byte, 8+len(indexMagic))
+	if size < indexLength(0)+4 {
+		return nil
+	} else if _, err := r.ReadAt(footer, size-int64(len(footer))); err != nil {
+		return nil
+	} else if string(footer[8:]) != indexMagic {
+		return nil
+	}
+	offset := int64(binary.BigEndian.Uint64(footer))
+	if offset < 4 || offset > size-indexLength(0) {
+		return nil
+	}
+	data := make([]byte, size-offset-int64(len(footer)))
+	if _, err := r.ReadAt(data, offset); err != nil {
+		return nil
+	}
+	count := int64(binary.BigEndian.Uint32(data))
+	if indexLength(count) != size-offset {
+		return nil
+	}
+	index := &archiveIndex{entries: make([]entryLocation, count), end: offset}
+	last := int64(4)
+	for i := range index.entries {
+		entry := data[4+i*12:]
+		index.entries[i] = entryLocation{
+			block:  int64(binary.BigEndian.Uint64(entry)),
+			offset: binary.BigEndian.Uint32(entry[8:]),
+		}
+		if b := index.entries[i].block; b < last || b >= offset {
+			return nil
+		}
+		last = index.entries[i].block
+	}
+	return index
+}
+
+// Returns the offsets of the blocks of the archive, in order, each with the
+// number of entries that it holds.
+func (a *archiveIndex) blocks() (offsets []int64, counts []int) {
+	for _, e := range a.entries {
+		if len(offsets) == 0 || offsets[len(offsets)-1] != e.block {
+			offsets = append(offsets, e.block)
+			counts = append(counts, 0)
+		}
+		counts[len(counts)-1]++
+	}
+	return offsets, counts
+}
+
+// Writes version 2 entries into blocks, each compressed as a gzip member of
+// its own, and the index of where each entry is once it is closed. Keeping
+// the blocks separate lets an archive with an index be decompressed in
+// parallel, and a single entry be read without reading those before it.
+type blockWriter struct {
+	// Where the archive is written, and the offset in the file of the next
+	// byte written to it.
+	w      io.Writer
+	offset int64
+
+	// The compressor of the current block, or nil between blocks, and the
+	// offset of the block and the length of the entries written to it.
+	compressor *gzip.Writer
+	level      int
+	block      int64
+	size       int64
+
+	index []entryLocation
+}
+
+// Returns a blockWriter that writes to w, the next byte of which is at the
+// given offset in the archive, with the given compression level.
+func newBlockWriter(w io.Writer, offset int64, level int) *blockWriter {
+	return &blockWriter{w: w, offset: offset, level: level}
+}
+
+// io.Writer. This counts the bytes of the compressed blocks.
+func (b *blockWriter) Write(p []byte) (int, error) {
+	n, err := b.w.Write(p)
+	b.offset += int64(n)
+	return n, err
+}
+
+// Adds an entry holding data to the current block, starting a block if there
+// isn't one and ending it once it is at least blockSize.
+func (b *blockWriter) writeEntry(data []byte) error {
+	if b.compressor == nil {
+		var err error
+		b.compressor, err = gzip.NewWriterLevel(b, b.level)
+		if err != nil {
+			return err
+		}
+		b.block, b.size = b.offset, 0
+	}
+	b.index = append(b.index, entryLocation{
+		block:  b.block,
+		offset: uint32(b.size),
+	})
+	if err := writeEntry(b.compressor, data); err != nil {
+		return err
+	}
+	b.size += 4 + int64(len(data))
+	if b.size >= blockSize {
+		return b.endBlock()
+	}
+	return nil
+}
+
+// Ends the current block, if there is one, so that it can be read from the
+// archive.
+func (b *blockWriter) endBlock() error {
+	if b.compressor == nil {
+		return nil
+	}
+	err := b.compressor.Close()
+	b.compressor = nil
+	return err
+}
+
+// Ends the last block and writes the index.
+func (b *blockWriter) close() error {
+	if err := b.endBlock(); err != nil {
+		return err
+	}
+	index := bytes.NewBuffer(make([]byte, 0, indexLength(int64(len(b.index)))))
+	binary.Write(index, binary.BigEndian, uint32(len(b.index)))
+	for _, e := range b.index {
+		binary.Write(index, binary.BigEndian, uint64(e.block))
+		binary.Write(index, binary.BigEndian, e.offset)
+	}
+	binary.Write(index, binary.BigEndian, uint64(b.offset))
+	index.WriteString(indexMagic)
+	_, err := b.w.Write(index.Bytes())
+	return err
+}
+
+// Reads the entry at the given location from the version 2 archive r.
+func readEntryAt(r io.ReaderAt, end int64, at entryLocation) ([]byte, error) {
+	gzipReader, err := gzip.NewReader(io.NewSectionReader(r, at.block,
+		end-at.block))
+	if err != nil {
+		return nil, err
+	}
+	gzipReader.Multistream(false)
+	_, err = io.CopyN(ioutil.Discard, gzipReader, int64(at.offset))
+	if err == io.EOF {
+		return nil, io.ErrUnexpectedEOF
+	} else if err != nil {
+		return nil, err
+	}
+	data, err := entryReader(archiveVersion, gzipReader)()
+	if err == io.EOF {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return data, err
+}
@@ -0,0 +1,228 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvr
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/liquidgecka/testlib"
+)
+
+func TestEntryReader(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	// Version 2 entries are read back in order.
+	buffer := &bytes.Buffer{}
+	T.ExpectSuccess(writeEntry(buffer, []byte("one")))
+	T.ExpectSuccess(writeEntry(buffer, []byte{}))
+	T.ExpectSuccess(writeEntry(buffer, []byte("three")))
+	data := buffer.Bytes()
+	next := entryReader(2, bytes.NewReader(data))
+	for _, want := range []string{"one", "", "three"} {
+		entry, err := next()
+		T.ExpectSuccess(err)
+		T.Equal(string(entry), want)
+	}
+	_, err := next()
+	T.Equal(err, io.EOF)
+
+	// Truncated entries are reported as such.
+	for _, end := range []int{2, 5} {
+		next = entryReader(2, bytes.NewReader(data[:end]))
+		_, err = next()
+		T.Equal(err, io.ErrUnexpectedEOF)
+	}
+}
+
+func TestReadArchiveVersion1(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	// Archives written before version 2 are still read.
+	buffer := bytes.NewBuffer([]byte{0, 0, 0, 1})
+	compressor := gzip.NewWriter(buffer)
+	writer := tar.NewWriter(compressor)
+	for i := 0; i < 3; i++ {
+		entry := &bytes.Buffer{}
+		q := testQuery("GET", fmt.Sprintf("http://api.example.com/%d", i),
+			"", 200, "")
+		T.ExpectSuccess(gob.NewEncoder(entry).Encode(q))
+		T.ExpectSuccess(writer.WriteHeader(&tar.Header{
+			Name: fmt.Sprint(i), Size: int64(entry.Len())}))
+		_, err := writer.Write(entry.Bytes())
+		T.ExpectSuccess(err)
+	}
+	T.ExpectSuccess(writer.Close())
+	T.ExpectSuccess(compressor.Close())
+	queries, err := readArchive(bytes.NewReader(buffer.Bytes()))
+	T.ExpectSuccess(err)
+	T.Equal(len(queries), 3)
+	T.Equal(queries[2].Request.URL, "http://api.example.com/2")
+
+	// Unknown versions are rejected.
+	_, err = readArchive(bytes.NewReader([]byte{0, 0, 0, 0}))
+	T.ExpectErrorMessage(err, "Unknown version: 0")
+}
+
+func TestReadVersion_Newer(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	// Newer versions name the features that they need.
+	features := "sharded entries, zstd"
+	data := []byte{0, 0, 0, 3, 0, byte(len(features))}
+	data = append(data, features...)
+	_, err := readVersion(bytes.NewReader(data))
+	T.Equal(err.Error(), "dvr: the archive was written by a newer version "+
+		"of dvr using archive format v3, this version supports formats v1 "+
+		"to v2 and the archive requires sharded entries, zstd. Please "+
+		"upgrade github.com/orchestrate-io/dvr.")
+
+	// Without a readable list the upgrade is still asked for.
+	_, err = readVersion(bytes.NewReader([]byte{0, 0, 0, 4}))
+	T.Equal(err.Error(), "dvr: the archive was written by a newer version "+
+		"of dvr using archive format v4, this version supports formats v1 "+
+		"to v2. Please upgrade github.com/orchestrate-io/dvr.")
+	_, err = readVersion(bytes.NewReader([]byte{0, 0, 0, 4, 0xff, 0xff}))
+	T.ExpectErrorMessage(err, "supports formats v1 to v2. Please upgrade")
+
+	// Values that can't be versions are not mistaken for newer archives.
+	_, err = readVersion(bytes.NewReader([]byte{0x1f, 0x8b, 8, 0}))
+	T.ExpectErrorMessage(err, "Unknown version")
+}
+
+func TestBlockWriter(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	// Entries are split into blocks once they reach blockSize, and the
+	// index says where each of them is.
+	buffer := bytes.NewBuffer([]byte{0, 0, 0, 2})
+	blocks := newBlockWriter(buffer, 4, gzip.BestSpeed)
+	var entries [][]byte
+	for i := 0; i < 7; i++ {
+		entry := bytes.Repeat([]byte{byte('a' + i)}, blockSize/3)
+		entries = append(entries, entry)
+		T.ExpectSuccess(blocks.writeEntry(entry))
+	}
+	T.ExpectSuccess(blocks.close())
+	data := buffer.Bytes()
+	index := readIndex(bytes.NewReader(data), int64(len(data)))
+	T.NotEqual(index, nil)
+	T.Equal(len(index.entries), 7)
+	offsets, counts := index.blocks()
+	T.Equal(counts, []int{3, 3, 1})
+	T.Equal(offsets[0], int64(4))
+	for i, at := range index.entries {
+		entry, err := readEntryAt(bytes.NewReader(data), index.end, at)
+		T.ExpectSuccess(err)
+		T.Equal(entry, entries[i])
+	}
+
+	// Readers that can't seek read the blocks in order, and check the
+	// index once they reach it.
+	next, err := archiveEntries(2, bytes.NewReader(data[4:]))
+	T.ExpectSuccess(err)
+	for i := range entries {
+		entry, err := next()
+		T.ExpectSuccess(err)
+		T.Equal(entry, entries[i])
+	}
+	_, err = next()
+	T.Equal(err, io.EOF)
+
+	bad := append([]byte{}, data...)
+	bad[index.end+3]--
+	next, err = archiveEntries(2, bytes.NewReader(bad[4:]))
+	T.ExpectSuccess(err)
+	for range entries {
+		_, err = next()
+		T.ExpectSuccess(err)
+	}
+	_, err = next()
+	T.ExpectErrorMessage(err, "the index lists 6 entries but the archive "+
+		"has 7")
+	T.Equal(readIndex(bytes.NewReader(bad), int64(len(bad))), nil)
+
+	// An archive without entries is only its index.
+	buffer = &bytes.Buffer{}
+	T.ExpectSuccess(newBlockWriter(buffer, 0, gzip.BestSpeed).close())
+	next, err = archiveEntries(2, bytes.NewReader(buffer.Bytes()))
+	T.ExpectSuccess(err)
+	_, err = next()
+	T.Equal(err, io.EOF)
+}
+
+func TestReadArchiveIndexed(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	// Archives are read from their index when they can be seeked, and in
+	// order when they can't, with the same result.
+	var queries []*gobQuery
+	for i := 0; i < 50; i++ {
+		queries = append(queries, testQuery("GET",
+			fmt.Sprintf("http://api.example.com/%d", i), "", 200,
+			strings.Repeat(fmt.Sprint(i), blockSize/40)))
+	}
+	path := filepath.Join(T.TempDir(), "archive.dvr")
+	T.ExpectSuccess(writeArchiveFile(path, queries))
+	data, err := ioutil.ReadFile(path)
+	T.ExpectSuccess(err)
+	index := readIndex(bytes.NewReader(data), int64(len(data)))
+	T.NotEqual(index, nil)
+	offsets, _ := index.blocks()
+	T.Equal(len(offsets) > 1, true)
+
+	indexed, err := readArchive(bytes.NewReader(data))
+	T.ExpectSuccess(err)
+	inOrder, err := readArchive(struct{ io.Reader }{bytes.NewReader(data)})
+	T.ExpectSuccess(err)
+	T.Equal(len(indexed), len(queries))
+	T.Equal(indexed, inOrder)
+	T.Equal(indexed[49].Request.URL, "http://api.example.com/49")
+
+	// A block that can't be read fails the archive either way.
+	data[offsets[1]+20]++
+	_, err = readArchive(bytes.NewReader(data))
+	T.ExpectError(err)
+	_, err = readArchive(struct{ io.Reader }{bytes.NewReader(data)})
+	T.ExpectError(err)
+
+	// Version 2 archives written before the index was added are a single
+	// gzip stream, and are still read.
+	buffer := bytes.NewBuffer([]byte{0, 0, 0, 2})
+	compressor := gzip.NewWriter(buffer)
+	for _, q := range queries[:3] {
+		entry := &bytes.Buffer{}
+		T.ExpectSuccess(gob.NewEncoder(entry).Encode(q))
+		T.ExpectSuccess(writeEntry(compressor, entry.Bytes()))
+	}
+	T.ExpectSuccess(compressor.Close())
+	old, err := readArchive(bytes.NewReader(buffer.Bytes()))
+	T.ExpectSuccess(err)
+	T.Equal(len(old), 3)
+	T.Equal(old[2].Request.URL, "http://api.example.com/2")
+}
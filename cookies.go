@@ -0,0 +1,68 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvr
+
+import (
+	"sort"
+	"strings"
+)
+
+// Replaces the values of cookies in the Cookie header.
+type cookieNormalizer struct {
+	names map[string]bool
+}
+
+// Rewrites the Cookie header of the request with the matching cookie values
+// replaced, and the cookies sorted by name.
+func (c *cookieNormalizer) normalize(rr *RequestResponse) {
+	if rr.Request == nil || len(rr.Request.Header["Cookie"]) == 0 {
+		return
+	}
+	cookies := rr.Request.Cookies()
+	sort.SliceStable(cookies, func(i, j int) bool {
+		return cookies[i].Name < cookies[j].Name
+	})
+	pairs := make([]string, len(cookies))
+	for i, cookie := range cookies {
+		if len(c.names) == 0 || c.names[cookie.Name] {
+			cookie.Value = redactedValue
+		}
+		pairs[i] = cookie.Name + "=" + cookie.Value
+	}
+	rr.Request.Header["Cookie"] = []string{strings.Join(pairs, "; ")}
+}
+
+// NormalizeCookies replaces the values of the named cookies in the Cookie
+// header of requests with "REDACTED", or the values of every cookie if no
+// names are given, and sorts the cookies by name. This is intended for
+// clients using an http.CookieJar, whose session cookies are issued by the
+// server and so differ between the run that recorded them and the run
+// replaying them.
+//
+// The jar adds cookies to each request before it reaches the RoundTripper,
+// so the Cookie header that is recorded is the one that was sent for each
+// hop, including redirects. Set-Cookie headers in responses are left alone
+// so that the jar is populated in the same way when replaying.
+//
+// This adds a symmetric obfuscator to the chain, the returned function
+// removes it.
+func NormalizeCookies(names ...string) (remove func()) {
+	c := &cookieNormalizer{names: make(map[string]bool)}
+	for _, name := range names {
+		c.names[name] = true
+	}
+	return addSymmetricObfuscator(
+		"NormalizeCookies("+strings.Join(names, ", ")+")", c.normalize)
+}
@@ -0,0 +1,110 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvr
+
+import (
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/liquidgecka/testlib"
+)
+
+func TestNormalizeCookies(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+	defer ResetObfuscators()
+
+	newRR := func() *RequestResponse {
+		return &RequestResponse{
+			Request: &http.Request{Header: http.Header{
+				"Cookie": {"session=abc; theme=dark", "csrf=xyz"},
+			}},
+			Response: &http.Response{Header: http.Header{
+				"Set-Cookie": {"session=def"},
+			}},
+		}
+	}
+
+	// Only the named cookies.
+	rr := newRR()
+	(&cookieNormalizer{names: map[string]bool{
+		"session": true, "csrf": true}}).normalize(rr)
+	T.Equal(rr.Request.Header["Cookie"], []string{
+		"csrf=REDACTED; session=REDACTED; theme=dark"})
+	T.Equal(rr.Response.Header["Set-Cookie"], []string{"session=def"})
+
+	// Every cookie.
+	rr = newRR()
+	(&cookieNormalizer{}).normalize(rr)
+	T.Equal(rr.Request.Header["Cookie"], []string{
+		"csrf=REDACTED; session=REDACTED; theme=REDACTED"})
+
+	// Requests without cookies are left alone.
+	rr = &RequestResponse{Request: &http.Request{Header: http.Header{}}}
+	(&cookieNormalizer{}).normalize(rr)
+	T.Equal(rr.Request.Header, http.Header{})
+
+	// The normalizer is installed on both chains.
+	remove := NormalizeCookies("session")
+	T.Equal(len(obfuscators()), 1)
+	T.Equal(len(replayNormalizers()), 1)
+	remove()
+	T.Equal(len(replayNormalizers()), 0)
+}
+
+// An http.RoundTripper implemented by a function.
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestCookieJarHops(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+	defer func() {
+		replay = false
+		passThrough = false
+	}()
+	replay = false
+	passThrough = true
+
+	// The server sets a session cookie and redirects.
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/login" {
+				http.SetCookie(w, &http.Cookie{Name: "session", Value: "abc"})
+				http.Redirect(w, r, "/home", http.StatusFound)
+			}
+		}))
+	defer server.Close()
+
+	// Each hop reaches the RoundTripper with the jar's cookies.
+	var cookies []string
+	rt := &roundTripper{realRoundTripper: roundTripperFunc(
+		func(req *http.Request) (*http.Response, error) {
+			cookies = append(cookies, req.Header.Get("Cookie"))
+			return OriginalDefaultTransport.RoundTrip(req)
+		})}
+	jar, err := cookiejar.New(nil)
+	T.ExpectSuccess(err)
+	client := &http.Client{Transport: rt, Jar: jar}
+	resp, err := client.Get(server.URL + "/login")
+	T.ExpectSuccess(err)
+	T.ExpectSuccess(resp.Body.Close())
+	T.Equal(cookies, []string{"", "session=abc"})
+}
@@ -0,0 +1,101 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvr
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+)
+
+// InterceptDialTLS wraps the DialTLSContext function of an http.Transport so
+// that the requests sent over the connections it makes are recorded and
+// replayed. This is for clients that pin certificates or otherwise customize
+// TLS inside a transport that can not be wrapped with NewRoundTripper(), for
+// example one built inside a library that only accepts a dial function:
+//
+//	transport.DialTLSContext = dvr.InterceptDialTLS(transport.DialTLSContext)
+//
+// Rather than dialing, the returned function returns one end of an in memory
+// connection whose other end reads the HTTP/1.1 requests written by the
+// transport and passes them through dvr as requests to https://<Host>/. In
+// replay mode the responses come from the archive without any connection
+// being made, otherwise the requests are sent by a transport that uses dial
+// so the client's TLS configuration is still applied. In pass through mode
+// dial is called directly. Clients using the deprecated DialTLS can wrap it
+// with a function that ignores the context.
+//
+// Since the transport sees a plain connection Response.TLS is nil and HTTP/2
+// is not negotiated.
+func InterceptDialTLS(
+	dial func(ctx context.Context, network, addr string) (net.Conn, error),
+) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	rt := NewRoundTripper(&http.Transport{DialTLSContext: dial})
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		ProbeAutoMode(addr)
+		if IsPassingThrough() {
+			err := checkPassThroughAllowed("the TLS dial of " + network +
+				" " + addr)
+			if err != nil {
+				return nil, err
+			}
+			return dial(ctx, network, addr)
+		}
+		client, server := net.Pipe()
+		go serveIntercepted(server, rt, addr)
+		return client, nil
+	}
+}
+
+// Reads requests from the connection, sending each through rt and writing
+// back the response. The connection is closed if a request fails so the
+// client sees an error rather than a response.
+func serveIntercepted(conn net.Conn, rt http.RoundTripper, addr string) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		req, err := http.ReadRequest(reader)
+		if err != nil {
+			return
+		}
+		req.RequestURI = ""
+		req.URL.Scheme = "https"
+		req.URL.Host = req.Host
+		if req.URL.Host == "" {
+			req.URL.Host = addr
+		}
+
+		resp, err := rt.RoundTrip(req.WithContext(context.Background()))
+		io.Copy(ioutil.Discard, req.Body)
+		if err != nil {
+			return
+		}
+
+		// Responses without a length are chunked so the connection can be
+		// reused.
+		if resp.ContentLength < 0 && len(resp.TransferEncoding) == 0 &&
+			resp.ProtoAtLeast(1, 1) {
+			resp.TransferEncoding = []string{"chunked"}
+		}
+		err = resp.Write(conn)
+		resp.Body.Close()
+		if err != nil || req.Close || resp.Close {
+			return
+		}
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvr
+
+import (
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/liquidgecka/testlib"
+)
+
+func TestInterceptDialTLS(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+	defer func() {
+		replay = false
+		isSetup = sync.Once{}
+		requestList = nil
+	}()
+
+	server := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("live " + r.URL.Path))
+		}))
+	defer server.Close()
+
+	// The dial function trusts only the test server's certificate.
+	dials := 0
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dials++
+		config := server.Client().Transport.(*http.Transport).TLSClientConfig
+		return tls.Dial(network, server.Listener.Addr().String(), config)
+	}
+
+	q := testQuery("GET", "https://secure.example.com/items", "", 200, "items")
+	q.Request.Header = nil
+	replay = true
+	isSetup = sync.Once{}
+	isSetup.Do(func() {})
+	requestList = []*RequestResponse{q.RequestResponse()}
+	Matcher = func(left, right *RequestResponse) bool {
+		return left.Request.URL.String() == right.Request.URL.String()
+	}
+	defer func() { Matcher = nil }()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialTLSContext: InterceptDialTLS(dial),
+	}}
+	get := func(url string) string {
+		resp, err := client.Get(url)
+		T.ExpectSuccess(err)
+		defer resp.Body.Close()
+		data, err := ioutil.ReadAll(resp.Body)
+		T.ExpectSuccess(err)
+		return string(data)
+	}
+
+	// Recorded requests are replayed without dialing, and the connection
+	// can be reused.
+	T.Equal(get("https://secure.example.com/items"), "items")
+	T.Equal(get("https://secure.example.com/items"), "items")
+	T.Equal(dials, 0)
+
+	// Other requests are sent with the client's dial function.
+	T.Equal(get("https://secure.example.com/other"), "live /other")
+	T.Equal(dials, 1)
+}
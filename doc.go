@@ -22,6 +22,15 @@
 // This ensures that a unit test can remove all dependencies on remote services
 // while running, which is ideal for most testing environments.
 //
+// The flags are registered on flag.CommandLine when the package is
+// initialized. If that collides with an application's own flags then build
+// with "-tags dvr_noflags" and call RegisterFlags() with a FlagSet of your
+// choosing instead.
+//
+// Archives can also be kept outside of the repository by naming a URL with
+// -dvr.file, such as "s3://bucket/key" once the dvrs3 package has been
+// imported. See ArchiveStore for details.
+//
 // Note that this library works be replaying net.http's DefaultTransport
 // with one that will intercept queries. If you are using a custom client,
 // or replacing the http.DefaultTransport you may need to sub a RoundTripper
@@ -40,6 +49,21 @@
 // then you can make value Match() contain a function that can parse two
 // requests and establish if they are the same.
 //
+// A record run must call Close() once its tests have finished, normally from
+// TestMain after m.Run() returns. The recording only replaces the archive
+// once Close() has been called, so a run that panics, times out or is killed
+// leaves the previous archive as it was.
+//
+// Tests that make similar requests, such as table driven tests using t.Run,
+// can call Partition(t) so that their recordings are kept apart from those
+// of every other test.
+//
+// Helper processes started by a test that is recording, such as the test
+// binary running itself, record the calls they make into the same archive
+// if they import this package and are given no mode flag of their own. Each
+// one records a segment of its own that is merged into the archive when the
+// test binary finishes, so helpers must call Close() and exit before it does.
+//
 // This library is intended to be user during unit testing so much of its
 // design is wrapped around this, and while it can be used outside of unit
 // tests it is strongly not recommended.
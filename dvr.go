@@ -15,14 +15,16 @@
 package dvr
 
 import (
-	"archive/tar"
+	"bufio"
 	"flag"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
 	"os/exec"
+	"strings"
 	"sync"
+	"time"
 )
 
 var (
@@ -42,6 +44,17 @@ var (
 	// This is the file that test recordings will be saved into.
 	fileName string
 
+	// If this is true then a line is written for every request that passes
+	// through the library describing what was done with it.
+	verbose bool
+
+	// If set, replay appends a line to this file for each archive entry
+	// that a request is matched to. "dvr prune" uses these to find
+	// recordings that are no longer used.
+	usageLogName string
+	usageLog     *os.File
+	usageLogLock sync.Mutex
+
 	// If this is set to true then -dvr.replay becomes default if not
 	// other flags are provided. If this is falls then the default will be
 	// to pass queries through without recording or replaying them
@@ -55,17 +68,42 @@ var (
 	// record or replay mode.
 	fd *os.File
 
-	// This is the tar.Writer that is used for writing the request gob's
-	// into the file. We also keep a mutex to ensure that we only write
-	// one request at a time to the file.
-	writer      *tar.Writer
+	// The local path that the archive is being recorded to. This differs
+	// from fileName when recording to a remote archive.
+	recordPath string
+
+	// The temporary file that the archive is recorded into, which holds the
+	// lock on it until Close() is called. See recordingPath().
+	archiveFD *os.File
+
+	// This is the stream that the request gob's are written into as archive
+	// entries. We also keep a mutex to ensure that we only write one
+	// request at a time to the file.
+	writer      io.Writer
 	writerLock  sync.Mutex
 	writerCount int
 	writerCmd   *exec.Cmd
 
-	// This is the list of object read from the gob file.
-	requestList []*RequestResponse
-	requestLock sync.Mutex
+	// The hashes of the response bodies that have been stored in the
+	// archive being recorded, protected by writerLock.
+	storedBodies map[string]bool
+
+	// If -dvr.flush_interval is set then the entry stream is buffered here
+	// and only written to the gzipper that often, rather than after every
+	// request. The buffer is also flushed by Close().
+	flushInterval time.Duration
+	writerBuffer  *bufio.Writer
+
+	// Identifies this recording run. Stored with each query so that newer
+	// recordings of a partition supersede the older ones.
+	runID int64
+
+	// This is the list of object read from the gob file, along with the
+	// index of each within the archive. These are not changed once they
+	// are loaded. The lock is held while a custom Matcher is called.
+	requestList    []*RequestResponse
+	requestIndexes []int
+	requestLock    sync.Mutex
 )
 
 // This is the round tripper that replaced the default round tripper in the
@@ -76,18 +114,64 @@ var DefaultRoundTripper http.RoundTripper
 // here in case it needs be recovered.
 var OriginalDefaultTransport http.RoundTripper
 
-// Initialize the flags.
-func init() {
-	flag.BoolVar(&record, "dvr.record", false,
+// Registers the -dvr.* flags on the given FlagSet. Unless the package is
+// built with the "dvr_noflags" tag this is done automatically for
+// flag.CommandLine. Applications that define their own -dvr.* flags, or that
+// parse arguments with another library (pflag, cobra, etc), should build with
+// that tag and call this on a FlagSet of their choosing. For pflag this can
+// be a fresh flag.FlagSet handed to pflag's AddGoFlagSet().
+func RegisterFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&record, "dvr.record", false,
 		"Record HTTP calls into -dvr.record_file for use later.")
-	flag.BoolVar(&replay, "dvr.replay", false,
+	fs.BoolVar(&replay, "dvr.replay", false,
 		"Replay HTTP calls from -svr.record_file.")
-	flag.BoolVar(&passThrough, "dvr.passthrough", false,
+	fs.BoolVar(&passThrough, "dvr.passthrough", false,
 		"Allow queries to pass through without being recorded or replayed.")
-	flag.StringVar(&fileName, "dvr.file",
+	fs.BoolVar(&autoMode, "dvr.auto", false,
+		"Record if the service can be reached when the first request is "+
+			"made, otherwise replay.")
+	fs.StringVar(&autoProbe, "dvr.auto_probe", "",
+		"The host:port that -dvr.auto checks, rather than the host of the "+
+			"first request.")
+	fs.DurationVar(&cacheTTL, "dvr.cache", 0,
+		"Replay recordings younger than this and record the requests "+
+			"that have none, rather than recording or replaying them all.")
+	fs.BoolVar(&goldenMode, "dvr.golden", false,
+		"Make each request for real and fail it if the response differs "+
+			"from its recording.")
+	fs.Var(forbidFlag{}, "dvr.forbid_record",
+		"Fail rather than record, or send requests that match no "+
+			"recording to the network. Defaults to true when CI=true, "+
+			"and when given explicitly requests that are passed "+
+			"through fail too.")
+	fs.StringVar(&fileName, "dvr.file",
 		"testdata/archive.dvr",
 		"The file that stores recorded HTTP calls.")
+	fs.StringVar(&labels, "dvr.labels", "",
+		"Comma separated labels to tag recordings with, or to select the "+
+			"recordings that are replayed.")
+	fs.BoolVar(&verbose, "dvr.verbose", false,
+		"Print a line describing each intercepted HTTP call.")
+	fs.StringVar(&usageLogName, "dvr.usage_log", "",
+		"Append a line for each archive entry that is replayed to this file.")
+	fs.BoolVar(&streamBodies, "dvr.stream_bodies", false,
+		"Read replayed response bodies from disk rather than memory.")
+	fs.Int64Var(&maxMemory, "dvr.max_memory", 0,
+		"Keep at most this many bytes of replayed response bodies in "+
+			"memory, reading the rest from disk.")
+	fs.StringVar(&compression, "dvr.compression", "best",
+		"How hard recorded archives are compressed: none, fast or best.")
+	fs.BoolVar(&simulateLatency, "dvr.simulate_latency", false,
+		"Delay replayed responses by the time they took when recorded, "+
+			"and rate limit for as long as Retry-After asks.")
+	fs.DurationVar(&flushInterval, "dvr.flush_interval", 0,
+		"Write recordings to the archive this often rather than after "+
+			"each request, flushing it so that dvr tail can follow the "+
+			"run.")
+}
 
+// Install the intercepting RoundTripper.
+func init() {
 	// Replace DefaultTransport!
 	OriginalDefaultTransport = http.DefaultTransport
 	DefaultRoundTripper = NewRoundTripper(http.DefaultTransport)
@@ -95,8 +179,11 @@ func init() {
 }
 
 // Returns booleans representing the current running mode. If none of the
-// returns are true then the library is in pass through mode.
+// returns are true then the library is in pass through mode, and both are
+// true when -dvr.cache is set. With -dvr.auto the choice is made first if
+// nothing has made it yet.
 func mode() (rec bool, rep bool) {
+	settleAutoMode(func() string { return "" })
 	switch {
 	case record:
 		return true, false
@@ -104,6 +191,12 @@ func mode() (rec bool, rep bool) {
 		return false, true
 	case passThrough:
 		return false, false
+	case cacheTTL > 0:
+		return true, true
+	case goldenMode:
+		return false, false
+	case segmentDir() != "":
+		return true, false
 	case DefaultReplay:
 		return false, true
 	default:
@@ -111,6 +204,36 @@ func mode() (rec bool, rep bool) {
 	}
 }
 
+// Returns an error if more than one of the mode flags is set, since mode()
+// would otherwise silently pick one of them. This is checked when recording
+// or replaying is set up.
+func checkModeFlags() error {
+	var set []string
+	if record {
+		set = append(set, "-dvr.record")
+	}
+	if replay {
+		set = append(set, "-dvr.replay")
+	}
+	if passThrough {
+		set = append(set, "-dvr.passthrough")
+	}
+	if autoPending() {
+		set = append(set, "-dvr.auto")
+	}
+	if cacheTTL > 0 {
+		set = append(set, "-dvr.cache")
+	}
+	if goldenMode {
+		set = append(set, "-dvr.golden")
+	}
+	if len(set) > 1 {
+		return fmt.Errorf("dvr: %s can not be used together, only one "+
+			"mode can be chosen", strings.Join(set, " and "))
+	}
+	return nil
+}
+
 // Returns true if the DVR library is in recording mode.
 func IsRecording() bool {
 	b, _ := mode()
@@ -143,6 +266,23 @@ func (d *dvrFailure) Error() string {
 // Basically this allows us to mute the error during tests.
 var panicOutput io.Writer = os.Stdout
 
+// This is where the -dvr.verbose trace lines are written.
+var traceOutput io.Writer = os.Stdout
+
+// Writes a line describing what was done with the given request if the
+// -dvr.verbose flag is set.
+func trace(mode string, req *http.Request, format string, args ...interface{}) {
+	if !verbose {
+		return
+	}
+	url := ""
+	if req.URL != nil {
+		url = req.URL.String()
+	}
+	fmt.Fprintf(traceOutput, "dvr: %-11s %s %s: %s\n",
+		mode, req.Method, url, fmt.Sprintf(format, args...))
+}
+
 // This function is used when the library can not continue safely. The idea
 // is that the user has requested a specific configuration (say replaying
 // requests) and that is not possible. We have no way of reporting this
@@ -190,17 +330,70 @@ func NewRoundTripper(fallback http.RoundTripper) http.RoundTripper {
 // In our case we can either pass the request through, record it, or return
 // the data from a request in the recorded file.
 func (r *roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	sent, err := normalizeRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := r.roundTrip(sent)
+	if resp != nil && resp.Request == sent {
+		resp.Request = req
+	}
+	return resp, err
+}
+
+// Passes through, records or replays the request given by RoundTrip().
+func (r *roundTripper) roundTrip(req *http.Request) (*http.Response, error) {
+	chooseAutoMode(req)
 	rec, rep := mode()
 	switch {
+	case rec && rep:
+		return r.cache(req)
 	case rec:
 		return r.record(req)
 	case rep:
 		return r.replay(req)
+	case goldenMode:
+		return r.compareLive(req)
 	default:
+		origin := requestOrigin()
+		err := checkPassThroughAllowed(liveCallDesc(req, origin))
+		if err != nil {
+			return nil, err
+		}
+		noteLiveCall(req, origin)
+		trace("passthrough", req, "passed through")
 		return r.realRoundTripper.RoundTrip(req)
 	}
 }
 
+// Checks a request before it is recorded, replayed or passed through, the way
+// that http.Client and http.Transport do, so that a request built by hand
+// gets a descriptive error rather than failing somewhere inside this library.
+// A nil Header or empty Method are given the defaults that http.Client uses.
+// A request with a body is always copied, since reading the body to record
+// or match it replaces Body and GetBody, and a RoundTripper must leave the
+// caller's request unchanged.
+func normalizeRequest(req *http.Request) (*http.Request, error) {
+	switch {
+	case req == nil:
+		return nil, fmt.Errorf("dvr: nil Request")
+	case req.URL == nil:
+		return nil, fmt.Errorf("dvr: the %s request has a nil URL",
+			req.Method)
+	case req.Header != nil && req.Method != "" && req.Body == nil:
+		return req, nil
+	}
+	r := new(http.Request)
+	*r = *req
+	if r.Header == nil {
+		r.Header = make(http.Header)
+	}
+	if r.Method == "" {
+		r.Method = http.MethodGet
+	}
+	return r, nil
+}
+
 // Interface to match http.Transport's CancelRequest method.
 type httpCancelRequest interface {
 	CancelRequest(*http.Request)
@@ -232,9 +425,52 @@ type RequestResponse struct {
 	ResponseBody      []byte
 	ResponseBodyError error
 
+	// The informational (1xx) responses that the server sent before the
+	// final response, in the order that they were received.
+	Interim []InterimResponse
+
+	// The httptrace events seen while the request was recorded. When
+	// replayed the request's httptrace.ClientTrace hooks are called for them.
+	Trace *RequestTrace
+
 	// This is the error returned from the RountTrip() call.
 	Error error
 
 	// This stores any user data that is necessary for the Matcher() function.
 	UserData interface{}
+
+	// The names of the query parameters whose values were replaced by
+	// ObfuscateQueryParams() when this was recorded. The default Matcher
+	// accepts any value for them.
+	RedactedQueryParams []string
+
+	// The name of the test that recorded this request, see Partition(). This
+	// is empty if the request was not made by a test.
+	Partition string
+
+	// The labels given by -dvr.labels when this request was recorded,
+	// sorted.
+	Labels []string
+
+	// The time this request was recorded, or the zero time if it is not
+	// known.
+	Recorded time.Time
+
+	// How long the request took to return a response, or an error, when it
+	// was recorded. Zero if it is not known.
+	Duration time.Duration
+
+	// Identifies the recording run that made this recording. When a
+	// partition was recorded by more than one run only the recordings from
+	// the latest run are replayed.
+	RunID int64
+
+	// A digest of RequestBody, set in replay mode for recordings and for the
+	// incoming request so that large bodies are not compared byte by byte
+	// against every recording. Empty if it has not been computed.
+	requestBodyDigest string
+
+	// The fingerprint of the matching configuration when this was recorded,
+	// see matchingFingerprint().
+	matching string
 }
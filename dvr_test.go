@@ -17,12 +17,15 @@ package dvr
 import (
 	"bytes"
 	"crypto/md5"
+	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"path/filepath"
 	"sync"
 	"testing"
 	"time"
@@ -247,6 +250,7 @@ func runTests(
 func resetTest(T *testlib.T) {
 	isSetup = sync.Once{}
 	if fd != nil {
+		T.ExpectSuccess(writeEntry(fd, []byte(completeToken)))
 		T.ExpectSuccess(fd.Close())
 		fd = nil
 	}
@@ -254,6 +258,10 @@ func resetTest(T *testlib.T) {
 		T.ExpectSuccess(writerCmd.Wait())
 		writerCmd = nil
 	}
+	if archiveFD != nil {
+		T.ExpectSuccess(archiveFD.Close())
+		archiveFD = nil
+	}
 }
 
 func TestFullCycle(t *testing.T) {
@@ -263,6 +271,7 @@ func TestFullCycle(t *testing.T) {
 		replay = false
 		passThrough = false
 		DefaultReplay = false
+		Obfuscator = nil
 		fileName = "testdata/archive.dvr"
 	}()
 	T := testlib.NewT(t)
@@ -317,45 +326,27 @@ func TestFullCycle(t *testing.T) {
 	replayTripper := &roundTripper{realRoundTripper: OriginalDefaultTransport}
 	T.Equal(runTests(T, replayTripper, addr, "", ""), directResponses)
 
-	// Make sure that a new, completely unknown requests results in a panic
-	// with the right types and such.
+	// A request that matches no recording is sent to the network, unless
+	// -dvr.forbid_record is set, in which case it fails with an error that
+	// names it.
 	var err error
 	req := &http.Request{}
 	req.URL, err = url.Parse(fmt.Sprintf("http://%s/wtf", addr))
 	T.ExpectSuccess(err)
 	req.Header = map[string][]string{"TestHeader": []string{"Value1"}}
-	req.Trailer = map[string][]string{"TestTrailer": []string{"Value2"}}
 	bodyWriter := &bytesBufferCloser{}
 	_, err = bodyWriter.Write(bytes.Repeat([]byte("TEST"), 256))
 	T.ExpectSuccess(err)
 	req.Body = bodyWriter
 	client := &http.Client{}
 	client.Transport = replayTripper
-	func() {
-		defer func() {
-			panicErr := recover()
-			if panicErr == nil {
-				T.Fatalf("An expected panic didn't happen!")
-			} else if err, ok := panicErr.(*dvrFailure); !ok {
-				panic(panicErr)
-			} else {
-				T.ExpectErrorMessage(err, "Matcher didn't match any execeted")
-				T.ExpectErrorMessage(err, "URL: "+req.URL.String())
-				T.ExpectErrorMessage(err, "Method", "GET")
-				T.ExpectErrorMessage(err, "Headers:")
-				T.ExpectErrorMessage(err, "TestHeader: Value1")
-				T.ExpectErrorMessage(err, "Trailers:")
-				T.ExpectErrorMessage(err, "TestTrailer: Value2")
-				T.ExpectErrorMessage(err, "Body:")
-				T.ExpectErrorMessage(err, "TESTTESTTESTTEST")
-				T.ExpectErrorMessage(err, "(content truncated by dvr)")
-			}
-		}()
-		panicOutput = ioutil.Discard
-		resp, err := client.Do(req)
-		T.Fatalf("The previous call should have paniced. It Returned: %#v %#v",
-			resp, err)
-	}()
+	forbidRecord = true
+	resp, err := client.Do(req)
+	forbidRecord = false
+	T.Equal(resp, (*http.Response)(nil))
+	T.ExpectErrorMessage(err, "GET "+req.URL.String())
+	T.ExpectErrorMessage(err, "which matched no recording")
+	T.ExpectErrorMessage(err, "forbidden by -dvr.forbid_record")
 
 	//
 	// Obfuscator
@@ -514,3 +505,143 @@ func TestObfuscator(t *testing.T) {
 	T.Equal(rr.Request.URL.User.String(), "user1")
 	T.Equal(rr.Request.Header.Get("Authorization"), "Basic dXNlcjE6")
 }
+
+func TestRegisterFlags(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+	defer func() {
+		record = false
+		replay = false
+		passThrough = false
+		fileName = "testdata/archive.dvr"
+	}()
+
+	fs := flag.NewFlagSet("custom", flag.ContinueOnError)
+	RegisterFlags(fs)
+	T.ExpectSuccess(fs.Parse([]string{
+		"-dvr.replay", "-dvr.file", "testdata/other.dvr"}))
+	T.Equal(replay, true)
+	T.Equal(record, false)
+	T.Equal(fileName, "testdata/other.dvr")
+	T.NotEqual(fs.Lookup("dvr.passthrough"), nil)
+}
+
+func TestTrace(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+	defer func() {
+		verbose = false
+		traceOutput = os.Stdout
+	}()
+
+	buffer := &bytes.Buffer{}
+	traceOutput = buffer
+	req := &http.Request{
+		Method: "GET",
+		URL:    &url.URL{Scheme: "http", Host: "host", Path: "/path"},
+	}
+
+	// Nothing is written unless verbose is set.
+	trace("replay", req, "matched entry %d", 37)
+	T.Equal(buffer.String(), "")
+
+	verbose = true
+	trace("replay", req, "matched entry %d", 37)
+	T.Equal(buffer.String(),
+		"dvr: replay      GET http://host/path: matched entry 37\n")
+}
+
+func TestCheckModeFlags(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+	defer func() {
+		record = false
+		replay = false
+		passThrough = false
+	}()
+
+	T.ExpectSuccess(checkModeFlags())
+	replay = true
+	T.ExpectSuccess(checkModeFlags())
+	record = true
+	T.ExpectErrorMessage(checkModeFlags(),
+		"-dvr.record and -dvr.replay can not be used together")
+	replay = false
+	passThrough = true
+	T.ExpectErrorMessage(checkModeFlags(),
+		"-dvr.record and -dvr.passthrough can not be used together")
+
+	// Setup fails rather than picking one of the modes.
+	panicOutput = ioutil.Discard
+	func() {
+		defer func() {
+			failure, ok := recover().(*dvrFailure)
+			T.Equal(ok, true)
+			T.ExpectErrorMessage(failure, "only one mode can be chosen")
+		}()
+		(&roundTripper{}).recordSetup()
+	}()
+
+	// As does recording to a directory that doesn't exist.
+	passThrough = false
+	defer func() { fileName = "testdata/archive.dvr" }()
+	fileName = filepath.Join(t.TempDir(), "missing", "archive.dvr")
+	func() {
+		defer func() {
+			failure, ok := recover().(*dvrFailure)
+			T.Equal(ok, true)
+			T.ExpectErrorMessage(failure, "can not write the archive")
+		}()
+		(&roundTripper{}).recordSetup()
+	}()
+}
+
+func TestNormalizeRequest(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+	defer resetBenchmark()
+
+	var sent []*http.Request
+	rt := &roundTripper{realRoundTripper: roundTripperFunc(
+		func(req *http.Request) (*http.Response, error) {
+			sent = append(sent, req)
+			return &http.Response{
+				StatusCode: 200,
+				Header:     http.Header{},
+				Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+			}, nil
+		})}
+
+	// Requests that can not be sent return descriptive errors.
+	_, err := rt.RoundTrip(nil)
+	T.ExpectErrorMessage(err, "dvr: nil Request")
+	_, err = rt.RoundTrip(&http.Request{Method: "POST"})
+	T.ExpectErrorMessage(err, "dvr: the POST request has a nil URL")
+
+	// A request with no Header or Method is recorded with the defaults that
+	// http.Client uses, without changing the caller's request.
+	fileName = T.TempFile().Name()
+	record = true
+	RecordRequest = func(*http.Request) bool { return true }
+	isSetup = sync.Once{}
+	u, err := url.Parse("http://api.example.com/x")
+	T.ExpectSuccess(err)
+	req := &http.Request{URL: u}
+	_, err = rt.RoundTrip(req)
+	T.ExpectSuccess(err)
+	T.ExpectSuccess(Close())
+	T.Equal(req.Method, "")
+	T.Equal(req.Header, http.Header(nil))
+	T.Equal(len(sent), 1)
+	T.Equal(sent[0].Method, "GET")
+	T.Equal(sent[0].Header, http.Header{})
+
+	// It also matches the recording when replayed.
+	record = false
+	replay = true
+	isSetup = sync.Once{}
+	resp, err := rt.RoundTrip(&http.Request{URL: u})
+	T.ExpectSuccess(err)
+	T.Equal(resp.StatusCode, 200)
+	T.Equal(len(sent), 1)
+}
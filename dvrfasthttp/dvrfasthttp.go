@@ -0,0 +1,188 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package dvrfasthttp provides a fasthttp client that records and replays
+// requests using the dvr library. Requests are stored in the same archive as
+// those made with net/http, controlled by the same -dvr.* flags:
+//
+//	client := dvrfasthttp.NewClient(&fasthttp.Client{})
+//	err := client.Do(req, resp)
+//
+// Requests are converted to *http.Request objects before being recorded, so
+// Matcher, the obfuscators and the other dvr hooks see them the same way they
+// see net/http requests.
+package dvrfasthttp
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/orchestrate-io/dvr"
+	"github.com/valyala/fasthttp"
+)
+
+// Doer is implemented by fasthttp.Client, fasthttp.HostClient,
+// fasthttp.PipelineClient and fasthttp.LBClient.
+type Doer interface {
+	Do(req *fasthttp.Request, resp *fasthttp.Response) error
+}
+
+// Client performs requests through a dvr RoundTripper, using the wrapped Doer
+// to make requests that are recorded or passed through.
+type Client struct {
+	doer Doer
+	rt   http.RoundTripper
+}
+
+// Creates a new Client that sends live requests with the given Doer.
+func NewClient(doer Doer) *Client {
+	return &Client{
+		doer: doer,
+		rt:   dvr.NewRoundTripper(&transport{doer: doer}),
+	}
+}
+
+// Performs the given request, filling in resp. This has the same semantics
+// as fasthttp.Client.Do().
+func (c *Client) Do(req *fasthttp.Request, resp *fasthttp.Response) error {
+	dvr.ProbeAutoMode(req.URI().String())
+	if dvr.IsPassingThrough() {
+		return c.doer.Do(req, resp)
+	}
+
+	hreq, err := httpRequest(req)
+	if err != nil {
+		return err
+	}
+	hresp, err := c.rt.RoundTrip(hreq)
+	if err != nil {
+		return err
+	}
+	defer hresp.Body.Close()
+	body, err := ioutil.ReadAll(hresp.Body)
+	if err != nil {
+		return err
+	}
+
+	resp.Reset()
+	resp.SetStatusCode(hresp.StatusCode)
+	for name, values := range hresp.Header {
+		if skipHeader(name) {
+			continue
+		}
+		for _, value := range values {
+			resp.Header.Add(name, value)
+		}
+	}
+	resp.SetBody(body)
+	return nil
+}
+
+// Headers that fasthttp manages itself based on the body.
+func skipHeader(name string) bool {
+	return name == "Content-Length" || name == "Transfer-Encoding"
+}
+
+// Converts a fasthttp request into a *http.Request.
+func httpRequest(req *fasthttp.Request) (*http.Request, error) {
+	u, err := url.Parse(string(req.URI().FullURI()))
+	if err != nil {
+		return nil, err
+	}
+	body := append([]byte(nil), req.Body()...)
+	hreq := &http.Request{
+		Method:        string(req.Header.Method()),
+		URL:           u,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{},
+		Host:          string(req.Host()),
+		ContentLength: int64(len(body)),
+	}
+	if len(body) > 0 {
+		hreq.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	req.Header.VisitAll(func(key, value []byte) {
+		name := http.CanonicalHeaderKey(string(key))
+		if name != "Host" && !skipHeader(name) {
+			hreq.Header.Add(name, string(value))
+		}
+	})
+	return hreq, nil
+}
+
+// The RoundTripper used for requests that are recorded or passed through.
+// It converts the request back and sends it with the Doer.
+type transport struct {
+	doer Doer
+}
+
+// http.RoundTripper
+func (t *transport) RoundTrip(hreq *http.Request) (*http.Response, error) {
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(resp)
+
+	req.SetRequestURI(hreq.URL.String())
+	req.Header.SetMethod(hreq.Method)
+	if hreq.Host != "" {
+		req.Header.SetHost(hreq.Host)
+	}
+	for name, values := range hreq.Header {
+		for _, value := range values {
+			req.Header.Add(name, value)
+		}
+	}
+	if hreq.Body != nil {
+		body, err := ioutil.ReadAll(hreq.Body)
+		if err != nil {
+			return nil, err
+		}
+		req.SetBody(body)
+	}
+
+	if err := t.doer.Do(req, resp); err != nil {
+		return nil, err
+	}
+
+	body := append([]byte(nil), resp.Body()...)
+	message := string(resp.Header.StatusMessage())
+	if message == "" {
+		message = http.StatusText(resp.StatusCode())
+	}
+	status := strconv.Itoa(resp.StatusCode()) + " " + message
+	hresp := &http.Response{
+		Status:        status,
+		StatusCode:    resp.StatusCode(),
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{},
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       hreq,
+	}
+	resp.Header.VisitAll(func(key, value []byte) {
+		name := http.CanonicalHeaderKey(string(key))
+		if !skipHeader(name) {
+			hresp.Header.Add(name, string(value))
+		}
+	})
+	return hresp, nil
+}
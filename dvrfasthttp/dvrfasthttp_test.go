@@ -0,0 +1,102 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvrfasthttp
+
+import (
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/liquidgecka/testlib"
+	"github.com/valyala/fasthttp"
+)
+
+// A Doer that answers every request itself.
+type doerFunc func(req *fasthttp.Request, resp *fasthttp.Response) error
+
+func (f doerFunc) Do(req *fasthttp.Request, resp *fasthttp.Response) error {
+	return f(req, resp)
+}
+
+func TestHTTPRequest(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+	req.SetRequestURI("https://api.example.com/items?a=1")
+	req.Header.SetMethod("POST")
+	req.Header.Set("X-Key", "abc")
+	req.SetBodyString("hello")
+
+	hreq, err := httpRequest(req)
+	T.ExpectSuccess(err)
+	T.Equal(hreq.Method, "POST")
+	T.Equal(hreq.URL.String(), "https://api.example.com/items?a=1")
+	T.Equal(hreq.Host, "api.example.com")
+	T.Equal(hreq.Header.Get("X-Key"), "abc")
+	T.Equal(hreq.Header.Get("Host"), "")
+	T.Equal(hreq.Header.Get("Content-Length"), "")
+	T.Equal(hreq.ContentLength, int64(5))
+	body, err := ioutil.ReadAll(hreq.Body)
+	T.ExpectSuccess(err)
+	T.Equal(string(body), "hello")
+}
+
+func TestTransport(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	tr := &transport{doer: doerFunc(
+		func(req *fasthttp.Request, resp *fasthttp.Response) error {
+			resp.SetStatusCode(201)
+			resp.Header.Set("X-Echo", string(req.Header.Peek("X-Key")))
+			resp.SetBodyString(string(req.Header.Method()) + " " +
+				string(req.URI().FullURI()) + " " + string(req.Body()))
+			return nil
+		})}
+
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+	req.SetRequestURI("http://api.example.com/items")
+	req.Header.SetMethod("PUT")
+	req.Header.Set("X-Key", "abc")
+	req.SetBodyString("hello")
+	hreq, err := httpRequest(req)
+	T.ExpectSuccess(err)
+
+	hresp, err := tr.RoundTrip(hreq)
+	T.ExpectSuccess(err)
+	T.Equal(hresp.StatusCode, 201)
+	T.Equal(hresp.Status, "201 Created")
+	T.Equal(hresp.Header.Get("X-Echo"), "abc")
+	T.Equal(hresp.Header.Get("Content-Length"), "")
+	body, err := ioutil.ReadAll(hresp.Body)
+	T.ExpectSuccess(err)
+	T.Equal(string(body), "PUT http://api.example.com/items hello")
+	T.Equal(hresp.ContentLength, int64(len(body)))
+	T.Equal(hresp.Request, hreq)
+
+	// Passing through uses the Doer directly.
+	client := NewClient(doerFunc(
+		func(req *fasthttp.Request, resp *fasthttp.Response) error {
+			resp.SetStatusCode(http.StatusTeapot)
+			return nil
+		}))
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(resp)
+	T.ExpectSuccess(client.Do(req, resp))
+	T.Equal(resp.StatusCode(), http.StatusTeapot)
+}
@@ -0,0 +1,124 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package dvrgcs stores dvr archives in Google Cloud Storage. Importing this
+// package registers a dvr.ArchiveStore for "gs" URLs so that the archive can
+// be named with -dvr.file=gs://bucket/object. Credentials are found using
+// Application Default Credentials.
+//
+// See dvr.ArchiveStore for details on caching and uploading recordings.
+package dvrgcs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/storage"
+	"github.com/orchestrate-io/dvr"
+)
+
+// Register the store for gs:// archives.
+func init() {
+	dvr.RegisterArchiveStore("gs", &Store{})
+}
+
+// Store is a dvr.ArchiveStore for gs://bucket/object URLs. The version of an
+// archive is its generation number. A Store with a custom client can be used
+// by registering it in place of the default one:
+//
+//	dvr.RegisterArchiveStore("gs", &dvrgcs.Store{Client: client})
+type Store struct {
+	// The client used to talk to GCS. If this is nil then a client using
+	// Application Default Credentials is created.
+	Client *storage.Client
+
+	once sync.Once
+	err  error
+}
+
+// Returns the handle of the object named by the URL, creating the default
+// client if necessary.
+func (s *Store) object(ctx context.Context, u *url.URL) (*storage.ObjectHandle, error) {
+	s.once.Do(func() {
+		if s.Client == nil {
+			s.Client, s.err = storage.NewClient(ctx)
+		}
+	})
+	if s.err != nil {
+		return nil, s.err
+	}
+	return s.Client.Bucket(u.Host).Object(strings.TrimPrefix(u.Path, "/")), nil
+}
+
+// Converts the error GCS returns for missing objects into an error that wraps
+// os.ErrNotExist.
+func notExist(u *url.URL, err error) error {
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return fmt.Errorf("%s: %w", u, os.ErrNotExist)
+	}
+	return err
+}
+
+// dvr.ArchiveStore
+func (s *Store) Version(ctx context.Context, u *url.URL) (string, error) {
+	obj, err := s.object(ctx, u)
+	if err != nil {
+		return "", err
+	}
+	attrs, err := obj.Attrs(ctx)
+	if err != nil {
+		return "", notExist(u, err)
+	}
+	return strconv.FormatInt(attrs.Generation, 10), nil
+}
+
+// dvr.ArchiveStore
+func (s *Store) Download(
+	ctx context.Context, u *url.URL, w io.Writer,
+) (string, error) {
+	obj, err := s.object(ctx, u)
+	if err != nil {
+		return "", err
+	}
+	reader, err := obj.NewReader(ctx)
+	if err != nil {
+		return "", notExist(u, err)
+	}
+	defer reader.Close()
+	if _, err := io.Copy(w, reader); err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(reader.Attrs.Generation, 10), nil
+}
+
+// dvr.ArchiveStore
+func (s *Store) Upload(ctx context.Context, u *url.URL, r io.Reader) error {
+	obj, err := s.object(ctx, u)
+	if err != nil {
+		return err
+	}
+	writer := obj.NewWriter(ctx)
+	if _, err := io.Copy(writer, r); err != nil {
+		writer.Close()
+		return err
+	}
+	return writer.Close()
+}
@@ -0,0 +1,39 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvrgcs
+
+import (
+	"errors"
+	"net/url"
+	"os"
+	"testing"
+
+	"cloud.google.com/go/storage"
+	"github.com/liquidgecka/testlib"
+)
+
+func TestNotExist(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	u, err := url.Parse("gs://bucket/archive.dvr")
+	T.ExpectSuccess(err)
+	err = notExist(u, storage.ErrObjectNotExist)
+	T.Equal(errors.Is(err, os.ErrNotExist), true)
+	T.ExpectErrorMessage(err, "gs://bucket/archive.dvr: file does not exist")
+
+	other := errors.New("other")
+	T.Equal(notExist(u, other), other)
+}
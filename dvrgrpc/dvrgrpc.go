@@ -0,0 +1,470 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package dvrgrpc provides gRPC client interceptors that record and replay
+// calls using the dvr library. Calls are stored in the same archive as HTTP
+// requests, controlled by the same -dvr.* flags, so a test can mix gRPC and
+// HTTP calls freely:
+//
+//	conn, err := grpc.Dial(addr,
+//		grpc.WithUnaryInterceptor(dvrgrpc.UnaryClientInterceptor()),
+//		grpc.WithStreamInterceptor(dvrgrpc.StreamClientInterceptor()))
+//
+// Each call is stored as a request to "grpc:///<full method name>" whose body
+// is the deterministically marshaled request message, so the default Matcher
+// matches calls on the method and request message. Outgoing metadata is not
+// recorded, but the header and trailer metadata sent by the server are, and
+// are returned through the grpc.Header() and grpc.Trailer() call options and
+// the Header() and Trailer() methods of streams. The status of failed calls
+// is preserved, including its details.
+//
+// Streams are recorded as a whole: the messages sent by the client are
+// buffered until the first call to RecvMsg() and then the entire stream is
+// run, with the received messages being returned one at a time. Header()
+// and Trailer() return nothing until RecvMsg() has been called. This works
+// for server streaming and client streaming calls, and for bidirectional
+// streams where the client sends everything before receiving. Streams that
+// interleave sends and receives, or that never end, can only be used in pass
+// through mode.
+package dvrgrpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/orchestrate-io/dvr"
+	spb "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// The headers used to store the status of a failed call in the recorded
+// response.
+const (
+	statusHeader        = "Grpc-Status"
+	statusMessageHeader = "Grpc-Message"
+	statusDetailsHeader = "Grpc-Status-Details-Bin"
+)
+
+// Returns the host:port that -dvr.auto probes for a connection to target,
+// which may name a resolver scheme such as "dns:///host:port". grpc uses port
+// 443 when none is given.
+func targetAddr(target string) string {
+	if i := strings.Index(target, ":///"); i >= 0 {
+		target = target[i+len(":///"):]
+	}
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		target = net.JoinHostPort(target, "443")
+	}
+	return target
+}
+
+// Returns a grpc.UnaryClientInterceptor that records and replays unary calls.
+func UnaryClientInterceptor() grpc.UnaryClientInterceptor {
+	return func(
+		ctx context.Context, method string, req, reply interface{},
+		cc *grpc.ClientConn, invoker grpc.UnaryInvoker,
+		opts ...grpc.CallOption,
+	) error {
+		dvr.ProbeAutoMode(targetAddr(cc.Target()))
+		if dvr.IsPassingThrough() {
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}
+
+		body, err := marshal(req)
+		if err != nil {
+			return err
+		}
+		replyMsg, ok := reply.(proto.Message)
+		if !ok {
+			return fmt.Errorf("dvrgrpc: %T is not a proto.Message", reply)
+		}
+
+		// The fallback performs the real call and converts its results into
+		// a response that can be recorded.
+		fallback := roundTripperFunc(func(*http.Request) (*http.Response, error) {
+			var md callMetadata
+			err := invoker(ctx, method, req, reply, cc, append(opts,
+				grpc.Header(&md.header), grpc.Trailer(&md.trailer))...)
+			if err != nil {
+				return newResponse(nil, md, err), nil
+			}
+			data, err := marshal(reply)
+			if err != nil {
+				return nil, err
+			}
+			return newResponse(data, md, nil), nil
+		})
+
+		data, md, err := roundTrip(ctx, fallback, method, body)
+		setCallMetadata(opts, md)
+		if err != nil {
+			return err
+		}
+		return proto.Unmarshal(data, replyMsg)
+	}
+}
+
+// Returns a grpc.StreamClientInterceptor that records and replays streaming
+// calls. See the package documentation for the limitations on streams.
+func StreamClientInterceptor() grpc.StreamClientInterceptor {
+	return func(
+		ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn,
+		method string, streamer grpc.Streamer, opts ...grpc.CallOption,
+	) (grpc.ClientStream, error) {
+		dvr.ProbeAutoMode(targetAddr(cc.Target()))
+		if dvr.IsPassingThrough() {
+			return streamer(ctx, desc, cc, method, opts...)
+		}
+		return &clientStream{
+			ctx: ctx,
+			open: func() (grpc.ClientStream, error) {
+				return streamer(ctx, desc, cc, method, opts...)
+			},
+			method: method,
+		}, nil
+	}
+}
+
+// A grpc.ClientStream that buffers sent messages and then replays (or runs
+// and records) the whole stream.
+type clientStream struct {
+	ctx    context.Context
+	open   func() (grpc.ClientStream, error)
+	method string
+
+	// The messages sent by the client, which are sent on to a real stream
+	// as they are, and the same messages framed for matching.
+	sent       []proto.Message
+	sentFrames bytes.Buffer
+
+	// Set once the stream has been run. received holds the framed messages
+	// that have not been returned from RecvMsg() yet and err is returned
+	// once they are exhausted. md holds the metadata that the server sent.
+	done     bool
+	received *bytes.Reader
+	err      error
+	md       callMetadata
+}
+
+// grpc.ClientStream
+func (c *clientStream) Header() (metadata.MD, error) {
+	return c.md.header, nil
+}
+
+// grpc.ClientStream
+func (c *clientStream) Trailer() metadata.MD {
+	return c.md.trailer
+}
+
+// grpc.ClientStream
+func (c *clientStream) CloseSend() error {
+	return nil
+}
+
+// grpc.ClientStream
+func (c *clientStream) Context() context.Context {
+	return c.ctx
+}
+
+// grpc.ClientStream
+func (c *clientStream) SendMsg(m interface{}) error {
+	if c.done {
+		return fmt.Errorf("dvrgrpc: SendMsg called after RecvMsg on %s",
+			c.method)
+	}
+	data, err := marshal(m)
+	if err != nil {
+		return err
+	}
+	writeFrame(&c.sentFrames, data)
+
+	// The message is copied since the caller is free to change it once
+	// this returns.
+	c.sent = append(c.sent, proto.Clone(m.(proto.Message)))
+	return nil
+}
+
+// grpc.ClientStream
+func (c *clientStream) RecvMsg(m interface{}) error {
+	msg, ok := m.(proto.Message)
+	if !ok {
+		return fmt.Errorf("dvrgrpc: %T is not a proto.Message", m)
+	}
+	if !c.done {
+		c.done = true
+		c.run(msg)
+	}
+	data, err := readFrame(c.received)
+	if err == io.EOF {
+		if c.err != nil {
+			return c.err
+		}
+		return io.EOF
+	} else if err != nil {
+		return err
+	}
+	return proto.Unmarshal(data, msg)
+}
+
+// Records or replays the stream. The prototype is the type of message
+// passed to RecvMsg(), which is used to create the messages received from a
+// real stream.
+func (c *clientStream) run(prototype proto.Message) {
+	fallback := roundTripperFunc(func(*http.Request) (*http.Response, error) {
+		stream, err := c.open()
+		if err != nil {
+			return newResponse(nil, callMetadata{}, err), nil
+		}
+		for _, msg := range c.sent {
+			if err := stream.SendMsg(msg); err != nil {
+				break
+			}
+		}
+		if err := stream.CloseSend(); err != nil {
+			return newResponse(nil, callMetadata{}, err), nil
+		}
+
+		// Receive everything, keeping the error that ended the stream. The
+		// header is ready once a message or error has been received, and
+		// the trailer once the stream has ended.
+		received := &bytes.Buffer{}
+		for {
+			msg := prototype.ProtoReflect().New().Interface()
+			err := stream.RecvMsg(msg)
+			if err != nil {
+				md := callMetadata{trailer: stream.Trailer()}
+				md.header, _ = stream.Header()
+				if err == io.EOF {
+					err = nil
+				}
+				return newResponse(received.Bytes(), md, err), nil
+			}
+			data, err := marshal(msg)
+			if err != nil {
+				return nil, err
+			}
+			writeFrame(received, data)
+		}
+	})
+
+	data, md, err := roundTrip(c.ctx, fallback, c.method,
+		c.sentFrames.Bytes())
+	c.received = bytes.NewReader(data)
+	c.err = err
+	c.md = md
+}
+
+//
+// Helpers
+//
+
+// Adapts a function to the http.RoundTripper interface.
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+// http.RoundTripper
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// The header and trailer metadata that the server sent with a call.
+type callMetadata struct {
+	header  metadata.MD
+	trailer metadata.MD
+}
+
+// Fills in the metadata asked for with grpc.Header() and grpc.Trailer() call
+// options, as the real call would have.
+func setCallMetadata(opts []grpc.CallOption, md callMetadata) {
+	for _, opt := range opts {
+		switch o := opt.(type) {
+		case grpc.HeaderCallOption:
+			*o.HeaderAddr = md.header
+		case grpc.TrailerCallOption:
+			*o.TrailerAddr = md.trailer
+		}
+	}
+}
+
+// Sends a call through a dvr RoundTripper, returning the response body and
+// metadata, and the error status that was recorded.
+func roundTrip(
+	ctx context.Context, fallback http.RoundTripper, method string,
+	body []byte,
+) ([]byte, callMetadata, error) {
+	u, err := url.Parse("grpc:///" + method)
+	if err != nil {
+		return nil, callMetadata{}, err
+	}
+	req := (&http.Request{
+		Method:        "POST",
+		URL:           u,
+		Proto:         "HTTP/2.0",
+		ProtoMajor:    2,
+		ContentLength: int64(len(body)),
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+	}).WithContext(ctx)
+
+	resp, err := dvr.NewRoundTripper(fallback).RoundTrip(req)
+	if err != nil {
+		return nil, callMetadata{}, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, callMetadata{}, err
+	}
+	md := callMetadata{
+		header:  headerMetadata(resp.Header),
+		trailer: headerMetadata(resp.Trailer),
+	}
+	return data, md, responseError(resp)
+}
+
+// Builds the response that is recorded for a call. The metadata is stored in
+// the headers and trailers, as it is sent over HTTP/2, and if err is not nil
+// then its status is stored in the headers as well.
+func newResponse(body []byte, md callMetadata, err error) *http.Response {
+	resp := &http.Response{
+		Status:        "200 OK",
+		StatusCode:    200,
+		Proto:         "HTTP/2.0",
+		ProtoMajor:    2,
+		Header:        metadataHeader(md.header),
+		Trailer:       metadataHeader(md.trailer),
+		ContentLength: int64(len(body)),
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+	}
+	if err != nil {
+		s := status.Convert(err)
+		resp.Header.Set(statusHeader, strconv.Itoa(int(s.Code())))
+		resp.Header.Set(statusMessageHeader, s.Message())
+		if len(s.Details()) > 0 {
+			if data, err := proto.Marshal(s.Proto()); err == nil {
+				resp.Header.Set(statusDetailsHeader,
+					base64.StdEncoding.EncodeToString(data))
+			}
+		}
+	}
+	return resp
+}
+
+// Returns the status error stored in the response headers, if any.
+func responseError(resp *http.Response) error {
+	code := resp.Header.Get(statusHeader)
+	if code == "" {
+		return nil
+	}
+	if details := resp.Header.Get(statusDetailsHeader); details != "" {
+		data, err := base64.StdEncoding.DecodeString(details)
+		if err == nil {
+			s := new(spb.Status)
+			if proto.Unmarshal(data, s) == nil {
+				return status.ErrorProto(s)
+			}
+		}
+	}
+	c, err := strconv.Atoi(code)
+	if err != nil {
+		c = int(codes.Unknown)
+	}
+	return status.Error(codes.Code(c), resp.Header.Get(statusMessageHeader))
+}
+
+// Stores metadata as HTTP headers, base64 encoding the values of binary keys
+// the way that gRPC does.
+func metadataHeader(md metadata.MD) http.Header {
+	h := http.Header{}
+	for key, values := range md {
+		for _, v := range values {
+			if strings.HasSuffix(key, "-bin") {
+				v = base64.StdEncoding.EncodeToString([]byte(v))
+			}
+			h.Add(key, v)
+		}
+	}
+	return h
+}
+
+// Returns the metadata stored by metadataHeader(). Keys starting with
+// "grpc-" are reserved by gRPC, which keeps the call status headers out of
+// the metadata.
+func headerMetadata(h http.Header) metadata.MD {
+	md := metadata.MD{}
+	for key, values := range h {
+		key = strings.ToLower(key)
+		if strings.HasPrefix(key, "grpc-") {
+			continue
+		}
+		for _, v := range values {
+			if strings.HasSuffix(key, "-bin") {
+				data, err := base64.StdEncoding.DecodeString(v)
+				if err != nil {
+					continue
+				}
+				v = string(data)
+			}
+			md.Append(key, v)
+		}
+	}
+	return md
+}
+
+// Deterministically marshals a message so that identical messages always
+// produce identical request bodies for matching.
+func marshal(m interface{}) ([]byte, error) {
+	msg, ok := m.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("dvrgrpc: %T is not a proto.Message", m)
+	}
+	return proto.MarshalOptions{Deterministic: true}.Marshal(msg)
+}
+
+// Writes a length prefixed message.
+func writeFrame(w *bytes.Buffer, data []byte) {
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(data)))
+	w.Write(size[:])
+	w.Write(data)
+}
+
+// Reads a length prefixed message, returning io.EOF when there are none
+// left.
+func readFrame(r *bytes.Reader) ([]byte, error) {
+	var size uint32
+	if err := binary.Read(r, binary.BigEndian, &size); err == io.EOF {
+		return nil, io.EOF
+	} else if err != nil {
+		return nil, err
+	}
+	if int64(size) > int64(r.Len()) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	data := make([]byte, size)
+	_, err := io.ReadFull(r, data)
+	return data, err
+}
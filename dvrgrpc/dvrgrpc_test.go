@@ -0,0 +1,261 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvrgrpc
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/liquidgecka/testlib"
+	"github.com/orchestrate-io/dvr"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// Set when the test binary is run by TestInterceptors to record the calls.
+const recordEnv = "DVRGRPC_TEST_RECORD"
+
+// A record run has to close the archive once the tests have finished.
+func TestMain(m *testing.M) {
+	flag.Parse()
+	code := m.Run()
+	if err := dvr.Close(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		code = 1
+	}
+	os.Exit(code)
+}
+
+func TestFrames(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	buffer := &bytes.Buffer{}
+	writeFrame(buffer, []byte("first"))
+	writeFrame(buffer, []byte{})
+	writeFrame(buffer, []byte("third"))
+
+	r := bytes.NewReader(buffer.Bytes())
+	for _, expected := range []string{"first", "", "third"} {
+		data, err := readFrame(r)
+		T.ExpectSuccess(err)
+		T.Equal(string(data), expected)
+	}
+	_, err := readFrame(r)
+	T.Equal(err, io.EOF)
+
+	// A truncated frame.
+	_, err = readFrame(bytes.NewReader([]byte{0, 0, 0, 9, 'a'}))
+	T.Equal(err, io.ErrUnexpectedEOF)
+}
+
+func TestResponseStatus(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	// Test 1: Success has no error.
+	T.ExpectSuccess(responseError(newResponse([]byte("x"), callMetadata{},
+		nil)))
+
+	// Test 2: Code and message are preserved.
+	err := responseError(newResponse(nil, callMetadata{},
+		status.Error(codes.NotFound, "missing")))
+	T.Equal(status.Code(err), codes.NotFound)
+	T.Equal(status.Convert(err).Message(), "missing")
+
+	// Test 3: Details are preserved.
+	s, err := status.New(codes.InvalidArgument, "bad").WithDetails(
+		&errdetails.BadRequest{
+			FieldViolations: []*errdetails.BadRequest_FieldViolation{
+				{Field: "name", Description: "required"},
+			},
+		})
+	T.ExpectSuccess(err)
+	err = responseError(newResponse(nil, callMetadata{}, s.Err()))
+	T.Equal(status.Code(err), codes.InvalidArgument)
+	details := status.Convert(err).Details()
+	T.Equal(len(details), 1)
+	br, ok := details[0].(*errdetails.BadRequest)
+	T.Equal(ok, true)
+	T.Equal(br.FieldViolations[0].Field, "name")
+}
+
+// A service with a unary and a bidirectional streaming method. Both take
+// strings and reply with their lengths, so the request and response messages
+// have incompatible types in field 1.
+var lengthService = grpc.ServiceDesc{
+	ServiceName: "dvrgrpc.Length",
+	HandlerType: (*interface{})(nil),
+	Methods: []grpc.MethodDesc{{
+		MethodName: "Length",
+		Handler: func(
+			srv interface{}, ctx context.Context, dec func(interface{}) error,
+			_ grpc.UnaryServerInterceptor,
+		) (interface{}, error) {
+			req := new(wrapperspb.StringValue)
+			if err := dec(req); err != nil {
+				return nil, err
+			}
+			grpc.SetHeader(ctx, metadata.Pairs("x-header", "unary"))
+			grpc.SetTrailer(ctx, metadata.Pairs("x-trailer-bin", "\x00\x01"))
+			if req.Value == "" {
+				return nil, status.Error(codes.InvalidArgument, "empty")
+			}
+			return wrapperspb.Int64(int64(len(req.Value))), nil
+		},
+	}},
+	Streams: []grpc.StreamDesc{{
+		StreamName:    "Lengths",
+		ServerStreams: true,
+		ClientStreams: true,
+		Handler: func(srv interface{}, stream grpc.ServerStream) error {
+			stream.SetHeader(metadata.Pairs("x-header", "stream"))
+			stream.SetTrailer(metadata.Pairs("x-trailer", "done"))
+			for {
+				req := new(wrapperspb.StringValue)
+				if err := stream.RecvMsg(req); err == io.EOF {
+					return nil
+				} else if err != nil {
+					return err
+				}
+				reply := wrapperspb.Int64(int64(len(req.Value)))
+				if err := stream.SendMsg(reply); err != nil {
+					return err
+				}
+			}
+		},
+	}},
+}
+
+// Checks that every message sent on a stream is a request, as an
+// interceptor inside dvrgrpc's might.
+func requestsOnly(
+	ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn,
+	method string, streamer grpc.Streamer, opts ...grpc.CallOption,
+) (grpc.ClientStream, error) {
+	stream, err := streamer(ctx, desc, cc, method, opts...)
+	return &checkedStream{stream}, err
+}
+
+type checkedStream struct {
+	grpc.ClientStream
+}
+
+func (c *checkedStream) SendMsg(m interface{}) error {
+	if _, ok := m.(*wrapperspb.StringValue); !ok {
+		return fmt.Errorf("sent a %T", m)
+	}
+	return c.ClientStream.SendMsg(m)
+}
+
+func TestInterceptors(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	// The calls are recorded by running this test in another process, since
+	// a process can only record or replay once.
+	dial := func(context.Context, string) (net.Conn, error) {
+		return nil, fmt.Errorf("the server is not running")
+	}
+	if os.Getenv(recordEnv) != "" {
+		dvr.RecordRequest = func(*http.Request) bool { return true }
+		listener := bufconn.Listen(1 << 20)
+		server := grpc.NewServer()
+		server.RegisterService(&lengthService, nil)
+		go server.Serve(listener)
+		defer server.Stop()
+		dial = func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}
+	} else {
+		path := filepath.Join(T.TempDir(), "archive.dvr")
+		cmd := exec.Command(os.Args[0], "-test.run=^TestInterceptors$",
+			"-dvr.record", "-dvr.file="+path)
+		cmd.Env = append(os.Environ(), recordEnv+"=1")
+		output, err := cmd.CombinedOutput()
+		T.ExpectSuccess(err, string(output))
+
+		T.ExpectSuccess(flag.Set("dvr.replay", "true"))
+		T.ExpectSuccess(flag.Set("dvr.file", path))
+		defer flag.Set("dvr.replay", "false")
+		T.Equal(dvr.IsReplay(), true)
+	}
+
+	conn, err := grpc.NewClient("passthrough:///length",
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithContextDialer(dial),
+		grpc.WithUnaryInterceptor(UnaryClientInterceptor()),
+		grpc.WithChainStreamInterceptor(StreamClientInterceptor(),
+			requestsOnly))
+	T.ExpectSuccess(err)
+	defer conn.Close()
+	ctx := context.Background()
+
+	// A unary call returns the reply and the metadata.
+	reply := new(wrapperspb.Int64Value)
+	var header, trailer metadata.MD
+	err = conn.Invoke(ctx, "/dvrgrpc.Length/Length",
+		wrapperspb.String("four"), reply, grpc.Header(&header),
+		grpc.Trailer(&trailer))
+	T.ExpectSuccess(err)
+	T.Equal(reply.Value, int64(4))
+	T.Equal(header.Get("x-header"), []string{"unary"})
+	T.Equal(trailer.Get("x-trailer-bin"), []string{"\x00\x01"})
+
+	// As does a failed one, along with its status.
+	err = conn.Invoke(ctx, "/dvrgrpc.Length/Length",
+		wrapperspb.String(""), reply, grpc.Header(&header))
+	T.Equal(status.Code(err), codes.InvalidArgument)
+	T.Equal(header.Get("x-header"), []string{"unary"})
+
+	// A stream sends the requests as they are, and returns every reply.
+	stream, err := conn.NewStream(ctx, &lengthService.Streams[0],
+		"/dvrgrpc.Length/Lengths")
+	T.ExpectSuccess(err)
+	for _, value := range []string{"a", "bb", "ccc"} {
+		T.ExpectSuccess(stream.SendMsg(wrapperspb.String(value)))
+	}
+	T.ExpectSuccess(stream.CloseSend())
+	var lengths []int64
+	for {
+		reply := new(wrapperspb.Int64Value)
+		if err := stream.RecvMsg(reply); err == io.EOF {
+			break
+		} else {
+			T.ExpectSuccess(err)
+		}
+		lengths = append(lengths, reply.Value)
+	}
+	T.Equal(lengths, []int64{1, 2, 3})
+	header, err = stream.Header()
+	T.ExpectSuccess(err)
+	T.Equal(header.Get("x-header"), []string{"stream"})
+	T.Equal(stream.Trailer().Get("x-trailer"), []string{"done"})
+}
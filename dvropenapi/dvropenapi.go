@@ -0,0 +1,130 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package dvropenapi checks replayed traffic against an OpenAPI 3 document.
+// Every request that matches a recording, and the response that is replayed
+// for it, are validated against the operation in the document so that tests
+// fail when fixtures drift out of contract:
+//
+//	func TestClient(t *testing.T) {
+//		dvropenapi.Validate(t, "testdata/openapi.yaml")
+//		...
+//	}
+//
+// Requests to URLs that are not described by the document are ignored, which
+// allows tests to call several services.
+package dvropenapi
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/getkin/kin-openapi/routers/gorillamux"
+	"github.com/orchestrate-io/dvr"
+)
+
+// Returns a validator for dvr.AddReplayValidator() that checks requests and
+// responses against the OpenAPI document at the given path. Requests whose
+// URL does not match any of the document's servers and paths are ignored.
+func NewValidator(specPath string) (func(*dvr.RequestResponse) error, error) {
+	loader := openapi3.NewLoader()
+	doc, err := loader.LoadFromFile(specPath)
+	if err != nil {
+		return nil, err
+	} else if err := doc.Validate(loader.Context); err != nil {
+		return nil, err
+	}
+	router, err := gorillamux.NewRouter(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(rr *dvr.RequestResponse) error {
+		return validate(router, rr)
+	}, nil
+}
+
+// Validates replayed traffic against the OpenAPI document at the given path
+// until the test completes. Violations are reported as test errors. The test
+// is failed immediately if the document can not be loaded.
+func Validate(t testing.TB, specPath string) {
+	t.Helper()
+	f, err := NewValidator(specPath)
+	if err != nil {
+		t.Fatalf("dvropenapi: loading %s: %s", specPath, err)
+	}
+	remove := dvr.AddReplayValidator(func(rr *dvr.RequestResponse) error {
+		if err := f(rr); err != nil {
+			t.Errorf("dvropenapi: %s %s does not conform to %s: %s",
+				rr.Request.Method, rr.Request.URL, specPath, err)
+		}
+		return nil
+	})
+	t.Cleanup(remove)
+}
+
+// Checks a single request and response.
+func validate(router routers.Router, rr *dvr.RequestResponse) error {
+	ctx := context.Background()
+
+	// The validator reads the body so it is given a copy of the request.
+	req := rr.Request.Clone(ctx)
+	req.Body = ioutil.NopCloser(bytes.NewReader(rr.RequestBody))
+
+	route, pathParams, err := router.FindRoute(req)
+	if err == routers.ErrPathNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	input := &openapi3filter.RequestValidationInput{
+		Request:    req,
+		PathParams: pathParams,
+		Route:      route,
+		Options: &openapi3filter.Options{
+			AuthenticationFunc: openapi3filter.NoopAuthenticationFunc,
+		},
+	}
+	if err := openapi3filter.ValidateRequest(ctx, input); err != nil {
+		return fmt.Errorf("request: %s", err)
+	}
+
+	// Responses are only validated if one was recorded.
+	if rr.Response == nil {
+		return nil
+	}
+	header := rr.Response.Header
+	if header == nil {
+		header = http.Header{}
+	}
+	responseInput := &openapi3filter.ResponseValidationInput{
+		RequestValidationInput: input,
+		Status:                 rr.Response.StatusCode,
+		Header:                 header,
+		Body:                   ioutil.NopCloser(bytes.NewReader(rr.ResponseBody)),
+		Options:                input.Options,
+	}
+	if err := openapi3filter.ValidateResponse(ctx, responseInput); err != nil {
+		return fmt.Errorf("response: %s", err)
+	}
+	return nil
+}
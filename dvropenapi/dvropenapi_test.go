@@ -0,0 +1,94 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvropenapi
+
+import (
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/liquidgecka/testlib"
+	"github.com/orchestrate-io/dvr"
+)
+
+const spec = `{
+	"openapi": "3.0.0",
+	"info": {"title": "items", "version": "1"},
+	"servers": [{"url": "https://api.example.com"}],
+	"paths": {
+		"/items/{id}": {
+			"get": {
+				"parameters": [{
+					"name": "id", "in": "path", "required": true,
+					"schema": {"type": "integer"}
+				}],
+				"responses": {
+					"200": {
+						"description": "an item",
+						"content": {"application/json": {"schema": {
+							"type": "object",
+							"required": ["id"],
+							"properties": {"id": {"type": "integer"}}
+						}}}
+					}
+				}
+			}
+		}
+	}
+}`
+
+func TestNewValidator(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	fd := T.TempFile()
+	_, err := fd.WriteString(spec)
+	T.ExpectSuccess(err)
+	T.ExpectSuccess(fd.Close())
+	f, err := NewValidator(fd.Name())
+	T.ExpectSuccess(err)
+
+	newRR := func(url, body string) *dvr.RequestResponse {
+		req, err := http.NewRequest("GET", url, nil)
+		T.ExpectSuccess(err)
+		return &dvr.RequestResponse{
+			Request: req,
+			Response: &http.Response{
+				StatusCode: 200,
+				Header: http.Header{
+					"Content-Type": {"application/json"}},
+			},
+			ResponseBody: []byte(body),
+		}
+	}
+
+	// Test 1: Conforming traffic.
+	T.ExpectSuccess(f(newRR("https://api.example.com/items/1", `{"id":1}`)))
+
+	// Test 2: A bad request parameter.
+	T.ExpectErrorMessage(
+		f(newRR("https://api.example.com/items/x", `{"id":1}`)), "request")
+
+	// Test 3: A response that doesn't match the schema.
+	T.ExpectErrorMessage(
+		f(newRR("https://api.example.com/items/1", `{"id":"1"}`)), "response")
+
+	// Test 4: Other services are ignored.
+	T.ExpectSuccess(f(newRR("https://other.example.com/x", `nope`)))
+
+	// A missing document can not be loaded.
+	_, err = NewValidator(os.DevNull + "/missing.json")
+	T.ExpectError(err)
+}
@@ -0,0 +1,54 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package dvrresty allows clients made with github.com/go-resty/resty/v2 to
+// be recorded and replayed with the dvr library. Resty creates its own
+// http.Transport rather than using http.DefaultTransport, so its requests are
+// not seen by dvr unless the client is wrapped:
+//
+//	client := dvrresty.ForResty(resty.New())
+package dvrresty
+
+import (
+	"net/http"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/orchestrate-io/dvr"
+)
+
+// Wraps the transport of the given client with a dvr RoundTripper and returns
+// the client. This should be called once per client, after any custom
+// transport has been set.
+//
+// Every attempt made by resty's retry loop is a separate round trip, so all
+// of them are recorded and they are replayed in the same order, with failed
+// attempts failing again. When replaying, the wait between attempts is
+// removed since the responses are already known.
+func ForResty(client *resty.Client) *resty.Client {
+	// http.DefaultTransport is already intercepted.
+	transport := client.GetClient().Transport
+	if transport != nil && transport != http.DefaultTransport {
+		client.SetTransport(dvr.NewRoundTripper(transport))
+	}
+	// resty reads the wait times once for each request, so with -dvr.auto
+	// the choice is made now, probing the client's base URL if it has one.
+	if client.BaseURL != "" {
+		dvr.ProbeAutoMode(client.BaseURL)
+	}
+	if dvr.IsReplay() {
+		client.SetRetryWaitTime(0)
+		client.SetRetryMaxWaitTime(0)
+	}
+	return client
+}
@@ -0,0 +1,60 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvrresty
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/liquidgecka/testlib"
+)
+
+func TestForResty(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	// The server fails the first attempt so that the client retries.
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			attempts++
+			if attempts == 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+			w.Write([]byte("ok"))
+		}))
+	defer server.Close()
+
+	client := resty.New()
+	original := client.GetClient().Transport
+	T.Equal(ForResty(client), client)
+	T.NotEqual(client.GetClient().Transport, original)
+
+	client.SetRetryCount(1).AddRetryCondition(
+		func(r *resty.Response, err error) bool {
+			return r.StatusCode() == http.StatusServiceUnavailable
+		})
+	resp, err := client.R().Get(server.URL)
+	T.ExpectSuccess(err)
+	T.Equal(resp.StatusCode(), http.StatusOK)
+	T.Equal(attempts, 2)
+
+	// A client using http.DefaultTransport is left alone.
+	client = resty.New().SetTransport(http.DefaultTransport)
+	ForResty(client)
+	T.Equal(client.GetClient().Transport, http.DefaultTransport)
+}
@@ -0,0 +1,70 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package dvrretryablehttp allows clients made with
+// github.com/hashicorp/go-retryablehttp to be recorded and replayed with the
+// dvr library. retryablehttp creates its own http.Transport rather than using
+// http.DefaultTransport, so its requests are not seen by dvr unless the
+// client is wrapped:
+//
+//	client := dvrretryablehttp.ForRetryable(retryablehttp.NewClient())
+package dvrretryablehttp
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/hashicorp/go-retryablehttp"
+	"github.com/orchestrate-io/dvr"
+)
+
+// Wraps the transport of the given client with a dvr RoundTripper and returns
+// the client. This should be called once per client, after any custom
+// HTTPClient or transport has been set.
+//
+// Every attempt made by the retry loop is a separate round trip, so all of
+// them are recorded and they are replayed in the same order, with failed
+// attempts failing again. When replaying, the wait between attempts is
+// removed since the responses are already known.
+func ForRetryable(client *retryablehttp.Client) *retryablehttp.Client {
+	if client.HTTPClient == nil {
+		client.HTTPClient = &http.Client{}
+	}
+	// http.DefaultTransport is already intercepted.
+	transport := client.HTTPClient.Transport
+	if transport != nil && transport != http.DefaultTransport {
+		client.HTTPClient.Transport = dvr.NewRoundTripper(transport)
+	}
+	backoff := client.Backoff
+	if backoff == nil {
+		backoff = retryablehttp.DefaultBackoff
+	}
+	client.Backoff = replayBackoff(backoff)
+	return client
+}
+
+// Returns a retryablehttp.Backoff that never waits when replaying and
+// otherwise waits as backoff does. The mode is checked for each attempt
+// rather than when the client is wrapped, since with -dvr.auto it is only
+// chosen once the first request is made.
+func replayBackoff(backoff retryablehttp.Backoff) retryablehttp.Backoff {
+	return func(
+		min, max time.Duration, attempt int, resp *http.Response,
+	) time.Duration {
+		if dvr.IsReplay() {
+			return 0
+		}
+		return backoff(min, max, attempt, resp)
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvrretryablehttp
+
+import (
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-retryablehttp"
+	"github.com/liquidgecka/testlib"
+)
+
+func TestForRetryable(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	// The server fails the first attempt so that the client retries.
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			attempts++
+			if attempts == 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+			w.Write([]byte("ok"))
+		}))
+	defer server.Close()
+
+	client := retryablehttp.NewClient()
+	client.Logger = nil
+	client.RetryWaitMin = time.Millisecond
+	client.RetryWaitMax = time.Millisecond
+	original := client.HTTPClient.Transport
+	T.Equal(ForRetryable(client), client)
+	T.NotEqual(client.HTTPClient.Transport, original)
+
+	resp, err := client.Get(server.URL)
+	T.ExpectSuccess(err)
+	T.ExpectSuccess(resp.Body.Close())
+	T.Equal(resp.StatusCode, http.StatusOK)
+	T.Equal(attempts, 2)
+
+	// A client without an HTTPClient uses http.DefaultTransport, which is
+	// already intercepted.
+	client = &retryablehttp.Client{}
+	ForRetryable(client)
+	T.Equal(client.HTTPClient.Transport, nil)
+
+	// The backoff is only skipped while replaying.
+	backoff := replayBackoff(func(
+		time.Duration, time.Duration, int, *http.Response,
+	) time.Duration {
+		return time.Second
+	})
+	T.Equal(backoff(time.Second, time.Minute, 3, nil), time.Second)
+	T.ExpectSuccess(flag.Set("dvr.replay", "true"))
+	defer flag.Set("dvr.replay", "false")
+	T.Equal(backoff(time.Second, time.Minute, 3, nil), time.Duration(0))
+}
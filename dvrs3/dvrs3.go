@@ -0,0 +1,155 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package dvrs3 stores dvr archives in Amazon S3. Importing this package
+// registers a dvr.ArchiveStore for "s3" URLs so that the archive can be named
+// with -dvr.file=s3://bucket/key. Credentials and the region are read from
+// the default AWS configuration (environment variables, shared config files
+// and so on).
+//
+// See dvr.ArchiveStore for details on caching and uploading recordings.
+package dvrs3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/orchestrate-io/dvr"
+)
+
+// Register the store for s3:// archives.
+func init() {
+	dvr.RegisterArchiveStore("s3", &Store{})
+}
+
+// API is the subset of *s3.Client used by Store.
+type API interface {
+	HeadObject(ctx context.Context, params *s3.HeadObjectInput,
+		optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
+	GetObject(ctx context.Context, params *s3.GetObjectInput,
+		optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	PutObject(ctx context.Context, params *s3.PutObjectInput,
+		optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+}
+
+// Store is a dvr.ArchiveStore for s3://bucket/key URLs. The version of an
+// archive is its ETag. A Store with a custom client can be used by
+// registering it in place of the default one:
+//
+//	dvr.RegisterArchiveStore("s3", &dvrs3.Store{Client: client})
+type Store struct {
+	// The client used to talk to S3. If this is nil then a client made
+	// from the default AWS configuration is used.
+	Client API
+
+	once sync.Once
+	err  error
+}
+
+// Returns the client, creating the default one if necessary.
+func (s *Store) client(ctx context.Context) (API, error) {
+	s.once.Do(func() {
+		if s.Client != nil {
+			return
+		}
+		cfg, err := config.LoadDefaultConfig(ctx)
+		if err != nil {
+			s.err = err
+			return
+		}
+		s.Client = s3.NewFromConfig(cfg)
+	})
+	return s.Client, s.err
+}
+
+// Returns the bucket and key named by the URL.
+func location(u *url.URL) (*string, *string) {
+	return aws.String(u.Host), aws.String(strings.TrimPrefix(u.Path, "/"))
+}
+
+// Converts the errors S3 returns for missing objects into errors that wrap
+// os.ErrNotExist.
+func notExist(u *url.URL, err error) error {
+	var noSuchKey *types.NoSuchKey
+	var notFound *types.NotFound
+	if errors.As(err, &noSuchKey) || errors.As(err, &notFound) {
+		return fmt.Errorf("%s: %w", u, os.ErrNotExist)
+	}
+	return err
+}
+
+// dvr.ArchiveStore
+func (s *Store) Version(ctx context.Context, u *url.URL) (string, error) {
+	client, err := s.client(ctx)
+	if err != nil {
+		return "", err
+	}
+	bucket, key := location(u)
+	out, err := client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: bucket,
+		Key:    key,
+	})
+	if err != nil {
+		return "", notExist(u, err)
+	}
+	return aws.ToString(out.ETag), nil
+}
+
+// dvr.ArchiveStore
+func (s *Store) Download(
+	ctx context.Context, u *url.URL, w io.Writer,
+) (string, error) {
+	client, err := s.client(ctx)
+	if err != nil {
+		return "", err
+	}
+	bucket, key := location(u)
+	out, err := client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: bucket,
+		Key:    key,
+	})
+	if err != nil {
+		return "", notExist(u, err)
+	}
+	defer out.Body.Close()
+	if _, err := io.Copy(w, out.Body); err != nil {
+		return "", err
+	}
+	return aws.ToString(out.ETag), nil
+}
+
+// dvr.ArchiveStore
+func (s *Store) Upload(ctx context.Context, u *url.URL, r io.Reader) error {
+	client, err := s.client(ctx)
+	if err != nil {
+		return err
+	}
+	bucket, key := location(u)
+	_, err = client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: bucket,
+		Key:    key,
+		Body:   r,
+	})
+	return err
+}
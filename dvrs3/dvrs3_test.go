@@ -0,0 +1,97 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvrs3
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/liquidgecka/testlib"
+)
+
+// An in memory S3 bucket.
+type fakeS3 struct {
+	objects map[string][]byte
+	puts    int
+}
+
+func (f *fakeS3) HeadObject(ctx context.Context, in *s3.HeadObjectInput,
+	_ ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	if _, ok := f.objects[*in.Bucket+"/"+*in.Key]; !ok {
+		return nil, &types.NotFound{}
+	}
+	return &s3.HeadObjectOutput{ETag: aws.String(strconv.Itoa(f.puts))}, nil
+}
+
+func (f *fakeS3) GetObject(ctx context.Context, in *s3.GetObjectInput,
+	_ ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	data, ok := f.objects[*in.Bucket+"/"+*in.Key]
+	if !ok {
+		return nil, &types.NoSuchKey{}
+	}
+	return &s3.GetObjectOutput{
+		Body: ioutil.NopCloser(bytes.NewReader(data)),
+		ETag: aws.String(strconv.Itoa(f.puts)),
+	}, nil
+}
+
+func (f *fakeS3) PutObject(ctx context.Context, in *s3.PutObjectInput,
+	_ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	data, err := ioutil.ReadAll(in.Body)
+	if err != nil {
+		return nil, err
+	}
+	f.objects[*in.Bucket+"/"+*in.Key] = data
+	f.puts++
+	return &s3.PutObjectOutput{}, nil
+}
+
+func TestStore(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	ctx := context.Background()
+	fake := &fakeS3{objects: map[string][]byte{}}
+	store := &Store{Client: fake}
+	u, err := url.Parse("s3://bucket/path/archive.dvr")
+	T.ExpectSuccess(err)
+
+	// Missing archives.
+	_, err = store.Version(ctx, u)
+	T.Equal(errors.Is(err, os.ErrNotExist), true)
+	_, err = store.Download(ctx, u, &bytes.Buffer{})
+	T.Equal(errors.Is(err, os.ErrNotExist), true)
+
+	T.ExpectSuccess(store.Upload(ctx, u, bytes.NewReader([]byte("data"))))
+	T.Equal(string(fake.objects["bucket/path/archive.dvr"]), "data")
+
+	version, err := store.Version(ctx, u)
+	T.ExpectSuccess(err)
+	T.Equal(version, "1")
+	buffer := &bytes.Buffer{}
+	version, err = store.Download(ctx, u, buffer)
+	T.ExpectSuccess(err)
+	T.Equal(version, "1")
+	T.Equal(buffer.String(), "data")
+}
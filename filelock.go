@@ -0,0 +1,53 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvr
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Returned by lockFile() when another process holds a conflicting lock.
+var errFileLocked = errors.New("file is locked")
+
+// The error returned when an archive can not be recorded because another
+// process is recording to it.
+type archiveLockedError struct {
+	path string
+}
+
+func (e *archiveLockedError) Error() string {
+	return fmt.Sprintf("dvr: the archive %s is locked by another process. "+
+		"Only one test binary can record to an archive at a time; run the "+
+		"packages sharing it with -p=1 or give each its own -dvr.file",
+		e.path)
+}
+
+// Takes an exclusive advisory lock on fd, the file that the given archive is
+// being recorded into, failing immediately if another process holds it. The
+// lock is released when fd is closed. Replaying doesn't need a lock since a
+// recording only replaces the archive once it is complete. On platforms
+// without file locking this does nothing.
+func lockArchive(fd *os.File, archive string) error {
+	err := lockFile(fd)
+	if err == errFileLocked {
+		return &archiveLockedError{path: archive}
+	} else if err != nil {
+		return fmt.Errorf("dvr: can not lock the archive %s: %s",
+			archive, err)
+	}
+	return nil
+}
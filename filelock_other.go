@@ -12,25 +12,21 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-// +build !go1.3
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !windows
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!windows
 
 package dvr
 
 import (
-	"net/http"
+	"os"
 )
 
-// This file contains functions calls that will be put in place with golang's
-// prior to 1.3.
-
-// This call does nothing since golang's prior to 1.3 do not have TLS fields.
-func newGobRequestVS(req *http.Request, r *gobRequest) {
-}
-
-// This call does nothing since golang's prior to 1.3 do not have TLS fields.
-func newGobResponseVS(resp *http.Response, r *gobResponse) {
+// Files are not locked on this platform.
+func lockFile(fd *os.File) error {
+	return nil
 }
 
-// This call does nothing since golang's prior to 1.3 do not have TLS fields.
-func (g *gobQuery) requestResponseVS(r *RequestResponse) {
+// Opens the file that an archive is recorded into.
+func openRecording(name string) (*os.File, error) {
+	return os.OpenFile(name, os.O_WRONLY|os.O_CREATE, os.FileMode(0755))
 }
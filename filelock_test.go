@@ -0,0 +1,81 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd || windows
+// +build darwin dragonfly freebsd linux netbsd openbsd windows
+
+package dvr
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/liquidgecka/testlib"
+)
+
+func TestLockArchive(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	// Locks taken through separate opens of the file conflict just as they
+	// would if they were held by separate processes.
+	name := T.TempFile().Name()
+	open := func() *os.File {
+		fd, err := os.Open(name)
+		T.ExpectSuccess(err)
+		return fd
+	}
+	first, second := open(), open()
+	defer second.Close()
+	T.ExpectSuccess(lockArchive(first, "a.dvr"))
+	T.ExpectErrorMessage(lockArchive(second, "a.dvr"),
+		"dvr: the archive a.dvr is locked by another process")
+
+	// The lock is released when the file is closed.
+	T.ExpectSuccess(first.Close())
+	T.ExpectSuccess(lockArchive(second, "a.dvr"))
+}
+
+func TestRecordSetupLocked(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+	defer resetBenchmark()
+	defer func() { panicOutput = ioutil.Discard }()
+	panicOutput = ioutil.Discard
+
+	// The recording is left alone if another process is making it.
+	fileName = T.TempFile().Name()
+	T.ExpectSuccess(ioutil.WriteFile(recordingPath(fileName),
+		[]byte("partial"), 0644))
+	defer os.Remove(recordingPath(fileName))
+	other, err := os.Open(recordingPath(fileName))
+	T.ExpectSuccess(err)
+	defer other.Close()
+	T.ExpectSuccess(lockArchive(other, fileName))
+	record = true
+	isSetup = sync.Once{}
+	func() {
+		defer func() {
+			failure, ok := recover().(*dvrFailure)
+			T.Equal(ok, true)
+			T.ExpectErrorMessage(failure, "is locked by another process")
+		}()
+		(&roundTripper{}).recordSetup()
+	}()
+	data, err := ioutil.ReadFile(recordingPath(fileName))
+	T.ExpectSuccess(err)
+	T.Equal(string(data), "partial")
+}
@@ -0,0 +1,103 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvr
+
+import (
+	"fmt"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	// The distinct matching fingerprints of the recordings being replayed,
+	// and the current fingerprints that have already been warned about.
+	recordedFingerprints map[string]bool
+	warnedFingerprints   map[string]bool
+	fingerprintLock      sync.Mutex
+)
+
+// Returns the name of a function without its package path, for example
+// "dvr.SOAPMatcher".
+func funcName(f interface{}) string {
+	fn := runtime.FuncForPC(reflect.ValueOf(f).Pointer())
+	if fn == nil {
+		return "unknown"
+	}
+	name := fn.Name()
+	if i := strings.LastIndexByte(name, '/'); i >= 0 {
+		name = name[i+1:]
+	}
+	return name
+}
+
+// Describes the configuration that decides which recordings a request
+// matches: the Matcher, and the normalizers that are run on requests before
+// they are matched, such as NormalizeCookies(). This is stored with each
+// recording so that replay can warn when it differs, since requests that
+// fail to match because of it are otherwise hard to explain.
+func matchingFingerprint() string {
+	matcher := "default"
+	if Matcher != nil {
+		matcher = funcName(Matcher)
+	}
+	obfuscatorLock.Lock()
+	names := make([]string, 0, len(normalizerChain))
+	for _, e := range normalizerChain {
+		names = append(names, e.name)
+	}
+	obfuscatorLock.Unlock()
+	return fmt.Sprintf("matcher=%s normalizers=[%s]",
+		matcher, strings.Join(names, "; "))
+}
+
+// Notes the fingerprints of the recordings that were loaded for replay.
+// Recordings made before fingerprints were stored are ignored.
+func loadFingerprints(rrs []*RequestResponse) {
+	fingerprintLock.Lock()
+	defer fingerprintLock.Unlock()
+	recordedFingerprints = map[string]bool{}
+	warnedFingerprints = map[string]bool{}
+	for _, rr := range rrs {
+		if rr.matching != "" {
+			recordedFingerprints[rr.matching] = true
+		}
+	}
+}
+
+// Called when a request doesn't match any recording. If the matching
+// configuration differs from that of every recording then a warning is
+// printed, once for each configuration, since it may be why.
+func warnMatchingChanged() {
+	current := matchingFingerprint()
+	fingerprintLock.Lock()
+	defer fingerprintLock.Unlock()
+	if len(recordedFingerprints) == 0 || recordedFingerprints[current] ||
+		warnedFingerprints[current] {
+		return
+	}
+	warnedFingerprints[current] = true
+	recorded := make([]string, 0, len(recordedFingerprints))
+	for fingerprint := range recordedFingerprints {
+		recorded = append(recorded, fingerprint)
+	}
+	sort.Strings(recorded)
+	fmt.Fprintf(panicOutput, "dvr: warning: a request did not match any "+
+		"recording and the matching configuration differs from when the "+
+		"archive was recorded.\n  recorded with: %s\n  replaying with: %s\n",
+		strings.Join(recorded, "\n                 "), current)
+}
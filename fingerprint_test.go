@@ -0,0 +1,99 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvr
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/liquidgecka/testlib"
+)
+
+func TestMatchingFingerprint(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+	defer ResetObfuscators()
+	defer func() { Matcher = nil }()
+
+	T.Equal(funcName(SOAPMatcher), "dvr.SOAPMatcher")
+	T.Equal(matchingFingerprint(), "matcher=default normalizers=[]")
+
+	NormalizeCookies("a", "b")
+	NormalizeIDs()
+	AddSymmetricObfuscator(normalizeSOAP)
+	AddObfuscator(normalizeIDs)
+	Matcher = SOAPMatcher
+	T.Equal(matchingFingerprint(), "matcher=dvr.SOAPMatcher normalizers=["+
+		"NormalizeCookies(a, b); NormalizeIDs(); dvr.normalizeSOAP]")
+}
+
+func TestWarnMatchingChanged(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+	defer ResetObfuscators()
+	defer func() {
+		replay = false
+		panicOutput = ioutil.Discard
+		fileName = "testdata/archive.dvr"
+		isSetup = sync.Once{}
+		requestList = nil
+		requestIndexes = nil
+	}()
+
+	// Recorded with NormalizeIDs().
+	remove := NormalizeIDs()
+	q := testQuery("GET", "http://api.example.com/", "", 200, "ok")
+	q.Matching = matchingFingerprint()
+	remove()
+	fileName = T.TempFile().Name()
+	T.ExpectSuccess(writeArchiveFile(fileName, []*gobQuery{q}))
+	replay = true
+	isSetup = sync.Once{}
+	output := &bytes.Buffer{}
+	panicOutput = output
+
+	rt := &roundTripper{realRoundTripper: roundTripperFunc(
+		func(req *http.Request) (*http.Response, error) {
+			return nil, fmt.Errorf("not matched")
+		})}
+	get := func(path string) {
+		req, err := http.NewRequest("GET", "http://api.example.com"+path, nil)
+		T.ExpectSuccess(err)
+		rt.RoundTrip(req)
+	}
+
+	// Matched requests say nothing.
+	get("/")
+	T.Equal(output.String(), "")
+
+	// Unmatched requests warn once while the configuration differs.
+	get("/missing")
+	T.Equal(strings.Contains(output.String(), ""+
+		"recorded with: matcher=default normalizers=[NormalizeIDs()]\n"+
+		"  replaying with: matcher=default normalizers=[]\n"), true)
+	output.Reset()
+	get("/missing")
+	T.Equal(output.String(), "")
+
+	// Nothing is said when it is the same.
+	defer NormalizeIDs()()
+	get("/missing")
+	T.Equal(output.String(), "")
+}
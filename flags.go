@@ -0,0 +1,30 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !dvr_noflags
+// +build !dvr_noflags
+
+package dvr
+
+import (
+	"flag"
+)
+
+// This file registers the flags on flag.CommandLine. Building with the
+// dvr_noflags tag removes it so that RegisterFlags() can be called manually.
+
+// Initialize the flags.
+func init() {
+	RegisterFlags(flag.CommandLine)
+}
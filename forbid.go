@@ -0,0 +1,104 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvr
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// Set by -dvr.forbid_record to keep a run from changing archives or depending
+// on the network, as a CI run should. Recording fails, and so do requests
+// that match no recording when replaying, rather than falling back to the
+// network. This defaults to true when the CI environment variable is set to
+// true, as most CI services do, so -dvr.forbid_record=false is needed to
+// record there. When it only defaults to true requests that are simply
+// passed through, when no mode is set, are still allowed so that binaries
+// which import this package but never record work as usual. Given
+// explicitly it also fails those, and -dvr.golden's live requests.
+var forbidRecord = inCI()
+
+// Set when -dvr.forbid_record is given on the command line rather than
+// defaulting from the CI environment variable.
+var forbidExplicit bool
+
+// The flag.Value for -dvr.forbid_record, which notes that it was given in
+// forbidExplicit.
+type forbidFlag struct{}
+
+// flag.Value
+func (forbidFlag) String() string {
+	return strconv.FormatBool(forbidRecord)
+}
+
+// flag.Value
+func (forbidFlag) Set(value string) error {
+	v, err := strconv.ParseBool(value)
+	if err != nil {
+		return err
+	}
+	forbidRecord = v
+	forbidExplicit = true
+	return nil
+}
+
+// Makes -dvr.forbid_record work without a value, like other boolean flags.
+func (forbidFlag) IsBoolFlag() bool {
+	return true
+}
+
+// Returns true if the CI environment variable says that this is a CI run.
+func inCI() bool {
+	ci, _ := strconv.ParseBool(os.Getenv("CI"))
+	return ci
+}
+
+// Returns an error if -dvr.forbid_record is set, for when a recording is
+// about to start.
+func checkRecordAllowed() error {
+	if !forbidRecord {
+		return nil
+	}
+	return fmt.Errorf("dvr: recording is forbidden by -dvr.forbid_record%s, "+
+		"so %s was not changed", ciNote(), fileName)
+}
+
+// Returns an error if -dvr.forbid_record is set, for when the call described
+// by desc matched no recording and is about to be sent to the network.
+func checkLiveAllowed(desc string) error {
+	if !forbidRecord {
+		return nil
+	}
+	return fmt.Errorf("dvr: %s was not sent to the network since it is "+
+		"forbidden by -dvr.forbid_record%s", desc, ciNote())
+}
+
+// Returns an error if -dvr.forbid_record was given explicitly, for when the
+// call described by desc is about to be passed through to the network.
+func checkPassThroughAllowed(desc string) error {
+	if !forbidExplicit {
+		return nil
+	}
+	return checkLiveAllowed(desc)
+}
+
+// Explains where -dvr.forbid_record came from if it was set by CI.
+func ciNote() string {
+	if inCI() && !forbidExplicit {
+		return " (which defaults to true since CI is set)"
+	}
+	return ""
+}
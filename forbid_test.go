@@ -0,0 +1,192 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvr
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/liquidgecka/testlib"
+)
+
+// The tests in this package record, so they must not be forbidden from it
+// when run by CI.
+func TestMain(m *testing.M) {
+	forbidRecord = false
+	os.Exit(m.Run())
+}
+
+func TestForbidRecord(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+	defer resetBenchmark()
+	defer func(dial func(string, time.Duration) error) {
+		autoDial = dial
+		autoMode = false
+		forbidRecord = false
+		panicOutput = ioutil.Discard
+	}(autoDial)
+	t.Setenv("CI", "")
+	output := &bytes.Buffer{}
+	panicOutput = output
+	forbidRecord = true
+
+	rt := &roundTripper{realRoundTripper: roundTripperFunc(
+		func(req *http.Request) (*http.Response, error) {
+			T.Fatalf("Unexpected request to the network: %s", req.URL)
+			return nil, nil
+		})}
+	get := func(url string) error {
+		req, err := http.NewRequest("GET", url, nil)
+		T.ExpectSuccess(err)
+		_, err = rt.RoundTrip(req)
+		return err
+	}
+
+	// Requests that have no recording when replaying are not sent to the
+	// network.
+	fileName = filepath.Join(T.TempDir(), "archive.dvr")
+	T.ExpectSuccess(writeArchiveFile(fileName, nil))
+	replay = true
+	err := get("http://x/unrecorded")
+	T.ExpectErrorMessage(err, "dvr: GET http://x/unrecorded (in "+
+		"TestForbidRecord at forbid_test.go:")
+	T.ExpectErrorMessage(err, "), which matched no recording, was not sent "+
+		"to the network since it is forbidden by -dvr.forbid_record")
+
+	// -dvr.auto replays without checking the network.
+	replay = false
+	isSetup = sync.Once{}
+	autoChosen = 0
+	autoMode = true
+	autoDial = func(addr string, timeout time.Duration) error {
+		T.Fatalf("Unexpected probe of %s", addr)
+		return nil
+	}
+	T.ExpectErrorMessage(get("http://x/auto"), "which matched no recording")
+	T.Equal(IsReplay(), true)
+	T.Equal(output.String(), "dvr: -dvr.auto is replaying since recording "+
+		"is forbidden by -dvr.forbid_record\n")
+
+	// Recording fails without touching the archive.
+	replay = false
+	record = true
+	isSetup = sync.Once{}
+	func() {
+		defer func() {
+			failure, ok := recover().(*dvrFailure)
+			T.Equal(ok, true)
+			T.ExpectErrorMessage(failure, "dvr: recording is forbidden by "+
+				"-dvr.forbid_record, so "+fileName+" was not changed")
+		}()
+		get("http://x/record")
+	}()
+	_, err = os.Stat(recordingPath(fileName))
+	T.Equal(os.IsNotExist(err), true)
+}
+
+func TestForbidRecordInCI(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+	defer func() { forbidRecord = false }()
+	forbidRecord = true
+
+	t.Setenv("CI", "")
+	T.Equal(inCI(), false)
+	T.Equal(ciNote(), "")
+	t.Setenv("CI", "true")
+	T.Equal(inCI(), true)
+	T.ExpectErrorMessage(checkRecordAllowed(), "-dvr.forbid_record (which "+
+		"defaults to true since CI is set)")
+}
+
+func TestForbidRecordPassesThrough(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+	defer func() { forbidRecord = false }()
+	t.Setenv("CI", "true")
+	forbidRecord = inCI()
+
+	// With no mode set requests are passed through as usual, even to a
+	// local server, since nothing is being recorded or replayed.
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("hello"))
+		}))
+	defer server.Close()
+	rt := &roundTripper{realRoundTripper: http.DefaultTransport}
+	req, err := http.NewRequest("GET", server.URL, nil)
+	T.ExpectSuccess(err)
+	resp, err := rt.RoundTrip(req)
+	T.ExpectSuccess(err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	T.ExpectSuccess(err)
+	T.Equal(string(body), "hello")
+}
+
+func TestForbidRecordExplicit(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+	defer func() {
+		forbidRecord = false
+		forbidExplicit = false
+	}()
+	t.Setenv("CI", "true")
+
+	// Given explicitly, requests that would be passed through fail too.
+	var value flag.Value = forbidFlag{}
+	T.ExpectSuccess(value.Set("true"))
+	T.Equal(forbidRecord, true)
+	T.Equal(forbidExplicit, true)
+	T.Equal(ciNote(), "")
+
+	rt := &roundTripper{realRoundTripper: roundTripperFunc(
+		func(req *http.Request) (*http.Response, error) {
+			T.Fatalf("Unexpected request to the network: %s", req.URL)
+			return nil, nil
+		})}
+	req, err := http.NewRequest("GET", "http://x/live", nil)
+	T.ExpectSuccess(err)
+	_, err = rt.RoundTrip(req)
+	T.ExpectErrorMessage(err, "dvr: GET http://x/live (in "+
+		"TestForbidRecordExplicit at forbid_test.go:")
+	T.ExpectErrorMessage(err, "was not sent to the network since it is "+
+		"forbidden by -dvr.forbid_record")
+
+	dial := InterceptDial(
+		func(context.Context, string, string) (net.Conn, error) {
+			T.Fatalf("Unexpected dial")
+			return nil, nil
+		})
+	_, err = dial(context.Background(), "tcp", "db:5432")
+	T.ExpectErrorMessage(err, "dvr: the dial of tcp db:5432 was not sent "+
+		"to the network")
+
+	// It can still be turned off.
+	T.ExpectSuccess(value.Set("false"))
+	T.Equal(forbidRecord, false)
+	T.Equal(value.String(), "false")
+}
@@ -16,15 +16,20 @@ package dvr
 
 import (
 	"bytes"
+	"context"
 	"crypto/rsa"
 	"crypto/tls"
 	"encoding/gob"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
+	"os"
 	"reflect"
+	"syscall"
+	"time"
 )
 
 //
@@ -39,6 +44,88 @@ func (g gobSafeError) Error() string {
 	return string(g)
 }
 
+// This is used in place of gobSafeError for errors that implement net.Error,
+// or wrap one, so that code checking Timeout() or Temporary() on a replayed
+// error sees the values the recorded error had.
+type gobNetError struct {
+	Message     string
+	IsTimeout   bool
+	IsTemporary bool
+}
+
+// Error() for gobNetError
+func (g *gobNetError) Error() string {
+	return g.Message
+}
+
+// Timeout() for gobNetError
+func (g *gobNetError) Timeout() bool {
+	return g.IsTimeout
+}
+
+// Temporary() for gobNetError
+func (g *gobNetError) Temporary() bool {
+	return g.IsTemporary
+}
+
+// This is stored in place of context.Canceled and context.DeadlineExceeded,
+// and the errors that wrap them, so that errors.Is() finds them in the
+// replayed error.
+type gobContextError struct {
+	Message          string
+	DeadlineExceeded bool
+}
+
+// Error() for gobContextError
+func (g *gobContextError) Error() string {
+	return g.Message
+}
+
+// Returns the context error itself if that was what was recorded, otherwise
+// an error with the recorded message that wraps it.
+func (g *gobContextError) restore() error {
+	cause := context.Canceled
+	if g.DeadlineExceeded {
+		cause = context.DeadlineExceeded
+	}
+	if g.Message == cause.Error() {
+		return cause
+	}
+	return fmt.Errorf("%s%.0w", g.Message, cause)
+}
+
+// Returns a gobContextError for err if it is, or wraps, a context error.
+func contextError(err error) (error, bool) {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return &gobContextError{
+			Message:          err.Error(),
+			DeadlineExceeded: true,
+		}, true
+	case errors.Is(err, context.Canceled):
+		return &gobContextError{Message: err.Error()}, true
+	}
+	return nil, false
+}
+
+// Returns a gobSafeError with the message from err, or a gobNetError if err
+// is or wraps a net.Error. Errors that wrap a context error are returned as
+// a gobContextError.
+func safeError(err error) error {
+	if ctxErr, ok := contextError(err); ok {
+		return ctxErr
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return &gobNetError{
+			Message:     err.Error(),
+			IsTimeout:   netErr.Timeout(),
+			IsTemporary: netErr.Temporary(),
+		}
+	}
+	return gobSafeError(err.Error())
+}
+
 // This is the list of known encodable types saved as a map of name -> bool.
 // This allows us to know if a given type will be decodable or not.. If not
 // then we need to wrap the type in a gobSafeError structure.
@@ -48,6 +135,9 @@ var encodableTypes map[string]bool = map[string]bool{}
 func init() {
 	// Error return types.
 	RegisterErrorType(new(gobSafeError))
+	RegisterErrorType(new(gobNetError))
+	RegisterErrorType(new(gobCertificateError))
+	RegisterErrorType(new(gobContextError))
 	RegisterErrorType(new(http.ProtocolError))
 	RegisterErrorType(new(net.AddrError))
 	RegisterErrorType(new(net.DNSConfigError))
@@ -57,33 +147,116 @@ func init() {
 	RegisterErrorType(new(net.OpError))
 	RegisterErrorType(new(net.ParseError))
 	RegisterErrorType(new(net.UnknownNetworkError))
+	RegisterErrorType(new(os.SyscallError))
+	RegisterErrorType(tls.AlertError(0))
+	RegisterErrorType(tls.RecordHeaderError{})
 	RegisterErrorType(new(url.Error))
 	RegisterErrorType(new(url.EscapeError))
+	RegisterErrorType(syscall.Errno(0))
 
 	// Other objects that we might end up seeing.
 	gob.Register(new(rsa.PublicKey))
 	gob.Register(new(rsa.PrivateKey))
+	gob.Register(new(net.IPAddr))
 	gob.Register(new(net.TCPAddr))
+	gob.Register(new(net.UDPAddr))
+	gob.Register(new(net.UnixAddr))
 }
 
 // Adds an error interface object to the list of known types that this library
 // will be able to encode. This is necessary due to the way that gob encodes
 // interface object. The only error types here are those that will be returned
-// from the RoundTripper object. Typical use cases should not need this at all.
-// If you are using this you must do it via your modules init() otherwise
-// results can be unpredictable.
+// from the RoundTripper object, or wrapped by them. Errors of other types are
+// replayed as an error with the same message but a different type, so this is
+// only needed if a test type asserts on a custom error type, for example one
+// returned by a custom RoundTripper. The example given should be of the type
+// the errors are returned as, so new(MyError) if they are returned as
+// pointers. If you are using this you must do it via your modules init()
+// otherwise results can be unpredictable.
 func RegisterErrorType(err error) {
-	// Walk the given interface all the way down to the raw object.
+	gob.Register(err)
+	encodableTypes[errorTypeID(reflect.TypeOf(err))] = true
+}
+
+// Returns the name that encodableTypes uses for the given type, ignoring any
+// pointers to it.
+func errorTypeID(typ reflect.Type) string {
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	return fmt.Sprintf("%s.%s", typ.PkgPath(), typ.Name())
+}
+
+// The type of the error interface, used to find the fields of an error that
+// wrap another error.
+var errorInterfaceType = reflect.TypeOf((*error)(nil)).Elem()
+
+// Returns a version of err that gob can encode. Errors of registered types
+// keep their type, and the errors that they wrap are converted the same way
+// so a *url.Error wrapping a *net.OpError keeps both types. Anything else is
+// replaced with safeError(). err itself is never modified.
+func encodableError(err error) error {
+	if err == nil {
+		return nil
+	}
 	value := reflect.ValueOf(err)
-	for value.Kind() == reflect.Interface || value.Kind() == reflect.Ptr {
-		if _, ok := value.Interface().(error); ok {
-			gob.Register(value.Interface())
+	if alert, ok := tlsAlertError(value); ok {
+		return alert
+	}
+	if certErr, ok := certificateError(err); ok {
+		return certErr
+	}
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		return safeError(err)
+	}
+	if !encodableTypes[errorTypeID(value.Type())] {
+		return safeError(err)
+	}
+	encodable, ok := copyEncodable(value).Interface().(error)
+	if !ok || !gobEncodable(encodable) {
+		return safeError(err)
+	}
+	return encodable
+}
+
+// Copies a struct, or a pointer to one, replacing the errors that it wraps
+// with encodableError() and clearing any other interface fields that gob is
+// unable to encode. Values of other kinds are returned as is.
+func copyEncodable(value reflect.Value) reflect.Value {
+	var copied reflect.Value
+	switch {
+	case value.Kind() == reflect.Struct:
+		copied = reflect.New(value.Type()).Elem()
+		copied.Set(value)
+	case value.Kind() == reflect.Ptr && !value.IsNil() &&
+		value.Elem().Kind() == reflect.Struct:
+		copied = reflect.New(value.Type().Elem())
+		copied.Elem().Set(value.Elem())
+	default:
+		return value
+	}
+
+	fields := reflect.Indirect(copied)
+	for i := 0; i < fields.NumField(); i++ {
+		field := fields.Field(i)
+		if field.Kind() != reflect.Interface || field.IsNil() ||
+			!field.CanSet() {
+			continue
+		}
+		if field.Type() == errorInterfaceType {
+			wrapped := encodableError(field.Interface().(error))
+			field.Set(reflect.ValueOf(&wrapped).Elem())
+		} else if !gobEncodable(field.Interface()) {
+			field.Set(reflect.Zero(field.Type()))
 		}
-		value = value.Elem()
 	}
-	typ := value.Type()
-	id := fmt.Sprintf("%s.%s", typ.PkgPath(), typ.Name())
-	encodableTypes[id] = true
+	return copied
+}
+
+// Returns true if gob is able to encode v when it is stored in an interface.
+func gobEncodable(v interface{}) bool {
+	holder := struct{ V interface{} }{v}
+	return gob.NewEncoder(ioutil.Discard).Encode(&holder) == nil
 }
 
 // This type is used to store errors. Since some errors might contain private
@@ -102,24 +275,10 @@ func (g *gobError) GobEncode() ([]byte, error) {
 	// If we are encoding a known safe type then we write the types name and
 	// then encode it into the byte stream, otherwise we are forced to convert
 	// it into a gobSafeError type so it can be safely stored.
-	value := reflect.ValueOf(g.Error)
-	for value.Kind() == reflect.Interface || value.Kind() == reflect.Ptr {
-		value = value.Elem()
-	}
-
-	// Figure out the name of this object type.
-	id := fmt.Sprintf("%s.%s", value.Type().PkgPath(), value.Type().Name())
-
-	// Make a safe error object for us to encode with.
-	rawError := gobRawError{
-		Error:             g.Error,
-		ErrorsErrorString: id == "errors.errorString",
-	}
-
-	// If the object that we are encoding is not safe then we need to change
-	// it into one that actually is.
-	if _, ok := encodableTypes[id]; !ok {
-		rawError.Error = gobSafeError(g.Error.Error())
+	id := errorTypeID(reflect.TypeOf(g.Error))
+	rawError := gobRawError{Error: encodableError(g.Error)}
+	if _, ok := rawError.Error.(gobSafeError); ok {
+		rawError.ErrorsErrorString = id == "errors.errorString"
 	}
 
 	// Encode the safe object and return the byte array.
@@ -145,7 +304,7 @@ func (g *gobError) GobDecode(data []byte) error {
 	if rawError.ErrorsErrorString {
 		g.Error = errors.New(rawError.Error.Error())
 	} else {
-		g.Error = rawError.Error
+		g.Error = restoreErrors(rawError.Error)
 	}
 	return nil
 }
@@ -197,7 +356,11 @@ type gobRequest struct {
 	Trailer          http.Header
 	RemoteAddr       string
 	RequestURI       string
-	TLS              *tls.ConnectionState
+
+	// The TLS connection state. TLS is only read from archives written
+	// before ConnectionState was added.
+	TLS             *tls.ConnectionState
+	ConnectionState *gobConnectionState
 
 	// The request body and err returned when reading it.
 	Body  []byte
@@ -226,7 +389,7 @@ func newGobRequest(req *http.Request) *gobRequest {
 	r.Trailer = req.Trailer
 	r.RemoteAddr = req.RemoteAddr
 	r.RequestURI = req.RequestURI
-	newGobRequestVS(req, r)
+	r.ConnectionState = newGobConnectionState(req.TLS)
 
 	return r
 }
@@ -248,11 +411,29 @@ type gobResponse struct {
 	TransferEncoding []string
 	Close            bool
 	Trailer          http.Header
-	TLS              *tls.ConnectionState
+
+	// The TLS connection state. TLS is only read from archives written
+	// before ConnectionState was added.
+	TLS             *tls.ConnectionState
+	ConnectionState *gobConnectionState
+
+	// Set if the transport removed the Content-Encoding of the response
+	// when it decompressed the body, which also leaves ContentLength -1.
+	Uncompressed bool
 
 	// The response body and err returned when reading it.
 	Body  []byte
 	Error gobError
+
+	// The SHA-256 of Body for bodies large enough to be worth sharing. If
+	// Body is empty but this is set then the body is the same as that of
+	// another entry in the archive with the same hash, which is where it is
+	// stored. See dedupResponseBody().
+	BodyHash string
+
+	// Where Body was moved to in bodySpool when the archive was read, see
+	// spooler. This is never stored in the archive.
+	spooled spooledBody
 }
 
 // This takes a Response object and returns a gob compatible gobResponse object.
@@ -272,7 +453,8 @@ func newGobResponse(resp *http.Response) *gobResponse {
 	r.TransferEncoding = resp.TransferEncoding
 	r.Close = resp.Close
 	r.Trailer = resp.Trailer
-	newGobResponseVS(resp, r)
+	r.Uncompressed = resp.Uncompressed
+	r.ConnectionState = newGobConnectionState(resp.TLS)
 
 	return r
 }
@@ -293,6 +475,102 @@ type gobQuery struct {
 
 	// This stores the error returned from the RoundTrip call.
 	Error gobError
+
+	// The informational responses received before the final response. Empty
+	// in archives written before they were recorded.
+	Interim []InterimResponse
+
+	// The httptrace events of the request, or nil if there were none or the
+	// archive was written before they were recorded.
+	Trace *RequestTrace
+
+	// The query parameters replaced by ObfuscateQueryParams(). Empty in
+	// archives written before they were stored.
+	RedactedQueryParams []string
+
+	// The partition (test name) that was active when this query was
+	// recorded, and an identifier of the recording run. Older runs of a
+	// partition are superseded by newer ones.
+	Partition string
+	RunID     int64
+
+	// The -dvr.labels given when the query was recorded, sorted.
+	Labels []string
+
+	// The time the query was recorded, and how long the RoundTrip call took.
+	// These are zero in archives written before they were added.
+	Recorded time.Time
+	Duration time.Duration
+
+	// The matching configuration when the query was recorded, see
+	// matchingFingerprint(). Empty in archives written before it was added.
+	Matching string
+}
+
+// Returns a deep copy of the query. Obfuscators are run against a copy so
+// that their changes are recorded without altering the Request and Response
+// handed back to the caller.
+func (g *gobQuery) clone() *gobQuery {
+	c := *g
+	c.Interim = cloneInterim(g.Interim)
+	c.Trace = g.Trace.clone()
+	c.Labels = cloneStrings(g.Labels)
+	c.RedactedQueryParams = cloneStrings(g.RedactedQueryParams)
+	if g.Request != nil {
+		r := *g.Request
+		r.Header = g.Request.Header.Clone()
+		r.TransferEncoding = cloneStrings(g.Request.TransferEncoding)
+		r.Form = cloneValues(g.Request.Form)
+		r.PostForm = cloneValues(g.Request.PostForm)
+		r.Trailer = g.Request.Trailer.Clone()
+		r.TLS = cloneConnectionState(g.Request.TLS)
+		r.Body = cloneBytes(g.Request.Body)
+		c.Request = &r
+	}
+	if g.Response != nil {
+		r := *g.Response
+		r.Header = g.Response.Header.Clone()
+		r.TransferEncoding = cloneStrings(g.Response.TransferEncoding)
+		r.Trailer = g.Response.Trailer.Clone()
+		r.TLS = cloneConnectionState(g.Response.TLS)
+		r.Body = cloneBytes(g.Response.Body)
+		c.Response = &r
+	}
+	return &c
+}
+
+// Copies a byte slice, keeping nil as nil.
+func cloneBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	return append([]byte{}, b...)
+}
+
+// Copies a string slice, keeping nil as nil.
+func cloneStrings(s []string) []string {
+	if s == nil {
+		return nil
+	}
+	return append([]string{}, s...)
+}
+
+// Copies url.Values, which has the same shape as http.Header.
+func cloneValues(v url.Values) url.Values {
+	return url.Values(http.Header(v).Clone())
+}
+
+// Copies the ConnectionState along with the certificate list. The
+// certificates themselves are not copied since obfuscators have no reason
+// to change them.
+func cloneConnectionState(cs *tls.ConnectionState) *tls.ConnectionState {
+	if cs == nil {
+		return nil
+	}
+	c := *cs
+	c.PeerCertificates = append(c.PeerCertificates[:0:0],
+		cs.PeerCertificates...)
+	return &c
 }
 
 // This call converts a gobQuery object into a RequestResponse object for use
@@ -320,6 +598,10 @@ func (g *gobQuery) RequestResponse() *RequestResponse {
 		rr.Request.Trailer = g.Request.Trailer
 		rr.Request.RemoteAddr = g.Request.RemoteAddr
 		rr.Request.RequestURI = g.Request.RequestURI
+		rr.Request.TLS = g.Request.TLS
+		if cs := g.Request.ConnectionState; cs != nil {
+			rr.Request.TLS = cs.connectionState()
+		}
 
 		// Next we deal with the body.
 		rr.RequestBody = g.Request.Body
@@ -339,17 +621,34 @@ func (g *gobQuery) RequestResponse() *RequestResponse {
 		rr.Response.TransferEncoding = g.Response.TransferEncoding
 		rr.Response.Close = g.Response.Close
 		rr.Response.Trailer = g.Response.Trailer
+		rr.Response.Uncompressed = g.Response.Uncompressed
+		rr.Response.TLS = g.Response.TLS
+		if cs := g.Response.ConnectionState; cs != nil {
+			rr.Response.TLS = cs.connectionState()
+		}
 
 		// Next we deal with the body.
 		rr.ResponseBody = g.Response.Body
 		rr.ResponseBodyError = g.Response.Error.Error
 	}
 
-	// Do golang version specific work.
-	g.requestResponseVS(rr)
-
 	// Copy the error
 	rr.Error = g.Error.Error
+	rr.Interim = g.Interim
+	rr.Trace = g.Trace
+
+	rr.RedactedQueryParams = g.RedactedQueryParams
+	rr.Partition = g.Partition
+	rr.RunID = g.RunID
+	rr.Labels = g.Labels
+
+	// Older archives only know when the run started.
+	rr.Recorded = g.Recorded
+	if rr.Recorded.IsZero() && g.RunID != 0 {
+		rr.Recorded = time.Unix(0, g.RunID)
+	}
+	rr.Duration = g.Duration
+	rr.matching = g.Matching
 
 	return rr
 }
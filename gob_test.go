@@ -16,11 +16,19 @@ package dvr
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/gob"
 	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
 	"reflect"
+	"syscall"
 	"testing"
 
 	"github.com/liquidgecka/testlib"
@@ -113,6 +121,153 @@ func TestGobError_GobDecode(t *testing.T) {
 	T.ExpectError(g.GobDecode([]byte{0, 1, 2, 3}))
 }
 
+// An error type that is registered with RegisterErrorType().
+type registeredError struct {
+	Code int
+	Err  error
+}
+
+func (r *registeredError) Error() string {
+	return fmt.Sprintf("code %d: %s", r.Code, r.Err)
+}
+
+func TestGobError_WrappedErrors(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+	RegisterErrorType(new(registeredError))
+
+	roundTrip := func(err error) error {
+		buffer := &bytes.Buffer{}
+		T.ExpectSuccess(gob.NewEncoder(buffer).Encode(&gobError{Error: err}))
+		g := new(gobError)
+		T.ExpectSuccess(gob.NewDecoder(buffer).Decode(g))
+		T.Equal(g.Error.Error(), err.Error())
+		return g.Error
+	}
+
+	// A typical connection failure keeps every layer of its type.
+	refused := &url.Error{
+		Op:  "Get",
+		URL: "http://127.0.0.1:1/",
+		Err: &net.OpError{
+			Op:   "dial",
+			Net:  "tcp",
+			Addr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1},
+			Err: &os.SyscallError{
+				Syscall: "connect",
+				Err:     syscall.ECONNREFUSED,
+			},
+		},
+	}
+	err := roundTrip(refused)
+	var opErr *net.OpError
+	T.Equal(errors.As(err, &opErr), true)
+	T.Equal(opErr.Addr.String(), "127.0.0.1:1")
+	T.Equal(errors.Is(err, syscall.ECONNREFUSED), true)
+
+	// Wrapped errors of unknown types keep their message but not their type,
+	// and the original error is left alone.
+	wrapped := &url.Error{Op: "Get", URL: "http://x/", Err: customError("x")}
+	err = roundTrip(wrapped)
+	T.Equal(errors.Is(err, customError("x")), false)
+	T.Equal(wrapped.Err, customError("x"))
+
+	// Registered custom types are kept.
+	err = roundTrip(&registeredError{Code: 7, Err: errors.New("failed")})
+	var custom *registeredError
+	T.Equal(errors.As(err, &custom), true)
+	T.Equal(custom.Code, 7)
+
+	// Wrapped errors.New() errors keep their message.
+	err = roundTrip(&net.OpError{Op: "read", Net: "tcp", Err: io.EOF})
+	T.Equal(err.Error(), "read tcp: EOF")
+
+	// TLS alerts are replayed as tls.AlertError.
+	err = roundTrip(&net.OpError{Op: "remote error", Err: tls.AlertError(42)})
+	var alert tls.AlertError
+	T.Equal(errors.As(err, &alert), true)
+	T.Equal(alert, tls.AlertError(42))
+}
+
+// A net.Error implementation that is unknown to the decoder.
+type customNetError struct {
+	timeout bool
+}
+
+func (c customNetError) Error() string   { return "custom net error" }
+func (c customNetError) Timeout() bool   { return c.timeout }
+func (c customNetError) Temporary() bool { return !c.timeout }
+
+func TestGobError_NetError(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	for _, timeout := range []bool{true, false} {
+		original := &url.Error{
+			Op:  "Get",
+			URL: "http://x/",
+			Err: fmt.Errorf("wrapped: %w", customNetError{timeout: timeout}),
+		}
+		buffer := &bytes.Buffer{}
+		g := &gobError{Error: original}
+		T.ExpectSuccess(gob.NewEncoder(buffer).Encode(g))
+		g2 := new(gobError)
+		T.ExpectSuccess(gob.NewDecoder(buffer).Decode(g2))
+
+		// The type is lost but the net.Error methods are not.
+		T.Equal(g2.Error.Error(), original.Error())
+		var netErr net.Error
+		T.Equal(errors.As(g2.Error, &netErr), true)
+		T.Equal(netErr.Timeout(), timeout)
+		T.Equal(netErr.Temporary(), !timeout)
+		T.Equal(errors.As(g2.Error, new(customNetError)), false)
+	}
+
+	// Plain errors are not turned into net.Errors.
+	buffer := &bytes.Buffer{}
+	g := &gobError{Error: &url.Error{Op: "Get", URL: "/", Err: customError("x")}}
+	T.ExpectSuccess(gob.NewEncoder(buffer).Encode(g))
+	g2 := new(gobError)
+	T.ExpectSuccess(gob.NewDecoder(buffer).Decode(g2))
+	T.Equal(g2.Error.(*url.Error).Timeout(), false)
+	_, isNetErr := g2.Error.(*url.Error).Err.(net.Error)
+	T.Equal(isNetErr, false)
+}
+
+func TestGobError_ContextErrors(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	roundTrip := func(err error) error {
+		buffer := &bytes.Buffer{}
+		T.ExpectSuccess(gob.NewEncoder(buffer).Encode(&gobError{Error: err}))
+		g := new(gobError)
+		T.ExpectSuccess(gob.NewDecoder(buffer).Decode(g))
+		T.Equal(g.Error.Error(), err.Error())
+		return g.Error
+	}
+
+	// The context errors themselves come back as the same values.
+	T.Equal(roundTrip(context.Canceled) == context.Canceled, true)
+	T.Equal(roundTrip(context.DeadlineExceeded) == context.DeadlineExceeded, true)
+
+	// Including when wrapped by a registered type.
+	err := roundTrip(&url.Error{
+		Op:  "Get",
+		URL: "http://x/",
+		Err: context.DeadlineExceeded,
+	})
+	T.Equal(errors.Is(err, context.DeadlineExceeded), true)
+	var netErr net.Error
+	T.Equal(errors.As(err, &netErr), true)
+	T.Equal(netErr.Timeout(), true)
+
+	// Unknown types that wrap them keep their message.
+	err = roundTrip(fmt.Errorf("dial failed: %w", context.Canceled))
+	T.Equal(errors.Is(err, context.Canceled), true)
+	T.Equal(errors.Is(err, context.DeadlineExceeded), false)
+}
+
 func TestGobQuery_RequestResponse(t *testing.T) {
 	T := testlib.NewT(t)
 	defer T.Finish()
@@ -137,3 +292,43 @@ func TestSimpleCoverage(t *testing.T) {
 	T.Equal(newGobRequest(nil), nil)
 	T.Equal(newGobResponse(nil), nil)
 }
+
+func TestGobQuery_Clone(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	gq := &gobQuery{
+		Request: &gobRequest{
+			URL:    "http://api.example.com/",
+			Header: http.Header{"Authorization": []string{"secret"}},
+			Form:   url.Values{"password": []string{"secret"}},
+			Body:   []byte("secret"),
+			TLS:    &tls.ConnectionState{ServerName: "api.example.com"},
+		},
+		Response: &gobResponse{
+			StatusCode: 200,
+			Header:     http.Header{"Set-Cookie": []string{"secret"}},
+			Body:       []byte("secret"),
+		},
+		Partition: "TestClone",
+	}
+	c := gq.clone()
+	T.Equal(c, gq)
+
+	// Changing the copy leaves the original alone.
+	c.Request.Header.Set("Authorization", "redacted")
+	c.Request.Form.Set("password", "redacted")
+	copy(c.Request.Body, "XXXXXX")
+	c.Request.TLS.ServerName = "redacted"
+	c.Response.Header.Set("Set-Cookie", "redacted")
+	copy(c.Response.Body, "XXXXXX")
+	T.Equal(gq.Request.Header.Get("Authorization"), "secret")
+	T.Equal(gq.Request.Form.Get("password"), "secret")
+	T.Equal(string(gq.Request.Body), "secret")
+	T.Equal(gq.Request.TLS.ServerName, "api.example.com")
+	T.Equal(gq.Response.Header.Get("Set-Cookie"), "secret")
+	T.Equal(string(gq.Response.Body), "secret")
+
+	// Missing halves stay missing.
+	T.Equal((&gobQuery{}).clone(), &gobQuery{})
+}
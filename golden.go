@@ -0,0 +1,239 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvr
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// Set by -dvr.golden to check that services still respond the way that they
+// did when recorded. Each request is made for real and the response is
+// compared with its recording, after being obfuscated the way that it would
+// be if it were recorded. If they differ then the request fails with an
+// error that describes the difference, so a test run this way, such as in a
+// nightly job, fails when a service has drifted from its recordings. The
+// live response is returned otherwise, and requests without a recording are
+// passed through. IsPassingThrough() reports true in this mode.
+var goldenMode bool
+
+// Bodies with more lines than this are not diffed line by line since the
+// diff is quadratic.
+const maxDiffLines = 2000
+
+// This is the RoundTrip() call when -dvr.golden is set.
+func (r *roundTripper) compareLive(req *http.Request) (*http.Response, error) {
+	// The archive is read the same way that it is for replaying.
+	isSetup.Do(r.replaySetup)
+
+	reqBody, reqErr, rrMatch, matchIndex, err := matchRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	desc := liveCallDesc(req, requestOrigin())
+	if err := checkPassThroughAllowed(desc); err != nil {
+		return nil, err
+	}
+	resp, realErr := r.realRoundTripper.RoundTrip(req)
+	if rrMatch == nil {
+		trace("golden", req, "no recording to compare with, passed through")
+		return resp, realErr
+	}
+
+	// The live response is read so that it can be compared, and then
+	// obfuscated on a copy so that it is compared with what would have been
+	// recorded while the caller gets the response untouched.
+	live := &RequestResponse{
+		Request:          req,
+		RequestBody:      reqBody,
+		RequestBodyError: reqErr,
+		Response:         resp,
+		Error:            realErr,
+	}
+	if resp != nil && resp.Body != nil {
+		live.ResponseBody, live.ResponseBodyError = readBody(
+			resp.Body, resp.ContentLength)
+		resp.Body = &bodyWriter{
+			data: live.ResponseBody,
+			err:  live.ResponseBodyError,
+		}
+	}
+	if fs := obfuscators(); len(fs) > 0 {
+		live = newGobQuery(live).clone().RequestResponse()
+		for _, f := range fs {
+			if err := f(live); err != nil {
+				return nil, fmt.Errorf("dvr: -dvr.golden could not "+
+					"obfuscate the response to %s %s: %s",
+					req.Method, req.URL, err)
+			}
+		}
+	}
+
+	if isSpooled(matchIndex) {
+		body, err := loadSpooled(matchIndex)
+		if err != nil {
+			return nil, err
+		}
+		rrMatch.ResponseBody = body
+	}
+
+	diff := goldenDiff(rrMatch, live)
+	if diff == "" {
+		trace("golden", req, "matches entry %d", matchIndex)
+		return resp, realErr
+	}
+	trace("golden", req, "differs from entry %d", matchIndex)
+	return nil, fmt.Errorf("dvr: the live response to %s differs from "+
+		"its recording:\n%s", desc, diff)
+}
+
+// Describes how the live response differs from the recorded one, one line
+// for each difference, or returns an empty string if they are the same.
+// The status, Content-Type and body are compared since other headers, such
+// as Date, normally change from one request to the next.
+func goldenDiff(recorded, live *RequestResponse) string {
+	var b strings.Builder
+	switch {
+	case recorded.Response == nil && live.Response == nil:
+		if was, now := errorText(recorded.Error),
+			errorText(live.Error); was != now {
+			fmt.Fprintf(&b, "  error: recorded %q, live %q\n", was, now)
+		}
+		return b.String()
+	case live.Response == nil:
+		return fmt.Sprintf("  the request failed, it succeeded when "+
+			"recorded: %s\n", live.Error)
+	case recorded.Response == nil:
+		return fmt.Sprintf("  the request succeeded, it failed when "+
+			"recorded: %s\n", recorded.Error)
+	}
+
+	if was, now := recorded.Response.StatusCode,
+		live.Response.StatusCode; was != now {
+		fmt.Fprintf(&b, "  status: recorded %d, live %d\n", was, now)
+	}
+	if was, now := recorded.Response.Header.Get("Content-Type"),
+		live.Response.Header.Get("Content-Type"); was != now {
+		fmt.Fprintf(&b, "  Content-Type: recorded %q, live %q\n", was, now)
+	}
+	was, now := recorded.ResponseBody, live.ResponseBody
+	if bytes.Equal(was, now) {
+		return b.String()
+	}
+
+	// JSON bodies are compared by value and diffed with their keys sorted
+	// so that the order that fields were encoded in doesn't matter.
+	var wasValue, nowValue interface{}
+	if json.Unmarshal(was, &wasValue) == nil &&
+		json.Unmarshal(now, &nowValue) == nil {
+		if reflect.DeepEqual(wasValue, nowValue) {
+			return b.String()
+		}
+		was, _ = json.MarshalIndent(wasValue, "", "  ")
+		now, _ = json.MarshalIndent(nowValue, "", "  ")
+	}
+	b.WriteString("  body (- recorded, + live):\n")
+	b.WriteString(diffLines(
+		strings.Split(string(was), "\n"), strings.Split(string(now), "\n")))
+	return b.String()
+}
+
+// Returns the text of an error, or an empty string if it is nil.
+func errorText(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// Returns a diff of two lists of lines, with the lines removed from a
+// prefixed by "-", those added in b by "+", and up to two unchanged lines
+// around each change. Longer runs of unchanged lines are replaced by "...".
+func diffLines(a, b []string) string {
+	if len(a) > maxDiffLines || len(b) > maxDiffLines {
+		return fmt.Sprintf("    %d lines were recorded and %d returned, "+
+			"too many to diff\n", len(a), len(b))
+	}
+
+	// lcs[i][j] is the length of the longest common subsequence of a[i:]
+	// and b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			switch {
+			case a[i] == b[j]:
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				lcs[i][j] = lcs[i+1][j]
+			default:
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	// Walk the table to produce each line of the diff.
+	var lines []string
+	for i, j := 0, 0; i < len(a) || j < len(b); {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			lines = append(lines, " "+a[i])
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			lines = append(lines, "-"+a[i])
+			i++
+		default:
+			lines = append(lines, "+"+b[j])
+			j++
+		}
+	}
+
+	// Only the changes and the lines around them are kept.
+	if lcs[0][0] == len(a) && len(a) == len(b) {
+		return ""
+	}
+	const context = 2
+	changed := func(i int) bool {
+		return i >= 0 && i < len(lines) && lines[i][0] != ' '
+	}
+	var out strings.Builder
+	skipped := false
+	for i, line := range lines {
+		near := false
+		for d := -context; d <= context; d++ {
+			near = near || changed(i+d)
+		}
+		if !near {
+			skipped = true
+			continue
+		}
+		if skipped {
+			out.WriteString("    ...\n")
+			skipped = false
+		}
+		out.WriteString("    " + line + "\n")
+	}
+	if skipped {
+		out.WriteString("    ...\n")
+	}
+	return out.String()
+}
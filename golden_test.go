@@ -0,0 +1,122 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvr
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/liquidgecka/testlib"
+)
+
+func TestGolden(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+	defer resetBenchmark()
+	defer func() { goldenMode = false }()
+
+	same := testQuery("GET", "http://x/same", "", 200, `{"a":1,"b":"X"}`)
+	drift := testQuery("GET", "http://x/drift", "", 200, "one\ntwo\nthree")
+	fileName = filepath.Join(T.TempDir(), "archive.dvr")
+	T.ExpectSuccess(writeArchiveFile(fileName, []*gobQuery{same, drift}))
+	remove := AddObfuscator(func(rr *RequestResponse) {
+		setResponseBody(rr, bytes.Replace(rr.ResponseBody,
+			[]byte("secret"), []byte("X"), -1))
+	})
+	defer remove()
+
+	goldenMode = true
+	isSetup = sync.Once{}
+	T.Equal(IsPassingThrough(), true)
+	live := map[string]string{
+		"http://x/same":  `{"b":"secret","a":1}`,
+		"http://x/drift": "one\n2\nthree",
+		"http://x/new":   "new",
+	}
+	rt := &roundTripper{realRoundTripper: roundTripperFunc(
+		func(req *http.Request) (*http.Response, error) {
+			status := 200
+			if req.URL.Path == "/drift" {
+				status = 500
+			}
+			body := live[req.URL.String()]
+			return &http.Response{
+				StatusCode: status,
+				Header:     http.Header{"Content-Type": {"text/plain"}},
+				Body:       ioutil.NopCloser(strings.NewReader(body)),
+			}, nil
+		})}
+	get := func(url string) (string, error) {
+		req, err := http.NewRequest("GET", url, nil)
+		T.ExpectSuccess(err)
+		resp, err := rt.RoundTrip(req)
+		if err != nil {
+			return "", err
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		T.ExpectSuccess(err)
+		return string(body), nil
+	}
+
+	// The caller gets the live response, which is compared after being
+	// obfuscated and with JSON fields in any order.
+	body, err := get("http://x/same")
+	T.ExpectSuccess(err)
+	T.Equal(body, `{"b":"secret","a":1}`)
+
+	// Requests without a recording are passed through.
+	body, err = get("http://x/new")
+	T.ExpectSuccess(err)
+	T.Equal(body, "new")
+
+	_, err = get("http://x/drift")
+	T.ExpectErrorMessage(err, "dvr: the live response to GET "+
+		"http://x/drift (in TestGolden at golden_test.go:")
+	T.ExpectErrorMessage(err, "  status: recorded 200, live 500\n"+
+		"  body (- recorded, + live):\n"+
+		"     one\n"+
+		"    -two\n"+
+		"    +2\n"+
+		"     three\n")
+}
+
+func TestDiffLines(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	T.Equal(diffLines([]string{"a"}, []string{"a"}), "")
+	T.Equal(diffLines(
+		[]string{"1", "2", "3", "4", "5", "6", "7"},
+		[]string{"1", "2", "3", "4", "5", "6", "8", "9"}),
+		"    ...\n"+
+			"     5\n"+
+			"     6\n"+
+			"    -7\n"+
+			"    +8\n"+
+			"    +9\n")
+	T.Equal(diffLines([]string{"x", "1", "2", "3", "4", "5", "6"},
+		[]string{"1", "2", "3", "4", "5", "6"}),
+		"    -x\n"+
+			"     1\n"+
+			"     2\n"+
+			"    ...\n")
+	T.Equal(diffLines(make([]string, maxDiffLines+1), nil),
+		"    2001 lines were recorded and 0 returned, too many to diff\n")
+}
@@ -0,0 +1,170 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvr
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/url"
+	"strings"
+)
+
+// The persisted query extension of a GraphQL request, as sent by Apollo
+// style clients.
+type graphQLExtensions struct {
+	PersistedQuery *struct {
+		Version    int    `json:"version"`
+		Sha256Hash string `json:"sha256Hash"`
+	} `json:"persistedQuery"`
+}
+
+// Returns the persisted query hash of a GraphQL request given its query text
+// and extensions, or "" if it is not a GraphQL request.
+func graphQLHash(query string, extensions []byte) string {
+	if len(extensions) > 0 {
+		var ext graphQLExtensions
+		if json.Unmarshal(extensions, &ext) == nil &&
+			ext.PersistedQuery != nil && ext.PersistedQuery.Sha256Hash != "" {
+			return ext.PersistedQuery.Sha256Hash
+		}
+	}
+	if query == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(query))
+	return hex.EncodeToString(sum[:])
+}
+
+// The canonical extensions for a persisted query with the given hash.
+func graphQLPersistedExtensions(hash string) []byte {
+	return []byte(`{"persistedQuery":{"sha256Hash":"` + hash + `","version":1}}`)
+}
+
+// Converts a single GraphQL request object into its hash only form. Returns
+// nil if the object is not a GraphQL request.
+func canonicalGraphQLOperation(raw json.RawMessage) json.RawMessage {
+	var op map[string]json.RawMessage
+	if json.Unmarshal(raw, &op) != nil {
+		return nil
+	}
+	var query string
+	if q, ok := op["query"]; ok && json.Unmarshal(q, &query) != nil {
+		return nil
+	}
+	hash := graphQLHash(query, op["extensions"])
+	if hash == "" {
+		return nil
+	}
+	delete(op, "query")
+	op["extensions"] = graphQLPersistedExtensions(hash)
+	data, err := json.Marshal(op)
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+// Converts a GraphQL request body, which is either a single operation or a
+// batch of them, into its hash only form. Returns nil if the body is not a
+// GraphQL request.
+func canonicalGraphQLBody(body []byte) []byte {
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) == 0 {
+		return nil
+	} else if trimmed[0] != '[' {
+		return canonicalGraphQLOperation(trimmed)
+	}
+	var batch []json.RawMessage
+	if json.Unmarshal(trimmed, &batch) != nil {
+		return nil
+	}
+	for i, op := range batch {
+		if batch[i] = canonicalGraphQLOperation(op); batch[i] == nil {
+			return nil
+		}
+	}
+	data, err := json.Marshal(batch)
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+// Normalizes GraphQL requests sent to the configured endpoints.
+type graphQLNormalizer struct {
+	paths map[string]bool
+}
+
+// Returns true if the request was sent to a GraphQL endpoint.
+func (g *graphQLNormalizer) endpoint(u *url.URL) bool {
+	if len(g.paths) == 0 {
+		return strings.HasSuffix(u.Path, "/graphql")
+	}
+	return g.paths[u.Path]
+}
+
+// Rewrites the request into its hash only form.
+func (g *graphQLNormalizer) normalize(rr *RequestResponse) {
+	if rr.Request == nil || rr.Request.URL == nil ||
+		!g.endpoint(rr.Request.URL) {
+		return
+	}
+
+	// GET requests carry the operation in the query string.
+	u := rr.Request.URL
+	if values, err := url.ParseQuery(u.RawQuery); err == nil {
+		hash := graphQLHash(values.Get("query"),
+			[]byte(values.Get("extensions")))
+		if hash != "" {
+			values.Del("query")
+			values.Set("extensions", string(graphQLPersistedExtensions(hash)))
+			u.RawQuery = values.Encode()
+		}
+	}
+
+	if body := canonicalGraphQLBody(rr.RequestBody); body != nil {
+		rr.RequestBody = body
+		if rr.Request.ContentLength > 0 {
+			rr.Request.ContentLength = int64(len(body))
+		}
+	}
+}
+
+// NormalizeGraphQL allows GraphQL requests using automatic persisted queries
+// to match recordings made with the full query text, and the other way
+// around. Apollo style clients send either the query text or only its
+// SHA-256 hash (in the "persistedQuery" extension) depending on what the
+// server has cached, so the form of each request changes between runs.
+//
+// Requests are rewritten into the hash only form, with the hash computed from
+// the query text when it is present, both when recording and when matching
+// incoming requests in replay mode. Batched requests and GET requests are
+// supported. Note that this means the query text is not kept in the archive.
+//
+// Only requests to the given URL paths are changed. If no paths are given
+// then requests to any path ending in "/graphql" are.
+//
+// This adds a symmetric obfuscator to the chain, the returned function
+// removes it.
+func NormalizeGraphQL(paths ...string) (remove func()) {
+	g := &graphQLNormalizer{paths: make(map[string]bool)}
+	for _, path := range paths {
+		g.paths[path] = true
+	}
+	return addSymmetricObfuscator(
+		"NormalizeGraphQL("+strings.Join(paths, ", ")+")", g.normalize)
+}
@@ -0,0 +1,98 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvr
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/liquidgecka/testlib"
+)
+
+func TestNormalizeGraphQL(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+	defer ResetObfuscators()
+
+	query := "query Item($id: ID!) { item(id: $id) { name } }"
+	sum := sha256.Sum256([]byte(query))
+	hash := hex.EncodeToString(sum[:])
+	g := &graphQLNormalizer{}
+
+	newRR := func(rawurl, body string) *RequestResponse {
+		u, err := url.Parse(rawurl)
+		T.ExpectSuccess(err)
+		return &RequestResponse{
+			Request: &http.Request{
+				URL:           u,
+				ContentLength: int64(len(body)),
+			},
+			RequestBody: []byte(body),
+		}
+	}
+
+	// The full query and the hash only form normalize the same way.
+	full := newRR("http://api/graphql", `{"query": "`+query+`",`+
+		` "operationName": "Item", "variables": {"id": 1}}`)
+	hashOnly := newRR("http://api/graphql", `{"operationName":"Item",`+
+		`"variables":{"id":1},"extensions":{"persistedQuery":`+
+		`{"version":1,"sha256Hash":"`+hash+`"}}}`)
+	g.normalize(full)
+	g.normalize(hashOnly)
+	expected := `{"extensions":{"persistedQuery":{"sha256Hash":"` + hash +
+		`","version":1}},"operationName":"Item","variables":{"id":1}}`
+	T.Equal(string(full.RequestBody), expected)
+	T.Equal(string(hashOnly.RequestBody), expected)
+	T.Equal(full.Request.ContentLength, int64(len(expected)))
+
+	// Batches.
+	batch := newRR("http://api/graphql", `[{"query":"`+query+`"}]`)
+	g.normalize(batch)
+	T.Equal(string(batch.RequestBody), `[{"extensions":{"persistedQuery":`+
+		`{"sha256Hash":"`+hash+`","version":1}}}]`)
+
+	// GET requests.
+	get := newRR("http://api/graphql?operationName=Item&query="+
+		url.QueryEscape(query), "")
+	g.normalize(get)
+	values, err := url.ParseQuery(get.Request.URL.RawQuery)
+	T.ExpectSuccess(err)
+	T.Equal(values.Get("query"), "")
+	T.Equal(values.Get("operationName"), "Item")
+	T.Equal(values.Get("extensions"), `{"persistedQuery":{"sha256Hash":"`+
+		hash+`","version":1}}`)
+
+	// Other endpoints and bodies are left alone.
+	other := newRR("http://api/search", `{"query":"shoes"}`)
+	g.normalize(other)
+	T.Equal(string(other.RequestBody), `{"query":"shoes"}`)
+	notGraphQL := newRR("http://api/graphql", `{"name":"x"}`)
+	g.normalize(notGraphQL)
+	T.Equal(string(notGraphQL.RequestBody), `{"name":"x"}`)
+
+	// Only the configured paths when given.
+	g = &graphQLNormalizer{paths: map[string]bool{"/api": true}}
+	custom := newRR("http://api/api", `{"query":"`+query+`"}`)
+	g.normalize(custom)
+	T.NotEqual(string(custom.RequestBody), `{"query":"`+query+`"}`)
+
+	remove := NormalizeGraphQL()
+	T.Equal(len(replayNormalizers()), 1)
+	remove()
+	T.Equal(len(replayNormalizers()), 0)
+}
@@ -15,9 +15,12 @@
 package dvr
 
 import (
+	"bufio"
 	"compress/gzip"
+	"fmt"
 	"io"
 	"os"
+	"strconv"
 )
 
 // This token allows us to intercept startup and therefor act as a command
@@ -29,6 +32,43 @@ import (
 // that it is impossible to close a gzip file.
 const InterceptorToken = "dvr_gzipper_token_a9s87d9aish2"
 
+// Set by -dvr.compression to choose how hard the archive is compressed when
+// recording: "none", "fast" or "best". Compressing less makes record runs
+// with large bodies faster at the cost of a larger archive. Archives are
+// read the same way whatever this was set to.
+var compression = "best"
+
+// Returns the gzip level that -dvr.compression names.
+func compressionLevel() (int, error) {
+	switch compression {
+	case "none":
+		return gzip.NoCompression, nil
+	case "fast":
+		return gzip.BestSpeed, nil
+	case "best":
+		return gzip.BestCompression, nil
+	default:
+		return 0, fmt.Errorf("dvr: unknown -dvr.compression %q, expected "+
+			"none, fast or best", compression)
+	}
+}
+
+// Close() writes this to the gzipper as an entry after the last one. A
+// recording only replaces the archive if it ends with this, since the pipe to the gzipper is
+// also closed when the test binary panics, calls os.Exit() or is killed part
+// way through a run.
+const completeToken = "dvr_recording_complete_7c1e95b0d34a"
+
+// Passed to the gzipper after the segment directory when -dvr.flush_interval
+// is set, in which case a block is ended after each write to the archive.
+const gzipperFlushArg = "flush"
+
+// Returns the temporary file that the archive at path is recorded into before
+// it replaces the archive.
+func recordingPath(path string) string {
+	return path + ".recording"
+}
+
 // At startup check the args and intercept if necessary.
 func init() {
 	initGzipper(os.Args, os.Stdin, os.Stdout, os.Exit)
@@ -36,24 +76,95 @@ func init() {
 
 // This function is setup to be tested, hence the awkward footprint.
 func initGzipper(args []string, in, out *os.File, exit func(int)) {
-	if len(args) != 2 {
+	if len(args) < 2 || len(args) > 6 {
 		return
 	} else if args[1] != InterceptorToken {
 		return
 	}
 
-	// We are in interceptor mode. Intercept and gzip stdin to stdout.
-	compressor, err := gzip.NewWriterLevel(out, 9)
-	panicIfError(err)
+	// We are in interceptor mode. The compression level follows the token,
+	// though older versions of this library didn't pass it.
+	level := gzip.BestCompression
+	if len(args) >= 3 {
+		var err error
+		level, err = strconv.Atoi(args[2])
+		panicIfError(err)
+	}
 
-	// Compress.
-	_, err = io.Copy(compressor, in)
-	panicIfError(err)
+	// Older versions of this library didn't pass the archive path, and
+	// have stdin compressed into stdout as a single stream.
+	if len(args) < 4 {
+		compressor, err := gzip.NewWriterLevel(out, level)
+		panicIfError(err)
+		_, err = io.Copy(compressor, in)
+		panicIfError(err)
+		panicIfError(compressor.Close())
+		exit(0)
+		return
+	}
 
-	// Close.
-	err = compressor.Close()
+	// Otherwise the archive path follows the compression level, and the
+	// output is the temporary file from recordingPath(), which replaces the
+	// archive once the recording is known to be complete. The entries are
+	// written into blocks, which are only ended as they are written when
+	// asked to since that compresses less.
+	offset, err := out.Seek(0, io.SeekCurrent)
 	panicIfError(err)
+	blocks := newBlockWriter(out, offset, level)
+	flush := len(args) == 6 && args[5] == gzipperFlushArg
+	input := bufio.NewReader(in)
+	next := entryReader(archiveVersion, input)
+	complete := false
+	for {
+		data, err := next()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		panicIfError(err)
+		if complete = string(data) == completeToken; complete {
+			continue
+		}
+		panicIfError(blocks.writeEntry(data))
+
+		// With -dvr.flush_interval the entries come in a write for each
+		// interval, so the block is ended once no more are waiting.
+		if flush && input.Buffered() == 0 {
+			panicIfError(blocks.endBlock())
+		}
+	}
+	if !complete {
+		discardRecording(args, out)
+		exit(1)
+		return
+	}
+
+	// The directory that helper processes recorded their segments into
+	// follows the archive path. They are appended now that the recording
+	// process has finished.
+	if len(args) >= 5 {
+		panicIfError(mergeSegments(blocks, args[4]))
+	}
+
+	// Close, and replace the archive now that it is complete.
+	panicIfError(blocks.close())
+	panicIfError(out.Sync())
+	panicIfError(os.Rename(recordingPath(args[3]), args[3]))
 
 	// Success!
 	exit(0)
 }
+
+// Removes the recording of the archive named in args, along with any segments
+// that helper processes recorded, when the recording process exited without
+// calling Close(). The archive is left as it was before the run.
+func discardRecording(args []string, out *os.File) {
+	out.Close()
+	os.Remove(recordingPath(args[3]))
+	if len(args) >= 5 {
+		os.RemoveAll(args[4])
+	}
+	fmt.Fprintf(os.Stderr, "dvr: %s was left unchanged since the process "+
+		"recording it exited without calling dvr.Close(), which record runs "+
+		"must call once the tests have finished, for example from "+
+		"TestMain\n", args[3])
+}
@@ -15,9 +15,13 @@
 package dvr
 
 import (
+	"bytes"
 	"compress/gzip"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/liquidgecka/testlib"
 )
@@ -71,9 +75,107 @@ func TestGzipper(t *testing.T) {
 	T.ExpectSuccess(err)
 	reader, err := gzip.NewReader(fd)
 	T.ExpectSuccess(err)
-	var readData []byte = make([]byte, 1024)
-	n, err := reader.Read(readData)
+	// The reader may return io.EOF along with the last of the data, so it
+	// is read to the end.
+	readData, err := ioutil.ReadAll(reader)
 	T.ExpectSuccess(err)
-	T.Equal(n, len(data))
-	T.Equal(readData[0:n], data)
+	T.Equal(readData, data)
+}
+
+func TestCompressionLevel(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+	defer func() { compression = "best" }()
+
+	for name, want := range map[string]int{
+		"none": gzip.NoCompression,
+		"fast": gzip.BestSpeed,
+		"best": gzip.BestCompression,
+	} {
+		compression = name
+		level, err := compressionLevel()
+		T.ExpectSuccess(err)
+		T.Equal(level, want)
+	}
+	compression = "fastest"
+	_, err := compressionLevel()
+	T.ExpectErrorMessage(err, `unknown -dvr.compression "fastest"`)
+
+	// Archives that aren't compressed are still gzip streams.
+	compression = "none"
+	in := T.TempFile()
+	out := T.TempFile()
+	_, err = in.WriteString("uncompressed")
+	T.ExpectSuccess(err)
+	_, err = in.Seek(0, 0)
+	T.ExpectSuccess(err)
+	initGzipper([]string{os.Args[0], InterceptorToken, "0"}, in, out,
+		func(int) {})
+	fd, err := os.Open(out.Name())
+	T.ExpectSuccess(err)
+	defer fd.Close()
+	reader, err := gzip.NewReader(fd)
+	T.ExpectSuccess(err)
+	data, err := ioutil.ReadAll(reader)
+	T.ExpectSuccess(err)
+	T.Equal(string(data), "uncompressed")
+}
+
+func TestGzipperFlush(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	// Returns true if the entry written so far can be read from the file.
+	readable := func(path string) bool {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return false
+		}
+		next, err := archiveEntries(2, bytes.NewReader(data))
+		if err != nil {
+			return false
+		}
+		entry, err := next()
+		return err == nil && string(entry) == "entry"
+	}
+
+	// Blocks are only ended as entries are written when asked to, which is
+	// done for -dvr.flush_interval.
+	for _, flush := range []bool{false, true} {
+		dir := T.TempDir()
+		path := filepath.Join(dir, "archive.dvr")
+		out, err := os.Create(recordingPath(path))
+		T.ExpectSuccess(err)
+		in, pipe, err := os.Pipe()
+		T.ExpectSuccess(err)
+		args := []string{os.Args[0], InterceptorToken, "9", path,
+			filepath.Join(dir, "segments")}
+		if flush {
+			args = append(args, gzipperFlushArg)
+		}
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			initGzipper(args, in, out, func(int) {})
+		}()
+
+		T.ExpectSuccess(writeEntry(pipe, []byte("entry")))
+		if flush {
+			deadline := time.Now().Add(5 * time.Second)
+			for !readable(recordingPath(path)) && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+			T.Equal(readable(recordingPath(path)), true)
+		} else {
+			time.Sleep(50 * time.Millisecond)
+			T.Equal(readable(recordingPath(path)), false)
+		}
+
+		// Either way the archive is complete once the recording is.
+		T.ExpectSuccess(writeEntry(pipe, []byte(completeToken)))
+		T.ExpectSuccess(pipe.Close())
+		<-done
+		in.Close()
+		T.Equal(readable(path), true)
+	}
 }
@@ -0,0 +1,155 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvr
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// The JSON layout of a ".replay" file written by the httpreplay package from
+// github.com/google/go-replayers.
+type httpReplayLog struct {
+	Initial []byte
+	Version string
+	Entries []*struct {
+		ID      string
+		Request *struct {
+			Method    string
+			URL       string
+			Header    http.Header
+			MediaType string
+			BodyParts [][]byte
+			Trailer   http.Header
+		}
+		Response *struct {
+			StatusCode int
+			Proto      string
+			ProtoMajor int
+			ProtoMinor int
+			Header     http.Header
+			Body       []byte
+			Trailer    http.Header
+		}
+	}
+}
+
+// ImportHTTPReplay converts the entries in a ".replay" file written by the
+// httpreplay package from github.com/google/go-replayers (used by the tests of
+// cloud.google.com/go) into recordings that can be written to an archive with
+// WriteArchiveFile(). The initial state stored in the file is not kept since
+// dvr has no equivalent.
+//
+// httpreplay stores the parts of multipart request bodies without their
+// headers, so these bodies are rebuilt using the boundary from the recorded
+// Content-Type header and will not be byte for byte the same as the body
+// that was sent. Since clients pick a random boundary for each request these
+// requests need a custom Matcher in any case.
+func ImportHTTPReplay(r io.Reader) ([]*RequestResponse, error) {
+	var log httpReplayLog
+	if err := json.NewDecoder(r).Decode(&log); err != nil {
+		return nil, fmt.Errorf("httpreplay: %s", err)
+	} else if !strings.HasPrefix(log.Version, "0.") {
+		return nil, fmt.Errorf(
+			"httpreplay: unsupported version %q", log.Version)
+	}
+
+	rrs := make([]*RequestResponse, 0, len(log.Entries))
+	for _, entry := range log.Entries {
+		if entry == nil || entry.Request == nil {
+			continue
+		}
+		u, err := url.Parse(entry.Request.URL)
+		if err != nil {
+			return nil, fmt.Errorf("httpreplay: entry %s: %s", entry.ID, err)
+		}
+
+		rr := &RequestResponse{}
+		rr.Request = &http.Request{
+			Method:     entry.Request.Method,
+			URL:        u,
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     entry.Request.Header,
+			Trailer:    entry.Request.Trailer,
+			Host:       u.Host,
+		}
+		if rr.Request.Header == nil {
+			rr.Request.Header = http.Header{}
+		}
+		rr.RequestBody = httpReplayBody(
+			rr.Request.Header, entry.Request.MediaType, entry.Request.BodyParts)
+		rr.Request.ContentLength = int64(len(rr.RequestBody))
+
+		if resp := entry.Response; resp != nil {
+			rr.Response = &http.Response{
+				Status: strconv.Itoa(resp.StatusCode) + " " +
+					http.StatusText(resp.StatusCode),
+				StatusCode: resp.StatusCode,
+				Proto:      resp.Proto,
+				ProtoMajor: resp.ProtoMajor,
+				ProtoMinor: resp.ProtoMinor,
+				Header:     resp.Header,
+				Trailer:    resp.Trailer,
+			}
+			if rr.Response.Header == nil {
+				rr.Response.Header = http.Header{}
+			}
+			rr.ResponseBody = decodeGzipBody(rr.Response, resp.Body)
+			rr.Response.ContentLength = int64(len(rr.ResponseBody))
+		}
+		rrs = append(rrs, rr)
+	}
+	return rrs, nil
+}
+
+// Rebuilds a request body from the parts stored by httpreplay.
+func httpReplayBody(header http.Header, mediaType string, parts [][]byte) []byte {
+	if !strings.HasPrefix(mediaType, "multipart/") {
+		if len(parts) == 0 {
+			return nil
+		}
+		return bytes.Join(parts, nil)
+	}
+
+	buffer := &bytes.Buffer{}
+	writer := multipart.NewWriter(buffer)
+	_, params, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	if boundary := params["boundary"]; boundary != "" {
+		if writer.SetBoundary(boundary) != nil {
+			writer = multipart.NewWriter(buffer)
+		}
+	}
+	for _, part := range parts {
+		w, err := writer.CreatePart(nil)
+		if err != nil {
+			return nil
+		}
+		w.Write(part)
+	}
+	writer.Close()
+	header.Set("Content-Type", mime.FormatMediaType(mediaType,
+		map[string]string{"boundary": writer.Boundary()}))
+	return buffer.Bytes()
+}
@@ -0,0 +1,115 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvr
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/liquidgecka/testlib"
+)
+
+func TestImportHTTPReplay(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	b64 := func(s string) string {
+		return base64.StdEncoding.EncodeToString([]byte(s))
+	}
+	log := `{
+		"Initial": "` + b64("seed") + `",
+		"Version": "0.2",
+		"Converter": {"ClearHeaders": ["Authorization"]},
+		"Entries": [{
+			"ID": "a1",
+			"Request": {
+				"Method": "GET",
+				"URL": "https://storage.googleapis.com/b/bucket/o?alt=json",
+				"Header": {"Accept": ["application/json"]},
+				"MediaType": "",
+				"BodyParts": [""]
+			},
+			"Response": {
+				"StatusCode": 200,
+				"Proto": "HTTP/1.1",
+				"ProtoMajor": 1,
+				"ProtoMinor": 1,
+				"Header": {"Content-Type": ["application/json"]},
+				"Body": "` + b64(`{"items":[]}`) + `"
+			}
+		}, {
+			"ID": "a2",
+			"Request": {
+				"Method": "POST",
+				"URL": "https://storage.googleapis.com/upload/b/bucket/o",
+				"Header": {
+					"Content-Type": ["multipart/related; boundary=abc"]
+				},
+				"MediaType": "multipart/related",
+				"BodyParts": ["` + b64(`{"name":"x"}`) + `", "` + b64("data") + `"]
+			},
+			"Response": {
+				"StatusCode": 404,
+				"Proto": "HTTP/1.1",
+				"ProtoMajor": 1,
+				"ProtoMinor": 1,
+				"Header": null,
+				"Body": null
+			}
+		}]
+	}`
+
+	rrs, err := ImportHTTPReplay(strings.NewReader(log))
+	T.ExpectSuccess(err)
+	T.Equal(len(rrs), 2)
+
+	T.Equal(rrs[0].Request.Method, "GET")
+	T.Equal(rrs[0].Request.URL.String(),
+		"https://storage.googleapis.com/b/bucket/o?alt=json")
+	T.Equal(rrs[0].Request.Host, "storage.googleapis.com")
+	T.Equal(len(rrs[0].RequestBody), 0)
+	T.Equal(rrs[0].Response.Status, "200 OK")
+	T.Equal(string(rrs[0].ResponseBody), `{"items":[]}`)
+	T.Equal(rrs[0].Response.ContentLength, int64(12))
+
+	// The multipart body is rebuilt with the recorded boundary.
+	mediaType, params, err := mime.ParseMediaType(
+		rrs[1].Request.Header.Get("Content-Type"))
+	T.ExpectSuccess(err)
+	T.Equal(mediaType, "multipart/related")
+	T.Equal(params["boundary"], "abc")
+	reader := multipart.NewReader(
+		strings.NewReader(string(rrs[1].RequestBody)), "abc")
+	for _, want := range []string{`{"name":"x"}`, "data"} {
+		part, err := reader.NextPart()
+		T.ExpectSuccess(err)
+		data, err := ioutil.ReadAll(part)
+		T.ExpectSuccess(err)
+		T.Equal(string(data), want)
+	}
+	T.Equal(rrs[1].Response.StatusCode, 404)
+	T.Equal(rrs[1].Response.Header, http.Header{})
+
+	// Other files are rejected.
+	_, err = ImportHTTPReplay(strings.NewReader(`{"Version": "1.0"}`))
+	T.ExpectErrorMessage(err, "unsupported version")
+	_, err = ImportHTTPReplay(strings.NewReader(`not json`))
+	T.ExpectError(err)
+}
@@ -0,0 +1,88 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvr
+
+import (
+	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
+)
+
+// An informational (1xx) response that the server sent before the final
+// response, such as 100 Continue or 103 Early Hints. The transport does not
+// return these to the caller, they are only seen through the
+// httptrace.ClientTrace hooks.
+type InterimResponse struct {
+	StatusCode int
+	Header     http.Header
+}
+
+// Delivers recorded interim responses to the httptrace.ClientTrace of the
+// request, in the order the transport would: Got100Continue is called for
+// a 100 Continue, then Got1xxResponse for every response. An error returned
+// from Got1xxResponse fails the request, as it does with the transport.
+func replayInterim(req *http.Request, responses []InterimResponse) error {
+	trace := httptrace.ContextClientTrace(req.Context())
+	if trace == nil {
+		return nil
+	}
+	for _, resp := range responses {
+		if resp.StatusCode == http.StatusContinue &&
+			trace.Got100Continue != nil {
+			trace.Got100Continue()
+		}
+		if trace.Got1xxResponse != nil {
+			err := trace.Got1xxResponse(resp.StatusCode,
+				textproto.MIMEHeader(resp.Header.Clone()))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Returns a deep copy of the interim responses, keeping nil as nil.
+func cloneInterim(responses []InterimResponse) []InterimResponse {
+	if responses == nil {
+		return nil
+	}
+	c := make([]InterimResponse, len(responses))
+	for i, resp := range responses {
+		c[i] = InterimResponse{
+			StatusCode: resp.StatusCode,
+			Header:     resp.Header.Clone(),
+		}
+	}
+	return c
+}
+
+// Writes the recorded interim responses to w ahead of the final response.
+// 100 Continue is left to the server, which sends it when the handler reads
+// the request body.
+func writeInterim(w http.ResponseWriter, responses []InterimResponse) {
+	for _, resp := range responses {
+		if resp.StatusCode == http.StatusContinue {
+			continue
+		}
+		for name, values := range resp.Header {
+			w.Header()[name] = values
+		}
+		w.WriteHeader(resp.StatusCode)
+		for name := range resp.Header {
+			delete(w.Header(), name)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvr
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+	"sync"
+	"testing"
+
+	"github.com/liquidgecka/testlib"
+)
+
+func TestRecordReplayInterim(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+	defer resetBenchmark()
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Link", "</style.css>; rel=preload")
+			w.WriteHeader(http.StatusEarlyHints)
+			w.Header().Del("Link")
+			w.Write([]byte("ok"))
+		}))
+	defer server.Close()
+
+	// Returns a request whose trace collects the interim responses, and
+	// fails them with err if it is set.
+	var got []string
+	newRequest := func(err error) *http.Request {
+		got = nil
+		req, e := http.NewRequest("GET", server.URL+"/page", nil)
+		T.ExpectSuccess(e)
+		trace := &httptrace.ClientTrace{
+			Got1xxResponse: func(code int, h textproto.MIMEHeader) error {
+				got = append(got, fmt.Sprintf("%d %s", code, h.Get("Link")))
+				return err
+			},
+		}
+		return req.WithContext(
+			httptrace.WithClientTrace(req.Context(), trace))
+	}
+
+	// The interim response is recorded, and the caller's hook still sees
+	// it.
+	fileName = T.TempFile().Name()
+	record = true
+	RecordRequest = func(*http.Request) bool { return true }
+	isSetup = sync.Once{}
+	rt := &roundTripper{realRoundTripper: OriginalDefaultTransport}
+	req := newRequest(nil)
+	resp, err := rt.RoundTrip(req)
+	T.ExpectSuccess(err)
+	T.Equal(resp.Request, req)
+	T.ExpectSuccess(resp.Body.Close())
+	T.Equal(got, []string{"103 </style.css>; rel=preload"})
+	T.ExpectSuccess(Close())
+	rrs, err := ReadArchiveFile(fileName)
+	T.ExpectSuccess(err)
+	T.Equal(len(rrs), 1)
+	T.Equal(rrs[0].Interim, []InterimResponse{{
+		StatusCode: http.StatusEarlyHints,
+		Header:     http.Header{"Link": {"</style.css>; rel=preload"}},
+	}})
+
+	// It is delivered to the hook when replayed.
+	record = false
+	replay = true
+	isSetup = sync.Once{}
+	rt.realRoundTripper = roundTripperFunc(
+		func(req *http.Request) (*http.Response, error) {
+			return nil, errors.New("not matched")
+		})
+	resp, err = rt.RoundTrip(newRequest(nil))
+	T.ExpectSuccess(err)
+	body, err := ioutil.ReadAll(resp.Body)
+	T.ExpectSuccess(err)
+	T.Equal(string(body), "ok")
+	T.Equal(got, []string{"103 </style.css>; rel=preload"})
+
+	// An error from the hook fails the request as the transport would.
+	requestList = nil
+	isSetup = sync.Once{}
+	hookErr := errors.New("no early hints")
+	_, err = rt.RoundTrip(newRequest(hookErr))
+	T.Equal(err, hookErr)
+
+	// The archive server sends it ahead of the final response.
+	h, err := NewHandler(fileName)
+	T.ExpectSuccess(err)
+	replayServer := httptest.NewServer(h)
+	defer replayServer.Close()
+	req = newRequest(nil)
+	req.URL.Host = replayServer.Listener.Addr().String()
+	req.Host = ""
+	resp, err = OriginalDefaultTransport.RoundTrip(req)
+	T.ExpectSuccess(err)
+	T.ExpectSuccess(resp.Body.Close())
+	T.Equal(resp.StatusCode, http.StatusOK)
+	T.Equal(resp.Header.Get("Link"), "")
+	T.Equal(got, []string{"103 </style.css>; rel=preload"})
+}
@@ -0,0 +1,81 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvr
+
+import (
+	"sort"
+	"strings"
+)
+
+// Set by -dvr.labels to a comma separated list of labels, such as
+// "rate-limited" or "maintenance-window", which lets one archive hold
+// several variants of the same requests. Recordings are tagged with the
+// labels given when they are recorded, and recording with a set of labels
+// only replaces the recordings that have exactly that set, keeping the
+// others. When replaying, recordings are only used if all of their labels
+// are given, and those with labels are matched before those without, so an
+// archive of the usual responses can be overridden by a labelled variant
+// for just the requests that behave differently in it.
+var labels string
+
+// Returns the labels that -dvr.labels gives, sorted and without duplicates.
+func activeLabels() []string {
+	var active []string
+	for _, label := range strings.Split(labels, ",") {
+		if label = strings.TrimSpace(label); label != "" {
+			active = append(active, label)
+		}
+	}
+	sort.Strings(active)
+	unique := active[:0]
+	for i, label := range active {
+		if i == 0 || label != active[i-1] {
+			unique = append(unique, label)
+		}
+	}
+	if len(unique) == 0 {
+		return nil
+	}
+	return unique
+}
+
+// Identifies the set of sorted labels that a recording was tagged with.
+func labelKey(labels []string) string {
+	return strings.Join(labels, ",")
+}
+
+// Returns the queries that are replayed with the active labels. Queries with
+// more labels are more specific, so they are moved before those with fewer
+// to be matched first.
+func selectLabels(queries []*gobQuery) []*gobQuery {
+	active := make(map[string]bool)
+	for _, label := range activeLabels() {
+		active[label] = true
+	}
+	selected := make([]*gobQuery, 0, len(queries))
+	for _, q := range queries {
+		all := true
+		for _, label := range q.Labels {
+			all = all && active[label]
+		}
+		if all {
+			selected = append(selected, q)
+		}
+	}
+	sort.SliceStable(selected, func(i, j int) bool {
+		return len(selected[i].Labels) > len(selected[j].Labels)
+	})
+	return selected
+}
@@ -0,0 +1,112 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvr
+
+import (
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/liquidgecka/testlib"
+)
+
+func TestActiveLabels(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+	defer func() { labels = "" }()
+
+	labels = ""
+	T.Equal(len(activeLabels()), 0)
+	labels = " b, a,,b "
+	T.Equal(activeLabels(), []string{"a", "b"})
+}
+
+func TestLabels(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+	defer resetBenchmark()
+	defer func() { labels = "" }()
+
+	// The live service is rate limiting when the test records with that
+	// label.
+	rt := &roundTripper{realRoundTripper: roundTripperFunc(
+		func(req *http.Request) (*http.Response, error) {
+			status, body := 200, req.URL.Path
+			if labels == "rate-limited" && req.URL.Path == "/status" {
+				status, body = 429, "slow down"
+			}
+			return &http.Response{
+				StatusCode: status,
+				Body:       ioutil.NopCloser(strings.NewReader(body)),
+			}, nil
+		})}
+	get := func(url string) string {
+		req, err := http.NewRequest("GET", url, nil)
+		T.ExpectSuccess(err)
+		resp, err := rt.RoundTrip(req)
+		T.ExpectSuccess(err)
+		body, err := ioutil.ReadAll(resp.Body)
+		T.ExpectSuccess(err)
+		return string(body)
+	}
+	run := func(rec bool, set string, urls ...string) []string {
+		record, replay, labels = rec, !rec, set
+		isSetup = sync.Once{}
+		var bodies []string
+		for _, url := range urls {
+			bodies = append(bodies, get(url))
+		}
+		if rec {
+			T.ExpectSuccess(Close())
+		}
+		return bodies
+	}
+	fileName = filepath.Join(T.TempDir(), "archive.dvr")
+	RecordRequest = func(*http.Request) bool { return true }
+
+	// The variant only replaces the recordings with its labels.
+	run(true, "", "http://x/status", "http://x/other")
+	run(true, "rate-limited", "http://x/status")
+	run(true, "rate-limited", "http://x/status")
+	// The test's recordings are partitioned, so the ones superseded by a
+	// later run are kept until the archive is next recorded.
+	queries, err := readArchiveFile(fileName)
+	T.ExpectSuccess(err)
+	T.Equal(len(queries), 4)
+	queries = latestPartitions(queries)
+	T.Equal(len(queries), 3)
+	T.Equal(queries[2].Labels, []string{"rate-limited"})
+
+	// Labelled recordings are only replayed when their labels are given,
+	// and then before the others.
+	T.Equal(run(false, "", "http://x/status", "http://x/other"),
+		[]string{"/status", "/other"})
+	T.Equal(run(false, "rate-limited", "http://x/status", "http://x/other"),
+		[]string{"slow down", "/other"})
+	T.Equal(run(false, "maintenance", "http://x/status"),
+		[]string{"/status"})
+
+	// Recording without labels keeps the variants.
+	run(true, "", "http://x/status")
+	queries, err = readArchiveFile(fileName)
+	T.ExpectSuccess(err)
+	queries = latestPartitions(queries)
+	T.Equal(len(queries), 2)
+	T.Equal(queries[0].Labels, []string{"rate-limited"})
+	T.Equal(len(queries[1].Labels), 0)
+}
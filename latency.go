@@ -0,0 +1,44 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvr
+
+import (
+	"net/http"
+	"time"
+)
+
+// If true then replayed requests take as long to return as they did when
+// they were recorded, and rate limited recordings are replayed until their
+// Retry-After has passed. See throttleUntil.
+var simulateLatency bool
+
+// Waits for the recorded duration of a request when -dvr.simulate_latency is
+// set. If the request's context is cancelled or its deadline passes first
+// then the context's error is returned at that moment, as it would be by a
+// live request, so client timeouts can be tested against recordings of slow
+// responses.
+func waitLatency(req *http.Request, d time.Duration) error {
+	if !simulateLatency || d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-req.Context().Done():
+		return req.Context().Err()
+	}
+}
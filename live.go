@@ -0,0 +1,152 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvr
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+var (
+	// The AssertNoLiveCalls() of each running test, which collect the live
+	// calls made by their tests. Nothing is kept when there are none.
+	liveTrackers     = map[*liveTracker]bool{}
+	liveTrackersLock sync.Mutex
+)
+
+// The live calls made by a test that called AssertNoLiveCalls().
+type liveTracker struct {
+	// The full name of the test, and the goroutine it called
+	// AssertNoLiveCalls() from.
+	name      string
+	goroutine int64
+
+	calls []string
+}
+
+// Returns true if a call made from the given goroutine in the given test,
+// as found by callOrigin(), was made by the tracker's test. A test found from
+// the stack only has the name of the top level test function, so it matches
+// all of that function's subtests.
+func (l *liveTracker) madeBy(goroutine int64, test string) bool {
+	switch {
+	case goroutine == l.goroutine || test == l.name:
+		return true
+	case test == "":
+		return false
+	case strings.HasPrefix(test, l.name+"/"):
+		return true
+	}
+	return !strings.Contains(test, "/") &&
+		strings.HasPrefix(l.name, test+"/")
+}
+
+// Notes that the given request is being sent to the real network. The origin
+// from requestOrigin is included so the offending test can be found.
+func noteLiveCall(req *http.Request, origin string) {
+	addLiveCall(liveCallDesc(req, origin))
+}
+
+// Notes that a connection made through InterceptDial() is being dialed on the
+// real network rather than replayed.
+func noteLiveDial(network, addr, origin string) {
+	desc := "dial " + network + " " + addr
+	if origin != "" {
+		desc += " (" + origin + ")"
+	}
+	addLiveCall(desc)
+}
+
+// Adds a description of a live call to the trackers of the test that made
+// it. A call that can't be tied to a test, for example one made from a
+// goroutine that a test started, is added to every running tracker.
+func addLiveCall(desc string) {
+	liveTrackersLock.Lock()
+	defer liveTrackersLock.Unlock()
+	if len(liveTrackers) == 0 {
+		return
+	}
+	test, _ := callOrigin()
+	id := goroutineID()
+	var matched []*liveTracker
+	for l := range liveTrackers {
+		if l.madeBy(id, test) {
+			matched = append(matched, l)
+		}
+	}
+	if len(matched) == 0 {
+		for l := range liveTrackers {
+			matched = append(matched, l)
+		}
+	}
+	for _, l := range matched {
+		l.calls = append(l.calls, desc)
+	}
+}
+
+// Describes a request being sent to the real network.
+func liveCallDesc(req *http.Request, origin string) string {
+	desc := req.Method
+	if desc == "" {
+		desc = "GET"
+	}
+	if req.URL != nil {
+		desc += " " + req.URL.String()
+	}
+	if origin != "" {
+		desc += " (" + origin + ")"
+	}
+	return desc
+}
+
+// AssertNoLiveCalls fails the given test if it sends a request through this
+// library to the real network from the time this is called until the test
+// completes. This happens when running in pass through mode, or when a
+// request can not be matched in replay mode. Nothing is checked while
+// recording since that requires live calls.
+//
+// Only calls made through this library can be seen: requests sent through
+// its RoundTripper, and connections made through InterceptDial(). This does
+// not catch every use of the network: clients that dial some other way, such
+// as a database driver or an http.Client with its own Transport, are not
+// seen at all.
+//
+// Calls are tied to the test that made them by the goroutine they were made
+// from, or by its Partition() or the test function on the stack, so tests
+// running in parallel are checked separately. Calls that can't be tied to a
+// test, such as those made from goroutines started by a test, count against
+// every test that is asserting this at the time.
+func AssertNoLiveCalls(t testing.TB) {
+	t.Helper()
+	l := &liveTracker{name: t.Name(), goroutine: goroutineID()}
+	liveTrackersLock.Lock()
+	liveTrackers[l] = true
+	liveTrackersLock.Unlock()
+
+	t.Cleanup(func() {
+		liveTrackersLock.Lock()
+		delete(liveTrackers, l)
+		calls := l.calls
+		liveTrackersLock.Unlock()
+		if IsRecording() {
+			return
+		}
+		for _, call := range calls {
+			t.Errorf("dvr: request was sent to the network: %s", call)
+		}
+	})
+}
@@ -0,0 +1,177 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/liquidgecka/testlib"
+)
+
+// A testing.TB that captures errors and cleanup functions rather than
+// acting on them.
+type fakeTB struct {
+	testing.TB
+	name     string
+	errors   []string
+	cleanups []func()
+}
+
+func (f *fakeTB) Helper() {}
+
+func (f *fakeTB) Name() string {
+	return f.name
+}
+
+func (f *fakeTB) Cleanup(c func()) {
+	f.cleanups = append(f.cleanups, c)
+}
+
+func (f *fakeTB) Errorf(format string, args ...interface{}) {
+	f.errors = append(f.errors, fmt.Sprintf(format, args...))
+}
+
+func (f *fakeTB) finish() {
+	for i := len(f.cleanups) - 1; i >= 0; i-- {
+		f.cleanups[i]()
+	}
+}
+
+func TestAssertNoLiveCalls(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	// Test 1: No live calls.
+	tb := &fakeTB{}
+	AssertNoLiveCalls(tb)
+	tb.finish()
+	T.Equal(len(tb.errors), 0)
+
+	// Test 2: A live call made after the assertion fails the test.
+	noteLiveCall(&http.Request{URL: &url.URL{Scheme: "http", Host: "a"}}, "")
+	tb = &fakeTB{}
+	AssertNoLiveCalls(tb)
+	noteLiveCall(&http.Request{
+		Method: "POST",
+		URL:    &url.URL{Scheme: "http", Host: "b", Path: "/x"},
+	}, "")
+	noteLiveCall(&http.Request{
+		URL: &url.URL{Scheme: "http", Host: "c"},
+	}, "in TestX at x_test.go:10")
+	tb.finish()
+	T.Equal(tb.errors, []string{
+		"dvr: request was sent to the network: POST http://b/x",
+		"dvr: request was sent to the network: GET http://c " +
+			"(in TestX at x_test.go:10)",
+	})
+}
+
+func TestAssertNoLiveCallsDial(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+	defer resetBenchmark()
+
+	// Connections made through InterceptDial() are counted too, both when
+	// passing through and when they match no recording while replaying.
+	errDial := errors.New("dialed")
+	dial := InterceptDial(
+		func(context.Context, string, string) (net.Conn, error) {
+			return nil, errDial
+		})
+	tb := &fakeTB{}
+	AssertNoLiveCalls(tb)
+	_, err := dial(context.Background(), "tcp", "db:5432")
+	T.Equal(err, errDial)
+
+	replay = true
+	fileName = filepath.Join(T.TempDir(), "archive.dvr")
+	T.ExpectSuccess(writeArchiveFile(fileName, nil))
+	_, err = dial(context.Background(), "tcp", "mail:25")
+	T.Equal(err, errDial)
+	tb.finish()
+	T.Equal(len(tb.errors), 2)
+	T.Equal(strings.HasPrefix(tb.errors[0], "dvr: request was sent to "+
+		"the network: dial tcp db:5432"), true)
+	T.Equal(strings.HasPrefix(tb.errors[1], "dvr: request was sent to "+
+		"the network: GET socket:///dial?addr=mail%3A25"), true)
+}
+
+func TestAssertNoLiveCallsPerTest(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	call := func(host string) {
+		noteLiveCall(&http.Request{
+			URL: &url.URL{Scheme: "http", Host: host},
+		}, "")
+	}
+
+	// Calls are only blamed on the test whose goroutine made them.
+	a := &fakeTB{name: "TestA"}
+	AssertNoLiveCalls(a)
+	b := &fakeTB{name: "TestB"}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		AssertNoLiveCalls(b)
+		call("b")
+	}()
+	wg.Wait()
+	call("a")
+
+	// A call from a goroutine that neither test is running on can't be
+	// tied to either of them, so both see it.
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		call("other")
+	}()
+	wg.Wait()
+
+	a.finish()
+	b.finish()
+	T.Equal(a.errors, []string{
+		"dvr: request was sent to the network: GET http://a",
+		"dvr: request was sent to the network: GET http://other",
+	})
+	T.Equal(b.errors, []string{
+		"dvr: request was sent to the network: GET http://b",
+		"dvr: request was sent to the network: GET http://other",
+	})
+
+	// Nothing is kept once the tests finish.
+	call("after")
+	liveTrackersLock.Lock()
+	T.Equal(len(liveTrackers), 0)
+	liveTrackersLock.Unlock()
+
+	// A subtest is matched by the name of its top level test.
+	l := &liveTracker{name: "TestA/sub", goroutine: -1}
+	T.Equal(l.madeBy(0, "TestA"), true)
+	T.Equal(l.madeBy(0, "TestA/sub/x"), true)
+	T.Equal(l.madeBy(0, "TestA/other"), false)
+	T.Equal(l.madeBy(0, "TestB"), false)
+	T.Equal(l.madeBy(0, ""), false)
+}
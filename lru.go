@@ -0,0 +1,79 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvr
+
+import (
+	"container/list"
+	"sync"
+)
+
+// A cache of byte slices keyed by index that holds at most a given number
+// of bytes, discarding the least recently used slices to make room.
+type lruCache struct {
+	lock    sync.Mutex
+	limit   int64
+	size    int64
+	order   *list.List
+	entries map[int]*list.Element
+}
+
+// An entry in the lruCache's order list.
+type lruEntry struct {
+	key  int
+	data []byte
+}
+
+// Returns a new cache holding at most limit bytes.
+func newLRUCache(limit int64) *lruCache {
+	return &lruCache{
+		limit:   limit,
+		order:   list.New(),
+		entries: make(map[int]*list.Element),
+	}
+}
+
+// Returns the data for the given key, marking it as the most recently used.
+func (c *lruCache) get(key int) ([]byte, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*lruEntry).data, true
+}
+
+// Adds data for the given key, discarding the least recently used entries
+// until it fits. Data larger than the whole cache is not added.
+func (c *lruCache) add(key int, data []byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if int64(len(data)) > c.limit {
+		return
+	} else if e, ok := c.entries[key]; ok {
+		c.size -= int64(len(e.Value.(*lruEntry).data))
+		c.order.Remove(e)
+		delete(c.entries, key)
+	}
+	for c.size+int64(len(data)) > c.limit {
+		e := c.order.Back()
+		c.size -= int64(len(e.Value.(*lruEntry).data))
+		c.order.Remove(e)
+		delete(c.entries, e.Value.(*lruEntry).key)
+	}
+	c.entries[key] = c.order.PushFront(&lruEntry{key: key, data: data})
+	c.size += int64(len(data))
+}
@@ -0,0 +1,51 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvr
+
+import (
+	"testing"
+
+	"github.com/liquidgecka/testlib"
+)
+
+func TestLRUCache(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	c := newLRUCache(10)
+	c.add(1, []byte("aaaa"))
+	c.add(2, []byte("bbbb"))
+	data, ok := c.get(1)
+	T.Equal(ok, true)
+	T.Equal(string(data), "aaaa")
+
+	// Adding more than fits discards the least recently used.
+	c.add(3, []byte("cccc"))
+	_, ok = c.get(2)
+	T.Equal(ok, false)
+	_, ok = c.get(1)
+	T.Equal(ok, true)
+	T.Equal(c.size, int64(8))
+
+	// Replacing an entry doesn't count it twice.
+	c.add(3, []byte("cc"))
+	T.Equal(c.size, int64(6))
+
+	// Entries larger than the cache are never held.
+	c.add(4, []byte("dddddddddddd"))
+	_, ok = c.get(4)
+	T.Equal(ok, false)
+	T.Equal(c.size, int64(6))
+}
@@ -0,0 +1,286 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvr
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+//
+// tnetstrings
+//
+
+// Reads a single tnetstring value from the reader. These are of the form
+// "<length>:<data><type>". Strings and byte strings are both returned as
+// []byte, dictionaries as map[string]interface{}, lists as []interface{},
+// integers as int64, floats as float64, booleans as bool and null as nil.
+func readTNetString(r *bufio.Reader) (interface{}, error) {
+	lengthStr, err := r.ReadString(':')
+	if err != nil {
+		return nil, err
+	}
+	length, err := strconv.Atoi(lengthStr[:len(lengthStr)-1])
+	if err != nil || length < 0 {
+		return nil, fmt.Errorf("invalid tnetstring length %q", lengthStr)
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	kind, err := r.ReadByte()
+	if err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return parseTNetString(data, kind)
+}
+
+// Converts the payload of a tnetstring into a value based on its type.
+func parseTNetString(data []byte, kind byte) (interface{}, error) {
+	switch kind {
+	case ',', ';':
+		return data, nil
+	case '#':
+		return strconv.ParseInt(string(data), 10, 64)
+	case '^':
+		return strconv.ParseFloat(string(data), 64)
+	case '!':
+		return string(data) == "true", nil
+	case '~':
+		return nil, nil
+	case ']', '}':
+		values := []interface{}{}
+		r := bufio.NewReader(bytes.NewReader(data))
+		for {
+			if _, err := r.Peek(1); err == io.EOF {
+				break
+			}
+			v, err := readTNetString(r)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, v)
+		}
+		if kind == ']' {
+			return values, nil
+		}
+		if len(values)%2 != 0 {
+			return nil, fmt.Errorf("tnetstring dictionary has an odd length")
+		}
+		m := make(map[string]interface{}, len(values)/2)
+		for i := 0; i < len(values); i += 2 {
+			key, ok := values[i].([]byte)
+			if !ok {
+				return nil, fmt.Errorf("tnetstring dictionary key is not a string")
+			}
+			m[string(key)] = values[i+1]
+		}
+		return m, nil
+	default:
+		return nil, fmt.Errorf("unknown tnetstring type %q", kind)
+	}
+}
+
+//
+// mitmproxy flows
+//
+
+// Helpers for reading the loosely typed flow dictionaries.
+type flowDict map[string]interface{}
+
+// Returns the value as a string, or "" if it is missing.
+func (f flowDict) str(key string) string {
+	if b, ok := f[key].([]byte); ok {
+		return string(b)
+	}
+	return ""
+}
+
+// Returns the value as an integer, or 0 if it is missing.
+func (f flowDict) int(key string) int64 {
+	i, _ := f[key].(int64)
+	return i
+}
+
+// Returns the value as a nested dictionary, or nil if it is missing.
+func (f flowDict) dict(key string) flowDict {
+	m, _ := f[key].(map[string]interface{})
+	return m
+}
+
+// Returns the value, a list of [name, value] pairs, as an http.Header.
+func (f flowDict) header(key string) http.Header {
+	list, _ := f[key].([]interface{})
+	if len(list) == 0 {
+		return nil
+	}
+	h := http.Header{}
+	for _, item := range list {
+		pair, _ := item.([]interface{})
+		if len(pair) != 2 {
+			continue
+		}
+		name, _ := pair[0].([]byte)
+		value, _ := pair[1].([]byte)
+		h.Add(string(name), string(value))
+	}
+	return h
+}
+
+// Parses an HTTP version string such as "HTTP/1.1".
+func parseFlowProto(proto string) (string, int, int) {
+	if proto == "" {
+		proto = "HTTP/1.1"
+	}
+	major, minor, ok := http.ParseHTTPVersion(proto)
+	if !ok {
+		return "HTTP/1.1", 1, 1
+	}
+	return proto, major, minor
+}
+
+// ImportMitmproxy converts the HTTP flows in a mitmproxy ".flows" capture
+// (as written by "mitmdump -w" or saved from mitmweb) into recordings that can
+// be written to an archive with WriteArchiveFile(). Flows of other types, such
+// as TCP or WebSocket flows, are ignored. Flows that failed are recorded with
+// their error message.
+//
+// mitmproxy stores the response body as it was sent, so gzip encoded bodies
+// are decoded.
+func ImportMitmproxy(r io.Reader) ([]*RequestResponse, error) {
+	reader := bufio.NewReader(r)
+	rrs := []*RequestResponse{}
+	for {
+		if _, err := reader.Peek(1); err == io.EOF {
+			return rrs, nil
+		}
+		value, err := readTNetString(reader)
+		if err != nil {
+			return nil, err
+		}
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("mitmproxy flow is not a dictionary")
+		}
+		flow := flowDict(m)
+		if flow.str("type") != "http" || flow.dict("request") == nil {
+			continue
+		}
+		rr, err := flow.recording()
+		if err != nil {
+			return nil, err
+		}
+		rrs = append(rrs, rr)
+	}
+}
+
+// Converts an HTTP flow into a recording.
+func (f flowDict) recording() (*RequestResponse, error) {
+	request := f.dict("request")
+
+	// Build the URL from its parts.
+	host := request.str("host")
+	port := request.int("port")
+	scheme := request.str("scheme")
+	if scheme == "" {
+		scheme = "http"
+	}
+	if (scheme == "http" && port != 80) || (scheme == "https" && port != 443) {
+		host = net.JoinHostPort(host, strconv.FormatInt(port, 10))
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	u, err := url.Parse(scheme + "://" + host + request.str("path"))
+	if err != nil {
+		return nil, err
+	}
+
+	rr := &RequestResponse{}
+	proto, major, minor := parseFlowProto(request.str("http_version"))
+	rr.Request = &http.Request{
+		Method:     request.str("method"),
+		URL:        u,
+		Proto:      proto,
+		ProtoMajor: major,
+		ProtoMinor: minor,
+		Header:     request.header("headers"),
+		Host:       u.Host,
+	}
+	if rr.Request.Header != nil {
+		rr.Request.Header.Del("Host")
+	}
+	if content, ok := request["content"].([]byte); ok && len(content) > 0 {
+		rr.RequestBody = content
+		rr.Request.ContentLength = int64(len(content))
+	}
+
+	if response := f.dict("response"); response != nil {
+		status := int(response.int("status_code"))
+		reason := response.str("reason")
+		if reason == "" {
+			reason = http.StatusText(status)
+		}
+		proto, major, minor := parseFlowProto(response.str("http_version"))
+		rr.Response = &http.Response{
+			Status:     strconv.Itoa(status) + " " + reason,
+			StatusCode: status,
+			Proto:      proto,
+			ProtoMajor: major,
+			ProtoMinor: minor,
+			Header:     response.header("headers"),
+		}
+		if rr.Response.Header == nil {
+			rr.Response.Header = http.Header{}
+		}
+		body, _ := response["content"].([]byte)
+		rr.ResponseBody = decodeGzipBody(rr.Response, body)
+		rr.Response.ContentLength = int64(len(rr.ResponseBody))
+	} else if e := f.dict("error"); e != nil {
+		rr.Error = errors.New(e.str("msg"))
+	}
+	return rr, nil
+}
+
+// Decodes a gzip encoded response body captured off the wire and removes the
+// Content-Encoding header, which is what the net/http client does when it
+// negotiates compression itself. Bodies that fail to decode are returned as
+// they are.
+func decodeGzipBody(resp *http.Response, body []byte) []byte {
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		return body
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return body
+	}
+	decoded, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return body
+	}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.Uncompressed = true
+	return decoded
+}
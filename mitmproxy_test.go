@@ -0,0 +1,127 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvr
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/liquidgecka/testlib"
+)
+
+// Encodes a value as a tnetstring. Dictionaries are written as alternating
+// key/value lists so that the output is deterministic.
+type tnetDict []interface{}
+
+func tnet(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "0:~"
+	case string:
+		return fmt.Sprintf("%d:%s,", len(v), v)
+	case int:
+		s := fmt.Sprint(v)
+		return fmt.Sprintf("%d:%s#", len(s), s)
+	case []interface{}:
+		s := ""
+		for _, item := range v {
+			s += tnet(item)
+		}
+		return fmt.Sprintf("%d:%s]", len(s), s)
+	case tnetDict:
+		s := ""
+		for _, item := range v {
+			s += tnet(item)
+		}
+		return fmt.Sprintf("%d:%s}", len(s), s)
+	}
+	panic("unknown type")
+}
+
+func TestImportMitmproxy(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	compressed := &bytes.Buffer{}
+	gz := gzip.NewWriter(compressed)
+	gz.Write([]byte(`{"id": 1}`))
+	gz.Close()
+
+	flows := tnet(tnetDict{
+		"type", "http",
+		"request", tnetDict{
+			"method", "POST",
+			"scheme", "https",
+			"host", "api.example.com",
+			"port", 443,
+			"path", "/items?a=1",
+			"http_version", "HTTP/1.1",
+			"headers", []interface{}{
+				[]interface{}{"Host", "api.example.com"},
+				[]interface{}{"Content-Type", "application/json"},
+			},
+			"content", `{"name": "x"}`,
+		},
+		"response", tnetDict{
+			"status_code", 201,
+			"reason", "Created",
+			"http_version", "HTTP/1.1",
+			"headers", []interface{}{
+				[]interface{}{"Content-Encoding", "gzip"},
+			},
+			"content", compressed.String(),
+		},
+	}) + tnet(tnetDict{
+		"type", "tcp",
+	}) + tnet(tnetDict{
+		"type", "http",
+		"request", tnetDict{
+			"method", "GET",
+			"scheme", "http",
+			"host", "localhost",
+			"port", 8080,
+			"path", "/",
+			"content", nil,
+		},
+		"response", nil,
+		"error", tnetDict{"msg", "connection refused"},
+	})
+
+	rrs, err := ImportMitmproxy(strings.NewReader(flows))
+	T.ExpectSuccess(err)
+	T.Equal(len(rrs), 2)
+
+	T.Equal(rrs[0].Request.Method, "POST")
+	T.Equal(rrs[0].Request.URL.String(), "https://api.example.com/items?a=1")
+	T.Equal(rrs[0].Request.Header,
+		http.Header{"Content-Type": {"application/json"}})
+	T.Equal(string(rrs[0].RequestBody), `{"name": "x"}`)
+	T.Equal(rrs[0].Response.StatusCode, 201)
+	T.Equal(rrs[0].Response.Status, "201 Created")
+	T.Equal(rrs[0].Response.Header, http.Header{})
+	T.Equal(string(rrs[0].ResponseBody), `{"id": 1}`)
+
+	T.Equal(rrs[1].Request.URL.String(), "http://localhost:8080/")
+	T.Equal(rrs[1].Response == nil, true)
+	T.ExpectErrorMessage(rrs[1].Error, "connection refused")
+
+	// Truncated input is an error.
+	_, err = ImportMitmproxy(strings.NewReader(flows[:20]))
+	T.ExpectError(err)
+}
@@ -0,0 +1,128 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvr
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	// Finds values that look like random tokens, such as session ids, trace
+	// ids or multipart boundaries. Values with too few distinct characters
+	// are not considered random, see randomToken().
+	tokenPattern = regexp.MustCompile(`[A-Za-z0-9_-]{20,}`)
+
+	// Finds values that are entirely a unix timestamp, in seconds or
+	// milliseconds.
+	unixTimePattern = regexp.MustCompile(`^\d{10}(\d{3})?$`)
+
+	// The request headers that have already been reported by
+	// warnNondeterministicHeaders(), so each is only reported once.
+	warnedHeaders     = map[string]bool{}
+	warnedHeadersLock sync.Mutex
+)
+
+// Returns a description of why the given header value looks like it will
+// differ between the run that records it and the run that replays it, or an
+// empty string if it doesn't.
+func nondeterministicValue(value string) string {
+	for i, kind := range []string{"a UUID", "a ULID", "a timestamp"} {
+		if idKinds[i].re.MatchString(value) {
+			return kind
+		}
+	}
+	if _, err := http.ParseTime(value); err == nil {
+		return "a date"
+	}
+	if unixTimePattern.MatchString(value) {
+		n, _ := strconv.ParseInt(value[:10], 10, 64)
+		if d := time.Since(time.Unix(n, 0)); d < 10*365*24*time.Hour &&
+			d > -10*365*24*time.Hour {
+			return "a timestamp"
+		}
+	}
+	for _, token := range tokenPattern.FindAllString(value, -1) {
+		if randomToken(token) {
+			return "a random token"
+		}
+	}
+	return ""
+}
+
+// Returns true if the token mixes letters and digits and has enough distinct
+// characters that it is unlikely to be a word or a version number.
+func randomToken(token string) bool {
+	letters, digits := false, false
+	distinct := map[rune]bool{}
+	for _, c := range token {
+		switch {
+		case c >= '0' && c <= '9':
+			digits = true
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+			letters = true
+		}
+		distinct[c] = true
+	}
+	return letters && digits && len(distinct) >= 10
+}
+
+// Called while recording with each request as it is stored. Headers whose
+// values look run-specific (dates, UUIDs, random tokens) will most likely
+// keep the request from matching when it is replayed, so a warning is
+// printed suggesting how to ignore them, once for each header. Nothing is
+// checked when a custom Matcher is set since it decides which headers
+// matter.
+func warnNondeterministicHeaders(req *http.Request, header http.Header) {
+	if Matcher != nil {
+		return
+	}
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	warnedHeadersLock.Lock()
+	defer warnedHeadersLock.Unlock()
+	for _, name := range names {
+		if warnedHeaders[name] {
+			continue
+		}
+		kind := ""
+		for _, value := range header[name] {
+			if kind = nondeterministicValue(value); kind != "" {
+				break
+			}
+		}
+		if kind == "" {
+			continue
+		}
+		warnedHeaders[name] = true
+		suggestion := fmt.Sprintf("dvr.IgnoreHeaders(%q)", name)
+		if name == "Cookie" {
+			suggestion = "dvr.NormalizeCookies()"
+		}
+		fmt.Fprintf(panicOutput, "dvr: warning: the %s header of %s %s "+
+			"contains %s that will likely differ when replayed, keeping "+
+			"the request from matching. Consider ignoring it with %s.\n",
+			name, req.Method, req.URL, kind, suggestion)
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvr
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/liquidgecka/testlib"
+)
+
+func TestNondeterministicValue(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	for value, kind := range map[string]string{
+		"6f1e2d3c-4b5a-4978-8c6d-5e4f3a2b1c0d": "a UUID",
+		"01ARZ3NDEKTSV4RRFFQ69G5FAV":           "a ULID",
+		"2024-01-02T03:04:05Z":                 "a timestamp",
+		"Tue, 02 Jan 2024 03:04:05 GMT":        "a date",
+		now:                                    "a timestamp",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01":             "a random token",
+		"multipart/form-data; boundary=9a7c3e1f5b2d8a4c6e0f1b3d5a7c9e2f4b6d8": "a random token",
+		"application/json":                 "",
+		"Go-http-client/1.1":               "",
+		"Bearer REDACTED":                  "",
+		"1234":                             "",
+		"gzip, deflate":                    "",
+		"aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa1": "",
+	} {
+		T.Equal(nondeterministicValue(value), kind, value)
+	}
+}
+
+func TestWarnNondeterministicHeaders(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+	defer ResetObfuscators()
+	defer func() {
+		panicOutput = ioutil.Discard
+		warnedHeaders = map[string]bool{}
+	}()
+	output := &bytes.Buffer{}
+	panicOutput = output
+
+	req, err := http.NewRequest("GET", "http://api.example.com/x", nil)
+	T.ExpectSuccess(err)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("X-Request-Id", "6f1e2d3c-4b5a-4978-8c6d-5e4f3a2b1c0d")
+	req.Header.Set("Cookie", "session=9a7c3e1f5b2d8a4c6e0f1b3d5a7c9e2f")
+
+	// Each run-specific header is reported once with a suggestion.
+	warnNondeterministicHeaders(req, req.Header)
+	warnNondeterministicHeaders(req, req.Header)
+	lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+	T.Equal(len(lines), 2)
+	T.Equal(lines[0], "dvr: warning: the Cookie header of GET "+
+		"http://api.example.com/x contains a random token that will "+
+		"likely differ when replayed, keeping the request from matching. "+
+		"Consider ignoring it with dvr.NormalizeCookies().")
+	T.Equal(lines[1], "dvr: warning: the X-Request-Id header of GET "+
+		"http://api.example.com/x contains a UUID that will likely differ "+
+		"when replayed, keeping the request from matching. Consider "+
+		"ignoring it with dvr.IgnoreHeaders(\"X-Request-Id\").")
+
+	// IgnoreHeaders removes the header before it is stored or matched.
+	IgnoreHeaders("X-Request-Id")
+	rr := &RequestResponse{Request: req.Clone(req.Context())}
+	for _, f := range replayNormalizers() {
+		T.ExpectSuccess(f(rr))
+	}
+	T.Equal(rr.Request.Header.Get("X-Request-Id"), "")
+	T.Equal(rr.Request.Header.Get("Accept"), "application/json")
+}
@@ -0,0 +1,158 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvr
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// The kinds of values that NormalizeIDs() replaces. Each has a pattern that
+// finds them and a function that generates the n'th placeholder. The
+// placeholders are valid values of the same kind so that code parsing them
+// during replay continues to work.
+var idKinds = []struct {
+	re          *regexp.Regexp
+	placeholder func(n int) string
+
+	// If set, matches of re that this returns false for are left alone.
+	valid func(id []byte) bool
+}{
+	// UUIDs.
+	{
+		re: regexp.MustCompile(`\b[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-` +
+			`[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}\b`),
+		placeholder: func(n int) string {
+			return fmt.Sprintf("00000000-0000-0000-0000-%012d", n)
+		},
+	},
+	// ULIDs, in Crockford's base32. A 26 digit number would also match, so
+	// at least one letter is required. The random part of a ULID is all
+	// digits about once in a hundred million.
+	{
+		re: regexp.MustCompile(`\b[0-7][0-9A-HJKMNP-TV-Z]{25}\b`),
+		placeholder: func(n int) string {
+			return fmt.Sprintf("%026d", n)
+		},
+		valid: func(id []byte) bool {
+			return bytes.IndexFunc(id, unicode.IsLetter) >= 0
+		},
+	},
+	// RFC3339 timestamps.
+	{
+		re: regexp.MustCompile(`\b\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}` +
+			`(\.\d+)?(Z|[+-]\d{2}:\d{2})`),
+		placeholder: func(n int) string {
+			t := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+			return t.Add(time.Duration(n) * time.Second).Format(time.RFC3339)
+		},
+	},
+}
+
+// Replaces ids and timestamps within a single recording. The same value is
+// always replaced with the same placeholder so relationships between the
+// request and response are kept.
+type idNormalizer struct {
+	seen map[string]string
+	next []int
+}
+
+// Replaces every id in the given data.
+func (n *idNormalizer) replace(data []byte) []byte {
+	for i, kind := range idKinds {
+		data = kind.re.ReplaceAllFunc(data, func(id []byte) []byte {
+			if kind.valid != nil && !kind.valid(id) {
+				return id
+			}
+			if p, ok := n.seen[string(id)]; ok {
+				return []byte(p)
+			}
+			n.next[i]++
+			p := kind.placeholder(n.next[i])
+			n.seen[string(id)] = p
+			return []byte(p)
+		})
+	}
+	return data
+}
+
+// Replaces every id in the given string.
+func (n *idNormalizer) replaceString(s string) string {
+	return string(n.replace([]byte(s)))
+}
+
+// Normalizes a recording. The request URL and body are done first so that an
+// incoming request in replay mode is assigned the same placeholders as the
+// recording was.
+func normalizeIDs(rr *RequestResponse) {
+	n := &idNormalizer{
+		seen: make(map[string]string),
+		next: make([]int, len(idKinds)),
+	}
+	if rr.Request != nil {
+		if u := rr.Request.URL; u != nil {
+			if path := n.replaceString(u.Path); path != u.Path {
+				u.Path = path
+				u.RawPath = ""
+			}
+			u.RawQuery = n.replaceString(u.RawQuery)
+		}
+		rr.RequestBody = n.replace(rr.RequestBody)
+		if rr.Request.ContentLength > 0 {
+			rr.Request.ContentLength = int64(len(rr.RequestBody))
+		}
+	}
+	if rr.Response != nil {
+		setResponseBody(rr, n.replace(rr.ResponseBody))
+	}
+}
+
+// NormalizeIDs replaces UUIDs, ULIDs and RFC3339 timestamps in request URLs
+// and request and response bodies with stable, sequence numbered
+// placeholders such as "00000000-0000-0000-0000-000000000001" or
+// "2000-01-01T00:00:01Z". This keeps archives from changing every time they
+// are re-recorded. Placeholders are numbered per recording, and the same
+// normalization is applied to incoming requests in replay mode so that they
+// still match the recordings.
+//
+// This adds a symmetric obfuscator to the chain, the returned function
+// removes it.
+func NormalizeIDs() (remove func()) {
+	return addSymmetricObfuscator("NormalizeIDs()", normalizeIDs)
+}
+
+// IgnoreHeaders removes the named headers from requests so that they are
+// neither recorded nor compared when matching. This is intended for headers
+// whose values differ on every run, such as request ids, trace ids or
+// timestamps, which dvr warns about while recording.
+//
+// This adds a symmetric obfuscator to the chain, the returned function
+// removes it.
+func IgnoreHeaders(names ...string) (remove func()) {
+	return addSymmetricObfuscator(
+		"IgnoreHeaders("+strings.Join(names, ", ")+")",
+		func(rr *RequestResponse) {
+			if rr.Request == nil {
+				return
+			}
+			for _, name := range names {
+				rr.Request.Header.Del(name)
+			}
+		})
+}
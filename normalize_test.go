@@ -0,0 +1,80 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvr
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/liquidgecka/testlib"
+)
+
+func TestNormalizeIDs(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+	defer ResetObfuscators()
+
+	id1 := "123e4567-e89b-12d3-a456-426614174000"
+	id2 := "01ARZ3NDEKTSV4RRFFQ69G5FAV"
+	rr := &RequestResponse{
+		Request: &http.Request{
+			URL: &url.URL{
+				Scheme:   "http",
+				Host:     "host",
+				Path:     "/items/" + id1,
+				RawQuery: "after=2021-03-04T05:06:07.123-07:00",
+			},
+		},
+		RequestBody: []byte(`{"parent":"` + id2 + `"}`),
+		Response: &http.Response{
+			Header:        http.Header{},
+			ContentLength: -1,
+		},
+		ResponseBody: []byte(`{"id":"` + id1 + `","child":"` +
+			"123E4567-E89B-12D3-A456-426614174999" + `"}`),
+	}
+	normalizeIDs(rr)
+	T.Equal(rr.Request.URL.String(), "http://host/items/"+
+		"00000000-0000-0000-0000-000000000001?after=2000-01-01T00:00:01Z")
+	T.Equal(string(rr.RequestBody),
+		`{"parent":"00000000000000000000000001"}`)
+	T.Equal(string(rr.ResponseBody), `{"id":"`+
+		`00000000-0000-0000-0000-000000000001","child":"`+
+		`00000000-0000-0000-0000-000000000002"}`)
+
+	// Values that only look like ULIDs are left alone: a 26 digit number, a
+	// first character above 7, letters outside Crockford's alphabet, and
+	// ULIDs within longer words.
+	for _, s := range []string{
+		"12345678901234567890123456",
+		"81ARZ3NDEKTSV4RRFFQ69G5FAV",
+		"01ARZ3NDEKTSV4RRFFQ69G5FAU",
+		"01ARZ3NDEKTSV4RRFFQ69G5FAVX",
+		"id_01ARZ3NDEKTSV4RRFFQ69G5FAV",
+	} {
+		rr.RequestBody = []byte(s)
+		normalizeIDs(rr)
+		T.Equal(string(rr.RequestBody), s)
+	}
+
+	// The normalizer is installed on both chains, and removed from both.
+	remove := NormalizeIDs()
+	T.Equal(len(obfuscators()), 1)
+	T.Equal(len(replayNormalizers()), 1)
+	remove()
+	T.Equal(len(obfuscators()), 0)
+	T.Equal(len(replayNormalizers()), 0)
+}
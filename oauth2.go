@@ -0,0 +1,204 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvr
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// The token request parameters that carry credentials. These differ between
+// runs (or must not be stored) so they are replaced when recording and
+// before matching.
+var oauth2SecretParams = []string{
+	"assertion",
+	"client_assertion",
+	"client_secret",
+	"code",
+	"code_verifier",
+	"password",
+	"refresh_token",
+	"subject_token",
+}
+
+// The clock used when refreshing token responses.
+var oauth2Now = time.Now
+
+// Stubs a single OAuth2 token endpoint.
+type oauth2Endpoint struct {
+	url string
+}
+
+// Returns true if the request was sent to this token endpoint.
+func (o *oauth2Endpoint) matches(rr *RequestResponse) bool {
+	if rr.Request == nil || rr.Request.URL == nil {
+		return false
+	}
+	u := *rr.Request.URL
+	u.RawQuery = ""
+	u.Fragment = ""
+	return u.String() == o.url
+}
+
+// Replaces the credentials in a token request.
+func (o *oauth2Endpoint) normalize(rr *RequestResponse) {
+	if !o.matches(rr) {
+		return
+	}
+	if rr.Request.Header.Get("Authorization") != "" {
+		rr.Request.Header.Set("Authorization", redactedValue)
+	}
+	values, err := url.ParseQuery(string(rr.RequestBody))
+	if err != nil {
+		return
+	}
+	for _, name := range oauth2SecretParams {
+		if _, ok := values[name]; ok {
+			values.Set(name, redactedValue)
+		}
+	}
+	rr.RequestBody = []byte(values.Encode())
+	if rr.Request.ContentLength > 0 {
+		rr.Request.ContentLength = int64(len(rr.RequestBody))
+	}
+}
+
+// Refreshes the expiry of a replayed token response so that it is valid
+// from now for as long as it was valid when it was recorded. JSON and form
+// encoded responses are supported.
+func (o *oauth2Endpoint) refresh(rr *RequestResponse) error {
+	if rr.Response == nil || !o.matches(rr) {
+		return nil
+	}
+	now := oauth2Now()
+	mediaType, _, _ := mime.ParseMediaType(
+		rr.Response.Header.Get("Content-Type"))
+	if mediaType == "application/x-www-form-urlencoded" {
+		values, err := url.ParseQuery(string(rr.ResponseBody))
+		if err != nil {
+			return nil
+		}
+		fields := map[string]interface{}{}
+		for name := range values {
+			fields[name] = values.Get(name)
+		}
+		refreshTokenFields(fields, now)
+		for name, value := range fields {
+			values.Set(name, value.(string))
+		}
+		setResponseBody(rr, []byte(values.Encode()))
+		return nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(rr.ResponseBody))
+	decoder.UseNumber()
+	var fields map[string]interface{}
+	if decoder.Decode(&fields) != nil {
+		return nil
+	}
+	refreshTokenFields(fields, now)
+	body, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	setResponseBody(rr, body)
+	return nil
+}
+
+// Reads a numeric field that may be encoded as a number or a string.
+func tokenField(fields map[string]interface{}, name string) (int64, bool) {
+	switch v := fields[name].(type) {
+	case json.Number:
+		i, err := v.Int64()
+		return i, err == nil
+	case string:
+		i, err := strconv.ParseInt(v, 10, 64)
+		return i, err == nil
+	}
+	return 0, false
+}
+
+// Sets a numeric field, keeping the encoding it was recorded with.
+func setTokenField(fields map[string]interface{}, name string, value int64) {
+	if _, ok := fields[name].(string); ok {
+		fields[name] = strconv.FormatInt(value, 10)
+	} else {
+		fields[name] = json.Number(strconv.FormatInt(value, 10))
+	}
+}
+
+// Moves the absolute times in a token response so that the token was issued
+// now. "expires_in" is relative so it is left alone. "issued_at" may be in
+// seconds or milliseconds.
+func refreshTokenFields(fields map[string]interface{}, now time.Time) {
+	issued, hasIssued := tokenField(fields, "issued_at")
+	if hasIssued {
+		if issued > 1e12 {
+			setTokenField(fields, "issued_at", now.UnixNano()/1e6)
+		} else {
+			setTokenField(fields, "issued_at", now.Unix())
+		}
+	}
+	expiresIn, hasExpiresIn := tokenField(fields, "expires_in")
+	for _, name := range []string{"expires_at", "expires_on"} {
+		expires, ok := tokenField(fields, name)
+		if !ok {
+			continue
+		}
+		switch {
+		case hasExpiresIn:
+			setTokenField(fields, name, now.Unix()+expiresIn)
+		case hasIssued && issued < 1e12:
+			setTokenField(fields, name, now.Unix()+expires-issued)
+		default:
+			setTokenField(fields, name, now.Add(time.Hour).Unix())
+		}
+	}
+}
+
+// OAuth2TokenEndpoint makes recordings of the given OAuth2 token endpoint
+// usable in replay mode long after they were made, for clients using
+// golang.org/x/oauth2 and similar libraries.
+//
+// Credentials in token requests (client secrets, refresh tokens, assertions,
+// authorization codes and so on, as well as the Authorization header) are
+// replaced with "REDACTED" when recording and before matching, so token
+// requests match regardless of the credentials used. Since a recording can be
+// matched any number of times one recorded token exchange serves every token
+// request made while replaying.
+//
+// When a token response is replayed its absolute times ("issued_at",
+// "expires_at" and "expires_on") are moved so that the token appears to have
+// been issued now, so clients don't treat the recorded token as expired.
+//
+// The URL is compared without its query string. The returned function
+// removes the helper.
+func OAuth2TokenEndpoint(tokenURL string) (remove func()) {
+	u, err := url.Parse(tokenURL)
+	panicIfError(err)
+	u.RawQuery = ""
+	u.Fragment = ""
+	o := &oauth2Endpoint{url: u.String()}
+	removeNormalizer := AddSymmetricObfuscator(o.normalize)
+	removeRewriter := addToChain(&rewriterChain, o.refresh)
+	return func() {
+		removeNormalizer()
+		removeRewriter()
+	}
+}
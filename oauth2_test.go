@@ -0,0 +1,116 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvr
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/liquidgecka/testlib"
+)
+
+func TestOAuth2TokenEndpoint(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+	defer func() { oauth2Now = time.Now }()
+	now := time.Unix(2000000000, 0)
+	oauth2Now = func() time.Time { return now }
+
+	o := &oauth2Endpoint{url: "https://auth.example.com/token"}
+	u, err := url.Parse("https://auth.example.com/token?tenant=1")
+	T.ExpectSuccess(err)
+	body := "client_secret=s3cret&grant_type=refresh_token&refresh_token=r1"
+	rr := &RequestResponse{
+		Request: &http.Request{
+			URL:           u,
+			Header:        http.Header{"Authorization": {"Basic abc"}},
+			ContentLength: int64(len(body)),
+		},
+		RequestBody: []byte(body),
+		Response: &http.Response{
+			Header: http.Header{"Content-Type": {"application/json"}},
+		},
+		ResponseBody: []byte(`{"access_token":"a","expires_in":3600,` +
+			`"expires_on":"1500003600","issued_at":1500000000000}`),
+	}
+
+	// Credentials are replaced.
+	o.normalize(rr)
+	T.Equal(string(rr.RequestBody), "client_secret=REDACTED&"+
+		"grant_type=refresh_token&refresh_token=REDACTED")
+	T.Equal(rr.Request.Header.Get("Authorization"), "REDACTED")
+	T.Equal(rr.Request.ContentLength, int64(len(rr.RequestBody)))
+
+	// Times are moved to now, keeping their encoding.
+	T.ExpectSuccess(o.refresh(rr))
+	T.Equal(string(rr.ResponseBody), `{"access_token":"a","expires_in":3600,`+
+		`"expires_on":"2000003600","issued_at":2000000000000}`)
+
+	// Form encoded responses.
+	rr.Response.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr.ResponseBody = []byte("access_token=a&expires_at=100&issued_at=40")
+	T.ExpectSuccess(o.refresh(rr))
+	T.Equal(string(rr.ResponseBody),
+		"access_token=a&expires_at=2000000060&issued_at=2000000000")
+
+	// Other endpoints are left alone.
+	other := &RequestResponse{
+		Request:     &http.Request{URL: &url.URL{Scheme: "https", Host: "x"}},
+		RequestBody: []byte("password=p"),
+	}
+	o.normalize(other)
+	T.Equal(string(other.RequestBody), "password=p")
+	T.ExpectSuccess(o.refresh(other))
+}
+
+func TestOAuth2TokenEndpointReplay(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+	defer func() {
+		replay = false
+		isSetup = sync.Once{}
+		requestList = nil
+	}()
+
+	q := testQuery("POST", "https://auth.example.com/token",
+		"client_secret=REDACTED&grant_type=client_credentials", 200,
+		`{"access_token":"a","expires_at":1500003600,"expires_in":3600}`)
+	replay = true
+	isSetup = sync.Once{}
+	isSetup.Do(func() {})
+	requestList = []*RequestResponse{q.RequestResponse()}
+	remove := OAuth2TokenEndpoint("https://auth.example.com/token")
+	defer remove()
+
+	// The recording is used for every token request.
+	rt := &roundTripper{realRoundTripper: OriginalDefaultTransport}
+	for _, secret := range []string{"one", "two"} {
+		body := "client_secret=" + secret + "&grant_type=client_credentials"
+		req, err := http.NewRequest("POST", "https://auth.example.com/token",
+			strings.NewReader(body))
+		T.ExpectSuccess(err)
+		resp, err := rt.RoundTrip(req)
+		T.ExpectSuccess(err)
+		data, err := ioutil.ReadAll(resp.Body)
+		T.ExpectSuccess(err)
+		T.NotEqual(string(data), string(q.Response.Body))
+		T.Equal(resp.ContentLength, int64(len(data)))
+	}
+}
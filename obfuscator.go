@@ -15,9 +15,14 @@
 package dvr
 
 import (
+	"bytes"
 	"encoding/base64"
 	"fmt"
+	"net/http"
 	"net/url"
+	"regexp"
+	"strings"
+	"sync"
 )
 
 // This is the type used to store the values, but not the stack from the call
@@ -61,3 +66,392 @@ func BasicAuthObfuscator(username, password string) func(*RequestResponse) {
 		password: password,
 	}).Obfuscator
 }
+
+// This is the type used to store the values from the call to
+// BearerTokenObfuscator.
+type bearerTokenObfuscator struct {
+	token    string
+	inBodies bool
+}
+
+// This is the Obfuscator function attached to the above.
+func (b *bearerTokenObfuscator) Obfuscator(rr *RequestResponse) {
+	// Only bearer tokens in the Authorization header are replaced.
+	auth := rr.Request.Header.Get("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+		return
+	}
+	live := strings.TrimSpace(auth[7:])
+	rr.Request.Header.Set("Authorization", "Bearer "+b.token)
+
+	// If requested the live token is also replaced anywhere that it appears
+	// in the request or response bodies.
+	if !b.inBodies || live == "" || live == b.token {
+		return
+	}
+	old, token := []byte(live), []byte(b.token)
+	if bytes.Contains(rr.RequestBody, old) {
+		rr.RequestBody = bytes.Replace(rr.RequestBody, old, token, -1)
+		if rr.Request.ContentLength > 0 {
+			rr.Request.ContentLength = int64(len(rr.RequestBody))
+		}
+	}
+	if rr.Response != nil && bytes.Contains(rr.ResponseBody, old) {
+		setResponseBody(rr, bytes.Replace(rr.ResponseBody, old, token, -1))
+	}
+}
+
+// This function call will return a function that can act as a Obfuscator
+// which replaces the token in any "Authorization: Bearer ..." header with the
+// given fake token, as used by OAuth2 and most token based APIs. If inBodies
+// is true then the live token is also replaced with the fake one anywhere
+// that it appears in the request or response bodies.
+func BearerTokenObfuscator(token string, inBodies bool) func(*RequestResponse) {
+	return (&bearerTokenObfuscator{
+		token:    token,
+		inBodies: inBodies,
+	}).Obfuscator
+}
+
+// Selects which parts of a recording RegexpObfuscator() rewrites. Values
+// can be combined with |, for example InHeaders|InBodies.
+type Location int
+
+const (
+	// Request and response header values.
+	InHeaders Location = 1 << iota
+
+	// Request and response bodies.
+	InBodies
+
+	// The request URL.
+	InURL
+)
+
+// This is the type used to store the values from the call to
+// RegexpObfuscator.
+type regexpObfuscator struct {
+	re          *regexp.Regexp
+	replacement []byte
+	where       Location
+}
+
+// Replaces every match in each of the values in the given header.
+func (r *regexpObfuscator) header(h http.Header) {
+	for _, values := range h {
+		for i, v := range values {
+			values[i] = string(r.re.ReplaceAll([]byte(v), r.replacement))
+		}
+	}
+}
+
+// This is the Obfuscator function attached to the above.
+func (r *regexpObfuscator) Obfuscator(rr *RequestResponse) {
+	if r.where&InHeaders != 0 {
+		r.header(rr.Request.Header)
+		if rr.Response != nil {
+			r.header(rr.Response.Header)
+		}
+	}
+	if r.where&InBodies != 0 {
+		if r.re.Match(rr.RequestBody) {
+			rr.RequestBody = r.re.ReplaceAll(rr.RequestBody, r.replacement)
+			if rr.Request.ContentLength > 0 {
+				rr.Request.ContentLength = int64(len(rr.RequestBody))
+			}
+		}
+		if rr.Response != nil && r.re.Match(rr.ResponseBody) {
+			setResponseBody(rr,
+				r.re.ReplaceAll(rr.ResponseBody, r.replacement))
+		}
+	}
+	if r.where&InURL != 0 && rr.Request.URL != nil {
+		s := rr.Request.URL.String()
+		if r.re.MatchString(s) {
+			s = r.re.ReplaceAllString(s, string(r.replacement))
+			if u, err := url.Parse(s); err == nil {
+				rr.Request.URL = u
+			}
+		}
+	}
+}
+
+// This function call will return a function that can act as a Obfuscator
+// which replaces every match of the regular expression with the replacement
+// in the given locations. The replacement may refer to submatches using the
+// syntax of regexp.Regexp.Expand, for example "$1". This will panic if the
+// pattern can not be compiled.
+//
+// For example, to remove email addresses from bodies and headers:
+//
+//	RegexpObfuscator(`[\w.+-]+@[\w-]+\.[\w.]+`, "user@example.com",
+//	    InHeaders|InBodies)
+func RegexpObfuscator(
+	pattern, replacement string, where Location,
+) func(*RequestResponse) {
+	re, err := regexp.Compile(pattern)
+	panicIfError(err)
+	return (&regexpObfuscator{
+		re:          re,
+		replacement: []byte(replacement),
+		where:       where,
+	}).Obfuscator
+}
+
+// This is the type used to store the canonical header names from the call
+// to HeaderAllowlistObfuscator.
+type headerAllowlistObfuscator struct {
+	allowed map[string]bool
+}
+
+// Removes every header that is not allowed.
+func (h *headerAllowlistObfuscator) header(header http.Header) {
+	for name := range header {
+		if !h.allowed[http.CanonicalHeaderKey(name)] {
+			delete(header, name)
+		}
+	}
+}
+
+// This is the Obfuscator function attached to the above.
+func (h *headerAllowlistObfuscator) Obfuscator(rr *RequestResponse) {
+	h.header(rr.Request.Header)
+	h.header(rr.Request.Trailer)
+	if rr.Response != nil {
+		h.header(rr.Response.Header)
+		h.header(rr.Response.Trailer)
+	}
+}
+
+// This function call will return a function that can act as a Obfuscator
+// which removes every request and response header (and trailer) that is not
+// in the given list of names. Names are case insensitive. This keeps
+// infrastructure headers such as tracing ids, CDN and internal routing
+// details out of the archive.
+//
+// Note that the default Matcher compares request headers, so this should be
+// added with AddSymmetricObfuscator() in order for replayed requests to match.
+func HeaderAllowlistObfuscator(headers ...string) func(*RequestResponse) {
+	h := &headerAllowlistObfuscator{allowed: make(map[string]bool)}
+	for _, name := range headers {
+		h.allowed[http.CanonicalHeaderKey(name)] = true
+	}
+	return h.Obfuscator
+}
+
+// This is the type used to store the parameter names from the call to
+// ObfuscateQueryParams.
+type queryParamObfuscator struct {
+	params map[string]bool
+}
+
+// This is the Obfuscator function attached to the above.
+func (q *queryParamObfuscator) Obfuscator(rr *RequestResponse) {
+	if rr.Request.URL != nil {
+		var names []string
+		rr.Request.URL.RawQuery, names = q.rawQuery(rr.Request.URL.RawQuery)
+		for _, name := range names {
+			if !containsString(rr.RedactedQueryParams, name) {
+				rr.RedactedQueryParams = append(rr.RedactedQueryParams, name)
+			}
+		}
+	}
+	for name := range q.params {
+		if _, ok := rr.Request.Form[name]; ok {
+			rr.Request.Form.Set(name, redactedValue)
+		}
+	}
+}
+
+// Returns true if the list contains the string.
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Rewrites the values of the parameters in the query while keeping the
+// order and encoding of everything else. The names of the parameters that
+// were rewritten are also returned.
+func (q *queryParamObfuscator) rawQuery(raw string) (string, []string) {
+	if raw == "" {
+		return raw, nil
+	}
+	var names []string
+	pairs := strings.Split(raw, "&")
+	for i, pair := range pairs {
+		key := pair
+		if j := strings.IndexByte(pair, '='); j >= 0 {
+			key = pair[:j]
+		}
+		if name, err := url.QueryUnescape(key); err == nil && q.params[name] {
+			pairs[i] = key + "=" + redactedValue
+			names = append(names, name)
+		}
+	}
+	return strings.Join(pairs, "&"), names
+}
+
+// This function call will return a function that can act as a Obfuscator
+// which replaces the values of the given query string parameters in the
+// recorded URL with "REDACTED". This is intended for API keys and signatures
+// that are passed in the URL. The names of the parameters it replaced are
+// stored with the recording in RedactedQueryParams, and the default Matcher
+// accepts any value for those so replay continues to work with live keys.
+// Other parameters are compared exactly, even if their recorded value
+// happens to be "REDACTED".
+func ObfuscateQueryParams(params ...string) func(*RequestResponse) {
+	q := &queryParamObfuscator{params: make(map[string]bool)}
+	for _, name := range params {
+		q.params[name] = true
+	}
+	return q.Obfuscator
+}
+
+//
+// Obfuscator chain
+//
+
+// An entry in the obfuscator chain. Entries are compared by pointer since
+// functions can not be compared.
+type obfuscatorEntry struct {
+	f func(*RequestResponse) error
+
+	// Describes the function for matchingFingerprint(). Only set for
+	// normalizers.
+	name string
+}
+
+var (
+	// The obfuscators added via AddObfuscator() in the order that they
+	// will be run.
+	obfuscatorChain []*obfuscatorEntry
+	obfuscatorLock  sync.Mutex
+
+	// Functions that are run on incoming requests in replay mode before
+	// they are matched. These are protected by obfuscatorLock.
+	normalizerChain []*obfuscatorEntry
+)
+
+// Adds an obfuscator to the end of the chain of obfuscators that are run on
+// every recorded request, allowing several obfuscators (say
+// BasicAuthObfuscator and a header scrubber) to be combined without writing a
+// wrapper function. They are run in the order that they were added, after the
+// Obfuscator variable. The returned function removes this obfuscator from the
+// chain.
+func AddObfuscator(f func(*RequestResponse)) (remove func()) {
+	return addToChain(&obfuscatorChain, unchecked(f))
+}
+
+// Adds an obfuscator that can fail to the chain, otherwise this is the same
+// as AddObfuscator(). If the obfuscator returns an error then the request is
+// not recorded at all and a message explaining why is printed, which ensures
+// that broken redaction logic never quietly writes unredacted data to the
+// archive. The returned function removes this obfuscator from the chain.
+func AddCheckedObfuscator(f func(*RequestResponse) error) (remove func()) {
+	return addToChain(&obfuscatorChain, f)
+}
+
+// Converts an obfuscator that can not fail into one that returns an error.
+func unchecked(f func(*RequestResponse)) func(*RequestResponse) error {
+	return func(rr *RequestResponse) error {
+		f(rr)
+		return nil
+	}
+}
+
+// Adds an obfuscator to the chain just like AddObfuscator(), however in replay
+// mode the obfuscator is also run on a copy of each incoming request before it
+// is matched. This allows requests that carry live credentials to match
+// recordings that were scrubbed with fake ones, for example:
+//
+//	dvr.AddSymmetricObfuscator(dvr.BasicAuthObfuscator("user", "pass"))
+//
+// Since the incoming request has not been sent yet the Response fields will
+// be nil when the obfuscator is run in replay mode. The returned function
+// removes the obfuscator from both recording and replay.
+func AddSymmetricObfuscator(f func(*RequestResponse)) (remove func()) {
+	return addSymmetricObfuscator(funcName(f), f)
+}
+
+// Adds a symmetric obfuscator that is described by name in the fingerprint
+// of the matching configuration, see matchingFingerprint().
+func addSymmetricObfuscator(
+	name string, f func(*RequestResponse),
+) (remove func()) {
+	removeObfuscator := AddObfuscator(f)
+	removeNormalizer := addNamedToChain(&normalizerChain, name, unchecked(f))
+	return func() {
+		removeObfuscator()
+		removeNormalizer()
+	}
+}
+
+// Adds an entry to the given chain, returning a function that removes it.
+func addToChain(
+	chain *[]*obfuscatorEntry, f func(*RequestResponse) error,
+) (remove func()) {
+	return addNamedToChain(chain, "", f)
+}
+
+// Adds a named entry to the given chain, see addToChain().
+func addNamedToChain(
+	chain *[]*obfuscatorEntry, name string, f func(*RequestResponse) error,
+) (remove func()) {
+	entry := &obfuscatorEntry{f: f, name: name}
+	obfuscatorLock.Lock()
+	*chain = append(*chain, entry)
+	obfuscatorLock.Unlock()
+
+	return func() {
+		obfuscatorLock.Lock()
+		defer obfuscatorLock.Unlock()
+		for i, e := range *chain {
+			if e == entry {
+				*chain = append((*chain)[:i:i], (*chain)[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// Removes every obfuscator added via AddObfuscator() or
+// AddSymmetricObfuscator(). This is intended to be
+// used to isolate tests from each other. The Obfuscator variable is left
+// untouched.
+func ResetObfuscators() {
+	obfuscatorLock.Lock()
+	defer obfuscatorLock.Unlock()
+	obfuscatorChain = nil
+	normalizerChain = nil
+}
+
+// Returns the list of obfuscators that should be run on a recorded request,
+// in order.
+func obfuscators() []func(*RequestResponse) error {
+	obfuscatorLock.Lock()
+	defer obfuscatorLock.Unlock()
+	fs := make([]func(*RequestResponse) error, 0, len(obfuscatorChain)+1)
+	if Obfuscator != nil {
+		fs = append(fs, unchecked(Obfuscator))
+	}
+	for _, e := range obfuscatorChain {
+		fs = append(fs, e.f)
+	}
+	return fs
+}
+
+// Returns the list of functions that should be run on an incoming request in
+// replay mode before it is matched, in order.
+func replayNormalizers() []func(*RequestResponse) error {
+	obfuscatorLock.Lock()
+	defer obfuscatorLock.Unlock()
+	fs := make([]func(*RequestResponse) error, 0, len(normalizerChain))
+	for _, e := range normalizerChain {
+		fs = append(fs, e.f)
+	}
+	return fs
+}
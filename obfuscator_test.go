@@ -0,0 +1,238 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvr
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/liquidgecka/testlib"
+)
+
+func TestObfuscatorChain(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+	defer ResetObfuscators()
+
+	order := []string{}
+	named := func(name string) func(*RequestResponse) {
+		return func(*RequestResponse) { order = append(order, name) }
+	}
+	run := func() []string {
+		order = []string{}
+		for _, f := range obfuscators() {
+			T.ExpectSuccess(f(nil))
+		}
+		return order
+	}
+
+	// Test 1: Nothing configured.
+	T.Equal(len(obfuscators()), 0)
+
+	// Test 2: Obfuscators run in order, after the Obfuscator variable.
+	Obfuscator = named("var")
+	defer func() { Obfuscator = nil }()
+	AddObfuscator(named("a"))
+	removeB := AddObfuscator(named("b"))
+	AddObfuscator(named("c"))
+	T.Equal(run(), []string{"var", "a", "b", "c"})
+
+	// Test 3: Removal only removes the one obfuscator, even if called twice.
+	removeB()
+	removeB()
+	T.Equal(run(), []string{"var", "a", "c"})
+
+	// Test 4: Reset clears the chain.
+	ResetObfuscators()
+	T.Equal(run(), []string{"var"})
+}
+
+func TestBearerTokenObfuscator(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	newRR := func(auth string) *RequestResponse {
+		return &RequestResponse{
+			Request: &http.Request{
+				Header:        http.Header{"Authorization": {auth}},
+				ContentLength: 15,
+			},
+			RequestBody: []byte("token=live-1234"),
+			Response: &http.Response{
+				Header:        http.Header{},
+				ContentLength: -1,
+			},
+			ResponseBody: []byte(`{"token":"live-1234"}`),
+		}
+	}
+
+	// Test 1: Only the header is replaced.
+	rr := newRR("Bearer live-1234")
+	BearerTokenObfuscator("fake", false)(rr)
+	T.Equal(rr.Request.Header.Get("Authorization"), "Bearer fake")
+	T.Equal(string(rr.RequestBody), "token=live-1234")
+	T.Equal(string(rr.ResponseBody), `{"token":"live-1234"}`)
+
+	// Test 2: Bodies are rewritten too.
+	rr = newRR("bearer live-1234")
+	BearerTokenObfuscator("fake", true)(rr)
+	T.Equal(rr.Request.Header.Get("Authorization"), "Bearer fake")
+	T.Equal(string(rr.RequestBody), "token=fake")
+	T.Equal(rr.Request.ContentLength, int64(10))
+	T.Equal(string(rr.ResponseBody), `{"token":"fake"}`)
+	T.Equal(rr.Response.ContentLength, int64(-1))
+
+	// Test 3: Other authorization schemes are left alone.
+	rr = newRR("Basic dXNlcjE6cGFzczE=")
+	BearerTokenObfuscator("fake", true)(rr)
+	T.Equal(rr.Request.Header.Get("Authorization"), "Basic dXNlcjE6cGFzczE=")
+}
+
+func TestRegexpObfuscator(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	newRR := func() *RequestResponse {
+		return &RequestResponse{
+			Request: &http.Request{
+				URL: &url.URL{
+					Scheme: "http", Host: "host", Path: "/accounts/1234-5678"},
+				Header: http.Header{"X-Account": {"1234-5678"}},
+			},
+			RequestBody: []byte("account=1234-5678"),
+			Response: &http.Response{
+				Header:        http.Header{"X-Account": {"1234-5678"}},
+				ContentLength: 17,
+			},
+			ResponseBody: []byte("account 1234-5678"),
+		}
+	}
+	pattern := `(\d{4})-\d{4}`
+
+	// Test 1: Everywhere.
+	rr := newRR()
+	RegexpObfuscator(pattern, "$1-XXXX", InHeaders|InBodies|InURL)(rr)
+	T.Equal(rr.Request.URL.String(), "http://host/accounts/1234-XXXX")
+	T.Equal(rr.Request.Header.Get("X-Account"), "1234-XXXX")
+	T.Equal(string(rr.RequestBody), "account=1234-XXXX")
+	T.Equal(rr.Response.Header.Get("X-Account"), "1234-XXXX")
+	T.Equal(string(rr.ResponseBody), "account 1234-XXXX")
+
+	// Test 2: Only bodies.
+	rr = newRR()
+	RegexpObfuscator(pattern, "0000", InBodies)(rr)
+	T.Equal(rr.Request.URL.String(), "http://host/accounts/1234-5678")
+	T.Equal(rr.Request.Header.Get("X-Account"), "1234-5678")
+	T.Equal(string(rr.RequestBody), "account=0000")
+	T.Equal(string(rr.ResponseBody), "account 0000")
+	T.Equal(rr.Response.ContentLength, int64(12))
+}
+
+func TestHeaderAllowlistObfuscator(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	rr := &RequestResponse{
+		Request: &http.Request{
+			Header: http.Header{
+				"Content-Type": {"text/plain"},
+				"X-Trace-Id":   {"1234"},
+				"x-lowercase":  {"value"},
+			},
+		},
+		Response: &http.Response{
+			Header: http.Header{
+				"Content-Type": {"application/json"},
+				"X-Cache":      {"HIT"},
+			},
+			Trailer: http.Header{"X-Checksum": {"abc"}},
+		},
+	}
+	HeaderAllowlistObfuscator("content-type", "X-Lowercase")(rr)
+	T.Equal(rr.Request.Header, http.Header{
+		"Content-Type": {"text/plain"},
+		"x-lowercase":  {"value"},
+	})
+	T.Equal(rr.Response.Header, http.Header{
+		"Content-Type": {"application/json"},
+	})
+	T.Equal(rr.Response.Trailer, http.Header{})
+}
+
+func TestObfuscateQueryParams(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	rr := &RequestResponse{
+		Request: &http.Request{
+			URL: &url.URL{
+				Scheme:   "http",
+				Host:     "host",
+				RawQuery: "z=1&api_key=secret&a=%20&sig=abc&sig=def&api_keyx=2",
+			},
+			Form: url.Values{"api_key": {"secret"}, "z": {"1"}},
+		},
+	}
+	ObfuscateQueryParams("api_key", "sig")(rr)
+	T.Equal(rr.Request.URL.RawQuery,
+		"z=1&api_key=REDACTED&a=%20&sig=REDACTED&sig=REDACTED&api_keyx=2")
+	T.Equal(rr.Request.Form, url.Values{
+		"api_key": {"REDACTED"}, "z": {"1"}})
+	T.Equal(rr.RedactedQueryParams, []string{"api_key", "sig"})
+
+	// The names are stored with the recording.
+	q := newGobQuery(rr)
+	T.Equal(q.RedactedQueryParams, []string{"api_key", "sig"})
+	T.Equal(q.RequestResponse().RedactedQueryParams,
+		[]string{"api_key", "sig"})
+}
+
+func TestAddSymmetricObfuscator(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+	defer ResetObfuscators()
+
+	f := func(*RequestResponse) {}
+	removeA := AddSymmetricObfuscator(f)
+	AddObfuscator(f)
+	AddSymmetricObfuscator(f)
+	T.Equal(len(obfuscators()), 3)
+	T.Equal(len(replayNormalizers()), 2)
+
+	removeA()
+	T.Equal(len(obfuscators()), 2)
+	T.Equal(len(replayNormalizers()), 1)
+
+	ResetObfuscators()
+	T.Equal(len(obfuscators()), 0)
+	T.Equal(len(replayNormalizers()), 0)
+}
+
+func TestAddCheckedObfuscator(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+	defer ResetObfuscators()
+
+	remove := AddCheckedObfuscator(func(*RequestResponse) error {
+		return fmt.Errorf("expected")
+	})
+	fs := obfuscators()
+	T.Equal(len(fs), 1)
+	T.ExpectErrorMessage(fs[0](nil), "expected")
+	remove()
+	T.Equal(len(obfuscators()), 0)
+}
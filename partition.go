@@ -0,0 +1,149 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvr
+
+import (
+	"bytes"
+	"runtime"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+var (
+	// Maps a goroutine id to the partition that is active within it.
+	partitions = map[int64]string{}
+
+	// Counts how many goroutines have a given partition active. This is
+	// used when a request is made from a goroutine that the test spawned.
+	partitionCounts = map[string]int{}
+
+	// Protects the above maps.
+	partitionLock sync.Mutex
+)
+
+// Partition namespaces all requests made by the given test (or subtest)
+// under its full name, for example "TestClient/not_found". Replay will
+// only match requests against recordings made by the same test, which
+// keeps table driven tests with near identical requests from matching each
+// other's recordings. When recording, the partitioned recordings of tests
+// that are not run (say because of -run) are carried over from the existing
+// archive so re-recording one subtest doesn't disturb its siblings.
+//
+// Requests made outside of a Partition() are partitioned automatically
+// under the name of the test function found on the stack of the goroutine
+// making them, such as "TestClient". Subtests can't be told apart that way,
+// which is what calling this is for. Automatically partitioned requests
+// also match recordings that have no partition, so archives recorded before
+// partitions were added still replay.
+//
+// This should be called at the start of each test or subtest, which is
+// expected to make its requests from the goroutine that called this. Requests
+// made from other goroutines use the partition if it is the only one active.
+// The partition is removed when the test completes.
+func Partition(t testing.TB) {
+	name := t.Name()
+	id := goroutineID()
+
+	partitionLock.Lock()
+	prev, hadPrev := partitions[id]
+	partitions[id] = name
+	partitionCounts[name]++
+	partitionLock.Unlock()
+
+	t.Cleanup(func() {
+		partitionLock.Lock()
+		defer partitionLock.Unlock()
+		if hadPrev {
+			partitions[id] = prev
+		} else {
+			delete(partitions, id)
+		}
+		if partitionCounts[name]--; partitionCounts[name] == 0 {
+			delete(partitionCounts, name)
+		}
+	})
+}
+
+// Returns the partition that requests from the calling goroutine belong in.
+func currentPartition() string {
+	partitionLock.Lock()
+	defer partitionLock.Unlock()
+	if len(partitions) == 0 {
+		return ""
+	} else if name, ok := partitions[goroutineID()]; ok {
+		return name
+	} else if len(partitionCounts) == 1 {
+		for name := range partitionCounts {
+			return name
+		}
+	}
+	return ""
+}
+
+// Returns the partition that a request made from the calling goroutine is
+// recorded in, and true if it was found on the stack rather than being set
+// with Partition(). Requests made outside of a test have no partition.
+func requestPartition() (name string, automatic bool) {
+	if name := currentPartition(); name != "" {
+		return name, false
+	}
+	name = stackTest()
+	return name, name != ""
+}
+
+// Returns true if the recording can be replayed for a request made in the
+// given partition.
+func inPartition(
+	rr *RequestResponse, partition string, automatic bool,
+) bool {
+	return rr.Partition == partition || automatic && rr.Partition == ""
+}
+
+// Filters the list of queries so that only the most recent recording run of
+// each partition remains. Queries that are not partitioned are all kept.
+// Recordings with different labels are variants of a partition, each with
+// its own latest run.
+func latestPartitions(queries []*gobQuery) []*gobQuery {
+	latest := map[string]int64{}
+	key := func(q *gobQuery) string {
+		return q.Partition + "\x00" + labelKey(q.Labels)
+	}
+	for _, q := range queries {
+		if q.RunID > latest[key(q)] {
+			latest[key(q)] = q.RunID
+		}
+	}
+	filtered := make([]*gobQuery, 0, len(queries))
+	for _, q := range queries {
+		if q.Partition == "" || q.RunID == latest[key(q)] {
+			filtered = append(filtered, q)
+		}
+	}
+	return filtered
+}
+
+// Returns the id of the calling goroutine, parsed from the first line of its
+// stack trace which looks like "goroutine 123 [running]:".
+func goroutineID() int64 {
+	var buf [64]byte
+	b := buf[:runtime.Stack(buf[:], false)]
+	b = bytes.TrimPrefix(b, []byte("goroutine "))
+	if i := bytes.IndexByte(b, ' '); i > 0 {
+		b = b[:i]
+	}
+	id, _ := strconv.ParseInt(string(b), 10, 64)
+	return id
+}
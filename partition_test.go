@@ -0,0 +1,88 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvr
+
+import (
+	"testing"
+
+	"github.com/liquidgecka/testlib"
+)
+
+func TestPartition(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	T.Equal(currentPartition(), "")
+	t.Run("first", func(t *testing.T) {
+		Partition(t)
+		T.Equal(currentPartition(), "TestPartition/first")
+
+		// A goroutine started by the test uses the only active partition.
+		done := make(chan string)
+		go func() { done <- currentPartition() }()
+		T.Equal(<-done, "TestPartition/first")
+	})
+	T.Equal(currentPartition(), "")
+}
+
+func TestLatestPartitions(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	queries := []*gobQuery{
+		{Partition: "", RunID: 1},
+		{Partition: "a", RunID: 1},
+		{Partition: "b", RunID: 1},
+		{Partition: "a", RunID: 2},
+		{Partition: "", RunID: 2},
+	}
+	T.Equal(latestPartitions(queries), []*gobQuery{
+		queries[0], queries[2], queries[3], queries[4],
+	})
+}
+
+func TestRequestPartition(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	// The test function on the stack is used when Partition() wasn't
+	// called.
+	name, automatic := requestPartition()
+	T.Equal(name, "TestRequestPartition")
+	T.Equal(automatic, true)
+	T.Equal(inPartition(&RequestResponse{}, name, automatic), true)
+	T.Equal(inPartition(
+		&RequestResponse{Partition: "TestOther"}, name, automatic), false)
+
+	t.Run("sub", func(t *testing.T) {
+		name, automatic := requestPartition()
+		T.Equal(name, "TestRequestPartition")
+		T.Equal(automatic, true)
+
+		Partition(t)
+		name, automatic = requestPartition()
+		T.Equal(name, "TestRequestPartition/sub")
+		T.Equal(automatic, false)
+		T.Equal(inPartition(&RequestResponse{}, name, automatic), false)
+	})
+
+	// A goroutine started by the test is found by its function.
+	done := make(chan string)
+	go func() {
+		name, _ := requestPartition()
+		done <- name
+	}()
+	T.Equal(<-done, "TestRequestPartition")
+}
@@ -0,0 +1,286 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvr
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// Link layer types that can be decoded from a pcap capture.
+const (
+	pcapLinkNull     = 0
+	pcapLinkEthernet = 1
+	pcapLinkRaw      = 101
+	pcapLinkLinuxSLL = 113
+)
+
+// A single TCP segment carrying data.
+type pcapSegment struct {
+	seq  uint32
+	data []byte
+}
+
+// One direction of a TCP connection.
+type pcapStream struct {
+	src, dst string
+	isn      uint32
+	hasSYN   bool
+	segments []pcapSegment
+}
+
+// Returns the data sent in this direction, in sequence order. Retransmitted
+// and overlapping segments are only included once. Reassembly stops at the
+// first gap since the data after it can not be trusted.
+func (s *pcapStream) data() []byte {
+	if len(s.segments) == 0 {
+		return nil
+	}
+	base := s.isn + 1
+	if !s.hasSYN {
+		base = s.segments[0].seq
+		for _, seg := range s.segments {
+			if int32(seg.seq-base) < 0 {
+				base = seg.seq
+			}
+		}
+	}
+	sort.SliceStable(s.segments, func(i, j int) bool {
+		return s.segments[i].seq-base < s.segments[j].seq-base
+	})
+	buffer := &bytes.Buffer{}
+	for _, seg := range s.segments {
+		offset := int(seg.seq - base)
+		if offset > buffer.Len() {
+			break
+		} else if end := offset + len(seg.data); end > buffer.Len() {
+			buffer.Write(seg.data[buffer.Len()-offset:])
+		}
+	}
+	return buffer.Bytes()
+}
+
+// ImportPcap extracts the plaintext HTTP/1.x exchanges from a pcap capture
+// (as written by tcpdump or Wireshark) and converts them into recordings that
+// can be written to an archive with WriteArchiveFile(). Ethernet, Linux
+// cooked, loopback and raw IP captures of IPv4 and IPv6 traffic are supported.
+// pcapng files are not, they can be converted with "editcap -F pcap".
+//
+// TCP connections that do not carry HTTP, such as TLS connections, are
+// ignored. The recordings are returned in the order the connections were
+// opened, and in order within each connection. Requests whose response was
+// not captured are dropped.
+func ImportPcap(r io.Reader) ([]*RequestResponse, error) {
+	// Read the global header, which determines the byte order.
+	header := make([]byte, 24)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("pcap: reading the file header: %s", err)
+	}
+	var order binary.ByteOrder
+	switch binary.LittleEndian.Uint32(header) {
+	case 0xa1b2c3d4, 0xa1b23c4d:
+		order = binary.LittleEndian
+	case 0xd4c3b2a1, 0x4d3cb2a1:
+		order = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("pcap: not a pcap file")
+	}
+	linkType := order.Uint32(header[20:])
+	switch linkType {
+	case pcapLinkNull, pcapLinkEthernet, pcapLinkRaw, pcapLinkLinuxSLL:
+	default:
+		return nil, fmt.Errorf("pcap: unsupported link type %d", linkType)
+	}
+
+	// Split the packets into streams.
+	streams := map[string]*pcapStream{}
+	var connections [][2]string
+	record := make([]byte, 16)
+	for {
+		if _, err := io.ReadFull(r, record); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("pcap: reading a packet header: %s", err)
+		}
+		packet := make([]byte, order.Uint32(record[8:]))
+		if _, err := io.ReadFull(r, packet); err != nil {
+			return nil, fmt.Errorf("pcap: reading a packet: %s", err)
+		}
+
+		src, dst, tcp := decodePcapPacket(linkType, packet)
+		if len(tcp) < 20 || len(tcp) < int(tcp[12]>>4)*4 {
+			continue
+		}
+		src = net.JoinHostPort(src, strconv.Itoa(int(tcp[0])<<8|int(tcp[1])))
+		dst = net.JoinHostPort(dst, strconv.Itoa(int(tcp[2])<<8|int(tcp[3])))
+		stream := streams[src+" "+dst]
+		if stream == nil {
+			stream = &pcapStream{src: src, dst: dst}
+			streams[src+" "+dst] = stream
+			if streams[dst+" "+src] == nil {
+				connections = append(connections, [2]string{src, dst})
+			}
+		}
+		seq := binary.BigEndian.Uint32(tcp[4:])
+		if tcp[13]&0x02 != 0 {
+			stream.isn = seq
+			stream.hasSYN = true
+		}
+		if data := tcp[int(tcp[12]>>4)*4:]; len(data) > 0 {
+			stream.segments = append(stream.segments, pcapSegment{
+				seq:  seq,
+				data: data,
+			})
+		}
+	}
+
+	// Parse the HTTP exchanges out of each connection.
+	rrs := []*RequestResponse{}
+	for _, c := range connections {
+		a := streams[c[0]+" "+c[1]]
+		b := streams[c[1]+" "+c[0]]
+		if b == nil {
+			continue
+		}
+		if exchanges := pcapExchanges(a, b); exchanges != nil {
+			rrs = append(rrs, exchanges...)
+		} else {
+			rrs = append(rrs, pcapExchanges(b, a)...)
+		}
+	}
+	return rrs, nil
+}
+
+// Decodes the link and network layers of a packet, returning the source and
+// destination addresses and the TCP header and payload. If the packet is not
+// TCP then the returned payload is nil.
+func decodePcapPacket(linkType uint32, packet []byte) (string, string, []byte) {
+	var etherType int
+	switch linkType {
+	case pcapLinkNull:
+		if len(packet) < 4 {
+			return "", "", nil
+		}
+		// The address family is in the byte order of the capturing host.
+		family := binary.LittleEndian.Uint32(packet)
+		if family > 0xffff {
+			family = binary.BigEndian.Uint32(packet)
+		}
+		etherType = 0x86dd
+		if family == 2 {
+			etherType = 0x0800
+		}
+		packet = packet[4:]
+	case pcapLinkEthernet:
+		if len(packet) < 14 {
+			return "", "", nil
+		}
+		etherType = int(binary.BigEndian.Uint16(packet[12:]))
+		packet = packet[14:]
+		for etherType == 0x8100 && len(packet) >= 4 {
+			etherType = int(binary.BigEndian.Uint16(packet[2:]))
+			packet = packet[4:]
+		}
+	case pcapLinkLinuxSLL:
+		if len(packet) < 16 {
+			return "", "", nil
+		}
+		etherType = int(binary.BigEndian.Uint16(packet[14:]))
+		packet = packet[16:]
+	case pcapLinkRaw:
+		if len(packet) < 1 {
+			return "", "", nil
+		}
+		etherType = 0x0800
+		if packet[0]>>4 == 6 {
+			etherType = 0x86dd
+		}
+	}
+
+	switch etherType {
+	case 0x0800:
+		if len(packet) < 20 || packet[9] != 6 {
+			return "", "", nil
+		}
+		headerLen := int(packet[0]&0x0f) * 4
+		totalLen := int(binary.BigEndian.Uint16(packet[2:]))
+		if totalLen > len(packet) || headerLen > totalLen {
+			return "", "", nil
+		}
+		return net.IP(packet[12:16]).String(), net.IP(packet[16:20]).String(),
+			packet[headerLen:totalLen]
+	case 0x86dd:
+		if len(packet) < 40 || packet[6] != 6 {
+			return "", "", nil
+		}
+		payloadLen := int(binary.BigEndian.Uint16(packet[4:]))
+		if 40+payloadLen > len(packet) {
+			return "", "", nil
+		}
+		return net.IP(packet[8:24]).String(), net.IP(packet[24:40]).String(),
+			packet[40 : 40+payloadLen]
+	}
+	return "", "", nil
+}
+
+// Parses the HTTP requests sent by the client and the responses sent back by
+// the server, pairing them in order. Returns nil if the client did not send
+// HTTP.
+func pcapExchanges(client, server *pcapStream) []*RequestResponse {
+	requests := bufio.NewReader(bytes.NewReader(client.data()))
+	responses := bufio.NewReader(bytes.NewReader(server.data()))
+	var rrs []*RequestResponse
+	for {
+		req, err := http.ReadRequest(requests)
+		if err != nil {
+			return rrs
+		}
+		rr := &RequestResponse{Request: req}
+		rr.RequestBody, rr.RequestBodyError = ioutil.ReadAll(req.Body)
+		req.Body = nil
+		req.RequestURI = ""
+		req.URL.Scheme = "http"
+		req.URL.Host = req.Host
+		if req.URL.Host == "" {
+			req.URL.Host = client.dst
+		}
+
+		resp, err := http.ReadResponse(responses, req)
+		if err != nil {
+			return rrs
+		}
+		rr.Response = resp
+		rr.ResponseBody, rr.ResponseBodyError = ioutil.ReadAll(resp.Body)
+		resp.Body = nil
+		resp.Request = nil
+		rr.ResponseBody = decodeGzipBody(resp, rr.ResponseBody)
+		if resp.Uncompressed {
+			// This matches what net/http does after decompressing.
+			resp.ContentLength = -1
+		}
+		if rrs == nil {
+			rrs = []*RequestResponse{}
+		}
+		rrs = append(rrs, rr)
+	}
+}
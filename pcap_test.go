@@ -0,0 +1,118 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvr
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/liquidgecka/testlib"
+)
+
+// Builds a little endian Ethernet pcap capture.
+type pcapBuilder struct {
+	bytes.Buffer
+}
+
+func newPcapBuilder() *pcapBuilder {
+	p := &pcapBuilder{}
+	binary.Write(p, binary.LittleEndian, []uint32{
+		0xa1b2c3d4, 0x00040002, 0, 0, 65535, pcapLinkEthernet})
+	return p
+}
+
+// Adds an IPv4 TCP packet to the capture.
+func (p *pcapBuilder) packet(
+	src string, sport uint16, dst string, dport uint16,
+	seq uint32, syn bool, data string,
+) {
+	tcp := make([]byte, 20)
+	binary.BigEndian.PutUint16(tcp[0:], sport)
+	binary.BigEndian.PutUint16(tcp[2:], dport)
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	tcp[12] = 5 << 4
+	if syn {
+		tcp[13] = 0x02
+	}
+	tcp = append(tcp, data...)
+
+	ip := make([]byte, 20)
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:], uint16(20+len(tcp)))
+	ip[9] = 6
+	copy(ip[12:], net.ParseIP(src).To4())
+	copy(ip[16:], net.ParseIP(dst).To4())
+
+	frame := append(make([]byte, 12), 0x08, 0x00)
+	frame = append(append(frame, ip...), tcp...)
+
+	binary.Write(p, binary.LittleEndian, []uint32{
+		0, 0, uint32(len(frame)), uint32(len(frame))})
+	p.Write(frame)
+}
+
+func TestImportPcap(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	client, server := "10.0.0.1", "10.0.0.2"
+	req1 := "POST /items?a=1 HTTP/1.1\r\nHost: api.example.com\r\n" +
+		"Content-Length: 5\r\n\r\nhello"
+	req2 := "GET /items/1 HTTP/1.1\r\nHost: api.example.com\r\n\r\n"
+	resp1 := "HTTP/1.1 201 Created\r\nContent-Length: 2\r\n\r\nok"
+	resp2 := "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n" +
+		"3\r\nabc\r\n0\r\n\r\n"
+
+	p := newPcapBuilder()
+	p.packet(client, 5000, server, 80, 100, true, "")
+	p.packet(server, 80, client, 5000, 900, true, "")
+	p.packet(client, 5000, server, 80, 101, false, req1[:10])
+	// Out of order and retransmitted segments.
+	p.packet(client, 5000, server, 80, 101+uint32(len(req1)), false, req2)
+	p.packet(client, 5000, server, 80, 111, false, req1[10:])
+	p.packet(client, 5000, server, 80, 101, false, req1[:10])
+	p.packet(server, 80, client, 5000, 901, false, resp1+resp2)
+	// A connection that isn't HTTP.
+	p.packet(client, 5001, server, 443, 7, false, "\x16\x03\x01\x00")
+	p.packet(server, 443, client, 5001, 8, false, "\x16\x03\x03\x00")
+
+	rrs, err := ImportPcap(&p.Buffer)
+	T.ExpectSuccess(err)
+	T.Equal(len(rrs), 2)
+
+	T.Equal(rrs[0].Request.Method, "POST")
+	T.Equal(rrs[0].Request.URL.String(), "http://api.example.com/items?a=1")
+	T.Equal(rrs[0].Request.RequestURI, "")
+	T.Equal(string(rrs[0].RequestBody), "hello")
+	T.Equal(rrs[0].Response.StatusCode, 201)
+	T.Equal(string(rrs[0].ResponseBody), "ok")
+
+	T.Equal(rrs[1].Request.Method, "GET")
+	T.Equal(rrs[1].Request.URL.String(), "http://api.example.com/items/1")
+	T.Equal(rrs[1].Response.StatusCode, 200)
+	T.Equal(rrs[1].Response.TransferEncoding, []string{"chunked"})
+	T.Equal(string(rrs[1].ResponseBody), "abc")
+	T.Equal(rrs[1].Response.Header, http.Header{})
+
+	// Invalid captures.
+	_, err = ImportPcap(strings.NewReader("not a pcap file at all!!"))
+	T.ExpectErrorMessage(err, "not a pcap file")
+	_, err = ImportPcap(bytes.NewReader(newPcapBuilder().Bytes()[:10]))
+	T.ExpectError(err)
+}
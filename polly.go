@@ -0,0 +1,379 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvr
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Returns the time stored as the start of each exported entry. This is a
+// variable so tests can control it.
+var pollyNow = time.Now
+
+// A name and value pair in a HAR document.
+type harPair struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// The body of a request in a HAR document. Forms may be given as params
+// rather than text.
+type harPostData struct {
+	MimeType string    `json:"mimeType"`
+	Params   []harPair `json:"params,omitempty"`
+	Text     string    `json:"text"`
+}
+
+// The HAR document written by the Polly.JS file system persister.
+type pollyHAR struct {
+	Log struct {
+		RecordingName string `json:"_recordingName"`
+		Creator       struct {
+			Comment string `json:"comment"`
+			Name    string `json:"name"`
+			Version string `json:"version"`
+		} `json:"creator"`
+		Entries []*pollyEntry `json:"entries"`
+		Pages   []struct{}    `json:"pages"`
+		Version string        `json:"version"`
+	} `json:"log"`
+}
+
+// A single entry in a Polly.JS recording.
+type pollyEntry struct {
+	ID      string   `json:"_id"`
+	Order   int      `json:"_order"`
+	Cache   struct{} `json:"cache"`
+	Request struct {
+		BodySize    int          `json:"bodySize"`
+		Cookies     []struct{}   `json:"cookies"`
+		Headers     []harPair    `json:"headers"`
+		HeadersSize int          `json:"headersSize"`
+		HTTPVersion string       `json:"httpVersion"`
+		Method      string       `json:"method"`
+		PostData    *harPostData `json:"postData,omitempty"`
+		QueryString []harPair    `json:"queryString"`
+		URL         string       `json:"url"`
+	} `json:"request"`
+	Response struct {
+		BodySize int `json:"bodySize"`
+		Content  struct {
+			IsBinary bool   `json:"_isBinary,omitempty"`
+			Encoding string `json:"encoding,omitempty"`
+			MimeType string `json:"mimeType"`
+			Size     int    `json:"size"`
+			Text     string `json:"text,omitempty"`
+		} `json:"content"`
+		Cookies     []struct{} `json:"cookies"`
+		Headers     []harPair  `json:"headers"`
+		HeadersSize int        `json:"headersSize"`
+		HTTPVersion string     `json:"httpVersion"`
+		RedirectURL string     `json:"redirectURL"`
+		Status      int        `json:"status"`
+		StatusText  string     `json:"statusText"`
+	} `json:"response"`
+	StartedDateTime string         `json:"startedDateTime"`
+	Time            int            `json:"time"`
+	Timings         map[string]int `json:"timings"`
+}
+
+// ExportPolly writes the given recordings as a HAR document in the format
+// used by the Polly.JS file system persister, so that recordings can be
+// shared with JavaScript projects. name is the Polly recording name, and
+// the document should be saved as "recording.har" in the directory Polly
+// uses for that recording. Recordings of requests that failed, which Polly
+// can not represent, are skipped.
+//
+// Polly finds entries by an "_id" that hashes the parts of the request
+// selected by its matchRequestsBy option. The ids written here hash the
+// method, URL and body, which is what Polly computes when it is configured
+// with matchRequestsBy set to {headers: false, order: false}.
+func ExportPolly(w io.Writer, name string, rrs []*RequestResponse) error {
+	har := &pollyHAR{}
+	har.Log.RecordingName = name
+	har.Log.Creator.Comment = "persister:fs"
+	har.Log.Creator.Name = "dvr"
+	har.Log.Creator.Version = "1.0"
+	har.Log.Entries = []*pollyEntry{}
+	har.Log.Pages = []struct{}{}
+	har.Log.Version = "1.2"
+
+	started := pollyNow().UTC().Format("2006-01-02T15:04:05.000Z")
+	orders := map[string]int{}
+	for _, rr := range rrs {
+		if rr.Request == nil || rr.Request.URL == nil || rr.Response == nil {
+			continue
+		}
+		entry := &pollyEntry{StartedDateTime: started}
+		entry.Timings = map[string]int{
+			"blocked": -1, "connect": -1, "dns": -1, "receive": 0,
+			"send": 0, "ssl": -1, "wait": 0,
+		}
+
+		req := rr.Request
+		method := req.Method
+		if method == "" {
+			method = "GET"
+		}
+		entry.Request.BodySize = len(rr.RequestBody)
+		entry.Request.Cookies = []struct{}{}
+		entry.Request.Headers = harHeaders(req.Header)
+		entry.Request.HeadersSize = -1
+		entry.Request.HTTPVersion = harVersion(req.Proto)
+		entry.Request.Method = method
+		entry.Request.QueryString = harQuery(req.URL.RawQuery)
+		entry.Request.URL = req.URL.String()
+		if len(rr.RequestBody) > 0 {
+			entry.Request.PostData = &harPostData{
+				MimeType: req.Header.Get("Content-Type"),
+				Text:     string(rr.RequestBody),
+			}
+		}
+
+		resp := rr.Response
+		entry.Response.BodySize = len(rr.ResponseBody)
+		entry.Response.Content.MimeType = resp.Header.Get("Content-Type")
+		entry.Response.Content.Size = len(rr.ResponseBody)
+		if utf8.Valid(rr.ResponseBody) {
+			entry.Response.Content.Text = string(rr.ResponseBody)
+		} else {
+			entry.Response.Content.IsBinary = true
+			entry.Response.Content.Encoding = "base64"
+			entry.Response.Content.Text =
+				base64.StdEncoding.EncodeToString(rr.ResponseBody)
+		}
+		entry.Response.Cookies = []struct{}{}
+		entry.Response.Headers = harHeaders(resp.Header)
+		entry.Response.HeadersSize = -1
+		entry.Response.HTTPVersion = harVersion(resp.Proto)
+		entry.Response.RedirectURL = resp.Header.Get("Location")
+		entry.Response.Status = resp.StatusCode
+		entry.Response.StatusText = http.StatusText(resp.StatusCode)
+		if i := strings.IndexByte(resp.Status, ' '); i >= 0 {
+			entry.Response.StatusText = resp.Status[i+1:]
+		}
+
+		id, err := pollyID(method, req.URL.String(), rr.RequestBody)
+		if err != nil {
+			return err
+		}
+		entry.ID = id
+		entry.Order = orders[id]
+		orders[id]++
+		har.Log.Entries = append(har.Log.Entries, entry)
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(har)
+}
+
+// Computes the id that Polly.JS gives a request, which is the MD5 of the
+// stable JSON encoding of its identifiers.
+func pollyID(method, rawurl string, body []byte) (string, error) {
+	identifiers := map[string]string{
+		"method": strings.ToUpper(method),
+		"url":    rawurl,
+	}
+	if len(body) > 0 {
+		identifiers["body"] = string(body)
+	}
+	buffer := &bytes.Buffer{}
+	encoder := json.NewEncoder(buffer)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(identifiers); err != nil {
+		return "", err
+	}
+	sum := md5.Sum(bytes.TrimSuffix(buffer.Bytes(), []byte("\n")))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Converts headers into HAR pairs, sorted by name. Names are lower cased as
+// Polly.JS does.
+func harHeaders(header http.Header) []harPair {
+	pairs := []harPair{}
+	for name, values := range header {
+		for _, value := range values {
+			pairs = append(pairs, harPair{
+				Name:  strings.ToLower(name),
+				Value: value,
+			})
+		}
+	}
+	sort.SliceStable(pairs, func(i, j int) bool {
+		return pairs[i].Name < pairs[j].Name
+	})
+	return pairs
+}
+
+// Converts a query string into HAR pairs, in order.
+func harQuery(rawQuery string) []harPair {
+	pairs := []harPair{}
+	for _, part := range strings.Split(rawQuery, "&") {
+		if part == "" {
+			continue
+		}
+		name, value := part, ""
+		if i := strings.IndexByte(part, '='); i >= 0 {
+			name, value = part[:i], part[i+1:]
+		}
+		if unescaped, err := url.QueryUnescape(name); err == nil {
+			name = unescaped
+		}
+		if unescaped, err := url.QueryUnescape(value); err == nil {
+			value = unescaped
+		}
+		pairs = append(pairs, harPair{Name: name, Value: value})
+	}
+	return pairs
+}
+
+// Returns the HTTP version in the form HAR uses.
+func harVersion(proto string) string {
+	if proto == "" {
+		return "HTTP/1.1"
+	}
+	return proto
+}
+
+// ImportHAR converts the entries of a HAR document, such as a Polly.JS
+// recording or a capture saved from a browser's developer tools, into
+// recordings that can be written to an archive with WriteArchiveFile().
+// Entries without a response (which browsers record with a status of 0) are
+// recorded as failed requests, and HTTP/2 pseudo headers are dropped.
+func ImportHAR(r io.Reader) ([]*RequestResponse, error) {
+	var har pollyHAR
+	if err := json.NewDecoder(r).Decode(&har); err != nil {
+		return nil, fmt.Errorf("har: %s", err)
+	}
+
+	rrs := make([]*RequestResponse, 0, len(har.Log.Entries))
+	for i, entry := range har.Log.Entries {
+		u, err := url.Parse(entry.Request.URL)
+		if err != nil {
+			return nil, fmt.Errorf("har: entry %d: %s", i, err)
+		}
+		rr := &RequestResponse{}
+		if started, err := time.Parse(time.RFC3339Nano,
+			entry.StartedDateTime); err == nil {
+			rr.Recorded = started
+		}
+
+		proto, major, minor := harProto(entry.Request.HTTPVersion)
+		rr.Request = &http.Request{
+			Method:     strings.ToUpper(entry.Request.Method),
+			URL:        u,
+			Proto:      proto,
+			ProtoMajor: major,
+			ProtoMinor: minor,
+			Header:     harHeader(entry.Request.Headers),
+			Host:       u.Host,
+		}
+		if post := entry.Request.PostData; post != nil {
+			if post.Text != "" {
+				rr.RequestBody = []byte(post.Text)
+			} else if len(post.Params) > 0 {
+				form := url.Values{}
+				for _, p := range post.Params {
+					form.Add(p.Name, p.Value)
+				}
+				rr.RequestBody = []byte(form.Encode())
+			}
+			if rr.Request.Header.Get("Content-Type") == "" && post.MimeType != "" {
+				rr.Request.Header.Set("Content-Type", post.MimeType)
+			}
+		}
+		rr.Request.ContentLength = int64(len(rr.RequestBody))
+
+		if entry.Response.Status == 0 {
+			rr.Error = fmt.Errorf("har: the request failed")
+			rrs = append(rrs, rr)
+			continue
+		}
+		content := entry.Response.Content
+		if content.Encoding == "base64" {
+			rr.ResponseBody, err = base64.StdEncoding.DecodeString(content.Text)
+			if err != nil {
+				return nil, fmt.Errorf("har: entry %d: %s", i, err)
+			}
+		} else if content.Text != "" {
+			rr.ResponseBody = []byte(content.Text)
+		}
+		proto, major, minor = harProto(entry.Response.HTTPVersion)
+		statusText := entry.Response.StatusText
+		if statusText == "" {
+			statusText = http.StatusText(entry.Response.Status)
+		}
+		rr.Response = &http.Response{
+			Status:        strconv.Itoa(entry.Response.Status) + " " + statusText,
+			StatusCode:    entry.Response.Status,
+			Proto:         proto,
+			ProtoMajor:    major,
+			ProtoMinor:    minor,
+			Header:        harHeader(entry.Response.Headers),
+			ContentLength: int64(len(rr.ResponseBody)),
+		}
+		if rr.Response.Header.Get("Content-Type") == "" && content.MimeType != "" {
+			rr.Response.Header.Set("Content-Type", content.MimeType)
+		}
+
+		// The content is stored decoded, so the encoding no longer applies.
+		rr.Response.Header.Del("Content-Encoding")
+		rr.Response.Header.Del("Content-Length")
+		rrs = append(rrs, rr)
+	}
+	return rrs, nil
+}
+
+// Converts HAR pairs into a header, dropping HTTP/2 pseudo headers.
+func harHeader(pairs []harPair) http.Header {
+	header := http.Header{}
+	for _, p := range pairs {
+		if !strings.HasPrefix(p.Name, ":") {
+			header.Add(p.Name, p.Value)
+		}
+	}
+	return header
+}
+
+// Parses a HAR HTTP version, which defaults to HTTP/1.1. Browsers write
+// versions such as "h2" and "http/2.0".
+func harProto(version string) (string, int, int) {
+	switch strings.ToLower(version) {
+	case "h2", "http/2", "http/2.0":
+		return "HTTP/2.0", 2, 0
+	case "h3", "http/3", "http/3.0":
+		return "HTTP/3.0", 3, 0
+	}
+	if major, minor, ok := http.ParseHTTPVersion(
+		strings.ToUpper(version)); ok {
+		return strings.ToUpper(version), major, minor
+	}
+	return "HTTP/1.1", 1, 1
+}
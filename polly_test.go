@@ -0,0 +1,191 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvr
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/liquidgecka/testlib"
+)
+
+func TestExportPolly(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+	defer func() { pollyNow = time.Now }()
+	pollyNow = func() time.Time {
+		return time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	}
+
+	u, _ := url.Parse("https://api.example.com/items?a=1&b=x%20y")
+	get := &RequestResponse{
+		Request: &http.Request{
+			Method: "GET",
+			URL:    u,
+			Proto:  "HTTP/1.1",
+			Header: http.Header{"Accept": {"application/json"}},
+		},
+		Response: &http.Response{
+			Status:     "200 OK",
+			StatusCode: 200,
+			Proto:      "HTTP/1.1",
+			Header:     http.Header{"Content-Type": {"application/json"}},
+		},
+		ResponseBody: []byte(`{"items":[]}`),
+	}
+	binary := &RequestResponse{
+		Request: &http.Request{
+			Method: "POST",
+			URL:    u,
+			Header: http.Header{"Content-Type": {"text/plain"}},
+		},
+		RequestBody: []byte("<data>"),
+		Response: &http.Response{
+			Status:     "201 Created",
+			StatusCode: 201,
+			Header:     http.Header{},
+		},
+		ResponseBody: []byte{0xff, 0xfe},
+	}
+	failed := &RequestResponse{Request: get.Request}
+
+	buffer := &bytes.Buffer{}
+	T.ExpectSuccess(ExportPolly(buffer, "my recording",
+		[]*RequestResponse{get, binary, failed, get}))
+
+	var har pollyHAR
+	T.ExpectSuccess(json.Unmarshal(buffer.Bytes(), &har))
+	T.Equal(har.Log.RecordingName, "my recording")
+	T.Equal(har.Log.Version, "1.2")
+	T.Equal(len(har.Log.Entries), 3)
+
+	entry := har.Log.Entries[0]
+	T.Equal(entry.Request.Method, "GET")
+	T.Equal(entry.Request.URL, "https://api.example.com/items?a=1&b=x%20y")
+	T.Equal(entry.Request.Headers, []harPair{{"accept", "application/json"}})
+	T.Equal(entry.Request.QueryString, []harPair{{"a", "1"}, {"b", "x y"}})
+	T.Equal(entry.Request.PostData == nil, true)
+	T.Equal(entry.Response.Status, 200)
+	T.Equal(entry.Response.StatusText, "OK")
+	T.Equal(entry.Response.Content.Text, `{"items":[]}`)
+	T.Equal(entry.Response.Content.MimeType, "application/json")
+	T.Equal(entry.StartedDateTime, "2020-01-02T03:04:05.000Z")
+
+	// The id hashes the method, URL and body, and repeated requests are
+	// numbered.
+	id, err := pollyID("GET", "https://api.example.com/items?a=1&b=x%20y", nil)
+	T.ExpectSuccess(err)
+	T.Equal(entry.ID, id)
+	T.Equal(entry.Order, 0)
+	T.Equal(har.Log.Entries[2].ID, id)
+	T.Equal(har.Log.Entries[2].Order, 1)
+
+	entry = har.Log.Entries[1]
+	T.NotEqual(entry.ID, id)
+	T.Equal(entry.Request.PostData.Text, "<data>")
+	T.Equal(entry.Request.PostData.MimeType, "text/plain")
+	T.Equal(entry.Response.StatusText, "Created")
+	T.Equal(entry.Response.Content.IsBinary, true)
+	T.Equal(entry.Response.Content.Text, "//4=")
+	T.Equal(bytes.Contains(buffer.Bytes(), []byte(`"<data>"`)), true)
+}
+
+func TestImportHAR(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	u, _ := url.Parse("https://api.example.com/items?a=1")
+	rr := &RequestResponse{
+		Request: &http.Request{
+			Method: "POST",
+			URL:    u,
+			Proto:  "HTTP/1.1",
+			Header: http.Header{"Content-Type": {"application/json"}},
+		},
+		RequestBody: []byte(`{"name":"x"}`),
+		Response: &http.Response{
+			Status:     "201 Created",
+			StatusCode: 201,
+			Proto:      "HTTP/1.1",
+			Header:     http.Header{"Content-Type": {"image/png"}},
+		},
+		ResponseBody: []byte{0x89, 0x50, 0xff},
+	}
+
+	// Recordings survive a round trip through Polly.
+	buffer := &bytes.Buffer{}
+	T.ExpectSuccess(ExportPolly(buffer, "items", []*RequestResponse{rr}))
+	rrs, err := ImportHAR(buffer)
+	T.ExpectSuccess(err)
+	T.Equal(len(rrs), 1)
+	T.Equal(rrs[0].Request.Method, "POST")
+	T.Equal(rrs[0].Request.URL.String(), "https://api.example.com/items?a=1")
+	T.Equal(rrs[0].Request.Header,
+		http.Header{"Content-Type": {"application/json"}})
+	T.Equal(string(rrs[0].RequestBody), `{"name":"x"}`)
+	T.Equal(rrs[0].Response.Status, "201 Created")
+	T.Equal(rrs[0].Response.Header, http.Header{"Content-Type": {"image/png"}})
+	T.Equal(rrs[0].ResponseBody, []byte{0x89, 0x50, 0xff})
+	T.Equal(rrs[0].Recorded.IsZero(), false)
+
+	// Browser captures use HTTP/2 names, forms and failed entries.
+	browser := `{"log": {"entries": [{
+		"startedDateTime": "2020-01-02T03:04:05.678+01:00",
+		"request": {
+			"method": "post",
+			"url": "https://example.com/login",
+			"httpVersion": "h2",
+			"headers": [{"name": ":authority", "value": "example.com"}],
+			"postData": {
+				"mimeType": "application/x-www-form-urlencoded",
+				"params": [{"name": "user", "value": "a b"}]
+			}
+		},
+		"response": {
+			"status": 302,
+			"statusText": "",
+			"httpVersion": "h2",
+			"headers": [
+				{"name": "location", "value": "/home"},
+				{"name": "content-encoding", "value": "gzip"}
+			],
+			"content": {"mimeType": "text/html", "text": "moved"}
+		}
+	}, {
+		"request": {"method": "GET", "url": "https://blocked.example.com/"},
+		"response": {"status": 0}
+	}]}}`
+	rrs, err = ImportHAR(bytes.NewReader([]byte(browser)))
+	T.ExpectSuccess(err)
+	T.Equal(len(rrs), 2)
+	T.Equal(rrs[0].Request.Method, "POST")
+	T.Equal(rrs[0].Request.Proto, "HTTP/2.0")
+	T.Equal(rrs[0].Request.Header, http.Header{
+		"Content-Type": {"application/x-www-form-urlencoded"}})
+	T.Equal(string(rrs[0].RequestBody), "user=a+b")
+	T.Equal(rrs[0].Response.Status, "302 Found")
+	T.Equal(rrs[0].Response.Header, http.Header{
+		"Location":     {"/home"},
+		"Content-Type": {"text/html"},
+	})
+	T.Equal(rrs[0].Recorded.UTC(),
+		time.Date(2020, 1, 2, 2, 4, 5, 678000000, time.UTC))
+	T.Equal(rrs[1].Response == nil, true)
+	T.NotEqual(rrs[1].Error, nil)
+}
@@ -0,0 +1,216 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvr
+
+import (
+	"mime"
+	"net/url"
+	"strings"
+)
+
+// A Preset describes which parts of the requests and responses of a service
+// hold secrets or change from one request to the next, so that archives of
+// it are safe to commit and still match when replayed. See UsePreset().
+// Presets for common services are provided, and others can be described
+// the same way.
+type Preset struct {
+	// Describes the preset in messages.
+	Name string
+
+	// The hosts of the service. Recordings of other hosts are left alone.
+	// A host starting with "." matches any subdomain of it.
+	Hosts []string
+
+	// Request and response headers that hold secrets. Their values are
+	// replaced with "REDACTED".
+	SecretHeaders []string
+
+	// Request headers whose values change from one request to the next,
+	// such as idempotency keys or signing dates. They are removed so that
+	// they are neither recorded nor compared when matching.
+	VolatileHeaders []string
+
+	// Query parameters, and fields of form encoded request bodies, that
+	// hold secrets. Their values are replaced with "REDACTED".
+	SecretParams []string
+
+	// The JSON paths of response body fields that hold secrets, as taken by
+	// RedactJSON(). Their values are replaced with "REDACTED".
+	SecretFields []string
+}
+
+var (
+	// The Stripe API, which is authenticated with a secret key and returns
+	// client secrets for payment intents, setup intents and ephemeral keys.
+	PresetStripe = &Preset{
+		Name: "Stripe",
+		Hosts: []string{"api.stripe.com", "files.stripe.com",
+			"connect.stripe.com", "uploads.stripe.com"},
+		SecretHeaders: []string{"Authorization"},
+		VolatileHeaders: []string{"Idempotency-Key",
+			"X-Stripe-Client-User-Agent"},
+		SecretFields: []string{"$.client_secret", "$.secret",
+			"$.data[*].client_secret", "$.data[*].secret"},
+	}
+
+	// The GitHub API, which is authenticated with a token and returns
+	// tokens when exchanging OAuth codes or creating installation tokens.
+	PresetGitHub = &Preset{
+		Name: "GitHub",
+		Hosts: []string{"github.com", "api.github.com",
+			"uploads.github.com"},
+		SecretHeaders: []string{"Authorization"},
+		SecretParams: []string{"access_token", "client_secret",
+			"code"},
+		SecretFields: []string{"$.token", "$.access_token",
+			"$.refresh_token", "$.client_secret",
+			"$.webhook_secret", "$.pem"},
+	}
+
+	// AWS services, whose requests are signed with SigV4 over a date that
+	// changes every run, and whose credential responses hold secret keys.
+	PresetAWS = &Preset{
+		Name:  "AWS",
+		Hosts: []string{".amazonaws.com", ".api.aws"},
+		SecretHeaders: []string{"Authorization",
+			"X-Amz-Security-Token"},
+		VolatileHeaders: []string{"X-Amz-Date", "Amz-Sdk-Invocation-Id",
+			"Amz-Sdk-Request"},
+		SecretParams: []string{"X-Amz-Credential", "X-Amz-Date",
+			"X-Amz-Security-Token", "X-Amz-Signature"},
+		SecretFields: []string{"$.Credentials.SecretAccessKey",
+			"$.Credentials.SessionToken", "$.Credentials.SecretKey",
+			"$.roleCredentials.secretAccessKey",
+			"$.roleCredentials.sessionToken"},
+	}
+
+	// The Slack Web API, which takes a token in the Authorization header or
+	// the form body, and returns tokens from the OAuth flow.
+	PresetSlack = &Preset{
+		Name:          "Slack",
+		Hosts:         []string{"slack.com", ".slack.com"},
+		SecretHeaders: []string{"Authorization"},
+		SecretParams:  []string{"token", "client_secret", "code"},
+		SecretFields: []string{"$.access_token", "$.refresh_token",
+			"$.authed_user.access_token",
+			"$.authed_user.refresh_token",
+			"$.bot.bot_access_token", "$.incoming_webhook.url"},
+	}
+)
+
+// UsePreset scrubs the secrets and volatile values that each of the presets
+// describe from recordings of their services, for example:
+//
+//	defer dvr.UsePreset(dvr.PresetStripe, dvr.PresetAWS)()
+//
+// Requests are scrubbed the same way in replay mode before they are
+// matched, so live credentials match the scrubbed recordings. This will panic
+// if any of the presets has a SecretFields path that can not be parsed.
+//
+// This adds a symmetric obfuscator to the chain for each preset, the returned
+// function removes them.
+func UsePreset(presets ...*Preset) (remove func()) {
+	var removes []func()
+	for _, p := range presets {
+		params := make(map[string]bool)
+		for _, name := range p.SecretParams {
+			params[name] = true
+		}
+		s := &presetScrubber{
+			preset:   p,
+			params:   &queryParamObfuscator{params: params},
+			redactor: RedactJSON(p.SecretFields...),
+		}
+		removes = append(removes, addSymmetricObfuscator(
+			"UsePreset("+p.Name+")", s.scrub))
+	}
+	return func() {
+		for _, remove := range removes {
+			remove()
+		}
+	}
+}
+
+// Scrubs the recordings of the service that a preset describes.
+type presetScrubber struct {
+	preset   *Preset
+	params   *queryParamObfuscator
+	redactor func(*RequestResponse)
+}
+
+// Returns true if the host belongs to the service.
+func (s *presetScrubber) matches(host string) bool {
+	host = strings.ToLower(host)
+	for _, h := range s.preset.Hosts {
+		h = strings.ToLower(h)
+		if host == h || strings.HasPrefix(h, ".") &&
+			(strings.HasSuffix(host, h) || host == h[1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// The obfuscator given to addSymmetricObfuscator().
+func (s *presetScrubber) scrub(rr *RequestResponse) {
+	if rr.Request == nil || rr.Request.URL == nil ||
+		!s.matches(rr.Request.URL.Hostname()) {
+		return
+	}
+	for _, name := range s.preset.SecretHeaders {
+		if rr.Request.Header.Get(name) != "" {
+			rr.Request.Header.Set(name, redactedValue)
+		}
+		if rr.Response != nil && rr.Response.Header.Get(name) != "" {
+			rr.Response.Header.Set(name, redactedValue)
+		}
+	}
+	for _, name := range s.preset.VolatileHeaders {
+		rr.Request.Header.Del(name)
+	}
+	if len(s.params.params) > 0 {
+		u := rr.Request.URL
+		u.RawQuery, _ = s.params.rawQuery(u.RawQuery)
+		s.scrubForm(rr)
+	}
+	s.redactor(rr)
+}
+
+// Replaces the secret fields of a form encoded request body.
+func (s *presetScrubber) scrubForm(rr *RequestResponse) {
+	mediaType, _, _ := mime.ParseMediaType(
+		rr.Request.Header.Get("Content-Type"))
+	if mediaType != "application/x-www-form-urlencoded" {
+		return
+	}
+	values, err := url.ParseQuery(string(rr.RequestBody))
+	if err != nil {
+		return
+	}
+	changed := false
+	for name := range s.params.params {
+		if _, ok := values[name]; ok {
+			values.Set(name, redactedValue)
+			changed = true
+		}
+	}
+	if !changed {
+		return
+	}
+	rr.RequestBody = []byte(values.Encode())
+	if rr.Request.ContentLength > 0 {
+		rr.Request.ContentLength = int64(len(rr.RequestBody))
+	}
+}
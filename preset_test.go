@@ -0,0 +1,106 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvr
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/liquidgecka/testlib"
+)
+
+func TestUsePreset(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+	defer ResetObfuscators()
+
+	// Every built in preset can be used.
+	remove := UsePreset(PresetStripe, PresetGitHub, PresetAWS, PresetSlack)
+	T.Equal(len(obfuscators()), 4)
+	T.Equal(len(replayNormalizers()), 4)
+	remove()
+	T.Equal(len(obfuscators()), 0)
+	T.Equal(len(replayNormalizers()), 0)
+
+	defer UsePreset(PresetStripe)()
+	newRR := func(rawurl, body string) *RequestResponse {
+		req, err := http.NewRequest("POST", rawurl, strings.NewReader(body))
+		T.ExpectSuccess(err)
+		req.Header.Set("Authorization", "Bearer sk_live_123")
+		req.Header.Set("Idempotency-Key", "5b2e")
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return &RequestResponse{
+			Request:     req,
+			RequestBody: []byte(body),
+			Response: &http.Response{
+				StatusCode:    200,
+				Header:        http.Header{},
+				ContentLength: -1,
+			},
+			ResponseBody: []byte(`{"id":"pi_1","client_secret":"pi_1_s"}`),
+		}
+	}
+	scrub := func(rr *RequestResponse) {
+		for _, f := range obfuscators() {
+			T.ExpectSuccess(f(rr))
+		}
+	}
+
+	rr := newRR("https://api.stripe.com/v1/payment_intents", "amount=1")
+	scrub(rr)
+	T.Equal(rr.Request.Header.Get("Authorization"), "REDACTED")
+	T.Equal(rr.Request.Header.Get("Idempotency-Key"), "")
+	T.Equal(string(rr.RequestBody), "amount=1")
+	T.Equal(string(rr.ResponseBody),
+		`{"id":"pi_1","client_secret":"REDACTED"}`)
+
+	// Other services are left alone.
+	rr = newRR("https://api.example.com/v1/payment_intents", "amount=1")
+	scrub(rr)
+	T.Equal(rr.Request.Header.Get("Authorization"), "Bearer sk_live_123")
+	T.Equal(rr.Request.Header.Get("Idempotency-Key"), "5b2e")
+	T.Equal(string(rr.ResponseBody), `{"id":"pi_1","client_secret":"pi_1_s"}`)
+}
+
+func TestPresetScrubberParams(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+	defer ResetObfuscators()
+
+	defer UsePreset(PresetSlack, PresetAWS)()
+	req, err := http.NewRequest("POST",
+		"https://slack.com/api/chat.postMessage?token=xoxb-1&a=b",
+		strings.NewReader("channel=C1&token=xoxb-1"))
+	T.ExpectSuccess(err)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr := &RequestResponse{
+		Request:     req,
+		RequestBody: []byte("channel=C1&token=xoxb-1"),
+	}
+	for _, f := range replayNormalizers() {
+		T.ExpectSuccess(f(rr))
+	}
+	T.Equal(rr.Request.URL.RawQuery, "token=REDACTED&a=b")
+	T.Equal(string(rr.RequestBody), "channel=C1&token=REDACTED")
+	T.Equal(rr.Request.ContentLength, int64(len(rr.RequestBody)))
+
+	// Presets with a host starting with "." match its subdomains.
+	s := &presetScrubber{preset: PresetAWS}
+	T.Equal(s.matches("s3.us-east-1.amazonaws.com"), true)
+	T.Equal(s.matches("AMAZONAWS.COM"), true)
+	T.Equal(s.matches("amazonaws.com.example.com"), false)
+	T.Equal(s.matches("notamazonaws.com"), false)
+}
@@ -0,0 +1,288 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvr
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Proxy is an HTTP forward proxy that sends every request it receives through
+// a RoundTripper from this library, so the requests are recorded, replayed or
+// passed through just like requests made by the test itself. This allows non
+// Go components and command line tools used in integration tests to be
+// pointed at the proxy (typically via HTTP_PROXY and HTTPS_PROXY) and have
+// their traffic captured in the archive.
+//
+// HTTPS is supported by intercepting CONNECT requests and terminating TLS
+// with certificates issued by a certificate authority generated when the
+// proxy is created. Clients must be configured to trust CACertPEM.
+type Proxy struct {
+	// The PEM encoded certificate of the generated certificate authority.
+	CACertPEM []byte
+
+	// The RoundTripper that requests are sent through. This defaults to
+	// DefaultRoundTripper.
+	Transport http.RoundTripper
+
+	// The certificate authority used to sign the per host certificates.
+	ca    *x509.Certificate
+	caKey *ecdsa.PrivateKey
+
+	// Certificates that have been generated for each host.
+	certs     map[string]*tls.Certificate
+	certsLock sync.Mutex
+}
+
+// Creates a new Proxy with a freshly generated certificate authority.
+func NewProxy() (*Proxy, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "dvr proxy CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(10 * 365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template,
+		&key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	ca, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &Proxy{
+		CACertPEM: pem.EncodeToMemory(&pem.Block{
+			Type:  "CERTIFICATE",
+			Bytes: der,
+		}),
+		ca:    ca,
+		caKey: key,
+		certs: make(map[string]*tls.Certificate),
+	}, nil
+}
+
+// ListenAndServeProxy starts a Proxy listening on the given address. The
+// certificate authority is written to the archive file name with ".ca.pem"
+// appended so that clients can be configured to trust it. This only returns
+// if the server fails.
+func ListenAndServeProxy(addr string) error {
+	p, err := NewProxy()
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(fileName+".ca.pem", p.CACertPEM, os.FileMode(0644))
+	if err != nil {
+		return err
+	}
+	return http.ListenAndServe(addr, p)
+}
+
+// Returns the RoundTripper requests should be sent through.
+func (p *Proxy) transport() http.RoundTripper {
+	if p.Transport != nil {
+		return p.Transport
+	}
+	return DefaultRoundTripper
+}
+
+// http.Handler
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "CONNECT" {
+		p.serveConnect(w, r)
+		return
+	} else if !r.URL.IsAbs() {
+		http.Error(w, "dvr proxy requires an absolute URL",
+			http.StatusBadRequest)
+		return
+	}
+
+	resp, err := p.transport().RoundTrip(outgoingRequest(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	for name, values := range resp.Header {
+		w.Header()[name] = values
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// Handles a CONNECT request by terminating TLS and then reading requests from
+// the tunnel until the client closes it.
+func (p *Proxy) serveConnect(w http.ResponseWriter, r *http.Request) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "dvr proxy can not hijack the connection",
+			http.StatusInternalServerError)
+		return
+	}
+	conn, _, err := hijacker.Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	if _, err := io.WriteString(conn,
+		"HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+		return
+	}
+
+	host := r.URL.Host
+	tlsConn := tls.Server(conn, &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (
+			*tls.Certificate, error,
+		) {
+			name := hello.ServerName
+			if name == "" {
+				name, _, _ = net.SplitHostPort(host)
+			}
+			return p.certificate(name)
+		},
+	})
+	defer tlsConn.Close()
+
+	reader := bufio.NewReader(tlsConn)
+	for {
+		req, err := http.ReadRequest(reader)
+		if err != nil {
+			return
+		}
+		req.URL.Scheme = "https"
+		req.URL.Host = req.Host
+		if req.URL.Host == "" {
+			req.URL.Host = host
+		}
+
+		resp, err := p.transport().RoundTrip(outgoingRequest(req))
+		if err != nil {
+			resp = &http.Response{
+				StatusCode: http.StatusBadGateway,
+				ProtoMajor: 1,
+				ProtoMinor: 1,
+				Header:     http.Header{},
+				Body:       ioutil.NopCloser(strings.NewReader(err.Error())),
+			}
+		}
+
+		// The tunnel carries HTTP/1.1 whatever the response arrived over.
+		// A body of unknown length, as from an HTTP/2 server that sent no
+		// Content-Length or one that was transparently decompressed, is
+		// chunked so that the tunnel can stay open for the next request.
+		resp.Proto, resp.ProtoMajor, resp.ProtoMinor = "HTTP/1.1", 1, 1
+		if resp.ContentLength < 0 && len(resp.TransferEncoding) == 0 {
+			resp.TransferEncoding = []string{"chunked"}
+		}
+		err = resp.Write(tlsConn)
+		resp.Body.Close()
+		if err != nil || req.Close || resp.Close {
+			return
+		}
+	}
+}
+
+// Returns a certificate for the given host, signed by the proxy's certificate
+// authority.
+func (p *Proxy) certificate(host string) (*tls.Certificate, error) {
+	p.certsLock.Lock()
+	defer p.certsLock.Unlock()
+	if cert, ok := p.certs[host]; ok {
+		return cert, nil
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{host}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, p.ca,
+		&key.PublicKey, p.caKey)
+	if err != nil {
+		return nil, err
+	}
+	cert := &tls.Certificate{
+		Certificate: [][]byte{der, p.ca.Raw},
+		PrivateKey:  key,
+	}
+	p.certs[host] = cert
+	return cert, nil
+}
+
+// The headers that only apply to the connection with the proxy and must not
+// be forwarded.
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// Converts a request received by the proxy into one that can be sent by a
+// client RoundTripper.
+func outgoingRequest(r *http.Request) *http.Request {
+	out := r.Clone(r.Context())
+	out.RequestURI = ""
+	for _, name := range hopHeaders {
+		out.Header.Del(name)
+	}
+	if r.ContentLength == 0 {
+		out.Body = nil
+	}
+	return out
+}
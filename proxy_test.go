@@ -0,0 +1,123 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvr
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/liquidgecka/testlib"
+)
+
+func TestProxy(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Proxied-Auth", r.Header.Get("Proxy-Authorization"))
+		w.Write([]byte("hello " + r.URL.Path))
+	})
+	plain := httptest.NewServer(handler)
+	defer plain.Close()
+	secure := httptest.NewTLSServer(handler)
+	defer secure.Close()
+
+	// The proxy talks to the servers through a pass through RoundTripper
+	// that trusts the test server's certificate.
+	p, err := NewProxy()
+	T.ExpectSuccess(err)
+	p.Transport = &roundTripper{realRoundTripper: secure.Client().Transport}
+	proxyServer := httptest.NewServer(p)
+	defer proxyServer.Close()
+
+	// The client trusts the proxy's certificate authority.
+	pool := x509.NewCertPool()
+	T.Equal(pool.AppendCertsFromPEM(p.CACertPEM), true)
+	proxyURL, err := url.Parse(proxyServer.URL)
+	T.ExpectSuccess(err)
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(proxyURL),
+		TLSClientConfig: &tls.Config{RootCAs: pool},
+		ProxyConnectHeader: http.Header{
+			"Proxy-Authorization": {"Basic secret"}},
+	}}
+
+	for _, server := range []*httptest.Server{plain, secure} {
+		resp, err := client.Get(server.URL + "/path")
+		T.ExpectSuccess(err)
+		body, err := ioutil.ReadAll(resp.Body)
+		T.ExpectSuccess(err)
+		T.ExpectSuccess(resp.Body.Close())
+		T.Equal(string(body), "hello /path")
+		T.Equal(resp.Header.Get("X-Proxied-Auth"), "")
+	}
+}
+
+func TestProxyUnknownLength(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	// Responses from HTTP/2 servers without a Content-Length, and those that
+	// were decompressed by the transport, have no known length.
+	p, err := NewProxy()
+	T.ExpectSuccess(err)
+	p.Transport = roundTripperFunc(func(r *http.Request) (
+		*http.Response, error,
+	) {
+		return &http.Response{
+			Status:        "200 OK",
+			StatusCode:    200,
+			Proto:         "HTTP/2.0",
+			ProtoMajor:    2,
+			Header:        http.Header{},
+			ContentLength: -1,
+			Uncompressed:  r.URL.Path == "/gzipped",
+			Body:          ioutil.NopCloser(strings.NewReader("hello")),
+		}, nil
+	})
+	proxyServer := httptest.NewServer(p)
+	defer proxyServer.Close()
+
+	pool := x509.NewCertPool()
+	T.Equal(pool.AppendCertsFromPEM(p.CACertPEM), true)
+	proxyURL, err := url.Parse(proxyServer.URL)
+	T.ExpectSuccess(err)
+	client := &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			Proxy:           http.ProxyURL(proxyURL),
+			TLSClientConfig: &tls.Config{RootCAs: pool},
+		},
+	}
+
+	// Both requests share the tunnel, which stays usable after each.
+	for _, path := range []string{"/plain", "/gzipped"} {
+		resp, err := client.Get("https://example.test" + path)
+		T.ExpectSuccess(err)
+		body, err := ioutil.ReadAll(resp.Body)
+		T.ExpectSuccess(err)
+		T.ExpectSuccess(resp.Body.Close())
+		T.Equal(string(body), "hello")
+		T.Equal(resp.Proto, "HTTP/1.1")
+		T.Equal(resp.TransferEncoding, []string{"chunked"})
+	}
+}
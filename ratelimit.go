@@ -0,0 +1,177 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvr
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Replayed requests normally match the first recording of them, so a client
+// that retries after being rate limited would be rate limited forever. A
+// recording that asks the client to retry later (a 429, or a 503 with a
+// Retry-After header) is instead only replayed once if a later recording
+// also matches the request, so an archive of a request that was rate limited
+// and then succeeded replays the same way. With -dvr.simulate_latency the
+// rate limit lasts until its Retry-After has passed, and requests retried
+// before then are rate limited again, so client backoff can be tested
+// against the timing that the service asked for.
+var (
+	// The time until which each rate limited recording in requestList is
+	// replayed, and whether it is used up. Reset when requestList is loaded
+	// and protected by throttleLock. Created when first needed.
+	throttleUntil map[int]time.Time
+	throttleUsed  map[int]bool
+	throttleLock  sync.Mutex
+)
+
+// Forgets which rate limited recordings have been replayed.
+func resetThrottles() {
+	throttleLock.Lock()
+	defer throttleLock.Unlock()
+	throttleUntil = nil
+	throttleUsed = nil
+}
+
+// Returns true if the recording asks the client to retry later.
+func throttled(rr *RequestResponse) bool {
+	if rr.Response == nil {
+		return false
+	}
+	switch rr.Response.StatusCode {
+	case http.StatusTooManyRequests:
+		return true
+	case http.StatusServiceUnavailable:
+		return rr.Response.Header.Get("Retry-After") != ""
+	}
+	return false
+}
+
+// Returns true if the rate limited recording at index i of requestList has
+// been used up, so the next recording of the request should be replayed.
+func throttleUsedUp(i int) bool {
+	throttleLock.Lock()
+	defer throttleLock.Unlock()
+	return throttleUsed[i]
+}
+
+// Replays the rate limited recording at index i of requestList, returning
+// false if it has been used up in the meantime. It is used up now, or once
+// its Retry-After has passed with -dvr.simulate_latency.
+func useThrottle(i int, rr *RequestResponse) bool {
+	throttleLock.Lock()
+	defer throttleLock.Unlock()
+	if throttleUsed == nil {
+		throttleUntil = make(map[int]time.Time)
+		throttleUsed = make(map[int]bool)
+	}
+	switch until, ok := throttleUntil[i]; {
+	case throttleUsed[i]:
+		return false
+	case !simulateLatency:
+		throttleUsed[i] = true
+	case !ok:
+		throttleUntil[i] = clockNow().Add(retryAfter(rr))
+	case !clockNow().Before(until):
+		throttleUsed[i] = true
+		return false
+	}
+	return true
+}
+
+// Returns how long the recorded response asked the client to wait. The
+// Retry-After header is either a number of seconds or a date, which is
+// relative to the response's Date header, or failing that to when it was
+// recorded.
+func retryAfter(rr *RequestResponse) time.Duration {
+	value := rr.Response.Header.Get("Retry-After")
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	at, err := http.ParseTime(value)
+	if err != nil {
+		return 0
+	}
+	sent := rr.Recorded
+	date, err := http.ParseTime(rr.Response.Header.Get("Date"))
+	if err == nil {
+		sent = date
+	}
+	if d := at.Sub(sent); d > 0 && !sent.IsZero() {
+		return d
+	}
+	return 0
+}
+
+// Moves a Retry-After date in a replayed rate limited response so that it
+// is as far from now as it was from the recorded response, since the
+// recorded date has long passed.
+func refreshRetryAfter(rr *RequestResponse) {
+	if !throttled(rr) {
+		return
+	}
+	value := rr.Response.Header.Get("Retry-After")
+	if _, err := http.ParseTime(value); err != nil {
+		return
+	}
+	at := clockNow().Add(retryAfter(rr)).UTC()
+	rr.Response.Header.Set("Retry-After", at.Format(http.TimeFormat))
+}
+
+// RateLimitSequence returns recordings of the request in rr being rate
+// limited the given number of times, each with a 429 response asking the
+// client to retry after the given delay, followed by rr itself. Written to
+// an archive with WriteArchiveFile() they replay in that order, which lets
+// the backoff of a client be tested without having recorded a service
+// rate limiting it.
+func RateLimitSequence(
+	rr *RequestResponse, times int, retryAfter time.Duration,
+) []*RequestResponse {
+	seconds := (retryAfter + time.Second - 1) / time.Second
+	retry := strconv.Itoa(int(seconds))
+	body := []byte(http.StatusText(http.StatusTooManyRequests) + "\n")
+	sequence := make([]*RequestResponse, 0, times+1)
+	for i := 0; i < times; i++ {
+		limited := &RequestResponse{
+			Request:     rr.Request,
+			RequestBody: rr.RequestBody,
+			Response: &http.Response{
+				Status:     "429 Too Many Requests",
+				StatusCode: http.StatusTooManyRequests,
+				Proto:      "HTTP/1.1",
+				ProtoMajor: 1,
+				ProtoMinor: 1,
+				Header: http.Header{
+					"Content-Type": {"text/plain"},
+					"Retry-After":  {retry},
+				},
+				ContentLength: int64(len(body)),
+			},
+			ResponseBody:        body,
+			RedactedQueryParams: rr.RedactedQueryParams,
+			Partition:           rr.Partition,
+			Labels:              rr.Labels,
+			RunID:               rr.RunID,
+			Recorded:            rr.Recorded,
+		}
+		sequence = append(sequence, limited)
+	}
+	return append(sequence, rr)
+}
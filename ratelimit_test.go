@@ -0,0 +1,134 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvr
+
+import (
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/liquidgecka/testlib"
+)
+
+func TestRateLimitSequence(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+	defer resetBenchmark()
+	defer func() {
+		simulateLatency = false
+		clockNow = time.Now
+	}()
+
+	ok := testQuery("GET", "http://x/items", "", 200, "items").
+		RequestResponse()
+	other := testQuery("GET", "http://x/other", "", 429, "").
+		RequestResponse()
+	fileName = filepath.Join(T.TempDir(), "archive.dvr")
+	rrs := append(RateLimitSequence(ok, 2, 1500*time.Millisecond), other)
+	T.ExpectSuccess(WriteArchiveFile(fileName, rrs))
+	T.Equal(rrs[0].Response.Header.Get("Retry-After"), "2")
+
+	rt := &roundTripper{}
+	get := func(url string) (int, string) {
+		req, err := http.NewRequest("GET", url, nil)
+		T.ExpectSuccess(err)
+		resp, err := rt.RoundTrip(req)
+		T.ExpectSuccess(err)
+		body, err := ioutil.ReadAll(resp.Body)
+		T.ExpectSuccess(err)
+		return resp.StatusCode, string(body)
+	}
+	start := func() {
+		replay = true
+		isSetup = sync.Once{}
+	}
+
+	// Each rate limited recording is replayed once, and the last recording
+	// of a request keeps being replayed.
+	start()
+	for _, want := range []int{429, 429, 200, 200} {
+		status, _ := get("http://x/items")
+		T.Equal(status, want)
+	}
+	for i := 0; i < 2; i++ {
+		status, _ := get("http://x/other")
+		T.Equal(status, 429)
+	}
+
+	// With simulated latency a client retrying too soon is rate limited
+	// again.
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	clockNow = func() time.Time { return now }
+	simulateLatency = true
+	start()
+	retry := func() int {
+		status, _ := get("http://x/items")
+		return status
+	}
+	T.Equal(retry(), 429)
+	now = now.Add(time.Second)
+	T.Equal(retry(), 429)
+	now = now.Add(time.Second)
+	T.Equal(retry(), 429)
+	now = now.Add(time.Second)
+	T.Equal(retry(), 429)
+	now = now.Add(2 * time.Second)
+	status, body := get("http://x/items")
+	T.Equal(status, 200)
+	T.Equal(body, "items")
+}
+
+func TestRetryAfter(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+	defer func() { clockNow = time.Now }()
+
+	sent := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	rr := &RequestResponse{
+		Response: &http.Response{
+			StatusCode: 503,
+			Header: http.Header{
+				"Date":        {sent.Format(http.TimeFormat)},
+				"Retry-After": {"120"},
+			},
+		},
+		Recorded: sent.Add(time.Hour),
+	}
+	T.Equal(throttled(rr), true)
+	T.Equal(retryAfter(rr), 2*time.Minute)
+
+	// Dates are relative to the Date header, or to when it was recorded.
+	rr.Response.Header.Set("Retry-After",
+		sent.Add(time.Minute).Format(http.TimeFormat))
+	T.Equal(retryAfter(rr), time.Minute)
+	rr.Response.Header.Del("Date")
+	T.Equal(retryAfter(rr), time.Duration(0))
+	rr.Recorded = sent
+	T.Equal(retryAfter(rr), time.Minute)
+
+	// Replayed dates are moved to be as far from now.
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	clockNow = func() time.Time { return now }
+	refreshRetryAfter(rr)
+	T.Equal(rr.Response.Header.Get("Retry-After"),
+		"Sat, 01 Jun 2024 12:01:00 GMT")
+
+	// A 503 without Retry-After is just an error.
+	rr.Response.Header.Del("Retry-After")
+	T.Equal(throttled(rr), false)
+}
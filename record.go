@@ -15,15 +15,24 @@
 package dvr
 
 import (
-	"archive/tar"
+	"bufio"
 	"bytes"
+	"crypto/sha256"
 	"encoding/binary"
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 // Record certain request
@@ -38,19 +47,63 @@ var RecordRequest func(*http.Request) bool
 // An example usage of this function is to change the password used to
 // authenticate against a web service in order to allow any user to
 // run the test. See the "RequestObfuscation" example for details.
+//
+// This is run before any of the obfuscators added with AddObfuscator().
 var Obfuscator func(*RequestResponse)
 
 // This function setups up the rountTripper in recording mode. This will open
 // the output file as a zip stream so each follow up call can write an
 // individual call to the output.
 func (r *roundTripper) recordSetup() {
-	// Open the gzip file.
-	gzipFD, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC,
-		os.FileMode(0755))
+	panicIfError(checkModeFlags())
+	panicIfError(checkRecordAllowed())
+
+	path, err := archivePath()
+	panicIfError(err)
+	recordPath = path
+	runID = recordingRunID()
+
+	// Check the compression level before the archive is replaced.
+	level, err := compressionLevel()
 	panicIfError(err)
 
+	// Open the gzip file. The recording is written to a temporary file next
+	// to the archive which the gzipper renames over the archive once it is
+	// complete, so an interrupted run leaves the previous archive intact.
+	// It is locked before it is truncated so that a recording being made
+	// by another process is left alone.
+	gzipFD, err := openRecording(recordingPath(path))
+	if err != nil {
+		panicIfError(fmt.Errorf("dvr: -dvr.record can not write the "+
+			"archive %s, check that its directory exists and is "+
+			"writable: %s", path, err))
+	}
+	if err := lockArchive(gzipFD, path); err != nil {
+		gzipFD.Close()
+		panicIfError(err)
+	}
+	archiveFD = gzipFD
+	panicIfError(gzipFD.Truncate(0))
+
+	// Recordings from partitioned tests in the existing archive are kept so
+	// that re-recording a single test doesn't discard its siblings, as are
+	// those with other -dvr.labels and those that -dvr.cache still considers
+	// fresh. Errors are ignored here since there may not be a previous
+	// archive at all.
+	var carried []*gobQuery
+	if queries, err := readArchiveFile(path); err == nil && cacheTTL > 0 {
+		carried = freshQueries(queries)
+	} else if err == nil {
+		key := labelKey(activeLabels())
+		for _, q := range latestPartitions(queries) {
+			if q.Partition != "" || labelKey(q.Labels) != key {
+				carried = append(carried, q)
+			}
+		}
+	}
+
 	// Write the current version to the file as a 32 bit word.
-	version := uint32(1)
+	version := uint32(archiveVersion)
 	err = binary.Write(gzipFD, binary.BigEndian, version)
 	panicIfError(err)
 
@@ -58,15 +111,119 @@ func (r *roundTripper) recordSetup() {
 	gzipReader, gzipWriter, err := os.Pipe()
 	panicIfError(err)
 
-	// Start the gzipper command.
-	writerCmd = exec.Command(os.Args[0], InterceptorToken)
+	// Helper processes started from here on record into segments that the
+	// gzipper merges into the archive once this process is done.
+	segments, err := startSegments(runID)
+	panicIfError(err)
+
+	// Start the gzipper command, which is this binary. os.Args[0] is not a
+	// usable path to it on every platform.
+	executable, err := os.Executable()
+	panicIfError(err)
+	args := []string{InterceptorToken, strconv.Itoa(level), path, segments}
+	if flushInterval > 0 {
+		args = append(args, gzipperFlushArg)
+	}
+	writerCmd = exec.Command(executable, args...)
 	writerCmd.Stdout = gzipFD
 	writerCmd.Stdin = gzipReader
+	writerCmd.Stderr = os.Stderr
 	panicIfError(writerCmd.Start())
 
 	// Create the new zip writer that will store our results.
 	fd = gzipWriter
-	writer = tar.NewWriter(gzipWriter)
+	if flushInterval > 0 {
+		writerBuffer = bufio.NewWriterSize(gzipWriter, 1<<16)
+		writer = writerBuffer
+		go flushPeriodically(writerBuffer, flushInterval)
+	} else {
+		writer = gzipWriter
+	}
+
+	// Write out the recordings that are being carried over.
+	writerLock.Lock()
+	storedBodies = map[string]bool{}
+	writerLock.Unlock()
+	for _, q := range carried {
+		buffer := getEncodeBuffer()
+		panicIfError(gob.NewEncoder(buffer).Encode(dedupStored(q)))
+		writeBuffer(buffer)
+		putEncodeBuffer(buffer)
+	}
+
+	// When caching the carried recordings are also replayed. They are the
+	// first entries of the new archive.
+	if cacheTTL > 0 {
+		indexes := make(map[*gobQuery]int, len(carried))
+		for i, q := range carried {
+			indexes[q] = i
+		}
+		loadRequests(carried, indexes)
+	}
+}
+
+// Buffers that queries are gob encoded into before being written to the
+// archive. They are only needed until the entry is written so they are
+// reused rather than allocated for every request.
+var encodeBuffers = sync.Pool{
+	New: func() interface{} { return &bytes.Buffer{} },
+}
+
+// Buffers that have grown larger than this are left for the garbage
+// collector rather than being kept around by the pool, otherwise a single
+// huge body would pin that memory for the rest of the run.
+const maxPooledBuffer = 1 << 20
+
+// Returns an empty buffer from the pool.
+func getEncodeBuffer() *bytes.Buffer {
+	return encodeBuffers.Get().(*bytes.Buffer)
+}
+
+// Returns a buffer from getEncodeBuffer() to the pool.
+func putEncodeBuffer(buffer *bytes.Buffer) {
+	if buffer.Cap() > maxPooledBuffer {
+		return
+	}
+	buffer.Reset()
+	encodeBuffers.Put(buffer)
+}
+
+// Reads the whole body into a new slice. The slice is kept by the recording
+// so it can't come from a pool, but when the length is known up front the
+// buffer is sized so it doesn't have to be grown while reading.
+func readBody(body io.Reader, length int64) ([]byte, error) {
+	buffer := &bytes.Buffer{}
+	if length > 0 && length <= maxPooledBuffer {
+		// ReadFrom wants MinRead bytes free before each read, including
+		// the one that finds the end of the body.
+		buffer.Grow(int(length) + bytes.MinRead)
+	}
+	_, err := io.Copy(buffer, body)
+	return buffer.Bytes(), err
+}
+
+// Reads the body of a request so that it can be recorded or matched. If the
+// request has a GetBody function then the body is read from a copy made by
+// it, leaving Body to be sent untouched. Otherwise Body is read, closed and
+// replaced with a reader of the same bytes, and GetBody is set so that the
+// transport and http.Client can still resend the request when retrying or
+// following a redirect. Body is always read for requests that declare
+// trailers since their values are normally set once the body has been read,
+// and are then complete when this returns.
+func captureRequestBody(req *http.Request) ([]byte, error) {
+	if req.GetBody != nil && len(req.Trailer) == 0 {
+		if body, err := req.GetBody(); err == nil {
+			defer body.Close()
+			return readBody(body, req.ContentLength)
+		}
+	}
+	data, err := readBody(req.Body, req.ContentLength)
+	req.Body.Close()
+	req.Body = &bodyWriter{data: data, err: err}
+	req.GetBody = func() (io.ReadCloser, error) {
+		return &bodyWriter{data: data, err: err}, nil
+	}
+	return data, err
 }
 
 // This function is called if the testing library is in recording mode.
@@ -77,36 +234,62 @@ func (r *roundTripper) record(req *http.Request) (*http.Response, error) {
 	isSetup.Do(r.recordSetup)
 
 	// The structure that saves all of our transmitted data.
-	q := &gobQuery{}
+	partition, _ := requestPartition()
+	q := &gobQuery{
+		Partition: partition,
+		RunID:     runID,
+		Labels:    activeLabels(),
+		Recorded:  time.Now(),
+		Matching:  matchingFingerprint(),
+	}
 	q.Request = newGobRequest(req)
+	q.Request.Header = withoutProxyHeaders(q.Request.Header)
 
 	if req.Body != nil {
 		// Read the body into a buffer for us to save.
-		buffer := &bytes.Buffer{}
-		_, q.Request.Error.Error = io.Copy(buffer, req.Body)
-		q.Request.Body = buffer.Bytes()
-		req.Body = &bodyWriter{
-			offset: 0,
-			data:   q.Request.Body,
-			err:    q.Request.Error.Error,
-		}
+		q.Request.Body, q.Request.Error.Error = captureRequestBody(req)
+
+		// The trailer values sent are those set by the end of the body, so
+		// later changes by the caller are not recorded.
+		q.Request.Trailer = req.Trailer.Clone()
 	}
 
 	// Use the underlying round tripper to actually complete the request.
-	resp, realErr := r.realRoundTripper.RoundTrip(req)
+	// Interim responses and connection timings are only seen through the
+	// request's trace hooks.
+	tracer := &traceRecorder{}
+	traced := tracer.trace(req)
+	resp, realErr := r.realRoundTripper.RoundTrip(traced)
+	q.Duration = time.Since(q.Recorded)
+	if resp != nil && resp.Request == traced {
+		resp.Request = req
+	}
+	q.Interim = tracer.interimResponses()
+	q.Trace = tracer.requestTrace()
 	if RecordRequest == nil || !RecordRequest(req) {
+		trace("record", req, "passed through, not recorded")
+		return resp, realErr
+	}
+
+	// Failures to reach the fallback transport's proxy say nothing about the
+	// server, and would fail the request when replayed anywhere else.
+	var opErr *net.OpError
+	if errors.As(realErr, &opErr) && opErr.Op == "proxyconnect" {
+		trace("record", req, "not recorded, the proxy failed: %s", realErr)
 		return resp, realErr
 	}
 
 	// Save the data we were returned.
 	q.Error.Error = realErr
 	q.Response = newGobResponse(resp)
+	if q.Response != nil {
+		q.Response.Header = withoutProxyHeaders(q.Response.Header)
+	}
 
 	// Encode the body if necessary.
 	if resp != nil && resp.Body != nil {
-		buffer := &bytes.Buffer{}
-		_, q.Response.Error.Error = io.Copy(buffer, resp.Body)
-		q.Response.Body = buffer.Bytes()
+		q.Response.Body, q.Response.Error.Error = readBody(
+			resp.Body, resp.ContentLength)
 		resp.Body = &bodyWriter{
 			offset: 0,
 			data:   q.Response.Body,
@@ -114,68 +297,205 @@ func (r *roundTripper) record(req *http.Request) (*http.Response, error) {
 		}
 	}
 
+	// If an Obfuscator is present then it needs to work on a copy of the
+	// data so that mutation won't impact the Request or Response we return
+	// from this function.
+	if fs := obfuscators(); len(fs) > 0 {
+		// Convert a copy to a RequestResponse object, then allow each
+		// Obfuscator to mutate it in what ever way it sees fit.
+		// If any of them fail then nothing is recorded since the data may
+		// not have been scrubbed.
+		rr := q.clone().RequestResponse()
+		length := len(rr.ResponseBody)
+		for _, f := range fs {
+			if err := f(rr); err != nil {
+				fmt.Fprintf(panicOutput, "dvr: not recording %s %s, the "+
+					"obfuscator failed: %s\n", req.Method, req.URL, err)
+				trace("record", req, "not recorded, obfuscator failed: %s",
+					err)
+				return resp, realErr
+			}
+		}
+
+		syncContentLength(rr, length)
+
+		// Now we need to convert the object back into a gobQuery.
+		obfuscated := newGobQuery(rr)
+		q.Request = obfuscated.Request
+		q.Response = obfuscated.Response
+	}
+
+	if q.Request != nil {
+		warnNondeterministicHeaders(req, q.Request.Header)
+	}
+
 	// Gob encode the request into a byte buffer so that we know the size.
-	buffer := &bytes.Buffer{}
+	buffer := getEncodeBuffer()
+	defer putEncodeBuffer(buffer)
 	encoder := gob.NewEncoder(buffer)
-	panicIfError(encoder.Encode(q))
-
-	// If an Obfuscator is present then we need to do a bunch of extra work.
-	f := Obfuscator
-	if f != nil {
-		// First we decode the encoded object back over its self. This allows
-		// us to know that we have copies of all data, so mutation won't impact
-		// the Request or Response we return from this function.
-		decoder := gob.NewDecoder(buffer)
-		panicIfError(decoder.Decode(q))
-
-		// Convert this to a RequestResponse object, then allow the Obfuscator
-		// to mutate it in what ever way it sees fit.
-		rr := q.RequestResponse()
-		f(rr)
-
-		// Now we need to re-encode the object back into a gobQuery.
-		q.Request = newGobRequest(rr.Request)
-		if q.Request != nil {
-			q.Request.Body = rr.RequestBody
-			q.Request.Error.Error = rr.RequestBodyError
-		}
-		q.Response = newGobResponse(rr.Response)
-		if q.Response != nil {
-			q.Response.Body = rr.ResponseBody
-			q.Response.Error.Error = rr.ResponseBodyError
-		}
+	panicIfError(encoder.Encode(dedupStored(q)))
+
+	index := writeBuffer(buffer)
+	trace("record", req, "recorded as entry %d", index)
+
+	// Success!
+	return resp, realErr
+}
+
+// Response bodies shorter than this are always stored in the entry since a
+// reference to another entry would save little.
+const minSharedBody = 128
 
-		// And lastly we encode this back into the buffer.
-		buffer = &bytes.Buffer{}
-		encoder := gob.NewEncoder(buffer)
-		panicIfError(encoder.Encode(q))
+// Returns q with its response body replaced by a reference if an identical
+// body has already been stored in the archive, which is tracked by stored.
+// Otherwise the hash of the body is added to stored. Many recordings share
+// a body, such as a common error or a static asset, and this keeps a single
+// copy of it in the archive and in memory once the archive is read. q itself
+// is not altered.
+func dedupResponseBody(q *gobQuery, stored map[string]bool) *gobQuery {
+	if q.Response == nil || len(q.Response.Body) < minSharedBody {
+		return q
+	}
+	sum := sha256.Sum256(q.Response.Body)
+	resp := *q.Response
+	resp.BodyHash = string(sum[:])
+	if stored[resp.BodyHash] {
+		resp.Body = nil
+	} else {
+		stored[resp.BodyHash] = true
 	}
+	out := *q
+	out.Response = &resp
+	return &out
+}
+
+// Calls dedupResponseBody() with the bodies stored in the archive being
+// recorded.
+func dedupStored(q *gobQuery) *gobQuery {
+	writerLock.Lock()
+	defer writerLock.Unlock()
+	return dedupResponseBody(q, storedBodies)
+}
 
+// Writes an encoded gobQuery into the archive as a new entry, returning the
+// index of the entry.
+func writeBuffer(buffer *bytes.Buffer) int {
 	// Lock the writer output so that we don't have race conditions adding
 	// to the zip file.
 	writerLock.Lock()
 	defer writerLock.Unlock()
-
-	// Add a "Header" for the nea request. Headers are functionally virtual
-	// files in the tar stream.
-	header := &tar.Header{
-		Name: fmt.Sprintf("%d", writerCount),
-		Size: int64(buffer.Len()),
+	if writer == nil {
+		panicIfError(fmt.Errorf("dvr: the archive has been closed"))
 	}
+
+	// Write the entry into the stream. Unless -dvr.flush_interval is set
+	// this goes straight to the gzipper, which is necessary since we don't
+	// know when the program is going to exit.
+	index := writerCount
 	writerCount = writerCount + 1
-	panicIfError(writer.WriteHeader(header))
+	panicIfError(writeEntry(writer, buffer.Bytes()))
+	buffer.Reset()
 
-	// Write the buffer into the tar stream.
-	_, err := io.Copy(writer, buffer)
-	panicIfError(err)
+	return index
+}
 
-	// Next we need to ensure that the full object is flushed to the tar
-	// stream. We do this by flushing the writer and then syncing the
-	// underlying file descriptor.. This is necessary since we don't know
-	// when the program is going to exit.
-	panicIfError(writer.Flush())
-	//	panicIfError(fd.Sync())
+// Writes anything held in writerBuffer out to the gzipper. The caller must
+// hold writerLock.
+func flushWriterBuffer() error {
+	if writerBuffer == nil {
+		return nil
+	}
+	return writerBuffer.Flush()
+}
 
-	// Success!
-	return resp, realErr
+// Writes the given buffer out to the gzipper every interval until it is no
+// longer the writerBuffer, which happens when the archive is closed. The
+// gzipper flushes the archive after each of these writes, which keeps it
+// reasonably up to date for "dvr tail" without a flush for every request.
+func flushPeriodically(buffer *bufio.Writer, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		writerLock.Lock()
+		if writerBuffer != buffer {
+			writerLock.Unlock()
+			return
+		}
+		err := buffer.Flush()
+		writerLock.Unlock()
+		panicIfError(err)
+	}
+}
+
+// Writes the given queries into a new archive at the given path, replacing
+// any existing file. Unlike recording this compresses the archive in process
+// since the writer can be closed. Like recording the archive is written to a
+// temporary file that is renamed over the existing one once it is complete.
+func writeArchiveFile(name string, queries []*gobQuery) error {
+	level, err := compressionLevel()
+	if err != nil {
+		return err
+	}
+	fd, err := ioutil.TempFile(filepath.Dir(name),
+		"."+filepath.Base(name)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(fd.Name())
+	defer fd.Close()
+	if err := fd.Chmod(os.FileMode(0755)); err != nil {
+		return err
+	}
+
+	// Write the current version to the file as a 32 bit word.
+	err = binary.Write(fd, binary.BigEndian, uint32(archiveVersion))
+	if err != nil {
+		return err
+	}
+
+	output := bufio.NewWriter(fd)
+	blocks := newBlockWriter(output, 4, level)
+	buffer := getEncodeBuffer()
+	defer putEncodeBuffer(buffer)
+	stored := map[string]bool{}
+	for _, q := range queries {
+		buffer.Reset()
+		q = dedupResponseBody(q, stored)
+		if err := gob.NewEncoder(buffer).Encode(q); err != nil {
+			return err
+		}
+		if err := blocks.writeEntry(buffer.Bytes()); err != nil {
+			return err
+		}
+	}
+	if err := blocks.close(); err != nil {
+		return err
+	} else if err := output.Flush(); err != nil {
+		return err
+	} else if err := fd.Close(); err != nil {
+		return err
+	}
+	return os.Rename(fd.Name(), name)
+}
+
+// Returns the header without the Proxy-Authorization and other Proxy-*
+// headers, which are meant for a proxy between the client and the server
+// rather than the server itself. This keeps credentials for a corporate
+// proxy out of archives, and lets requests that carry them match recordings
+// made without one. The header is returned as is if it has none of them,
+// otherwise a copy is returned.
+func withoutProxyHeaders(h http.Header) http.Header {
+	var out http.Header
+	for name := range h {
+		if strings.HasPrefix(name, "Proxy-") {
+			if out == nil {
+				out = h.Clone()
+			}
+			delete(out, name)
+		}
+	}
+	if out == nil {
+		return h
+	}
+	return out
 }
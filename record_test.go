@@ -0,0 +1,424 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvr
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/liquidgecka/testlib"
+)
+
+func TestReadBody(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	// A known length is read without growing the buffer.
+	data, err := readBody(strings.NewReader("hello"), 5)
+	T.ExpectSuccess(err)
+	T.Equal(string(data), "hello")
+	T.Equal(cap(data) >= 5+bytes.MinRead, true)
+
+	// Unknown and wrong lengths still read the whole body.
+	data, err = readBody(strings.NewReader("hello"), -1)
+	T.ExpectSuccess(err)
+	T.Equal(string(data), "hello")
+	data, err = readBody(strings.NewReader("hello"), 2)
+	T.ExpectSuccess(err)
+	T.Equal(string(data), "hello")
+
+	// Read errors are returned along with what was read.
+	data, err = readBody(&errorReader{data: "he"}, 5)
+	T.ExpectErrorMessage(err, "expected")
+	T.Equal(string(data), "he")
+}
+
+// A request body that notes when it is closed.
+type closeRecorder struct {
+	io.Reader
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestCaptureRequestBody(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	// Requests with GetBody keep their Body.
+	req, err := http.NewRequest("POST", "http://x/", strings.NewReader("data"))
+	T.ExpectSuccess(err)
+	body := req.Body
+	data, err := captureRequestBody(req)
+	T.ExpectSuccess(err)
+	T.Equal(string(data), "data")
+	T.Equal(req.Body == body, true)
+	sent, err := ioutil.ReadAll(req.Body)
+	T.ExpectSuccess(err)
+	T.Equal(string(sent), "data")
+
+	// Otherwise the body is replaced, and can be resent with GetBody.
+	original := &closeRecorder{Reader: strings.NewReader("other")}
+	req, err = http.NewRequest("POST", "http://x/", original)
+	T.ExpectSuccess(err)
+	T.Equal(req.GetBody == nil, true)
+	data, err = captureRequestBody(req)
+	T.ExpectSuccess(err)
+	T.Equal(string(data), "other")
+	T.Equal(original.closed, true)
+	for i := 0; i < 2; i++ {
+		sent, err = ioutil.ReadAll(req.Body)
+		T.ExpectSuccess(err)
+		T.Equal(string(sent), "other")
+		req.Body, err = req.GetBody()
+		T.ExpectSuccess(err)
+	}
+
+	// Read errors are kept for the copies too.
+	req, err = http.NewRequest("POST", "http://x/",
+		ioutil.NopCloser(&errorReader{data: "he"}))
+	T.ExpectSuccess(err)
+	data, err = captureRequestBody(req)
+	T.ExpectErrorMessage(err, "expected")
+	T.Equal(string(data), "he")
+	copied, err := req.GetBody()
+	T.ExpectSuccess(err)
+	_, err = ioutil.ReadAll(copied)
+	T.ExpectErrorMessage(err, "expected")
+}
+
+func TestPutEncodeBuffer(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	// Buffers are emptied before being reused.
+	buffer := getEncodeBuffer()
+	buffer.WriteString("data")
+	putEncodeBuffer(buffer)
+	T.Equal(buffer.Len(), 0)
+
+	// Oversized buffers are not kept.
+	buffer = getEncodeBuffer()
+	buffer.Grow(maxPooledBuffer + 1)
+	buffer.WriteString("data")
+	putEncodeBuffer(buffer)
+	T.Equal(buffer.Len(), 4)
+}
+
+// A reader that returns data and then an error.
+type errorReader struct {
+	data string
+}
+
+func (e *errorReader) Read(p []byte) (int, error) {
+	if e.data == "" {
+		return 0, fmt.Errorf("expected")
+	}
+	n := copy(p, e.data)
+	e.data = e.data[n:]
+	return n, nil
+}
+
+func TestFlushPeriodically(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+	defer func() {
+		writerLock.Lock()
+		writer = nil
+		writerBuffer = nil
+		writerCount = 0
+		writerLock.Unlock()
+	}()
+
+	// Recordings are held in the buffer until the next flush.
+	output := &lockedBuffer{}
+	writerLock.Lock()
+	writerBuffer = bufio.NewWriter(output)
+	writer = writerBuffer
+	writerLock.Unlock()
+	writeBuffer(bytes.NewBufferString("entry"))
+	T.Equal(output.Len(), 0)
+
+	go flushPeriodically(writerBuffer, time.Millisecond)
+	for start := time.Now(); output.Len() == 0; {
+		if time.Since(start) > 5*time.Second {
+			T.Fatalf("The buffer was never flushed.")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	T.Equal(output.Len() > len("entry"), true)
+}
+
+// A bytes.Buffer that can be written from the flushing goroutine while the
+// test is checking it.
+type lockedBuffer struct {
+	lock   sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (l *lockedBuffer) Write(p []byte) (int, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.buffer.Write(p)
+}
+
+func (l *lockedBuffer) Len() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.buffer.Len()
+}
+
+func TestDedupResponseBody(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	body := strings.Repeat("x", minSharedBody)
+	stored := map[string]bool{}
+
+	// The first copy of a body is kept, later ones are referenced.
+	q1 := testQuery("GET", "http://api.example.com/a", "", 200, body)
+	out := dedupResponseBody(q1, stored)
+	T.Equal(string(out.Response.Body), body)
+	T.NotEqual(out.Response.BodyHash, "")
+	q2 := testQuery("GET", "http://api.example.com/b", "", 200, body)
+	out2 := dedupResponseBody(q2, stored)
+	T.Equal(len(out2.Response.Body), 0)
+	T.Equal(out2.Response.BodyHash, out.Response.BodyHash)
+
+	// The queries given are not altered.
+	T.Equal(string(q2.Response.Body), body)
+	T.Equal(q2.Response.BodyHash, "")
+
+	// Small bodies are left alone.
+	q3 := testQuery("GET", "http://api.example.com/c", "", 200, "small")
+	T.Equal(dedupResponseBody(q3, stored), q3)
+	T.Equal(dedupResponseBody(q3, stored), q3)
+}
+
+// A request body that sets a trailer once it has been read.
+type trailerBody struct {
+	io.Reader
+	req *http.Request
+}
+
+func (t *trailerBody) Read(p []byte) (int, error) {
+	n, err := t.Reader.Read(p)
+	if err == io.EOF {
+		t.req.Trailer.Set("Checksum", "abc")
+	}
+	return n, err
+}
+
+func (t *trailerBody) Close() error {
+	return nil
+}
+
+func TestRecordRequestTrailers(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+	defer resetBenchmark()
+	fileName = T.TempFile().Name()
+	record = true
+	RecordRequest = func(*http.Request) bool { return true }
+	isSetup = sync.Once{}
+
+	var sent http.Header
+	rt := &roundTripper{realRoundTripper: roundTripperFunc(
+		func(req *http.Request) (*http.Response, error) {
+			ioutil.ReadAll(req.Body)
+			sent = req.Trailer.Clone()
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(strings.NewReader("ok")),
+			}, nil
+		})}
+	newRequest := func() *http.Request {
+		req, err := http.NewRequest("POST", "http://x/upload", nil)
+		T.ExpectSuccess(err)
+		req.Trailer = http.Header{"Checksum": nil}
+		req.Body = &trailerBody{Reader: strings.NewReader("data"), req: req}
+		req.GetBody = func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(strings.NewReader("data")), nil
+		}
+		req.ContentLength = -1
+		return req
+	}
+
+	// The trailer is set when the body is read, and later changes are not
+	// recorded.
+	req := newRequest()
+	_, err := rt.RoundTrip(req)
+	T.ExpectSuccess(err)
+	req.Trailer.Set("Checksum", "changed")
+	T.ExpectSuccess(Close())
+	T.Equal(sent.Get("Checksum"), "abc")
+	queries, err := readArchiveFile(fileName)
+	T.ExpectSuccess(err)
+	T.Equal(len(queries), 1)
+	T.Equal(queries[0].Request.Trailer.Get("Checksum"), "abc")
+
+	// When replayed the trailers are matched once the body has been read.
+	record = false
+	replay = true
+	isSetup = sync.Once{}
+	rt.realRoundTripper = roundTripperFunc(
+		func(req *http.Request) (*http.Response, error) {
+			return nil, fmt.Errorf("not matched")
+		})
+	resp, err := rt.RoundTrip(newRequest())
+	T.ExpectSuccess(err)
+	T.Equal(resp.StatusCode, 200)
+	req = newRequest()
+	req.Body = ioutil.NopCloser(strings.NewReader("data"))
+	_, err = rt.RoundTrip(req)
+	T.ExpectErrorMessage(err, "not matched")
+}
+
+func TestRecordReplacesArchiveWhenComplete(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+	defer resetBenchmark()
+
+	old := testQuery("GET", "http://x/old", "", 200, "old")
+	fileName = T.TempFile().Name()
+	T.ExpectSuccess(writeArchiveFile(fileName, []*gobQuery{old}))
+	rt := &roundTripper{realRoundTripper: roundTripperFunc(
+		func(req *http.Request) (*http.Response, error) {
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(strings.NewReader("new")),
+			}, nil
+		})}
+	urls := func() []string {
+		queries, err := readArchiveFile(fileName)
+		T.ExpectSuccess(err)
+		var urls []string
+		for _, q := range queries {
+			urls = append(urls, q.Request.URL)
+		}
+		return urls
+	}
+	start := func() {
+		record = true
+		RecordRequest = func(*http.Request) bool { return true }
+		isSetup = sync.Once{}
+		req, err := http.NewRequest("GET", "http://x/new", nil)
+		T.ExpectSuccess(err)
+		_, err = rt.RoundTrip(req)
+		T.ExpectSuccess(err)
+	}
+
+	// An interrupted run leaves the previous archive in place.
+	start()
+	T.ExpectSuccess(writerCmd.Process.Kill())
+	writerCmd.Wait()
+	fd.Close()
+	archiveFD.Close()
+	writer, writerBuffer, fd, writerCmd, archiveFD = nil, nil, nil, nil, nil
+	T.Equal(urls(), []string{"http://x/old"})
+
+	// So does a run that ends without calling Close(), as when the test
+	// binary exits part way through.
+	start()
+	T.ExpectSuccess(fd.Close())
+	T.ExpectErrorMessage(writerCmd.Wait(), "exit status 1")
+	archiveFD.Close()
+	writer, writerBuffer, fd, writerCmd, archiveFD = nil, nil, nil, nil, nil
+	T.Equal(urls(), []string{"http://x/old"})
+	_, err := os.Stat(recordingPath(fileName))
+	T.Equal(os.IsNotExist(err), true)
+
+	// A completed run replaces it, and the temporary file is gone.
+	start()
+	T.Equal(urls(), []string{"http://x/old"})
+	T.ExpectSuccess(Close())
+	T.Equal(urls(), []string{"http://x/new"})
+	_, err = os.Stat(recordingPath(fileName))
+	T.Equal(os.IsNotExist(err), true)
+}
+
+// The archive that TestRecordCrashHelper records into.
+const crashArchiveEnv = "DVR_TEST_CRASH_ARCHIVE"
+
+func TestRecordDiscardedWhenProcessDies(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	old := testQuery("GET", "http://x/old", "", 200, "old")
+	path := filepath.Join(T.TempDir(), "archive.dvr")
+	T.ExpectSuccess(writeArchiveFile(path, []*gobQuery{old}))
+
+	// The helper panics part way through recording. Its gzipper shares its
+	// stderr so the output is complete once the gzipper has exited too.
+	executable, err := os.Executable()
+	T.ExpectSuccess(err)
+	cmd := exec.Command(executable, "-test.run=^TestRecordCrashHelper$")
+	cmd.Env = append(os.Environ(), crashArchiveEnv+"="+path)
+	output, err := cmd.CombinedOutput()
+	T.ExpectErrorMessage(err, "exit status")
+	T.Equal(strings.Contains(string(output),
+		"panic: crashed while recording"), true)
+	T.Equal(strings.Contains(string(output), path+" was left unchanged "+
+		"since the process recording it exited without calling "+
+		"dvr.Close()"), true)
+
+	queries, err := readArchiveFile(path)
+	T.ExpectSuccess(err)
+	T.Equal(len(queries), 1)
+	T.Equal(queries[0].Request.URL, "http://x/old")
+	_, err = os.Stat(recordingPath(path))
+	T.Equal(os.IsNotExist(err), true)
+}
+
+// Records a request and then panics, when run by
+// TestRecordDiscardedWhenProcessDies.
+func TestRecordCrashHelper(t *testing.T) {
+	path := os.Getenv(crashArchiveEnv)
+	if path == "" {
+		return
+	}
+	fileName = path
+	record = true
+	RecordRequest = func(*http.Request) bool { return true }
+	rt := &roundTripper{realRoundTripper: roundTripperFunc(
+		func(req *http.Request) (*http.Response, error) {
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(strings.NewReader("new")),
+			}, nil
+		})}
+	req, err := http.NewRequest("GET", "http://x/new", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rt.RoundTrip(req); err != nil {
+		t.Fatal(err)
+	}
+	panic("crashed while recording")
+}
@@ -0,0 +1,253 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvr
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// This is the value that redacted data is replaced with.
+const redactedValue = "REDACTED"
+
+// A single step in a JSON path. If wildcard is true then every element of an
+// object or array is selected, otherwise key is used for objects and index
+// for arrays.
+type jsonPathStep struct {
+	key      string
+	index    int
+	isIndex  bool
+	wildcard bool
+}
+
+// Parses the subset of JSONPath supported by RedactJSON(): "$" followed by
+// any number of ".name", "['name']", "[n]", ".*" or "[*]" steps.
+func parseJSONPath(path string) ([]jsonPathStep, error) {
+	if !strings.HasPrefix(path, "$") {
+		return nil, fmt.Errorf("JSON path %q must start with '$'", path)
+	}
+	rest := path[1:]
+	steps := []jsonPathStep{}
+	for len(rest) > 0 {
+		switch rest[0] {
+		case '.':
+			rest = rest[1:]
+			end := strings.IndexAny(rest, ".[")
+			if end == -1 {
+				end = len(rest)
+			}
+			if end == 0 {
+				return nil, fmt.Errorf("JSON path %q has an empty name", path)
+			}
+			if rest[:end] == "*" {
+				steps = append(steps, jsonPathStep{wildcard: true})
+			} else {
+				steps = append(steps, jsonPathStep{key: rest[:end]})
+			}
+			rest = rest[end:]
+		case '[':
+			end := strings.IndexByte(rest, ']')
+			if end == -1 {
+				return nil, fmt.Errorf("JSON path %q has an unclosed '['", path)
+			}
+			inner := rest[1:end]
+			rest = rest[end+1:]
+			switch {
+			case inner == "*":
+				steps = append(steps, jsonPathStep{wildcard: true})
+			case len(inner) >= 2 && inner[0] == '\'' &&
+				inner[len(inner)-1] == '\'':
+				steps = append(steps, jsonPathStep{key: inner[1 : len(inner)-1]})
+			default:
+				i, err := strconv.Atoi(inner)
+				if err != nil || i < 0 {
+					return nil, fmt.Errorf(
+						"JSON path %q has an invalid index %q", path, inner)
+				}
+				steps = append(steps, jsonPathStep{index: i, isIndex: true})
+			}
+		default:
+			return nil, fmt.Errorf(
+				"JSON path %q has an unexpected %q", path, rest[0])
+		}
+	}
+	if len(steps) == 0 {
+		return nil, fmt.Errorf("JSON path %q selects the whole document", path)
+	}
+	return steps, nil
+}
+
+// The location of a JSON value within a response body, from start up to but
+// not including end.
+type jsonSpan struct {
+	start int
+	end   int
+}
+
+// Adds the location of every value selected by the given steps to spans.
+// data is a JSON value found at offset in the body. The values are found by
+// walking the document's tokens so that the body can be edited in place.
+func findJSONPath(
+	data []byte, offset int, steps []jsonPathStep, spans *[]jsonSpan,
+) {
+	if len(steps) == 0 {
+		*spans = append(*spans, jsonSpan{offset, offset + len(data)})
+		return
+	}
+	step := steps[0]
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	token, err := decoder.Token()
+	if err != nil {
+		return
+	}
+	delim, _ := token.(json.Delim)
+	if delim != '{' && delim != '[' {
+		return
+	}
+	for index := 0; decoder.More(); index++ {
+		selected := step.wildcard
+		if delim == '{' {
+			key, err := decoder.Token()
+			if err != nil {
+				return
+			}
+			selected = selected || !step.isIndex && key == step.key
+		} else {
+			selected = selected || step.isIndex && index == step.index
+		}
+		var child json.RawMessage
+		if err := decoder.Decode(&child); err != nil {
+			return
+		}
+		if selected {
+			end := offset + int(decoder.InputOffset())
+			findJSONPath(child, end-len(child), steps[1:], spans)
+		}
+	}
+}
+
+// This is the type used to store the parsed paths given to RedactJSON().
+type jsonRedactor struct {
+	paths [][]jsonPathStep
+}
+
+// Redacts the recorded response body if it is a JSON document with any
+// values selected by the paths.
+func (j *jsonRedactor) Obfuscator(rr *RequestResponse) {
+	if rr.Response == nil || len(rr.ResponseBody) == 0 {
+		return
+	}
+
+	// Bodies that are not JSON are left alone.
+	decoder := json.NewDecoder(bytes.NewReader(rr.ResponseBody))
+	var doc json.RawMessage
+	if err := decoder.Decode(&doc); err != nil {
+		return
+	}
+	offset := int(decoder.InputOffset()) - len(doc)
+
+	var spans []jsonSpan
+	for _, steps := range j.paths {
+		findJSONPath(doc, offset, steps, &spans)
+	}
+	if len(spans) == 0 {
+		return
+	}
+
+	// Only the selected values are replaced, so everything else in the body
+	// keeps its order and formatting. Values inside one that is already
+	// being replaced are skipped.
+	sort.Slice(spans, func(a, b int) bool {
+		if spans[a].start != spans[b].start {
+			return spans[a].start < spans[b].start
+		}
+		return spans[a].end > spans[b].end
+	})
+	body := make([]byte, 0, len(rr.ResponseBody))
+	last := 0
+	for _, span := range spans {
+		if span.start < last {
+			continue
+		}
+		body = append(body, rr.ResponseBody[last:span.start]...)
+		body = append(body, '"')
+		body = append(body, redactedValue...)
+		body = append(body, '"')
+		last = span.end
+	}
+	body = append(body, rr.ResponseBody[last:]...)
+	setResponseBody(rr, body)
+}
+
+// Replaces the recorded response body, keeping the Content-Length header and
+// ContentLength field consistent with the new body.
+func setResponseBody(rr *RequestResponse, body []byte) {
+	rr.ResponseBody = body
+	if rr.Response.ContentLength >= 0 {
+		rr.Response.ContentLength = int64(len(body))
+	}
+	if rr.Response.Header.Get("Content-Length") != "" {
+		rr.Response.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+}
+
+// Called after obfuscators or rewriters that may have replaced the response
+// body without using setResponseBody(), given the length the body had
+// before. If the ContentLength field or Content-Length header matched that
+// length then they are updated to match the new body. Any other length, such
+// as the -1 of a chunked response or the length sent in reply to a HEAD
+// request, is left as it was recorded.
+func syncContentLength(rr *RequestResponse, length int) {
+	if rr.Response == nil || len(rr.ResponseBody) == length {
+		return
+	}
+	if rr.Response.ContentLength == int64(length) {
+		rr.Response.ContentLength = int64(len(rr.ResponseBody))
+	}
+	if rr.Response.Header.Get("Content-Length") == strconv.Itoa(length) {
+		rr.Response.Header.Set("Content-Length",
+			strconv.Itoa(len(rr.ResponseBody)))
+	}
+}
+
+// This function call will return a function that can act as an Obfuscator
+// which replaces the values selected by the given JSON paths in recorded
+// response bodies with the string "REDACTED". Paths use a subset of JSONPath,
+// for example "$.access_token", "$.customer.email", "$.items[*].card" or
+// "$['odd key'][0]". Only the selected values are replaced, so the rest of
+// the body keeps its key order and formatting. Responses that are not JSON
+// are left alone. This will panic if any of the paths can not be parsed.
+func RedactJSON(paths ...string) func(*RequestResponse) {
+	j := &jsonRedactor{}
+	for _, path := range paths {
+		steps, err := parseJSONPath(path)
+		panicIfError(err)
+		j.paths = append(j.paths, steps)
+	}
+	return j.Obfuscator
+}
+
+// Returns an error if the path can not be used with RedactJSON(), so that
+// tools that read paths from configuration can report them rather than
+// panic.
+func ValidateJSONPath(path string) error {
+	_, err := parseJSONPath(path)
+	return err
+}
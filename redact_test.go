@@ -0,0 +1,87 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvr
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/liquidgecka/testlib"
+)
+
+func TestParseJSONPath(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	steps, err := parseJSONPath("$.a['b c'][2].*[*]")
+	T.ExpectSuccess(err)
+	T.Equal(steps, []jsonPathStep{
+		{key: "a"},
+		{key: "b c"},
+		{index: 2, isIndex: true},
+		{wildcard: true},
+		{wildcard: true},
+	})
+
+	for _, bad := range []string{"a.b", "$", "$..a", "$[x]", "$[1", "$a"} {
+		_, err := parseJSONPath(bad)
+		T.ExpectError(err)
+		T.ExpectError(ValidateJSONPath(bad))
+	}
+	T.ExpectSuccess(ValidateJSONPath("$.items[*].card"))
+}
+
+func TestRedactJSON(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	f := RedactJSON("$.access_token", "$.customer.email", "$.cards[*].number")
+	body := `{"access_token":"secret","customer":{"email":"a@b.com",` +
+		`"name":"<a&b>"},"cards":[{"number":"4242"},{"number":"1234"}],` +
+		`"count":12345678901234567890}`
+	rr := &RequestResponse{
+		Response: &http.Response{
+			Header:        http.Header{"Content-Length": {"1"}},
+			ContentLength: 1,
+		},
+		ResponseBody: []byte(body),
+	}
+	f(rr)
+	expected := `{"access_token":"REDACTED","customer":{"email":"REDACTED",` +
+		`"name":"<a&b>"},"cards":[{"number":"REDACTED"},` +
+		`{"number":"REDACTED"}],"count":12345678901234567890}`
+	T.Equal(string(rr.ResponseBody), expected)
+	T.Equal(rr.Response.ContentLength, int64(len(expected)))
+	T.Equal(rr.Response.Header.Get("Content-Length"), "157")
+
+	// Only the selected values are changed, so the order of keys and the
+	// formatting of everything else are kept. A value inside one that is
+	// being redacted is replaced along with it.
+	f = RedactJSON("$.b", "$.b.c", "$.list[1]")
+	body = "{\n  \"z\": 1.50,\n  \"b\": {\"c\": [1, 2]},\n" +
+		"  \"list\": [1e3, {\"x\": null}, true]\n}\n"
+	rr.ResponseBody = []byte(body)
+	f(rr)
+	T.Equal(string(rr.ResponseBody), "{\n  \"z\": 1.50,\n  "+
+		"\"b\": \"REDACTED\",\n  \"list\": [1e3, \"REDACTED\", true]\n}\n")
+
+	// Bodies that are not JSON, or that don't contain the paths, are not
+	// changed at all.
+	for _, body := range []string{"not json", `{ "other" : 1 }`} {
+		rr.ResponseBody = []byte(body)
+		f(rr)
+		T.Equal(string(rr.ResponseBody), body)
+	}
+}
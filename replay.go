@@ -15,16 +15,22 @@
 package dvr
 
 import (
-	"archive/tar"
 	"bytes"
 	"compress/gzip"
-	"encoding/binary"
+	"crypto/sha256"
 	"encoding/gob"
 	"fmt"
 	"io"
+	"io/fs"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
+	"path/filepath"
 	"reflect"
+	"runtime"
+	"sync"
+	"time"
 )
 
 // This function is used by the replay component of this library to determine
@@ -38,6 +44,90 @@ import (
 // and Trailers are all the same.
 var Matcher func(left, right *RequestResponse) bool
 
+// If set then archives are replayed from this file system rather than the
+// local disk. See ReplayFromFS().
+var archiveFS fs.FS
+
+// Functions that are run in replay mode on a copy of each recording that
+// matched, allowing the response to be altered before it is returned. These
+// are protected by obfuscatorLock.
+var rewriterChain []*obfuscatorEntry
+
+// Runs each of the rewriters on the given recording.
+func rewriteReplay(rr *RequestResponse) error {
+	obfuscatorLock.Lock()
+	fs := make([]func(*RequestResponse) error, 0, len(rewriterChain))
+	for _, e := range rewriterChain {
+		fs = append(fs, e.f)
+	}
+	obfuscatorLock.Unlock()
+
+	for _, f := range fs {
+		if err := f(rr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Replays archives from the given file system rather than the local disk,
+// with -dvr.file naming the archive within it. This allows test binaries that
+// are run without their source tree, such as cross compiled integration test
+// runners, to replay fixtures compiled into the binary:
+//
+//	//go:embed testdata/archive.dvr
+//	var fixtures embed.FS
+//
+//	func TestMain(m *testing.M) {
+//		dvr.ReplayFromFS(fixtures)
+//		os.Exit(m.Run())
+//	}
+//
+// This must be called before the first request is made. Recording still
+// writes to the local disk. Passing nil restores the default.
+func ReplayFromFS(fsys fs.FS) {
+	archiveFS = fsys
+}
+
+// Returns the name of -dvr.file within the file system given to
+// ReplayFromFS(). Those names are always slash separated and unrooted, while
+// -dvr.file may be written with the platform's separators, and with a
+// leading "./".
+func fsPath(name string) string {
+	return path.Clean(filepath.ToSlash(name))
+}
+
+// If set then only the recordings whose requests this returns true for are
+// loaded in replay mode. See ReplayOnly().
+var replayOnly func(*http.Request) bool
+
+// Limits the recordings loaded in replay mode to those whose requests keep
+// returns true for. A package whose tests use a few services from a large
+// archive shared with other packages can use this to avoid the memory and
+// startup time taken by the rest. Only the Method, URL, Host and Header
+// fields of the request given to keep are set. Requests that would have
+// matched a recording that wasn't loaded are handled like any other request
+// that doesn't match.
+//
+// This must be called before the first request is made. Passing nil loads
+// every recording again.
+func ReplayOnly(keep func(*http.Request) bool) {
+	replayOnly = keep
+}
+
+// Limits the recordings loaded in replay mode to those made to the given
+// hosts, see ReplayOnly(). A host without a port matches it on any port.
+func ReplayOnlyHosts(hosts ...string) {
+	ReplayOnly(func(req *http.Request) bool {
+		for _, host := range hosts {
+			if req.URL.Host == host || req.URL.Hostname() == host {
+				return true
+			}
+		}
+		return false
+	})
+}
+
 // This is the default implementation of Matcher()
 func matcher(left, right *RequestResponse) bool {
 	// For the default match we use UserData purely as a boolean where "nil"
@@ -46,7 +136,18 @@ func matcher(left, right *RequestResponse) bool {
 		return false
 	} else if right.UserData != nil {
 		return false
-	} else if right.Request == nil || left.Request == nil {
+	} else if !requestMatches(left, right) {
+		return false
+	}
+
+	right.UserData = right
+	return true
+}
+
+// Compares the requests the way that the default Matcher does, without
+// altering either.
+func requestMatches(left, right *RequestResponse) bool {
+	if right.Request == nil || left.Request == nil {
 		return false
 	}
 
@@ -54,7 +155,7 @@ func matcher(left, right *RequestResponse) bool {
 	rreq := right.Request
 
 	// Case 1: URL elements match.
-	if lreq.URL == nil {
+	if lreq.URL == nil || rreq.URL == nil {
 		return false
 	} else if lreq.URL.Scheme != rreq.URL.Scheme {
 		return false
@@ -64,7 +165,8 @@ func matcher(left, right *RequestResponse) bool {
 		return false
 	} else if lreq.URL.Path != rreq.URL.Path {
 		return false
-	} else if lreq.URL.RawQuery != rreq.URL.RawQuery {
+	} else if !queryMatches(lreq.URL.RawQuery, rreq.URL.RawQuery,
+		right.RedactedQueryParams) {
 		return false
 	} else if lreq.URL.Fragment != rreq.URL.Fragment {
 		return false
@@ -82,7 +184,7 @@ func matcher(left, right *RequestResponse) bool {
 	}
 
 	// Case 2: Request Body match.
-	if bytes.Compare(left.RequestBody, right.RequestBody) != 0 {
+	if !requestBodiesMatch(left, right) {
 		return false
 	}
 
@@ -93,114 +195,569 @@ func matcher(left, right *RequestResponse) bool {
 	if !reflect.DeepEqual(lreq.Trailer, rreq.Trailer) {
 		return false
 	}
-
-	right.UserData = right
 	return true
 }
 
-// the contents of the request are matched to ensure that the request is
-// appropriate.
-func (r *roundTripper) replaySetup() {
-	// Open the tar file for reading.
-	fd, err := os.OpenFile(fileName, os.O_RDONLY, os.FileMode(755))
-	panicIfError(err)
+// Reads every query stored in the archive at the given path. The queries
+// are returned in the order that they were recorded.
+func readArchiveFile(name string) ([]*gobQuery, error) {
+	// Open the archive for reading.
+	fd, err := os.OpenFile(name, os.O_RDONLY, os.FileMode(755))
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	return readArchive(fd)
+}
 
+// Reads every query stored in the archive read from fd.
+func readArchive(fd io.Reader) ([]*gobQuery, error) {
+	return readArchiveOnly(fd, nil, nil)
+}
+
+// Reads the archive from fd like readArchive(), but if keep is not nil then
+// the queries whose requests it returns false for are not fully decoded and
+// are returned with a nil Request, see decodeEntry(). If spool is not nil
+// then each response body is moved into it as soon as it is decoded, and if
+// it leaves them in the archive then fd must stay open until it is closed.
+func readArchiveOnly(
+	fd io.Reader, keep func(*http.Request) bool, spool *spooler,
+) ([]*gobQuery, error) {
 	// Read the file version in.
-	version := uint32(0)
-	err = binary.Read(fd, binary.BigEndian, &version)
-	panicIfError(err)
-	if version != 1 {
-		panic(fmt.Errorf("Unknown version: %d", version))
+	version, err := readVersion(fd)
+	if err != nil {
+		return nil, err
 	}
 
-	// Make a gzip reader.
-	gzipReader, err := gzip.NewReader(fd)
-	panicIfError(err)
+	// Entries are handed to workers that decode them, which is most of the
+	// time taken to read a large archive. Each is a separate gob stream so
+	// they can be decoded in any order.
+	d := &entryDecoder{keep: keep, spool: spool, errIndex: -1}
+	if index := seekIndex(version, fd); index != nil {
+		if spool != nil {
+			spool.useArchive(fd.(io.ReaderAt), index)
+		}
+		d.readIndexed(fd.(io.ReaderAt), index)
+	} else if err := d.readInOrder(version, fd); err != nil {
+		return nil, err
+	}
+
+	// The first entry that couldn't be decoded is returned so that the
+	// result doesn't depend on the order that the workers ran in.
+	if d.err != nil {
+		return nil, d.err
+	}
+	if errs := resolveBodies(d.queries); len(errs) > 0 {
+		return nil, errs[0]
+	}
+	return d.queries, nil
+}
 
-	// Create the tar reader and the list used to store the results.
-	reader := tar.NewReader(gzipReader)
-	requestList = make([]*RequestResponse, 0, 100)
+// Returns the index of the version 2 archive being read from fd, if it has
+// one and fd can seek to it. Otherwise nil is returned and fd is left just
+// after the version word.
+func seekIndex(version uint32, fd io.Reader) *archiveIndex {
+	seeker, ok := fd.(io.Seeker)
+	readerAt, ok2 := fd.(io.ReaderAt)
+	if version != 2 || !ok || !ok2 {
+		return nil
+	}
+	start, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil
+	}
+	size, err := seeker.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil
+	} else if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+		return nil
+	}
+	return readIndex(readerAt, size)
+}
+
+// Decodes the entries of an archive into queries.
+type entryDecoder struct {
+	keep  func(*http.Request) bool
+	spool *spooler
+
+	// The decoded queries, in the order they are in the archive, and the
+	// first error found decoding them along with the index of its entry.
+	lock     sync.Mutex
+	queries  []*gobQuery
+	err      error
+	errIndex int
+}
 
-	// While the archive has elements in it we loop through decoding them
-	// and adding them to a list.
-	for {
-		// Read the next header.
-		if _, err := reader.Next(); err == io.EOF {
+// Decodes the entry at the given index of the archive.
+func (d *entryDecoder) decode(index int, data []byte) {
+	q, err := decodeEntry(data, d.keep)
+	if err == nil && d.spool != nil {
+		err = d.spool.spool(index, q)
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	for len(d.queries) <= index {
+		d.queries = append(d.queries, nil)
+	}
+	d.queries[index] = q
+	if err != nil && (d.errIndex < 0 || index < d.errIndex) {
+		d.err, d.errIndex = err, index
+	}
+}
+
+// Reads the entries of the archive from fd in turn, handing them to workers
+// that decode them. Only a few entries are waiting to be decoded at a time
+// so the decompressed archive is never held in memory as a whole. A stream
+// that can't be read is returned rather than the entries that couldn't be
+// decoded.
+func (d *entryDecoder) readInOrder(version uint32, fd io.Reader) error {
+	next, err := archiveEntries(version, fd)
+	if err != nil {
+		return err
+	}
+	type entry struct {
+		index int
+		data  []byte
+	}
+	workers := runtime.GOMAXPROCS(0)
+	entries := make(chan entry, workers)
+	wg := sync.WaitGroup{}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for e := range entries {
+				d.decode(e.index, e.data)
+			}
+		}()
+	}
+	var readErr error
+	for i := 0; ; i++ {
+		data, err := next()
+		if err == io.EOF {
 			break
-		} else {
-			panicIfError(err)
+		} else if err != nil {
+			readErr = err
+			break
+		}
+		entries <- entry{index: i, data: data}
+	}
+	close(entries)
+	wg.Wait()
+	return readErr
+}
+
+// Reads the blocks of the archive r from the locations in its index, with
+// each worker decompressing a block at a time and decoding its entries.
+// Blocks that can't be read are reported as an error for their first entry.
+func (d *entryDecoder) readIndexed(r io.ReaderAt, index *archiveIndex) {
+	d.queries = make([]*gobQuery, len(index.entries))
+	offsets, counts := index.blocks()
+	type block struct {
+		first, count int
+		start, end   int64
+	}
+	blocks := make(chan block, len(offsets))
+	first := 0
+	for i, offset := range offsets {
+		end := index.end
+		if i+1 < len(offsets) {
+			end = offsets[i+1]
 		}
+		blocks <- block{first: first, count: counts[i], start: offset, end: end}
+		first += counts[i]
+	}
+	close(blocks)
+
+	wg := sync.WaitGroup{}
+	for w := 0; w < runtime.GOMAXPROCS(0); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for b := range blocks {
+				if err := d.readBlock(r, b.first, b.count, b.start,
+					b.end); err != nil {
+					d.lock.Lock()
+					if d.errIndex < 0 || b.first < d.errIndex {
+						d.err, d.errIndex = err, b.first
+					}
+					d.lock.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
 
-		// Create a decoder and a list for us to store the results in.
-		gobDecoder := gob.NewDecoder(reader)
+// Decodes the count entries of the block between start and end in r, the
+// first of which is at the given index of the archive.
+func (d *entryDecoder) readBlock(
+	r io.ReaderAt, first, count int, start, end int64,
+) error {
+	gzipReader, err := gzip.NewReader(io.NewSectionReader(r, start,
+		end-start))
+	if err != nil {
+		return err
+	}
+	gzipReader.Multistream(false)
+	next := entryReader(archiveVersion, gzipReader)
+	for i := 0; i < count; i++ {
+		data, err := next()
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		} else if err != nil {
+			return err
+		}
+		d.decode(first+i, data)
+	}
 
-		// Read the results from the stream.
-		gobQuery := gobQuery{}
-		panicIfError(gobDecoder.Decode(&gobQuery))
+	// The checksum is checked once the end of the block is read.
+	if _, err := next(); err == nil {
+		return fmt.Errorf("the block at %d holds more entries than the "+
+			"index lists", start)
+	} else if err != io.EOF {
+		return err
+	}
+	return nil
+}
 
-		// Add the query to the list.
-		requestList = append(requestList, gobQuery.RequestResponse())
+// The parts of a gobQuery that are decoded to decide whether it is kept by
+// readArchiveOnly(). gob skips the fields that aren't here.
+type gobQueryHeader struct {
+	Request *struct {
+		Method string
+		URL    string
+		Host   string
+		Header http.Header
 	}
+	Response *struct {
+		Body     []byte
+		BodyHash string
+	}
+	Partition string
+	RunID     int64
+}
 
-	// Close the file.
-	panicIfError(fd.Close())
+// Decodes an archive entry. If keep is given and returns false for the
+// entry's request then the query returned only has the Partition and RunID,
+// which are needed to find the latest recording of each partition, and the
+// response body if another entry may share it.
+func decodeEntry(
+	data []byte, keep func(*http.Request) bool,
+) (*gobQuery, error) {
+	if keep != nil {
+		h := new(gobQueryHeader)
+		if err := gob.NewDecoder(bytes.NewReader(data)).Decode(h); err != nil {
+			return nil, err
+		}
+		var u *url.URL
+		if h.Request != nil {
+			u, _ = url.Parse(h.Request.URL)
+		}
+		if u != nil && !keep(&http.Request{
+			Method: h.Request.Method,
+			URL:    u,
+			Host:   h.Request.Host,
+			Header: h.Request.Header,
+		}) {
+			q := &gobQuery{Partition: h.Partition, RunID: h.RunID}
+			if h.Response != nil && h.Response.BodyHash != "" {
+				q.Response = &gobResponse{
+					Body:     h.Response.Body,
+					BodyHash: h.Response.BodyHash,
+				}
+			}
+			return q, nil
+		}
+	}
+	q := new(gobQuery)
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(q); err != nil {
+		return nil, err
+	}
+	return q, nil
 }
 
-// This is the RoundTrip() call when we are in replay mode.
-func (r *roundTripper) replay(req *http.Request) (*http.Response, error) {
-	// Ensure that the replay system is setup.
-	isSetup.Do(r.replaySetup)
+// Fills in the response bodies that dedupResponseBody() replaced with a
+// reference to an identical body stored in another entry. Entries sharing a
+// body share the same slice, or the same location if it was spooled. The
+// references can point forwards since concurrent recordings are not written
+// in the order they were encoded. An error is returned for each entry whose
+// body can't be found, and nil entries are skipped.
+func resolveBodies(queries []*gobQuery) []error {
+	bodies := make(map[string]*gobResponse)
+	for _, q := range queries {
+		if q != nil && q.Response != nil && q.Response.BodyHash != "" &&
+			(len(q.Response.Body) > 0 || q.Response.spooled.length > 0) {
+			bodies[q.Response.BodyHash] = q.Response
+		}
+	}
+	var errs []error
+	for i, q := range queries {
+		if q == nil || q.Response == nil || q.Response.BodyHash == "" {
+			continue
+		}
+		if len(q.Response.Body) == 0 && q.Response.spooled.length == 0 {
+			shared, ok := bodies[q.Response.BodyHash]
+			if !ok {
+				errs = append(errs, fmt.Errorf("entry %d: the response "+
+					"body it shares with another entry is missing", i))
+				continue
+			}
+			q.Response.Body = shared.Body
+			q.Response.spooled = shared.spooled
+		}
+		q.Response.BodyHash = ""
+	}
+	return errs
+}
 
-	// Read the body into a buffer.
-	buffer := &bytes.Buffer{}
-	var reqErr error
-	if req.Body != nil {
-		_, reqErr = io.Copy(buffer, req.Body)
+// Returns true if the request bodies are the same. The digests are compared
+// when both are known, which avoids comparing large bodies that only differ
+// towards the end.
+func requestBodiesMatch(left, right *RequestResponse) bool {
+	if len(left.RequestBody) != len(right.RequestBody) {
+		return false
+	} else if left.requestBodyDigest != "" && right.requestBodyDigest != "" {
+		return left.requestBodyDigest == right.requestBodyDigest
 	}
+	return bytes.Equal(left.RequestBody, right.RequestBody)
+}
 
-	// Since this function deals with the requestList we need to lock.
-	requestLock.Lock()
-	defer requestLock.Unlock()
+// Returns the digest used by requestBodiesMatch() for the given body.
+func requestBodyDigest(body []byte) string {
+	sum := sha256.Sum256(body)
+	return string(sum[:])
+}
 
-	// Figure out which match function to use.
-	f := Matcher
-	if f == nil {
-		f = matcher
+// Returns true if the query strings are the same. The redacted parameters,
+// those obfuscated in the recording (right) with ObfuscateQueryParams(),
+// match any value in the incoming request (left).
+func queryMatches(left, right string, redacted []string) bool {
+	if left == right {
+		return true
+	} else if len(redacted) == 0 {
+		return false
+	}
+	lvalues, err := url.ParseQuery(left)
+	if err != nil {
+		return false
+	}
+	rvalues, err := url.ParseQuery(right)
+	if err != nil || len(lvalues) != len(rvalues) {
+		return false
+	}
+	for name, rvals := range rvalues {
+		lvals := lvalues[name]
+		if len(lvals) != len(rvals) {
+			return false
+		}
+		for i := range rvals {
+			if rvals[i] != lvals[i] && (rvals[i] != redactedValue ||
+				!containsString(redacted, name)) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// the contents of the request are matched to ensure that the request is
+// appropriate.
+func (r *roundTripper) replaySetup() {
+	panicIfError(checkModeFlags())
+
+	var fd io.ReadCloser
+	if archiveFS != nil {
+		var err error
+		fd, err = archiveFS.Open(fsPath(fileName))
+		panicIfError(err)
+	} else {
+		path, err := archivePath()
+		panicIfError(err)
+		fd, err = os.Open(path)
+		panicIfError(err)
+	}
+
+	// When spooling the bodies are moved out of memory as they are read.
+	// If they are left in the archive it is kept open to read them from.
+	closeSpool()
+	bodySpool, spooledBodies, bodyCache = nil, nil, nil
+	var spool *spooler
+	if streamBodies || maxMemory > 0 {
+		spool = &spooler{}
+	}
+	queries, err := readArchiveOnly(fd, replayOnly, spool)
+	if spool == nil || spool.archive == nil {
+		fd.Close()
+	}
+	if err != nil && spool != nil {
+		spool.close()
+	}
+	panicIfError(err)
+	bodySpool = spool
+
+	// Only the latest recording of each partition is used.
+	indexes := make(map[*gobQuery]int, len(queries))
+	for i, q := range queries {
+		indexes[q] = i
+	}
+	loadRequests(latestPartitions(queries), indexes)
+	if maxMemory > 0 {
+		bodyCache = newLRUCache(maxMemory)
+	}
+}
+
+// Sets the recordings that requests are matched against, those selected by
+// -dvr.labels. indexes gives the position of each query in the archive. The
+// locations of the bodies are kept in spooledBodies if there is a bodySpool.
+func loadRequests(queries []*gobQuery, indexes map[*gobQuery]int) {
+	requestList = make([]*RequestResponse, 0, len(queries))
+	requestIndexes = make([]int, 0, len(queries))
+	spooledBodies = nil
+	for _, q := range selectLabels(queries) {
+		// The queries that ReplayOnly() excluded have no request.
+		if q.Request == nil {
+			continue
+		}
+		rr := q.RequestResponse()
+		rr.requestBodyDigest = requestBodyDigest(rr.RequestBody)
+		requestList = append(requestList, rr)
+		requestIndexes = append(requestIndexes, indexes[q])
+		if bodySpool != nil && q.Response != nil {
+			spooledBodies = append(spooledBodies, q.Response.spooled)
+		} else if bodySpool != nil {
+			spooledBodies = append(spooledBodies, spooledBody{})
+		}
+	}
+	loadFingerprints(requestList)
+	resetThrottles()
+}
+
+// Reads the body of the request and finds the recording that it matches,
+// returning a copy of it and its index in requestList. The recording is nil
+// if none match. The request is still sendable afterwards in case it doesn't
+// match a recording.
+func matchRequest(req *http.Request) (
+	reqBody []byte, reqErr error, rrMatch *RequestResponse, index int,
+	err error,
+) {
+	// Read the body into a buffer.
+	if req.Body != nil {
+		reqBody, reqErr = captureRequestBody(req)
 	}
 
 	// Walk through the objects in our archive list and see if any of them
 	// match the incoming request.
 	rrSource := &RequestResponse{
 		Request:          req,
-		RequestBody:      buffer.Bytes(),
+		RequestBody:      reqBody,
 		RequestBodyError: reqErr,
 	}
 
-	var rrMatch *RequestResponse
-	for _, rr := range requestList {
-		// copy requestresponse obj, so it can be modified in matcher
-		copyrr := new(RequestResponse)
-		*copyrr = *rr
-		copyrr.Response = new(http.Response)
-		*copyrr.Response = *rr.Response
-		// copy body
-		copyrr.RequestBody = make([]byte, len(rr.RequestBody))
-		// copy header
-		copyrr.Response.Header = http.Header{}
-		for k, vals := range rr.Response.Header {
-			for _, v := range vals {
-				copyrr.Response.Header.Add(k, v)
+	// Requests are normalized the same way that the recordings were before
+	// they are matched. This is done on a copy so the caller's request is
+	// not altered. Proxy headers are removed since they are never recorded.
+	header := withoutProxyHeaders(req.Header)
+	if fs := replayNormalizers(); len(fs) > 0 || len(header) != len(req.Header) {
+		rrSource.Request = req.Clone(req.Context())
+		rrSource.Request.Header = withoutProxyHeaders(rrSource.Request.Header)
+		for _, f := range fs {
+			if err := f(rrSource); err != nil {
+				return nil, nil, nil, -1, err
 			}
 		}
-		copy(copyrr.RequestBody, rr.RequestBody)
-		if f(rrSource, copyrr) {
-			rrMatch = copyrr
-			break
+	}
+	rrSource.requestBodyDigest = requestBodyDigest(rrSource.RequestBody)
+
+	partition, automatic := requestPartition()
+	rrMatch, index, err = findMatch(rrSource, partition, automatic)
+	return reqBody, reqErr, rrMatch, index, err
+}
+
+// This is the RoundTrip() call when we are in replay mode.
+func (r *roundTripper) replay(req *http.Request) (*http.Response, error) {
+	// Ensure that the replay system is setup.
+	isSetup.Do(r.replaySetup)
+
+	reqBody, reqErr, rrMatch, matchIndex, err := matchRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	if rrMatch == nil && cacheTTL > 0 {
+		// When caching a request without a fresh recording is recorded
+		// for the next run.
+		trace("cache", req, "no fresh recording, recording")
+		return r.record(req)
+	} else if rrMatch == nil {
+		// use the fallback transport to execute http request
+		warnMatchingChanged()
+		origin := requestOrigin()
+		desc := liveCallDesc(req, origin) + ", which matched no recording,"
+		if err := checkLiveAllowed(desc); err != nil {
+			trace("replay", req, "no match, not passed through, forbidden")
+			return nil, err
 		}
+		noteLiveCall(req, origin)
+		if origin == "" {
+			trace("replay", req, "no match, passed through")
+		} else {
+			trace("replay", req, "no match (%s), passed through", origin)
+		}
+		return r.realRoundTripper.RoundTrip(req)
 	}
-	if rrMatch == nil {
-		// use default transport to execute http request
-		return OriginalDefaultTransport.RoundTrip(req)
+
+	trace("replay", req, "matched entry %d", matchIndex)
+	if matchIndex < len(requestIndexes) {
+		logUsage(requestIndexes[matchIndex], requestList[matchIndex])
+	}
+
+	// Rewriters and validators are given the body, so a spooled body has to
+	// be read back in for them, as it is when -dvr.max_memory allows it to
+	// be cached. Otherwise it is streamed from the spool.
+	spooled := isSpooled(matchIndex)
+	if spooled && (bodyCache != nil || hasReplayHooks()) {
+		body, err := loadSpooled(matchIndex)
+		if err != nil {
+			return nil, err
+		}
+		rrMatch.ResponseBody = body
+		spooled = false
+	}
+
+	// Give the rewriters a chance to alter the response.
+	refreshRetryAfter(rrMatch)
+	length := len(rrMatch.ResponseBody)
+	if err := rewriteReplay(rrMatch); err != nil {
+		return nil, err
+	}
+	syncContentLength(rrMatch, length)
+
+	// Give the validators a chance to reject the recording.
+	err = validateReplay(&RequestResponse{
+		Request:           req,
+		RequestBody:       reqBody,
+		RequestBodyError:  reqErr,
+		Response:          rrMatch.Response,
+		ResponseBody:      rrMatch.ResponseBody,
+		ResponseBodyError: rrMatch.ResponseBodyError,
+		Error:             rrMatch.Error,
+		Partition:         rrMatch.Partition,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The connection and interim response events come first, and then the
+	// rest of the recorded duration.
+	start := time.Now()
+	if err := replayTrace(req, start, rrMatch); err != nil {
+		return nil, err
+	} else if err := replayInterim(req, rrMatch.Interim); err != nil {
+		return nil, err
+	}
+	err = waitLatency(req, rrMatch.Duration-time.Since(start))
+	if err != nil {
+		return nil, err
 	}
 
 	// Check to see if the response was an error when recorded.
@@ -216,15 +773,162 @@ func (r *roundTripper) replay(req *http.Request) (*http.Response, error) {
 	// Lastly we need to setup a bodyWriter for the Body. This will allow the
 	// client to read the body we captured and it will return the error we
 	// captured (if any) rather than EOF.
-	resp.Body = &bodyWriter{
-		data: rrMatch.ResponseBody,
-		err:  rrMatch.ResponseBodyError,
+	if spooled {
+		reader, err := spooledReader(matchIndex)
+		if err != nil {
+			return nil, err
+		}
+		resp.Body = &spoolReader{
+			reader: reader,
+			err:    rrMatch.ResponseBodyError,
+		}
+	} else {
+		resp.Body = &bodyWriter{
+			data: rrMatch.ResponseBody,
+			err:  rrMatch.ResponseBodyError,
+		}
 	}
 
 	// And lastly we return the response.
 	return resp, rrMatch.Error
 }
 
+// Returns a copy of the first recording in the given partition that matches
+// the request, along with its index in requestList, or nil if none match.
+// requestList is not changed once it is loaded so concurrent replays with
+// the default matcher don't need to wait on each other. A custom Matcher is
+// only ever called by one replay at a time since it may keep state of its
+// own. With the default matcher rate limited recordings are skipped once
+// they are used up, see throttleUntil.
+func findMatch(
+	rrSource *RequestResponse, partition string, automatic bool,
+) (*RequestResponse, int, error) {
+	f := Matcher
+	if f != nil {
+		requestLock.Lock()
+		defer requestLock.Unlock()
+	}
+
+	for i, rr := range requestList {
+		// Recordings made by other tests are never considered.
+		if !inPartition(rr, partition, automatic) {
+			continue
+		}
+
+		// Matchers may only change UserData, so a custom one is given a
+		// shallow copy that keeps the change out of the archive. The default
+		// matcher changes nothing so it is given the recording itself. The
+		// body and headers are only copied for the recording that matched.
+		candidate := rr
+		if f != nil {
+			shallow := *rr
+			candidate = &shallow
+		}
+		rrLive, err := resignForMatch(rrSource, candidate)
+		if err != nil {
+			return nil, -1, err
+		}
+		var rrMatch *RequestResponse
+		if f == nil {
+			if candidate.UserData != nil ||
+				!requestMatches(rrLive, candidate) ||
+				throttleUsedUp(i) {
+				continue
+			}
+			if throttled(candidate) {
+				later, err := matchesLater(rrSource, partition,
+					automatic, i)
+				if err != nil {
+					return nil, -1, err
+				} else if later && !useThrottle(i, candidate) {
+					continue
+				}
+			}
+			rrMatch = copyForMatch(candidate)
+			rrMatch.UserData = rrMatch
+		} else if f(rrLive, candidate) {
+			rrMatch = copyForMatch(candidate)
+		} else {
+			continue
+		}
+		return rrMatch, i, nil
+	}
+	return nil, -1, nil
+}
+
+// Returns true if a recording after index i of requestList that hasn't been
+// used up also matches the request with the default matcher.
+func matchesLater(
+	rrSource *RequestResponse, partition string, automatic bool, i int,
+) (bool, error) {
+	for j := i + 1; j < len(requestList); j++ {
+		rr := requestList[j]
+		if !inPartition(rr, partition, automatic) || throttleUsedUp(j) {
+			continue
+		}
+		rrLive, err := resignForMatch(rrSource, rr)
+		if err != nil {
+			return false, err
+		} else if requestMatches(rrLive, rr) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Copies the RequestResponse from the archive that matched so that it can be
+// rewritten and returned without altering the archive.
+func copyForMatch(rr *RequestResponse) *RequestResponse {
+	// copy requestresponse obj, so it can be modified in matcher
+	copyrr := new(RequestResponse)
+	*copyrr = *rr
+	// copy body
+	copyrr.RequestBody = make([]byte, len(rr.RequestBody))
+	copy(copyrr.RequestBody, rr.RequestBody)
+	copyrr.Interim = cloneInterim(rr.Interim)
+	copyrr.Trace = rr.Trace.clone()
+	copyrr.Labels = cloneStrings(rr.Labels)
+	copyrr.RedactedQueryParams = cloneStrings(rr.RedactedQueryParams)
+	if rr.Response != nil {
+		copyrr.Response = new(http.Response)
+		*copyrr.Response = *rr.Response
+		copyrr.Response.TransferEncoding = cloneStrings(
+			rr.Response.TransferEncoding)
+		// copy header
+		copyrr.Response.Header = http.Header{}
+		for k, vals := range rr.Response.Header {
+			for _, v := range vals {
+				copyrr.Response.Header.Add(k, v)
+			}
+		}
+	}
+	return copyrr
+}
+
+// Appends a line naming the archive entry at the given index to the
+// -dvr.usage_log file, if one was given. Each line holds the index, method
+// and URL of the entry so that "dvr prune" can check that the log belongs to
+// the archive.
+func logUsage(index int, rr *RequestResponse) {
+	if usageLogName == "" {
+		return
+	}
+	usageLogLock.Lock()
+	defer usageLogLock.Unlock()
+	if usageLog == nil {
+		var err error
+		usageLog, err = os.OpenFile(usageLogName,
+			os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		panicIfError(err)
+	}
+	method := rr.Request.Method
+	if method == "" {
+		method = "GET"
+	}
+	_, err := fmt.Fprintf(usageLog, "%d %s %s\n", index, method, rr.Request.URL)
+	panicIfError(err)
+}
+
 //
 // bodyWriter
 //
@@ -15,10 +15,26 @@
 package dvr
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
 	"net/http"
 	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"testing/fstest"
+	"time"
 
 	"github.com/liquidgecka/testlib"
 )
@@ -162,3 +178,710 @@ func TestBadVersion(t *testing.T) {
 	rt := roundTripper{}
 	rt.replaySetup()
 }
+
+func TestQueryMatches(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	key := []string{"key"}
+	T.Equal(queryMatches("", "", nil), true)
+	T.Equal(queryMatches("a=1&b=2", "a=1&b=2", nil), true)
+	T.Equal(queryMatches("b=2&a=1", "a=1&b=2", nil), false)
+	T.Equal(queryMatches("key=live&a=1", "key=REDACTED&a=1", key), true)
+	T.Equal(queryMatches("a=1&key=live", "key=REDACTED&a=1", key), true)
+	T.Equal(queryMatches("key=live&a=2", "key=REDACTED&a=1", key), false)
+	T.Equal(queryMatches("a=1", "key=REDACTED&a=1", key), false)
+	T.Equal(queryMatches("key=1&key=2", "key=REDACTED", key), false)
+
+	// Only parameters that were obfuscated match any value. Others are
+	// compared exactly, even when their recorded value is "REDACTED".
+	T.Equal(queryMatches("key=live", "key=REDACTED", nil), false)
+	T.Equal(queryMatches("key=live&a=1", "key=REDACTED&a=REDACTED", key),
+		false)
+	T.Equal(queryMatches("key=live&a=REDACTED", "key=REDACTED&a=REDACTED",
+		key), true)
+}
+
+func TestFSPath(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	T.Equal(fsPath("fixtures/archive.dvr"), "fixtures/archive.dvr")
+	T.Equal(fsPath("./fixtures/archive.dvr"), "fixtures/archive.dvr")
+	T.Equal(fsPath(filepath.Join("fixtures", "archive.dvr")),
+		"fixtures/archive.dvr")
+}
+
+func TestReplayFromFS(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+	defer func() {
+		replay = false
+		fileName = "testdata/archive.dvr"
+		archiveFS = nil
+		isSetup = sync.Once{}
+		requestList = nil
+	}()
+
+	// Build an archive in memory.
+	name := T.TempFile().Name()
+	T.ExpectSuccess(writeArchiveFile(name, []*gobQuery{
+		testQuery("GET", "http://api.example.com/items", "", 200, "embedded"),
+	}))
+	data, err := ioutil.ReadFile(name)
+	T.ExpectSuccess(err)
+
+	ReplayFromFS(fstest.MapFS{
+		"fixtures/archive.dvr": &fstest.MapFile{Data: data},
+	})
+	fileName = "fixtures/archive.dvr"
+	replay = true
+	isSetup = sync.Once{}
+
+	rt := &roundTripper{realRoundTripper: OriginalDefaultTransport}
+	req, err := http.NewRequest("GET", "http://api.example.com/items", nil)
+	T.ExpectSuccess(err)
+	resp, err := rt.RoundTrip(req)
+	T.ExpectSuccess(err)
+	body, err := ioutil.ReadAll(resp.Body)
+	T.ExpectSuccess(err)
+	T.Equal(string(body), "embedded")
+}
+
+func TestReplayIgnoresProxyHeaders(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+	defer func() {
+		replay = false
+		isSetup = sync.Once{}
+		requestList = nil
+	}()
+
+	header := http.Header{"Accept": {"text/plain"}}
+	T.Equal(withoutProxyHeaders(header), header)
+	header["Proxy-Authorization"] = []string{"Basic c2VjcmV0"}
+	header["Proxy-Connection"] = []string{"keep-alive"}
+	T.Equal(withoutProxyHeaders(header), http.Header{"Accept": {"text/plain"}})
+	T.Equal(len(header), 3)
+
+	q := testQuery("GET", "http://api.example.com/items", "", 200, "items")
+	replay = true
+	isSetup = sync.Once{}
+	isSetup.Do(func() {})
+	requestList = []*RequestResponse{q.RequestResponse()}
+
+	// Requests sent through a proxy match recordings made without one, and
+	// the caller's request is left alone.
+	rt := &roundTripper{realRoundTripper: OriginalDefaultTransport}
+	req, err := http.NewRequest("GET", "http://api.example.com/items", nil)
+	T.ExpectSuccess(err)
+	req.Header.Set("Proxy-Authorization", "Basic c2VjcmV0")
+	resp, err := rt.RoundTrip(req)
+	T.ExpectSuccess(err)
+	body, err := ioutil.ReadAll(resp.Body)
+	T.ExpectSuccess(err)
+	T.Equal(string(body), "items")
+	T.Equal(req.Header.Get("Proxy-Authorization"), "Basic c2VjcmV0")
+}
+
+func TestReplayUsageLog(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+	defer func() {
+		replay = false
+		fileName = "testdata/archive.dvr"
+		usageLogName = ""
+		usageLog = nil
+		isSetup = sync.Once{}
+		requestList = nil
+		requestIndexes = nil
+	}()
+
+	fileName = T.TempFile().Name()
+	T.ExpectSuccess(writeArchiveFile(fileName, []*gobQuery{
+		testQuery("GET", "http://api.example.com/unused", "", 200, "unused"),
+		testQuery("POST", "http://api.example.com/items", "x", 201, "created"),
+	}))
+	usageLogName = T.TempFile().Name()
+	replay = true
+	isSetup = sync.Once{}
+
+	rt := &roundTripper{realRoundTripper: OriginalDefaultTransport}
+	req, err := http.NewRequest("POST", "http://api.example.com/items",
+		strings.NewReader("x"))
+	T.ExpectSuccess(err)
+	_, err = rt.RoundTrip(req)
+	T.ExpectSuccess(err)
+	T.ExpectSuccess(usageLog.Close())
+
+	data, err := ioutil.ReadFile(usageLogName)
+	T.ExpectSuccess(err)
+	T.Equal(string(data), "1 POST http://api.example.com/items\n")
+}
+
+func TestReadArchive(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	// Entries are decoded in parallel but returned in order.
+	queries := make([]*gobQuery, 50)
+	for i := range queries {
+		queries[i] = testQuery("GET",
+			fmt.Sprintf("http://api.example.com/%d", i), "", 200, "")
+	}
+	name := T.TempFile().Name()
+	T.ExpectSuccess(writeArchiveFile(name, queries))
+	read, err := readArchiveFile(name)
+	T.ExpectSuccess(err)
+	T.Equal(len(read), len(queries))
+	for i, q := range read {
+		T.Equal(q.Request.URL, fmt.Sprintf("http://api.example.com/%d", i))
+	}
+
+	// An entry that can't be decoded fails the whole archive.
+	buffer := &bytes.Buffer{}
+	T.ExpectSuccess(binary.Write(buffer, binary.BigEndian, uint32(1)))
+	compressor := gzip.NewWriter(buffer)
+	writer := tar.NewWriter(compressor)
+	T.ExpectSuccess(writer.WriteHeader(&tar.Header{Name: "0", Size: 4}))
+	_, err = writer.Write([]byte("junk"))
+	T.ExpectSuccess(err)
+	T.ExpectSuccess(writer.Close())
+	T.ExpectSuccess(compressor.Close())
+	_, err = readArchive(buffer)
+	T.ExpectError(err)
+}
+
+func TestRequestBodiesMatch(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	left := &RequestResponse{RequestBody: []byte("body1")}
+	right := &RequestResponse{RequestBody: []byte("body1")}
+
+	// Without digests the bodies themselves are compared.
+	T.Equal(requestBodiesMatch(left, right), true)
+	right.RequestBody = []byte("body2")
+	T.Equal(requestBodiesMatch(left, right), false)
+	right.RequestBody = []byte("body22")
+	T.Equal(requestBodiesMatch(left, right), false)
+
+	// With both digests known only the digests are compared.
+	right.RequestBody = []byte("body2")
+	left.requestBodyDigest = requestBodyDigest(left.RequestBody)
+	right.requestBodyDigest = requestBodyDigest(right.RequestBody)
+	T.Equal(requestBodiesMatch(left, right), false)
+	right.requestBodyDigest = left.requestBodyDigest
+	T.Equal(requestBodiesMatch(left, right), true)
+
+	// A missing digest falls back to comparing the bodies.
+	left.requestBodyDigest = ""
+	T.Equal(requestBodiesMatch(left, right), false)
+}
+
+func TestReplayStreamBodies(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+	defer func() {
+		replay = false
+		streamBodies = false
+		fileName = "testdata/archive.dvr"
+		isSetup = sync.Once{}
+		requestList = nil
+		requestIndexes = nil
+		bodySpool = nil
+		spooledBodies = nil
+	}()
+
+	fileName = T.TempFile().Name()
+	T.ExpectSuccess(writeArchiveFile(fileName, []*gobQuery{
+		testQuery("GET", "http://api.example.com/empty", "", 204, ""),
+		testQuery("GET", "http://api.example.com/items", "", 200, "items"),
+	}))
+	replay = true
+	streamBodies = true
+	isSetup = sync.Once{}
+
+	get := func(path string) string {
+		rt := &roundTripper{realRoundTripper: OriginalDefaultTransport}
+		req, err := http.NewRequest("GET", "http://api.example.com"+path, nil)
+		T.ExpectSuccess(err)
+		resp, err := rt.RoundTrip(req)
+		T.ExpectSuccess(err)
+		data, err := ioutil.ReadAll(resp.Body)
+		T.ExpectSuccess(err)
+		return string(data)
+	}
+
+	// Bodies are only held on disk and are read from their entries in the
+	// archive each time.
+	T.Equal(get("/items"), "items")
+	T.Equal(requestList[1].ResponseBody == nil, true)
+	T.Equal(isSpooled(0), false)
+	T.Equal(isSpooled(1), true)
+	T.NotEqual(bodySpool.archive, nil)
+	T.Equal(bodySpool.file, (*os.File)(nil))
+	requestList[1].UserData = nil
+	T.Equal(get("/items"), "items")
+	T.Equal(get("/empty"), "")
+
+	// Rewriters see the body read back into memory.
+	requestList[1].UserData = nil
+	remove := addToChain(&rewriterChain, func(rr *RequestResponse) error {
+		rr.ResponseBody = append(rr.ResponseBody, "!"...)
+		return nil
+	})
+	defer remove()
+	T.Equal(get("/items"), "items!")
+
+	// The archive is closed by Close(), after which the bodies can't be
+	// replayed.
+	archive := bodySpool.archive.(*os.File)
+	T.ExpectSuccess(Close())
+	T.ExpectError(archive.Close())
+	requestList[1].UserData = nil
+	rt := &roundTripper{realRoundTripper: OriginalDefaultTransport}
+	req, err := http.NewRequest("GET", "http://api.example.com/items", nil)
+	T.ExpectSuccess(err)
+	_, err = rt.RoundTrip(req)
+	T.ExpectErrorMessage(err, "can not be replayed after dvr.Close()")
+}
+
+func TestReplayCustomMatcher(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+	defer func() {
+		replay = false
+		Matcher = nil
+		fileName = "testdata/archive.dvr"
+		isSetup = sync.Once{}
+		requestList = nil
+		requestIndexes = nil
+	}()
+
+	fileName = T.TempFile().Name()
+	T.ExpectSuccess(writeArchiveFile(fileName, []*gobQuery{
+		testQuery("GET", "http://api.example.com/a", "", 200, "a"),
+		testQuery("GET", "http://api.example.com/b", "", 200, "b"),
+	}))
+	replay = true
+	isSetup = sync.Once{}
+
+	// The matcher sees each recording, but its changes to UserData are not
+	// kept in the archive.
+	seen := 0
+	Matcher = func(left, right *RequestResponse) bool {
+		seen++
+		T.Equal(right.UserData, nil)
+		right.UserData = true
+		return left.Request.URL.Path == right.Request.URL.Path
+	}
+	rt := &roundTripper{realRoundTripper: OriginalDefaultTransport}
+	for i := 0; i < 2; i++ {
+		req, err := http.NewRequest("GET", "http://api.example.com/b", nil)
+		T.ExpectSuccess(err)
+		resp, err := rt.RoundTrip(req)
+		T.ExpectSuccess(err)
+		data, err := ioutil.ReadAll(resp.Body)
+		T.ExpectSuccess(err)
+		T.Equal(string(data), "b")
+
+		// The response headers returned are not the archive's.
+		resp.Header.Set("Content-Type", "changed")
+	}
+	T.Equal(seen, 4)
+	T.Equal(requestList[1].UserData, nil)
+	T.Equal(requestList[1].Response.Header.Get("Content-Type"), "text/plain")
+}
+
+func TestReplayMaxMemory(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+	defer func() {
+		replay = false
+		maxMemory = 0
+		fileName = "testdata/archive.dvr"
+		isSetup = sync.Once{}
+		requestList = nil
+		requestIndexes = nil
+		bodySpool = nil
+		spooledBodies = nil
+		bodyCache = nil
+	}()
+
+	fileName = T.TempFile().Name()
+	T.ExpectSuccess(writeArchiveFile(fileName, []*gobQuery{
+		testQuery("GET", "http://api.example.com/a", "", 200, "aaaa"),
+		testQuery("GET", "http://api.example.com/b", "", 200, "bbbb"),
+	}))
+	replay = true
+	maxMemory = 6
+	isSetup = sync.Once{}
+
+	get := func(path string) string {
+		rt := &roundTripper{realRoundTripper: OriginalDefaultTransport}
+		req, err := http.NewRequest("GET", "http://api.example.com"+path, nil)
+		T.ExpectSuccess(err)
+		resp, err := rt.RoundTrip(req)
+		T.ExpectSuccess(err)
+		data, err := ioutil.ReadAll(resp.Body)
+		T.ExpectSuccess(err)
+		return string(data)
+	}
+
+	// Bodies are spooled, and only as many as fit are kept in memory.
+	T.Equal(get("/a"), "aaaa")
+	T.Equal(requestList[0].ResponseBody == nil, true)
+	_, ok := bodyCache.get(0)
+	T.Equal(ok, true)
+	T.Equal(get("/b"), "bbbb")
+	_, ok = bodyCache.get(0)
+	T.Equal(ok, false)
+	T.Equal(get("/a"), "aaaa")
+}
+
+func TestReplayConcurrent(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+	defer func() {
+		replay = false
+		fileName = "testdata/archive.dvr"
+		isSetup = sync.Once{}
+		requestList = nil
+		requestIndexes = nil
+	}()
+
+	queries := make([]*gobQuery, 20)
+	for i := range queries {
+		queries[i] = testQuery("GET",
+			fmt.Sprintf("http://api.example.com/%d", i), "", 200, fmt.Sprint(i))
+	}
+	fileName = T.TempFile().Name()
+	T.ExpectSuccess(writeArchiveFile(fileName, queries))
+	replay = true
+	isSetup = sync.Once{}
+
+	// Replays made at the same time each get their own recording.
+	rt := &roundTripper{realRoundTripper: OriginalDefaultTransport}
+	bodies := make([]string, len(queries))
+	errs := make([]error, len(queries))
+	wg := sync.WaitGroup{}
+	for i := range queries {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req, err := http.NewRequest("GET",
+				fmt.Sprintf("http://api.example.com/%d", i), nil)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			resp, err := rt.RoundTrip(req)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			data, err := ioutil.ReadAll(resp.Body)
+			bodies[i], errs[i] = string(data), err
+		}(i)
+	}
+	wg.Wait()
+	for i := range queries {
+		T.ExpectSuccess(errs[i])
+		T.Equal(bodies[i], fmt.Sprint(i))
+	}
+}
+
+func TestReplayOnlyHosts(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+	defer func() {
+		replay = false
+		replayOnly = nil
+		fileName = "testdata/archive.dvr"
+		isSetup = sync.Once{}
+		requestList = nil
+		requestIndexes = nil
+	}()
+
+	// The first copy of the shared body is in an entry that isn't loaded.
+	shared := strings.Repeat("shared", 64)
+	fileName = T.TempFile().Name()
+	T.ExpectSuccess(writeArchiveFile(fileName, []*gobQuery{
+		testQuery("GET", "http://other.example.com/a", "", 200, shared),
+		testQuery("GET", "http://api.example.com:8080/b", "", 200, shared),
+		testQuery("GET", "http://third.example.com/c", "", 200, "c"),
+		testQuery("GET", "http://api.example.com/d", "", 200, "d"),
+	}))
+	replay = true
+	isSetup = sync.Once{}
+	ReplayOnlyHosts("api.example.com")
+
+	rt := &roundTripper{realRoundTripper: OriginalDefaultTransport}
+	req, err := http.NewRequest("GET", "http://api.example.com:8080/b", nil)
+	T.ExpectSuccess(err)
+	resp, err := rt.RoundTrip(req)
+	T.ExpectSuccess(err)
+	data, err := ioutil.ReadAll(resp.Body)
+	T.ExpectSuccess(err)
+	T.Equal(string(data), shared)
+
+	T.Equal(len(requestList), 2)
+	T.Equal(requestIndexes, []int{1, 3})
+	T.Equal(requestList[1].Request.URL.String(), "http://api.example.com/d")
+}
+
+func TestReplaySimulateLatency(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+	defer func() {
+		replay = false
+		simulateLatency = false
+		fileName = "testdata/archive.dvr"
+		isSetup = sync.Once{}
+		requestList = nil
+		requestIndexes = nil
+	}()
+
+	q := testQuery("GET", "http://api.example.com/slow", "", 200, "slow")
+	q.Duration = 100 * time.Millisecond
+	fileName = T.TempFile().Name()
+	T.ExpectSuccess(writeArchiveFile(fileName, []*gobQuery{q}))
+	replay = true
+	simulateLatency = true
+	isSetup = sync.Once{}
+	rt := &roundTripper{realRoundTripper: OriginalDefaultTransport}
+
+	// Without a deadline the response takes as long as it did to record.
+	req, err := http.NewRequest("GET", "http://api.example.com/slow", nil)
+	T.ExpectSuccess(err)
+	start := time.Now()
+	resp, err := rt.RoundTrip(req)
+	T.ExpectSuccess(err)
+	T.Equal(resp.StatusCode, 200)
+	T.Equal(time.Since(start) >= q.Duration, true)
+
+	// A deadline that passes first fails the request when it passes.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	_, err = rt.RoundTrip(req.WithContext(ctx))
+	T.Equal(err, context.DeadlineExceeded)
+	T.Equal(time.Since(start) < q.Duration, true)
+}
+
+func TestReplayContentLength(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+	defer func() {
+		replay = false
+		fileName = "testdata/archive.dvr"
+		isSetup = sync.Once{}
+		requestList = nil
+		requestIndexes = nil
+	}()
+
+	chunked := testQuery("GET", "http://api.example.com/chunked", "", 200, "c")
+	chunked.Response.ContentLength = -1
+	chunked.Response.TransferEncoding = []string{"chunked"}
+	gzipped := testQuery("GET", "http://api.example.com/gzip", "", 200, "g")
+	gzipped.Response.ContentLength = -1
+	gzipped.Response.Uncompressed = true
+	sized := testQuery("GET", "http://api.example.com/sized", "", 200, "s")
+	sized.Response.Header.Set("Content-Length", "1")
+	head := testQuery("HEAD", "http://api.example.com/head", "", 200, "")
+	head.Response.ContentLength = 1
+	fileName = T.TempFile().Name()
+	T.ExpectSuccess(writeArchiveFile(fileName, []*gobQuery{
+		chunked, gzipped, sized, head,
+	}))
+	replay = true
+	isSetup = sync.Once{}
+
+	rt := &roundTripper{realRoundTripper: OriginalDefaultTransport}
+	get := func(method, path string) (*http.Response, string) {
+		req, err := http.NewRequest(method, "http://api.example.com"+path, nil)
+		T.ExpectSuccess(err)
+		resp, err := rt.RoundTrip(req)
+		T.ExpectSuccess(err)
+		data, err := ioutil.ReadAll(resp.Body)
+		T.ExpectSuccess(err)
+		return resp, string(data)
+	}
+
+	// Rewriters that change the body leave lengths that were not the
+	// length of the body alone.
+	remove := addToChain(&rewriterChain, func(rr *RequestResponse) error {
+		rr.ResponseBody = append(rr.ResponseBody, "!!"...)
+		return nil
+	})
+	defer remove()
+
+	resp, body := get("GET", "/chunked")
+	T.Equal(body, "c!!")
+	T.Equal(resp.ContentLength, int64(-1))
+	T.Equal(resp.TransferEncoding, []string{"chunked"})
+	resp.TransferEncoding[0] = "changed"
+
+	resp, body = get("GET", "/gzip")
+	T.Equal(body, "g!!")
+	T.Equal(resp.ContentLength, int64(-1))
+	T.Equal(resp.Uncompressed, true)
+
+	resp, body = get("GET", "/sized")
+	T.Equal(body, "s!!")
+	T.Equal(resp.ContentLength, int64(3))
+	T.Equal(resp.Header.Get("Content-Length"), "3")
+
+	resp, body = get("HEAD", "/head")
+	T.Equal(body, "!!")
+	T.Equal(resp.ContentLength, int64(1))
+
+	// The archive itself is not changed by the caller.
+	resp, _ = get("GET", "/chunked")
+	T.Equal(resp.TransferEncoding, []string{"chunked"})
+}
+
+func TestReplayStatusLine(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+	defer func() {
+		replay = false
+		fileName = "testdata/archive.dvr"
+		isSetup = sync.Once{}
+		requestList = nil
+		requestIndexes = nil
+	}()
+
+	q := testQuery("GET", "http://api.example.com/", "", 220, "")
+	q.Response.Status = "220 Unknown"
+	q.Response.Proto = "HTTP/2.0"
+	q.Response.ProtoMajor = 2
+	q.Response.ProtoMinor = 0
+	fileName = T.TempFile().Name()
+	T.ExpectSuccess(writeArchiveFile(fileName, []*gobQuery{q}))
+	replay = true
+	isSetup = sync.Once{}
+
+	rt := &roundTripper{realRoundTripper: OriginalDefaultTransport}
+	req, err := http.NewRequest("GET", "http://api.example.com/", nil)
+	T.ExpectSuccess(err)
+	resp, err := rt.RoundTrip(req)
+	T.ExpectSuccess(err)
+	T.Equal(resp.Status, "220 Unknown")
+	T.Equal(resp.StatusCode, 220)
+	T.Equal(resp.Proto, "HTTP/2.0")
+	T.Equal(resp.ProtoMajor, 2)
+	T.Equal(resp.ProtoMinor, 0)
+}
+
+// Notes when the reader it wraps has been read to the end, calling atEOF
+// (if set) the first time.
+type eofReader struct {
+	r     io.Reader
+	eof   int32
+	atEOF func()
+}
+
+// io.Reader
+func (e *eofReader) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	if err == io.EOF && atomic.SwapInt32(&e.eof, 1) == 0 && e.atEOF != nil {
+		e.atEOF()
+	}
+	return n, err
+}
+
+func TestReadArchiveStreamsEntries(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(2))
+
+	// The bodies don't compress, so the archive has to be read from as its
+	// entries are.
+	random := rand.New(rand.NewSource(1))
+	var queries []*gobQuery
+	for i := 0; i < 50; i++ {
+		body := make([]byte, 16<<10)
+		random.Read(body)
+		queries = append(queries, testQuery("GET",
+			fmt.Sprintf("http://x/%d", i), "", 200, string(body)))
+	}
+	path := filepath.Join(T.TempDir(), "archive.dvr")
+	T.ExpectSuccess(writeArchiveFile(path, queries))
+	data, err := ioutil.ReadFile(path)
+	T.ExpectSuccess(err)
+
+	// Entries are decoded while the rest of the archive is still being read
+	// rather than once all of it is in memory, leaving only the few that
+	// are waiting for a worker when the end is reached.
+	reader := &eofReader{r: bytes.NewReader(data)}
+	early := int32(0)
+	read, err := readArchiveOnly(reader, func(*http.Request) bool {
+		if atomic.LoadInt32(&reader.eof) == 0 {
+			atomic.AddInt32(&early, 1)
+		}
+		return true
+	}, nil)
+	T.ExpectSuccess(err)
+	T.Equal(len(read), 50)
+	T.Equal(read[49].Request.URL, "http://x/49")
+	T.Equal(string(read[49].Response.Body), string(queries[49].Response.Body))
+	T.Equal(atomic.LoadInt32(&early) >= 40, true)
+}
+
+func TestReadArchiveSpoolsBodies(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(2))
+
+	// The last entry shares the body of the first.
+	random := rand.New(rand.NewSource(1))
+	var queries []*gobQuery
+	for i := 0; i < 50; i++ {
+		body := make([]byte, 16<<10)
+		random.Read(body)
+		queries = append(queries, testQuery("GET",
+			fmt.Sprintf("http://x/%d", i), "", 200, string(body)))
+	}
+	queries = append(queries, testQuery("GET", "http://x/shared", "", 200,
+		string(queries[0].Response.Body)))
+	path := filepath.Join(T.TempDir(), "archive.dvr")
+	T.ExpectSuccess(writeArchiveFile(path, queries))
+	data, err := ioutil.ReadFile(path)
+	T.ExpectSuccess(err)
+
+	// Bodies are spooled as their entries are decoded, so most are already
+	// on disk when the end of the archive is reached rather than all being
+	// in memory at once.
+	spool := &spooler{}
+	defer spool.close()
+	spooledAtEOF := int64(0)
+	reader := &eofReader{r: bytes.NewReader(data), atEOF: func() {
+		spool.lock.Lock()
+		spooledAtEOF = spool.offset
+		spool.lock.Unlock()
+	}}
+	read, err := readArchiveOnly(reader, nil, spool)
+	T.ExpectSuccess(err)
+	T.Equal(len(read), 51)
+	T.Equal(spooledAtEOF >= 40*16<<10, true)
+	T.Equal(spool.offset, int64(50*16<<10))
+
+	// Each body is read back from its location, and the shared body from
+	// the location of the first.
+	for i, q := range read {
+		T.Equal(q.Response.Body == nil, true)
+		body := make([]byte, q.Response.spooled.length)
+		_, err := spool.file.ReadAt(body, q.Response.spooled.offset)
+		T.ExpectSuccess(err)
+		T.Equal(string(body), string(queries[i].Response.Body))
+	}
+	T.Equal(read[50].Response.spooled, read[0].Response.spooled)
+
+	// The temporary file is closed and removed once the spool is closed.
+	T.ExpectSuccess(spool.close())
+	T.ExpectError(spool.file.Close())
+	_, err = os.Stat(spool.file.Name())
+	T.Equal(os.IsNotExist(err), true)
+}
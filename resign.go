@@ -0,0 +1,101 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvr
+
+// Re-signs a copy of a request that is about to be matched against a
+// recording. See AddResigner().
+type resignerEntry struct {
+	f func(live, recorded *RequestResponse) error
+}
+
+// The resigners, protected by obfuscatorLock.
+var resignerChain []*resignerEntry
+
+// AddResigner adds a function that is called in replay mode before a request
+// is compared with each recording, allowing requests signed over a value that
+// changes every run (a timestamp, nonce or expiry) to match. The function is
+// given a copy of the request being replayed and the recording it is about to
+// be compared with. It should copy the changing values from the recorded
+// request into the live one and compute the signature again, with the same
+// key that was used when recording, so that the matcher sees the request
+// that would have been sent at the time of the recording. For example, for
+// requests signed with an HMAC over an X-Timestamp header:
+//
+//	dvr.AddResigner(func(live, recorded *dvr.RequestResponse) error {
+//		ts := recorded.Request.Header.Get("X-Timestamp")
+//		if ts == "" {
+//			return nil
+//		}
+//		live.Request.Header.Set("X-Timestamp", ts)
+//		live.Request.Header.Set("X-Signature",
+//			sign(key, live.Request, live.RequestBody))
+//		return nil
+//	})
+//
+// SigV4 and JWT signers work the same way, signing with the X-Amz-Date or iat
+// claim of the recording. The recording must not be altered. Returning an
+// error fails the request.
+//
+// Resigners are run after the request has been normalized, and also by the
+// archive server. The returned function removes the resigner.
+func AddResigner(
+	f func(live, recorded *RequestResponse) error,
+) (remove func()) {
+	entry := &resignerEntry{f: f}
+	obfuscatorLock.Lock()
+	resignerChain = append(resignerChain, entry)
+	obfuscatorLock.Unlock()
+
+	return func() {
+		obfuscatorLock.Lock()
+		defer obfuscatorLock.Unlock()
+		for i, e := range resignerChain {
+			if e == entry {
+				resignerChain = append(
+					resignerChain[:i:i], resignerChain[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// Returns the request to compare with the given recording. If there are no
+// resigners this is the live request itself, otherwise it is a copy that has
+// been re-signed by each of them.
+func resignForMatch(live, recorded *RequestResponse) (*RequestResponse, error) {
+	obfuscatorLock.Lock()
+	fs := make([]func(live, recorded *RequestResponse) error, 0,
+		len(resignerChain))
+	for _, e := range resignerChain {
+		fs = append(fs, e.f)
+	}
+	obfuscatorLock.Unlock()
+	if len(fs) == 0 {
+		return live, nil
+	}
+
+	out := &RequestResponse{
+		Request:          live.Request.Clone(live.Request.Context()),
+		RequestBody:      append([]byte(nil), live.RequestBody...),
+		RequestBodyError: live.RequestBodyError,
+		Partition:        live.Partition,
+	}
+	for _, f := range fs {
+		if err := f(out, recorded); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
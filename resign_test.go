@@ -0,0 +1,85 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvr
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/liquidgecka/testlib"
+)
+
+func TestAddResigner(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+	defer func() {
+		replay = false
+		isSetup = sync.Once{}
+		requestList = nil
+	}()
+
+	sign := func(key, ts string, req *http.Request) string {
+		mac := hmac.New(sha256.New, []byte(key))
+		fmt.Fprintf(mac, "%s\n%s\n%s", req.Method, req.URL.Path, ts)
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+	newRequest := func(key, ts string) *http.Request {
+		req, err := http.NewRequest("GET", "https://api.example.com/items", nil)
+		T.ExpectSuccess(err)
+		req.Header.Set("X-Timestamp", ts)
+		req.Header.Set("X-Signature", sign(key, ts, req))
+		return req
+	}
+
+	q := testQuery("GET", "https://api.example.com/items", "", 200, "items")
+	q.Request.Header = newRequest("key", "1000").Header
+	replay = true
+	isSetup = sync.Once{}
+	isSetup.Do(func() {})
+	requestList = []*RequestResponse{q.RequestResponse()}
+	rt := &roundTripper{realRoundTripper: roundTripperFunc(
+		func(*http.Request) (*http.Response, error) {
+			return nil, fmt.Errorf("live call")
+		})}
+
+	// Without a resigner the new timestamp prevents matching.
+	_, err := rt.RoundTrip(newRequest("key", "2000"))
+	T.ExpectErrorMessage(err, "live call")
+
+	remove := AddResigner(func(live, recorded *RequestResponse) error {
+		ts := recorded.Request.Header.Get("X-Timestamp")
+		live.Request.Header.Set("X-Timestamp", ts)
+		live.Request.Header.Set("X-Signature", sign("key", ts, live.Request))
+		return nil
+	})
+	defer remove()
+
+	// The request is re-signed with the recorded timestamp, while the
+	// caller's request is left alone.
+	req := newRequest("key", "2000")
+	resp, err := rt.RoundTrip(req)
+	T.ExpectSuccess(err)
+	T.Equal(resp.StatusCode, 200)
+	T.Equal(req.Header.Get("X-Timestamp"), "2000")
+
+	remove()
+	_, err = rt.RoundTrip(newRequest("key", "2000"))
+	T.ExpectErrorMessage(err, "live call")
+}
@@ -0,0 +1,278 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvr
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// Resolver performs DNS lookups that are recorded and replayed along with
+// HTTP requests, for code that resolves host names itself before dialing,
+// such as health checks that contact every address of a service. It has the
+// same lookup methods as net.Resolver, so code that needs to accept either
+// can define an interface with the methods it uses.
+//
+// Each lookup is stored as a GET request to "dns:///<kind>?host=<name>" whose
+// response body is the JSON encoded result, so the default Matcher matches
+// lookups on their kind and arguments. Failed lookups are recorded and
+// replayed as a *net.DNSError.
+type Resolver struct {
+	// The resolver used for real lookups. If this is nil then
+	// net.DefaultResolver is used.
+	Resolver *net.Resolver
+}
+
+// Returns a Resolver that performs real lookups with r, which may be nil to
+// use net.DefaultResolver.
+func NewResolver(r *net.Resolver) *Resolver {
+	return &Resolver{Resolver: r}
+}
+
+// The recorded result of a lookup. Only the fields used by the kind of
+// lookup are set, or Error if it failed.
+type dnsResult struct {
+	Names []string      `json:",omitempty"`
+	IPs   []net.IPAddr  `json:",omitempty"`
+	MX    []*net.MX     `json:",omitempty"`
+	SRV   []*net.SRV    `json:",omitempty"`
+	Error *net.DNSError `json:",omitempty"`
+}
+
+// Returns the resolver used for real lookups.
+func (r *Resolver) resolver() *net.Resolver {
+	if r.Resolver == nil {
+		return net.DefaultResolver
+	}
+	return r.Resolver
+}
+
+// Performs a lookup through the dvr round tripper so that it is recorded or
+// replayed. live performs the real lookup, filling in the result.
+func (r *Resolver) lookup(
+	ctx context.Context, kind string, params url.Values,
+	live func(*dnsResult) error,
+) (*dnsResult, error) {
+	if IsPassingThrough() {
+		err := checkPassThroughAllowed("the " + kind + " lookup of " +
+			params.Encode())
+		if err != nil {
+			return nil, err
+		}
+		result := &dnsResult{}
+		return result, live(result)
+	}
+
+	req := (&http.Request{
+		Method: "GET",
+		URL: &url.URL{
+			Scheme:   "dns",
+			Path:     "/" + kind,
+			RawQuery: params.Encode(),
+		},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+	}).WithContext(ctx)
+	transport := &dnsTransport{name: params.Get("host"), live: live}
+	resp, err := NewRoundTripper(transport).RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	result := &dnsResult{}
+	if err := json.Unmarshal(data, result); err != nil {
+		return nil, err
+	} else if result.Error != nil {
+		return nil, result.Error
+	}
+	return result, nil
+}
+
+// The transport that performs real lookups, converting their results into
+// responses that can be recorded.
+type dnsTransport struct {
+	name string
+	live func(*dnsResult) error
+}
+
+// http.RoundTripper
+func (d *dnsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	result := &dnsResult{}
+	if err := d.live(result); err != nil {
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) {
+			dnsErr = &net.DNSError{Err: err.Error(), Name: d.name}
+		}
+		result = &dnsResult{Error: dnsErr}
+	}
+	data, err := json.Marshal(result)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    200,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"application/json"}},
+		ContentLength: int64(len(data)),
+		Body:          ioutil.NopCloser(bytes.NewReader(data)),
+		Request:       req,
+	}, nil
+}
+
+// Looks up the given host, returning its addresses.
+func (r *Resolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	result, err := r.lookup(ctx, "host", url.Values{"host": {host}},
+		func(result *dnsResult) (err error) {
+			result.Names, err = r.resolver().LookupHost(ctx, host)
+			return err
+		})
+	if err != nil {
+		return nil, err
+	}
+	return result.Names, nil
+}
+
+// Looks up the given host, returning its IPv4 and IPv6 addresses.
+func (r *Resolver) LookupIPAddr(
+	ctx context.Context, host string,
+) ([]net.IPAddr, error) {
+	result, err := r.lookup(ctx, "ipaddr", url.Values{"host": {host}},
+		func(result *dnsResult) (err error) {
+			result.IPs, err = r.resolver().LookupIPAddr(ctx, host)
+			return err
+		})
+	if err != nil {
+		return nil, err
+	}
+	return result.IPs, nil
+}
+
+// Looks up the given host, returning its addresses for the given network
+// which must be "ip", "ip4" or "ip6".
+func (r *Resolver) LookupIP(
+	ctx context.Context, network, host string,
+) ([]net.IP, error) {
+	params := url.Values{"host": {host}, "network": {network}}
+	result, err := r.lookup(ctx, "ip", params,
+		func(result *dnsResult) error {
+			ips, err := r.resolver().LookupIP(ctx, network, host)
+			for _, ip := range ips {
+				result.IPs = append(result.IPs, net.IPAddr{IP: ip})
+			}
+			return err
+		})
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, 0, len(result.IPs))
+	for _, addr := range result.IPs {
+		ips = append(ips, addr.IP)
+	}
+	return ips, nil
+}
+
+// Returns the canonical name of the given host.
+func (r *Resolver) LookupCNAME(ctx context.Context, host string) (string, error) {
+	result, err := r.lookup(ctx, "cname", url.Values{"host": {host}},
+		func(result *dnsResult) error {
+			cname, err := r.resolver().LookupCNAME(ctx, host)
+			result.Names = []string{cname}
+			return err
+		})
+	if err != nil || len(result.Names) == 0 {
+		return "", err
+	}
+	return result.Names[0], nil
+}
+
+// Returns the DNS TXT records of the given name.
+func (r *Resolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	result, err := r.lookup(ctx, "txt", url.Values{"host": {name}},
+		func(result *dnsResult) (err error) {
+			result.Names, err = r.resolver().LookupTXT(ctx, name)
+			return err
+		})
+	if err != nil {
+		return nil, err
+	}
+	return result.Names, nil
+}
+
+// Performs a reverse lookup of the given address, returning the names that
+// map to it.
+func (r *Resolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	result, err := r.lookup(ctx, "addr", url.Values{"host": {addr}},
+		func(result *dnsResult) (err error) {
+			result.Names, err = r.resolver().LookupAddr(ctx, addr)
+			return err
+		})
+	if err != nil {
+		return nil, err
+	}
+	return result.Names, nil
+}
+
+// Returns the DNS MX records of the given name, sorted by preference.
+func (r *Resolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	result, err := r.lookup(ctx, "mx", url.Values{"host": {name}},
+		func(result *dnsResult) (err error) {
+			result.MX, err = r.resolver().LookupMX(ctx, name)
+			return err
+		})
+	if err != nil {
+		return nil, err
+	}
+	return result.MX, nil
+}
+
+// Looks up the SRV records of the given service, returning the canonical
+// name and the records sorted by priority.
+func (r *Resolver) LookupSRV(
+	ctx context.Context, service, proto, name string,
+) (string, []*net.SRV, error) {
+	params := url.Values{
+		"host":    {name},
+		"proto":   {proto},
+		"service": {service},
+	}
+	result, err := r.lookup(ctx, "srv", params,
+		func(result *dnsResult) error {
+			cname, srvs, err := r.resolver().LookupSRV(ctx, service, proto, name)
+			result.Names = []string{cname}
+			result.SRV = srvs
+			return err
+		})
+	if err != nil {
+		return "", nil, err
+	} else if len(result.Names) == 0 {
+		return "", result.SRV, nil
+	}
+	return result.Names[0], result.SRV, nil
+}
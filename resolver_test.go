@@ -0,0 +1,79 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvr
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/liquidgecka/testlib"
+)
+
+func TestResolverReplay(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+	defer func() {
+		replay = false
+		isSetup = sync.Once{}
+		requestList = nil
+	}()
+
+	host := testQuery("GET", "dns:///host?host=db.internal", "", 200,
+		`{"Names":["10.0.0.1","10.0.0.2"]}`)
+	ip := testQuery("GET", "dns:///ip?host=db.internal&network=ip4", "", 200,
+		`{"IPs":[{"IP":"10.0.0.1","Zone":""}]}`)
+	missing := testQuery("GET", "dns:///host?host=missing.internal", "", 200,
+		`{"Error":{"Err":"no such host","Name":"missing.internal",`+
+			`"IsNotFound":true}}`)
+	replay = true
+	isSetup = sync.Once{}
+	isSetup.Do(func() {})
+	requestList = []*RequestResponse{
+		host.RequestResponse(),
+		ip.RequestResponse(),
+		missing.RequestResponse(),
+	}
+
+	// Lookups that are not recorded are performed for real.
+	r := NewResolver(&net.Resolver{
+		PreferGo: true,
+		Dial: func(context.Context, string, string) (net.Conn, error) {
+			return nil, errors.New("no network")
+		},
+	})
+	ctx := context.Background()
+
+	addrs, err := r.LookupHost(ctx, "db.internal")
+	T.ExpectSuccess(err)
+	T.Equal(addrs, []string{"10.0.0.1", "10.0.0.2"})
+
+	ips, err := r.LookupIP(ctx, "ip4", "db.internal")
+	T.ExpectSuccess(err)
+	T.Equal(len(ips), 1)
+	T.Equal(ips[0].String(), "10.0.0.1")
+
+	_, err = r.LookupHost(ctx, "missing.internal")
+	var dnsErr *net.DNSError
+	T.Equal(errors.As(err, &dnsErr), true)
+	T.Equal(dnsErr.IsNotFound, true)
+	T.Equal(dnsErr.Name, "missing.internal")
+
+	_, err = r.LookupTXT(ctx, "unrecorded.internal")
+	T.Equal(errors.As(err, &dnsErr), true)
+	T.Equal(dnsErr.Name, "unrecorded.internal")
+}
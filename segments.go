@@ -0,0 +1,138 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvr
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// The environment variable that a recording process sets to tell the
+// processes it starts where to record their segments.
+const segmentEnv = "DVR_RECORD_SEGMENTS"
+
+// The environment variable that carries the run id of the recording process
+// to the processes it starts, so that their segments are part of its run.
+const segmentRunEnv = "DVR_RECORD_RUN"
+
+var (
+	// The directory that this process records a segment into if it was
+	// started by a process that is recording, and the run id of that
+	// process. These are read when the process starts since it sets the
+	// variables for its own children once it starts recording.
+	inheritedSegments = os.Getenv(segmentEnv)
+	inheritedRunID, _ = strconv.ParseInt(os.Getenv(segmentRunEnv), 10, 64)
+
+	// The directory that processes started by this one record segments
+	// into, created when recording starts.
+	childSegments string
+)
+
+// Returns the directory that this process records a segment into, or an
+// empty string if it doesn't. Tests that start helper processes which also
+// make HTTP calls through this library, such as a test binary running
+// itself, have those calls recorded into the same archive: each helper
+// records into a segment of its own which is merged into the archive when
+// the recording is finished. A helper given a mode flag of its own keeps it.
+func segmentDir() string {
+	if record || replay || passThrough || autoMode || cacheTTL > 0 ||
+		goldenMode {
+		return ""
+	}
+	return inheritedSegments
+}
+
+// Returns the path that this process records its segment to.
+func segmentPath(dir string) string {
+	return filepath.Join(dir, strconv.Itoa(os.Getpid())+".dvr")
+}
+
+// Returns the run id that this process records with. A helper recording a
+// segment uses the id of the process that started it: the segment is merged
+// into that run's archive, and with an id of its own the helper's recordings
+// of a partition would supersede those made by the test that started it.
+func recordingRunID() int64 {
+	if segmentDir() != "" && inheritedRunID != 0 {
+		return inheritedRunID
+	}
+	return time.Now().UnixNano()
+}
+
+// Creates the directory that processes started from now on record their
+// segments into, as part of the given run.
+func startSegments(run int64) (string, error) {
+	dir, err := ioutil.TempDir("", "dvr-segments")
+	if err != nil {
+		return "", err
+	}
+	if err := os.Setenv(segmentRunEnv, strconv.FormatInt(run, 10)); err != nil {
+		return "", err
+	}
+	return dir, os.Setenv(segmentEnv, dir)
+}
+
+// Writes the recordings from each segment completed in dir to the archive
+// being written by w, oldest segment first, and then removes dir. Segments of helper
+// processes that are still running are incomplete, so they are skipped with
+// a warning.
+func mergeSegments(w *blockWriter, dir string) error {
+	defer os.RemoveAll(dir)
+	names, err := filepath.Glob(filepath.Join(dir, "*.dvr"))
+	if err != nil {
+		return err
+	}
+	modified := make(map[string]int64, len(names))
+	for _, name := range names {
+		if info, err := os.Stat(name); err == nil {
+			modified[name] = info.ModTime().UnixNano()
+		}
+	}
+	sort.SliceStable(names, func(i, j int) bool {
+		return modified[names[i]] < modified[names[j]]
+	})
+
+	running, _ := filepath.Glob(filepath.Join(dir, "*.recording"))
+	if len(running) > 0 {
+		fmt.Fprintf(os.Stderr, "dvr: %d helper processes were still "+
+			"recording when the archive was finished, their recordings "+
+			"are not included\n", len(running))
+	}
+	for _, name := range names {
+		queries, err := readArchiveFile(name)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "dvr: skipping the recordings of a "+
+				"helper process, %s: %s\n", name, err)
+			continue
+		}
+		for _, q := range queries {
+			buffer := getEncodeBuffer()
+			err := gob.NewEncoder(buffer).Encode(q)
+			if err == nil {
+				err = w.writeEntry(buffer.Bytes())
+			}
+			putEncodeBuffer(buffer)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvr
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/liquidgecka/testlib"
+)
+
+func TestSegmentDir(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+	defer resetBenchmark()
+	defer func(s string, id int64) {
+		inheritedSegments, inheritedRunID = s, id
+	}(inheritedSegments, inheritedRunID)
+	defer func() { DefaultReplay = false }()
+
+	dir := T.TempDir()
+	inheritedSegments = ""
+	T.Equal(segmentDir(), "")
+	rec, _ := mode()
+	T.Equal(rec, false)
+
+	// A helper records into a segment even if it would replay by default.
+	inheritedSegments = dir
+	DefaultReplay = true
+	T.Equal(segmentDir(), dir)
+	rec, rep := mode()
+	T.Equal(rec, true)
+	T.Equal(rep, false)
+	path, err := archivePath()
+	T.ExpectSuccess(err)
+	T.Equal(filepath.Dir(path), dir)
+	T.Equal(filepath.Ext(path), ".dvr")
+
+	// The helper records as part of the run that started it.
+	inheritedRunID = 42
+	T.Equal(recordingRunID(), int64(42))
+
+	// A mode flag of its own wins.
+	replay = true
+	T.Equal(segmentDir(), "")
+	T.NotEqual(recordingRunID(), int64(42))
+	path, err = archivePath()
+	T.ExpectSuccess(err)
+	T.Equal(path, fileName)
+}
+
+func TestRecordMergesSegments(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+	defer resetBenchmark()
+	defer os.Unsetenv(segmentEnv)
+
+	fileName = filepath.Join(T.TempDir(), "archive.dvr")
+	record = true
+	RecordRequest = func(*http.Request) bool { return true }
+	isSetup = sync.Once{}
+	rt := &roundTripper{realRoundTripper: roundTripperFunc(
+		func(req *http.Request) (*http.Response, error) {
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(strings.NewReader("parent")),
+			}, nil
+		})}
+	req, err := http.NewRequest("GET", "http://x/parent", nil)
+	T.ExpectSuccess(err)
+	_, err = rt.RoundTrip(req)
+	T.ExpectSuccess(err)
+
+	// Two helpers finished, oldest first, one was still recording and one
+	// left a segment that can't be read.
+	dir := os.Getenv(segmentEnv)
+	T.NotEqual(dir, "")
+	T.ExpectSuccess(writeArchiveFile(filepath.Join(dir, "1.dvr"),
+		[]*gobQuery{testQuery("GET", "http://x/two", "", 200, "one")}))
+	T.ExpectSuccess(writeArchiveFile(filepath.Join(dir, "2.dvr"),
+		[]*gobQuery{testQuery("GET", "http://x/one", "", 200, "one")}))
+	now := time.Now()
+	T.ExpectSuccess(os.Chtimes(filepath.Join(dir, "1.dvr"), now, now))
+	earlier := now.Add(-time.Minute)
+	T.ExpectSuccess(os.Chtimes(filepath.Join(dir, "2.dvr"), earlier, earlier))
+	T.ExpectSuccess(ioutil.WriteFile(filepath.Join(dir, "3.dvr.recording"),
+		[]byte("partial"), 0644))
+	T.ExpectSuccess(ioutil.WriteFile(filepath.Join(dir, "4.dvr"),
+		[]byte("garbage"), 0644))
+	T.ExpectSuccess(Close())
+
+	queries, err := readArchiveFile(fileName)
+	T.ExpectSuccess(err)
+	var urls []string
+	for _, q := range queries {
+		urls = append(urls, q.Request.URL)
+	}
+	T.Equal(urls, []string{"http://x/parent", "http://x/one", "http://x/two"})
+	T.Equal(string(queries[1].Response.Body), "one")
+	T.Equal(string(queries[2].Response.Body), "one")
+	_, err = os.Stat(dir)
+	T.Equal(os.IsNotExist(err), true)
+}
+
+func TestRecordPartitionWithSegments(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+	defer resetBenchmark()
+	defer os.Unsetenv(segmentEnv)
+	defer os.Unsetenv(segmentRunEnv)
+
+	fileName = filepath.Join(T.TempDir(), "archive.dvr")
+	RecordRequest = func(*http.Request) bool { return true }
+	rt := &roundTripper{realRoundTripper: roundTripperFunc(
+		func(req *http.Request) (*http.Response, error) {
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(strings.NewReader("parent")),
+			}, nil
+		})}
+
+	// Each run records the test's partition in the parent and in a helper,
+	// which is given the parent's run id. The second run replaces the
+	// first.
+	for _, path := range []string{"/old", "/new"} {
+		record = true
+		isSetup = sync.Once{}
+		req, err := http.NewRequest("GET", "http://x"+path, nil)
+		T.ExpectSuccess(err)
+		_, err = rt.RoundTrip(req)
+		T.ExpectSuccess(err)
+
+		run, err := strconv.ParseInt(os.Getenv(segmentRunEnv), 10, 64)
+		T.ExpectSuccess(err)
+		T.Equal(run, runID)
+		q := testQuery("GET", "http://x/helper"+path, "", 200, "helper")
+		q.Partition, q.RunID = t.Name(), run
+		T.ExpectSuccess(writeArchiveFile(
+			filepath.Join(os.Getenv(segmentEnv), "1.dvr"),
+			[]*gobQuery{q}))
+		T.ExpectSuccess(Close())
+	}
+
+	queries, err := readArchiveFile(fileName)
+	T.ExpectSuccess(err)
+	var urls []string
+	for _, q := range latestPartitions(queries) {
+		urls = append(urls, q.Request.URL)
+	}
+	T.Equal(urls, []string{"http://x/new", "http://x/helper/new"})
+}
@@ -0,0 +1,226 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvr
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// This is the header that is set on responses from an archive server when
+// no recording matched the request.
+const unmatchedHeader = "X-Dvr-Unmatched"
+
+// An http.Handler that answers requests from the recordings in an archive.
+type archiveHandler struct {
+	requestList []*RequestResponse
+}
+
+// Returns an http.Handler that answers every request it receives with the
+// recorded response of a matching request from the archive at the given
+// path. Requests that do not match any recording are answered with a 501
+// status and an X-Dvr-Unmatched header.
+//
+// Since requests arrive at the server rather than being sent to the recorded
+// host the scheme and host of the URL are not compared. If Matcher is set
+// then it is used, otherwise a request matches if the method, path, query and
+// body are the same as the recording, and every header that was recorded is
+// present with the same values. Symmetric obfuscators are applied to requests
+// before they are matched. Recordings may be used any number of times.
+// Responses whose recorded status text or HTTP/1.x version differs from what
+// net/http would send are written directly to the connection, which is then
+// closed, so clients see the recorded status line.
+func NewHandler(archivePath string) (http.Handler, error) {
+	queries, err := readArchiveFile(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	h := &archiveHandler{}
+	for _, q := range latestPartitions(queries) {
+		h.requestList = append(h.requestList, q.RequestResponse())
+	}
+	return h, nil
+}
+
+// NewServer starts an httptest.Server that serves the archive at the given
+// path using the handler from NewHandler(). This allows black box tests of
+// binaries, whose transport can not be replaced, to point at a server that
+// replays the recordings. The caller should Close() the server when done.
+func NewServer(archivePath string) (*httptest.Server, error) {
+	h, err := NewHandler(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	return httptest.NewServer(h), nil
+}
+
+// http.Handler
+func (h *archiveHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rrMatch, err := h.match(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if rrMatch == nil {
+		w.Header().Set(unmatchedHeader, "true")
+		http.Error(w, fmt.Sprintf(
+			"dvr: no recorded request matches %s %s", r.Method, r.URL),
+			http.StatusNotImplemented)
+		return
+	}
+
+	// Requests that failed when recorded have no response to serve.
+	if rrMatch.Response == nil {
+		http.Error(w, fmt.Sprintf("dvr: recorded error: %v", rrMatch.Error),
+			http.StatusBadGateway)
+		return
+	}
+
+	if needsRawResponse(r, rrMatch.Response) {
+		if hijacker, ok := w.(http.Hijacker); ok {
+			writeRawResponse(hijacker, r, rrMatch)
+			return
+		}
+	}
+	writeInterim(w, rrMatch.Interim)
+	for name, values := range rrMatch.Response.Header {
+		w.Header()[name] = values
+	}
+	w.WriteHeader(rrMatch.Response.StatusCode)
+	w.Write(rrMatch.ResponseBody)
+}
+
+// Returns true if net/http would not write the recorded status line of the
+// response to the HTTP/1.x request: it always uses the standard text for the
+// status code, and the protocol version of the request.
+func needsRawResponse(r *http.Request, resp *http.Response) bool {
+	if r.ProtoMajor != 1 {
+		return false
+	}
+	code := strconv.Itoa(resp.StatusCode)
+	text := http.StatusText(resp.StatusCode)
+	if text == "" {
+		text = "status code " + code
+	}
+	if resp.Status != "" && strings.TrimPrefix(resp.Status, code+" ") != text {
+		return true
+	}
+	return resp.ProtoMajor == 1 && resp.ProtoMinor != r.ProtoMinor
+}
+
+// Writes the recorded response directly to the connection so the client
+// sees the recorded status line. The connection is closed afterwards.
+func writeRawResponse(
+	hijacker http.Hijacker, r *http.Request, rr *RequestResponse,
+) {
+	conn, buffer, err := hijacker.Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	resp := *rr.Response
+	resp.Body = ioutil.NopCloser(bytes.NewReader(rr.ResponseBody))
+	if r.Method != http.MethodHead {
+		resp.ContentLength = int64(len(rr.ResponseBody))
+	}
+	resp.TransferEncoding = nil
+	resp.Trailer = nil
+	resp.Close = true
+	resp.Request = r
+	if resp.Write(buffer) == nil {
+		buffer.Flush()
+	}
+}
+
+// Returns the recording that matches the request, or nil if there is none.
+func (h *archiveHandler) match(r *http.Request) (*RequestResponse, error) {
+	buffer := &bytes.Buffer{}
+	if _, err := io.Copy(buffer, r.Body); err != nil {
+		return nil, err
+	}
+
+	// Build the request as a client would have sent it.
+	req := r.Clone(r.Context())
+	req.RequestURI = ""
+	req.Header.Del("Content-Length")
+	req.Header = withoutProxyHeaders(req.Header)
+	rrSource := &RequestResponse{
+		Request:     req,
+		RequestBody: buffer.Bytes(),
+	}
+	for _, f := range replayNormalizers() {
+		if err := f(rrSource); err != nil {
+			return nil, err
+		}
+	}
+
+	f := Matcher
+	if f == nil {
+		f = serverMatcher
+	}
+	for _, rr := range h.requestList {
+		if rr.Request == nil || rr.Request.URL == nil {
+			continue
+		}
+
+		// The request is sent to the server, not the recorded host.
+		req.URL.Scheme = rr.Request.URL.Scheme
+		req.URL.Host = rr.Request.URL.Host
+		copyrr := copyForMatch(rr)
+		rrLive, err := resignForMatch(rrSource, copyrr)
+		if err != nil {
+			return nil, err
+		}
+		if f(rrLive, copyrr) {
+			return copyrr, nil
+		}
+	}
+	return nil, nil
+}
+
+// This is the matcher used by the archive server when Matcher is not set.
+// Headers added by the client's transport (User-Agent, Accept-Encoding, etc)
+// are not recorded, so only the recorded headers are compared.
+func serverMatcher(left, right *RequestResponse) bool {
+	lreq, rreq := left.Request, right.Request
+	method := func(m string) string {
+		if m == "" {
+			return "GET"
+		}
+		return m
+	}
+	if method(lreq.Method) != method(rreq.Method) {
+		return false
+	} else if lreq.URL.Path != rreq.URL.Path {
+		return false
+	} else if !queryMatches(lreq.URL.RawQuery, rreq.URL.RawQuery,
+		right.RedactedQueryParams) {
+		return false
+	} else if !bytes.Equal(left.RequestBody, right.RequestBody) {
+		return false
+	}
+	for name, values := range rreq.Header {
+		if !reflect.DeepEqual(lreq.Header[name], values) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,148 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvr
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/liquidgecka/testlib"
+)
+
+// Builds a gobQuery for a simple recorded request and response.
+func testQuery(
+	method, rawurl, reqBody string, status int, respBody string,
+) *gobQuery {
+	req, err := http.NewRequest(method, rawurl, strings.NewReader(reqBody))
+	if err != nil {
+		panic(err)
+	}
+	q := &gobQuery{Request: newGobRequest(req)}
+	q.Request.Body = []byte(reqBody)
+	q.Response = &gobResponse{
+		Status:        http.StatusText(status),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"text/plain"}},
+		ContentLength: int64(len(respBody)),
+		Body:          []byte(respBody),
+	}
+	return q
+}
+
+func TestNewServer(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	name := T.TempFile().Name()
+	withHeader := testQuery("GET", "https://api.example.com/auth", "", 204, "")
+	withHeader.Request.Header = http.Header{"X-Key": {"abc"}}
+	T.ExpectSuccess(writeArchiveFile(name, []*gobQuery{
+		testQuery("GET", "https://api.example.com/items?a=1", "", 200, "items"),
+		testQuery("POST", "https://api.example.com/items", "new", 201, "made"),
+		withHeader,
+	}))
+
+	server, err := NewServer(name)
+	T.ExpectSuccess(err)
+	defer server.Close()
+
+	// The client must not be affected by the mode of the library.
+	client := &http.Client{Transport: OriginalDefaultTransport}
+	get := func(req *http.Request) (int, string, http.Header) {
+		resp, err := client.Do(req)
+		T.ExpectSuccess(err)
+		body, err := ioutil.ReadAll(resp.Body)
+		T.ExpectSuccess(err)
+		T.ExpectSuccess(resp.Body.Close())
+		return resp.StatusCode, string(body), resp.Header
+	}
+
+	req, _ := http.NewRequest("GET", server.URL+"/items?a=1", nil)
+	status, body, header := get(req)
+	T.Equal(status, 200)
+	T.Equal(body, "items")
+	T.Equal(header.Get("Content-Type"), "text/plain")
+
+	req, _ = http.NewRequest("POST", server.URL+"/items",
+		strings.NewReader("new"))
+	status, body, _ = get(req)
+	T.Equal(status, 201)
+	T.Equal(body, "made")
+
+	// Recorded headers must be present.
+	req, _ = http.NewRequest("GET", server.URL+"/auth", nil)
+	status, _, header = get(req)
+	T.Equal(status, 501)
+	T.Equal(header.Get("X-Dvr-Unmatched"), "true")
+	req.Header.Set("X-Key", "abc")
+	status, _, _ = get(req)
+	T.Equal(status, 204)
+
+	// Different methods do not match.
+	req, _ = http.NewRequest("DELETE", server.URL+"/items?a=1", nil)
+	status, _, _ = get(req)
+	T.Equal(status, 501)
+}
+
+func TestNewServer_StatusLine(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	unknown := testQuery("GET", "https://api.example.com/unknown", "", 220, "")
+	unknown.Response.Status = "220 Unknown"
+	old := testQuery("GET", "https://api.example.com/old", "", 200, "old")
+	old.Response.Status = "200 Fine"
+	old.Response.Proto = "HTTP/1.0"
+	old.Response.ProtoMinor = 0
+	name := T.TempFile().Name()
+	T.ExpectSuccess(writeArchiveFile(name, []*gobQuery{
+		unknown,
+		old,
+		testQuery("GET", "https://api.example.com/plain", "", 200, "plain"),
+	}))
+	server, err := NewServer(name)
+	T.ExpectSuccess(err)
+	defer server.Close()
+
+	client := &http.Client{Transport: OriginalDefaultTransport}
+	get := func(path string) (*http.Response, string) {
+		resp, err := client.Get(server.URL + path)
+		T.ExpectSuccess(err)
+		body, err := ioutil.ReadAll(resp.Body)
+		T.ExpectSuccess(err)
+		T.ExpectSuccess(resp.Body.Close())
+		return resp, string(body)
+	}
+
+	resp, _ := get("/unknown")
+	T.Equal(resp.Status, "220 Unknown")
+	T.Equal(resp.StatusCode, 220)
+
+	resp, body := get("/old")
+	T.Equal(resp.Status, "200 Fine")
+	T.Equal(resp.Proto, "HTTP/1.0")
+	T.Equal(resp.ProtoMinor, 0)
+	T.Equal(body, "old")
+
+	resp, body = get("/plain")
+	T.Equal(resp.Status, "200 OK")
+	T.Equal(resp.Proto, "HTTP/1.1")
+	T.Equal(body, "plain")
+}
@@ -0,0 +1,201 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvr
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Attributes within a WS-Security header that identify algorithms and token
+// types rather than carrying data, and so are kept when it is scrubbed.
+var wsSecurityKeptAttrs = map[string]bool{
+	"Algorithm":    true,
+	"EncodingType": true,
+	"Type":         true,
+	"ValueType":    true,
+}
+
+// Returns true if the request carries a SOAP envelope. SOAP 1.1 requests are
+// identified by their SOAPAction header and SOAP 1.2 requests by their
+// content type.
+func isSOAP(req *http.Request) bool {
+	if req == nil {
+		return false
+	} else if _, ok := req.Header["Soapaction"]; ok {
+		return true
+	}
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	return mediaType == "application/soap+xml"
+}
+
+// Returns the action of a SOAP request, from the SOAPAction header for SOAP
+// 1.1 or the action parameter of the content type for SOAP 1.2.
+func soapAction(req *http.Request) string {
+	if values, ok := req.Header["Soapaction"]; ok && len(values) > 0 {
+		return strings.Trim(values[0], `"`)
+	}
+	_, params, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	return strings.Trim(params["action"], `"`)
+}
+
+// Rewrites a SOAP envelope into a canonical form: namespaces are declared on
+// the elements that use them rather than with prefixes chosen by the client,
+// attributes are sorted, whitespace between elements and comments are
+// removed, and the text and attributes within WS-Security headers (which
+// carry passwords, nonces, timestamps and signatures) are replaced with
+// "REDACTED". Prefixes used within attribute values, such as xsi:type, are
+// not rewritten.
+func canonicalSOAP(body []byte) ([]byte, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(body))
+	buffer := &bytes.Buffer{}
+	encoder := xml.NewEncoder(buffer)
+
+	// The depth of the current element, and the depth of the WS-Security
+	// element if within one.
+	depth := 0
+	security := 0
+	inHeader := false
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			depth++
+			if depth == 2 && t.Name.Local == "Header" {
+				inHeader = true
+			} else if inHeader && depth == 3 && t.Name.Local == "Security" {
+				security = depth
+			}
+			attrs := make([]xml.Attr, 0, len(t.Attr))
+			for _, attr := range t.Attr {
+				if attr.Name.Space == "xmlns" || attr.Name.Space == "" &&
+					attr.Name.Local == "xmlns" {
+					continue
+				}
+				if security > 0 && !wsSecurityKeptAttrs[attr.Name.Local] {
+					attr.Value = redactedValue
+				}
+				attrs = append(attrs, attr)
+			}
+			sort.Slice(attrs, func(i, j int) bool {
+				if attrs[i].Name.Space != attrs[j].Name.Space {
+					return attrs[i].Name.Space < attrs[j].Name.Space
+				}
+				return attrs[i].Name.Local < attrs[j].Name.Local
+			})
+			t.Attr = attrs
+			err = encoder.EncodeToken(t)
+		case xml.EndElement:
+			if depth == security {
+				security = 0
+			} else if depth == 2 {
+				inHeader = false
+			}
+			depth--
+			err = encoder.EncodeToken(t)
+		case xml.CharData:
+			if len(bytes.TrimSpace(t)) == 0 {
+				continue
+			} else if security > 0 {
+				t = xml.CharData(redactedValue)
+			}
+			err = encoder.EncodeToken(t.Copy())
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := encoder.Flush(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// Canonicalizes the envelope of a SOAP request.
+func normalizeSOAP(rr *RequestResponse) {
+	if !isSOAP(rr.Request) {
+		return
+	}
+	body, err := canonicalSOAP(rr.RequestBody)
+	if err != nil {
+		return
+	}
+	rr.RequestBody = body
+	if rr.Request.ContentLength > 0 {
+		rr.Request.ContentLength = int64(len(body))
+	}
+}
+
+// NormalizeSOAP rewrites the envelopes of SOAP requests into a canonical form
+// so that requests from clients that choose different namespace prefixes or
+// formatting still match, and scrubs WS-Security headers so that passwords
+// are not stored and nonces, timestamps and signatures don't prevent
+// matching. Requests that are not SOAP, or whose envelope can not be parsed,
+// are left alone. Responses are not changed.
+//
+// This adds a symmetric obfuscator to the chain, the returned function
+// removes it.
+func NormalizeSOAP() (remove func()) {
+	return addSymmetricObfuscator("NormalizeSOAP()", normalizeSOAP)
+}
+
+// SOAPMatcher can be used as the Matcher for SOAP services. SOAP requests
+// match if their method, URL, action and canonical envelope (see
+// NormalizeSOAP()) are the same, so headers other than the action are
+// ignored. Requests that are not SOAP are matched with the default matcher.
+func SOAPMatcher(left, right *RequestResponse) bool {
+	if left == nil || right == nil || right.UserData != nil {
+		return false
+	} else if !isSOAP(left.Request) || !isSOAP(right.Request) {
+		return matcher(left, right)
+	}
+
+	lreq := left.Request
+	rreq := right.Request
+	if lreq.Method != rreq.Method || lreq.URL == nil || rreq.URL == nil {
+		return false
+	} else if lreq.URL.Scheme != rreq.URL.Scheme ||
+		lreq.URL.Host != rreq.URL.Host ||
+		lreq.URL.Path != rreq.URL.Path ||
+		!queryMatches(lreq.URL.RawQuery, rreq.URL.RawQuery,
+			right.RedactedQueryParams) {
+		return false
+	} else if soapAction(lreq) != soapAction(rreq) {
+		return false
+	}
+
+	lbody, lerr := canonicalSOAP(left.RequestBody)
+	rbody, rerr := canonicalSOAP(right.RequestBody)
+	if lerr != nil || rerr != nil {
+		lbody, rbody = left.RequestBody, right.RequestBody
+	}
+	if !bytes.Equal(lbody, rbody) {
+		return false
+	}
+
+	right.UserData = right
+	return true
+}
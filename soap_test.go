@@ -0,0 +1,146 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvr
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/liquidgecka/testlib"
+)
+
+const soapEnvelopeA = `<?xml version="1.0" encoding="UTF-8"?>
+<soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/"
+    xmlns:m="urn:example">
+  <soap:Header>
+    <wsse:Security xmlns:wsse="http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-wssecurity-secext-1.0.xsd">
+      <wsse:UsernameToken Id="token-1">
+        <wsse:Username>alice</wsse:Username>
+        <wsse:Password Type="PasswordText">secret</wsse:Password>
+        <wsse:Nonce>abc</wsse:Nonce>
+      </wsse:UsernameToken>
+    </wsse:Security>
+  </soap:Header>
+  <soap:Body>
+    <!-- a comment -->
+    <m:GetPrice b="2" a="1"><m:Item>Apples</m:Item></m:GetPrice>
+  </soap:Body>
+</soap:Envelope>`
+
+const soapEnvelopeB = `<env:Envelope xmlns:env="http://schemas.xmlsoap.org/soap/envelope/"><env:Header><s:Security xmlns:s="http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-wssecurity-secext-1.0.xsd"><s:UsernameToken Id="token-2"><s:Username>bob</s:Username><s:Password Type="PasswordText">hunter2</s:Password><s:Nonce>def</s:Nonce></s:UsernameToken></s:Security></env:Header><env:Body><x:GetPrice xmlns:x="urn:example" a="1" b="2"><x:Item>Apples</x:Item></x:GetPrice></env:Body></env:Envelope>`
+
+func TestCanonicalSOAP(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	a, err := canonicalSOAP([]byte(soapEnvelopeA))
+	T.ExpectSuccess(err)
+	b, err := canonicalSOAP([]byte(soapEnvelopeB))
+	T.ExpectSuccess(err)
+	T.Equal(string(a), string(b))
+
+	// The WS-Security header is scrubbed but its types are kept.
+	T.Equal(strings.Contains(string(a), "secret"), false)
+	T.Equal(strings.Contains(string(a), "alice"), false)
+	T.Equal(strings.Contains(string(a), "token-1"), false)
+	T.Equal(strings.Contains(string(a), "PasswordText"), true)
+	T.Equal(strings.Contains(string(a), "Apples"), true)
+
+	// The body is still compared.
+	c, err := canonicalSOAP([]byte(strings.Replace(
+		soapEnvelopeB, "Apples", "Pears", 1)))
+	T.ExpectSuccess(err)
+	T.NotEqual(string(a), string(c))
+
+	_, err = canonicalSOAP([]byte("<unclosed>"))
+	T.ExpectError(err)
+}
+
+func TestSOAPMatcher(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	newRR := func(action, body string) *RequestResponse {
+		u, _ := url.Parse("http://example.com/service")
+		return &RequestResponse{
+			Request: &http.Request{
+				Method: "POST",
+				URL:    u,
+				Header: http.Header{
+					"Content-Type": {"text/xml; charset=utf-8"},
+					"Soapaction":   {action},
+					"User-Agent":   {"client"},
+				},
+			},
+			RequestBody: []byte(body),
+		}
+	}
+
+	left := newRR(`"urn:example#GetPrice"`, soapEnvelopeA)
+	right := newRR("urn:example#GetPrice", soapEnvelopeB)
+	right.Request.Header.Set("User-Agent", "other")
+	T.Equal(SOAPMatcher(left, right), true)
+	T.Equal(right.UserData, right)
+
+	// Recordings are only used once.
+	T.Equal(SOAPMatcher(left, right), false)
+
+	// The action must match.
+	right = newRR("urn:example#SetPrice", soapEnvelopeB)
+	T.Equal(SOAPMatcher(left, right), false)
+
+	// SOAP 1.2 carries the action in the content type.
+	left = newRR("", soapEnvelopeA)
+	delete(left.Request.Header, "Soapaction")
+	left.Request.Header.Set("Content-Type",
+		`application/soap+xml; action="urn:example#GetPrice"`)
+	right = newRR("", soapEnvelopeB)
+	delete(right.Request.Header, "Soapaction")
+	right.Request.Header.Set("Content-Type",
+		`application/soap+xml; charset=utf-8; action="urn:example#GetPrice"`)
+	T.Equal(SOAPMatcher(left, right), true)
+}
+
+func TestNormalizeSOAP(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+	defer ResetObfuscators()
+
+	rr := &RequestResponse{
+		Request: &http.Request{
+			Header:        http.Header{"Soapaction": {"urn:example#GetPrice"}},
+			ContentLength: int64(len(soapEnvelopeA)),
+		},
+		RequestBody: []byte(soapEnvelopeA),
+	}
+	normalizeSOAP(rr)
+	T.Equal(strings.Contains(string(rr.RequestBody), "secret"), false)
+	T.Equal(rr.Request.ContentLength, int64(len(rr.RequestBody)))
+
+	// Other requests are left alone.
+	rr = &RequestResponse{
+		Request:     &http.Request{Header: http.Header{}},
+		RequestBody: []byte(soapEnvelopeA),
+	}
+	normalizeSOAP(rr)
+	T.Equal(string(rr.RequestBody), soapEnvelopeA)
+
+	remove := NormalizeSOAP()
+	T.Equal(len(normalizerChain), 1)
+	remove()
+	T.Equal(len(normalizerChain), 0)
+}
@@ -0,0 +1,380 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvr
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The kinds of frame stored in a recorded connection.
+const (
+	socketFrameWrite = '>'
+	socketFrameRead  = '<'
+	socketFrameEOF   = 'E'
+)
+
+// Returned by the fallback transport in replay mode when a connection was
+// not recorded, so that it is dialed for real instead.
+var errSocketNotRecorded = errors.New("dvr: connection not recorded")
+
+// InterceptDial wraps the DialContext function of an http.Transport (or any
+// other dialer) so that the raw bytes sent and received on each connection
+// are recorded and replayed. This is a lower level alternative to
+// NewRoundTripper() for protocols that HTTP level recording can not model,
+// such as NTLM handshakes that authenticate the connection rather than the
+// request, or servers relying on pipelining:
+//
+//	transport.DialContext = dvr.InterceptDial(dialer.DialContext)
+//
+// Each connection is stored as a GET request to
+// "socket:///dial?addr=<addr>&conn=<n>&network=<network>", where n counts
+// the connections made to that address by the returned function, with the
+// bytes written and read stored in order in the response body. In replay
+// mode the n'th connection to an address is served from the n'th recording:
+// the recorded bytes are returned from Read() once the client has written
+// everything it wrote before they arrived, and writes that differ from the
+// recording fail. Connections that were not recorded are dialed for real.
+// Deadlines are accepted but ignored when replaying.
+//
+// A connection is added to the archive when it is closed, so connections
+// must be closed (for example with Transport.CloseIdleConnections()) before
+// the test binary exits.
+func InterceptDial(
+	dial func(ctx context.Context, network, addr string) (net.Conn, error),
+) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	var lock sync.Mutex
+	counts := map[string]int{}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		ProbeAutoMode(addr)
+		if IsPassingThrough() {
+			err := checkPassThroughAllowed("the dial of " + network + " " +
+				addr)
+			if err != nil {
+				return nil, err
+			}
+			noteLiveDial(network, addr, requestOrigin())
+			return dial(ctx, network, addr)
+		}
+
+		lock.Lock()
+		counts[network+" "+addr]++
+		n := counts[network+" "+addr]
+		lock.Unlock()
+		u := &url.URL{
+			Scheme: "socket",
+			Path:   "/dial",
+			RawQuery: url.Values{
+				"addr":    {addr},
+				"conn":    {strconv.Itoa(n)},
+				"network": {network},
+			}.Encode(),
+		}
+
+		if IsReplay() {
+			fallback := &socketTransport{f: func() (*http.Response, error) {
+				return nil, errSocketNotRecorded
+			}}
+			frames, err := socketRoundTrip(ctx, u, fallback)
+			if err == errSocketNotRecorded {
+				err := checkLiveAllowed("the dial of " + network + " " +
+					addr + ", which matched no recording,")
+				if err != nil {
+					return nil, err
+				}
+				return dial(ctx, network, addr)
+			} else if err != nil {
+				return nil, err
+			}
+			return newReplayConn(network, addr, frames)
+		}
+
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			// Record the failure so that it is replayed.
+			fallback := &socketTransport{f: func() (*http.Response, error) {
+				return nil, err
+			}}
+			socketRoundTrip(ctx, u, fallback)
+			return nil, err
+		}
+		return &recordingConn{Conn: conn, url: u}, nil
+	}
+}
+
+// Sends the request for a connection through dvr, returning the recorded
+// frames.
+func socketRoundTrip(
+	ctx context.Context, u *url.URL, fallback http.RoundTripper,
+) ([]byte, error) {
+	req := (&http.Request{
+		Method:     "GET",
+		URL:        u,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+	}).WithContext(ctx)
+	resp, err := NewRoundTripper(fallback).RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return ioutil.ReadAll(resp.Body)
+}
+
+// A transport that returns the result of a function.
+type socketTransport struct {
+	f func() (*http.Response, error)
+}
+
+// http.RoundTripper
+func (s *socketTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := s.f()
+	if resp != nil {
+		resp.Request = req
+	}
+	return resp, err
+}
+
+// Appends a frame to the buffer.
+func appendSocketFrame(buffer *bytes.Buffer, kind byte, data []byte) {
+	var header [5]byte
+	header[0] = kind
+	binary.BigEndian.PutUint32(header[1:], uint32(len(data)))
+	buffer.Write(header[:])
+	buffer.Write(data)
+}
+
+// A connection whose traffic is recorded when it is closed.
+type recordingConn struct {
+	net.Conn
+	url *url.URL
+
+	lock   sync.Mutex
+	frames bytes.Buffer
+	closed bool
+}
+
+// net.Conn
+func (r *recordingConn) Read(p []byte) (int, error) {
+	n, err := r.Conn.Read(p)
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if n > 0 {
+		appendSocketFrame(&r.frames, socketFrameRead, p[:n])
+	}
+	if err == io.EOF {
+		appendSocketFrame(&r.frames, socketFrameEOF, nil)
+	}
+	return n, err
+}
+
+// net.Conn
+func (r *recordingConn) Write(p []byte) (int, error) {
+	n, err := r.Conn.Write(p)
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if n > 0 {
+		appendSocketFrame(&r.frames, socketFrameWrite, p[:n])
+	}
+	return n, err
+}
+
+// net.Conn
+func (r *recordingConn) Close() error {
+	err := r.Conn.Close()
+	r.lock.Lock()
+	if r.closed {
+		r.lock.Unlock()
+		return err
+	}
+	r.closed = true
+	data := append([]byte(nil), r.frames.Bytes()...)
+	r.lock.Unlock()
+
+	fallback := &socketTransport{f: func() (*http.Response, error) {
+		return &http.Response{
+			Status:        "200 OK",
+			StatusCode:    200,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        http.Header{},
+			ContentLength: int64(len(data)),
+			Body:          ioutil.NopCloser(bytes.NewReader(data)),
+		}, nil
+	}}
+	if _, rtErr := socketRoundTrip(context.Background(), r.url, fallback); err == nil {
+		err = rtErr
+	}
+	return err
+}
+
+// Data sent by the server in a recorded connection, and the number of bytes
+// the client had written before it arrived.
+type replayChunk struct {
+	after int
+	data  []byte
+}
+
+// A connection that plays back a recording.
+type replayConn struct {
+	local, remote net.Addr
+
+	lock    sync.Mutex
+	cond    *sync.Cond
+	written []byte // everything the client is expected to write
+	offset  int    // how much of written the client has written
+	chunks  []replayChunk
+	eof     bool // the server closed the connection after the chunks
+	closed  bool
+	err     error
+}
+
+// Decodes the recorded frames into a replayConn.
+func newReplayConn(network, addr string, frames []byte) (*replayConn, error) {
+	r := &replayConn{
+		local:  socketAddr{network: network, addr: "dvr"},
+		remote: socketAddr{network: network, addr: addr},
+	}
+	r.cond = sync.NewCond(&r.lock)
+	for len(frames) > 0 {
+		if len(frames) < 5 {
+			return nil, fmt.Errorf("dvr: the recording of %s is truncated", addr)
+		}
+		kind := frames[0]
+		size := int(binary.BigEndian.Uint32(frames[1:]))
+		if len(frames) < 5+size {
+			return nil, fmt.Errorf("dvr: the recording of %s is truncated", addr)
+		}
+		data := frames[5 : 5+size]
+		frames = frames[5+size:]
+		switch kind {
+		case socketFrameWrite:
+			r.written = append(r.written, data...)
+		case socketFrameRead:
+			r.chunks = append(r.chunks, replayChunk{
+				after: len(r.written),
+				data:  data,
+			})
+		case socketFrameEOF:
+			r.eof = true
+		}
+	}
+	return r, nil
+}
+
+// net.Conn
+func (r *replayConn) Read(p []byte) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for {
+		if r.err != nil {
+			return 0, r.err
+		} else if r.closed {
+			return 0, net.ErrClosed
+		} else if len(r.chunks) > 0 && r.chunks[0].after <= r.offset {
+			n := copy(p, r.chunks[0].data)
+			if r.chunks[0].data = r.chunks[0].data[n:]; len(r.chunks[0].data) == 0 {
+				r.chunks = r.chunks[1:]
+			}
+			return n, nil
+		} else if len(r.chunks) == 0 && r.eof {
+			return 0, io.EOF
+		}
+		r.cond.Wait()
+	}
+}
+
+// net.Conn
+func (r *replayConn) Write(p []byte) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	defer r.cond.Broadcast()
+	if r.err != nil {
+		return 0, r.err
+	} else if r.closed {
+		return 0, net.ErrClosed
+	}
+	expected := r.written[r.offset:]
+	if len(p) > len(expected) || !bytes.Equal(p, expected[:len(p)]) {
+		r.err = fmt.Errorf(
+			"dvr: data written to %s differs from the recording", r.remote)
+		return 0, r.err
+	}
+	r.offset += len(p)
+	return len(p), nil
+}
+
+// net.Conn
+func (r *replayConn) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.closed = true
+	r.cond.Broadcast()
+	return nil
+}
+
+// net.Conn
+func (r *replayConn) LocalAddr() net.Addr {
+	return r.local
+}
+
+// net.Conn
+func (r *replayConn) RemoteAddr() net.Addr {
+	return r.remote
+}
+
+// net.Conn
+func (r *replayConn) SetDeadline(time.Time) error {
+	return nil
+}
+
+// net.Conn
+func (r *replayConn) SetReadDeadline(time.Time) error {
+	return nil
+}
+
+// net.Conn
+func (r *replayConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+// The address of a replayed connection.
+type socketAddr struct {
+	network, addr string
+}
+
+// net.Addr
+func (s socketAddr) Network() string {
+	return s.network
+}
+
+// net.Addr
+func (s socketAddr) String() string {
+	return s.addr
+}
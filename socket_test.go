@@ -0,0 +1,128 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvr
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/liquidgecka/testlib"
+)
+
+func TestRecordingConn(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	client, server := net.Pipe()
+	go func() {
+		server.Write([]byte("220 ready\n"))
+		line, _ := bufio.NewReader(server).ReadString('\n')
+		server.Write([]byte("250 " + line))
+		server.Close()
+	}()
+
+	conn := &recordingConn{Conn: client, url: &url.URL{Scheme: "socket"}}
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadString('\n')
+	T.ExpectSuccess(err)
+	T.Equal(line, "220 ready\n")
+	_, err = conn.Write([]byte("HELO\n"))
+	T.ExpectSuccess(err)
+	line, err = reader.ReadString('\n')
+	T.ExpectSuccess(err)
+	T.Equal(line, "250 HELO\n")
+	_, err = reader.ReadString('\n')
+	T.Equal(err, io.EOF)
+	T.ExpectSuccess(conn.Close())
+
+	// The frames can be played back.
+	replayed, err := newReplayConn("tcp", "mail:25", conn.frames.Bytes())
+	T.ExpectSuccess(err)
+	T.Equal(string(replayed.written), "HELO\n")
+	T.Equal(len(replayed.chunks), 2)
+	T.Equal(replayed.chunks[0].after, 0)
+	T.Equal(replayed.chunks[1].after, 5)
+	T.Equal(replayed.eof, true)
+
+	_, err = newReplayConn("tcp", "mail:25", []byte{socketFrameRead, 0, 0})
+	T.ExpectErrorMessage(err, "truncated")
+}
+
+func TestInterceptDialReplay(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+	defer func() {
+		replay = false
+		isSetup = sync.Once{}
+		requestList = nil
+	}()
+
+	frames := &bytes.Buffer{}
+	appendSocketFrame(frames, socketFrameRead, []byte("220 ready\n"))
+	appendSocketFrame(frames, socketFrameWrite, []byte("HELO\n"))
+	appendSocketFrame(frames, socketFrameRead, []byte("250 HELO\n"))
+	appendSocketFrame(frames, socketFrameEOF, nil)
+	q := testQuery("GET",
+		"socket:///dial?addr=mail%3A25&conn=1&network=tcp", "", 200,
+		frames.String())
+	replay = true
+	isSetup = sync.Once{}
+	isSetup.Do(func() {})
+	requestList = []*RequestResponse{q.RequestResponse()}
+
+	errDial := errors.New("dialed")
+	dial := InterceptDial(
+		func(context.Context, string, string) (net.Conn, error) {
+			return nil, errDial
+		})
+
+	conn, err := dial(context.Background(), "tcp", "mail:25")
+	T.ExpectSuccess(err)
+	T.Equal(conn.RemoteAddr().String(), "mail:25")
+
+	// Data the server sent after the client wrote is held back until the
+	// client has written it.
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadString('\n')
+	T.ExpectSuccess(err)
+	T.Equal(line, "220 ready\n")
+	_, err = conn.Write([]byte("HELO\n"))
+	T.ExpectSuccess(err)
+	line, err = reader.ReadString('\n')
+	T.ExpectSuccess(err)
+	T.Equal(line, "250 HELO\n")
+	_, err = reader.ReadString('\n')
+	T.Equal(err, io.EOF)
+	T.ExpectSuccess(conn.Close())
+
+	// The second connection was not recorded so it is dialed.
+	_, err = dial(context.Background(), "tcp", "mail:25")
+	T.Equal(err, errDial)
+
+	// Writes that differ from the recording fail.
+	replayed, err := newReplayConn("tcp", "mail:25", frames.Bytes())
+	T.ExpectSuccess(err)
+	_, err = replayed.Write([]byte("EHLO\n"))
+	T.ExpectErrorMessage(err, "differs from the recording")
+	_, err = replayed.Read(make([]byte, 10))
+	T.ExpectErrorMessage(err, "differs from the recording")
+}
@@ -0,0 +1,247 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvr
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+var (
+	// Set by -dvr.stream_bodies. When true replayed response bodies are
+	// read from the archive as they are needed rather than all being kept
+	// in memory. Archives without an index have their bodies written to a
+	// temporary file as they are read, which they are read back from.
+	streamBodies bool
+
+	// Set by -dvr.max_memory. When above zero response bodies are spooled
+	// as with -dvr.stream_bodies, and the most recently replayed are kept
+	// in bodyCache until their total size reaches this many bytes. This
+	// lets large archives be replayed where memory is tight while the
+	// bodies that are used over and over are still served from memory.
+	maxMemory int64
+	bodyCache *lruCache
+
+	// Where the response bodies are read from when they are spooled, and
+	// where the body of each entry in requestList is. Entries with an
+	// empty body are not spooled and have a zero length.
+	bodySpool     *spooler
+	spooledBodies []spooledBody
+)
+
+// The location of a spooled response body: its offset and length in the
+// spooler's file, or if the bodies are left in the archive the index of the
+// entry holding it in place of the offset.
+type spooledBody struct {
+	offset int64
+	length int64
+}
+
+// Moves response bodies out of memory as the archive is read, so that each
+// body is only in memory until the entry holding it has been decoded. If
+// the archive has an index then the bodies are left in it, and each is read
+// back from its entry when it is replayed. Otherwise they are written to a
+// temporary file.
+type spooler struct {
+	// The temporary file, which is created when the first body is written,
+	// and the offset of the next body written to it.
+	file   *os.File
+	offset int64
+	lock   sync.Mutex
+
+	// The archive and its index, if bodies are left in it.
+	archive io.ReaderAt
+	index   *archiveIndex
+
+	// Set once close() has been called.
+	closed bool
+}
+
+// Leaves the response bodies in the given archive, which has an index, rather
+// than copying them. The archive must stay open until close() is called.
+func (s *spooler) useArchive(archive io.ReaderAt, index *archiveIndex) {
+	s.archive, s.index = archive, index
+}
+
+// Replaces the response body of the decoded query q, which is the entry at
+// the given index of the archive, with its location. The body is written to
+// the temporary file unless the bodies are left in the archive. It is safe to
+// call from several goroutines.
+func (s *spooler) spool(index int, q *gobQuery) error {
+	if q == nil || q.Response == nil || len(q.Response.Body) == 0 {
+		return nil
+	}
+	length := int64(len(q.Response.Body))
+	if s.archive != nil {
+		q.Response.spooled = spooledBody{offset: int64(index), length: length}
+		q.Response.Body = nil
+		return nil
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.file == nil {
+		file, err := ioutil.TempFile("", "dvr-bodies")
+		if err != nil {
+			return err
+		}
+
+		// The file is removed straight away so that it doesn't outlive the
+		// process. This fails on Windows, where it is removed by close().
+		os.Remove(file.Name())
+		s.file = file
+	}
+	if _, err := s.file.Write(q.Response.Body); err != nil {
+		return err
+	}
+	q.Response.spooled = spooledBody{offset: s.offset, length: length}
+	q.Response.Body = nil
+	s.offset += length
+	return nil
+}
+
+// Returns a reader for the body at the given location.
+func (s *spooler) reader(b spooledBody) (io.Reader, error) {
+	s.lock.Lock()
+	closed := s.closed
+	s.lock.Unlock()
+	if closed {
+		return nil, fmt.Errorf("dvr: response bodies can not be replayed " +
+			"after dvr.Close() has been called")
+	} else if s.archive == nil {
+		return io.NewSectionReader(s.file, b.offset, b.length), nil
+	}
+	data, err := readEntryAt(s.archive, s.index.end,
+		s.index.entries[b.offset])
+	if err != nil {
+		return nil, fmt.Errorf("dvr: reading the body of entry %d of the "+
+			"archive: %s", b.offset, err)
+	}
+
+	// gob skips the fields that aren't here.
+	entry := new(struct{ Response *struct{ Body []byte } })
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(entry); err != nil {
+		return nil, fmt.Errorf("dvr: reading the body of entry %d of the "+
+			"archive: %s", b.offset, err)
+	} else if entry.Response == nil ||
+		int64(len(entry.Response.Body)) != b.length {
+		return nil, fmt.Errorf("dvr: the body of entry %d of the archive "+
+			"has changed since it was read", b.offset)
+	}
+	return bytes.NewReader(entry.Response.Body), nil
+}
+
+// Closes the archive or the temporary file that the bodies are read from,
+// and removes the temporary file if it is still there.
+func (s *spooler) close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	if s.archive != nil {
+		if c, ok := s.archive.(io.Closer); ok {
+			return c.Close()
+		}
+		return nil
+	} else if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	os.Remove(s.file.Name())
+	return err
+}
+
+// Closes the spooler of the archive being replayed, if there is one.
+func closeSpool() error {
+	if bodySpool == nil {
+		return nil
+	}
+	return bodySpool.close()
+}
+
+// Returns true if the response body of the recording at the given index of
+// requestList is spooled.
+func isSpooled(index int) bool {
+	return bodySpool != nil && index < len(spooledBodies) &&
+		spooledBodies[index].length > 0
+}
+
+// Returns a reader for the spooled response body of the recording at the
+// given index of requestList.
+func spooledReader(index int) (io.Reader, error) {
+	return bodySpool.reader(spooledBodies[index])
+}
+
+// Reads the spooled response body of the recording at the given index of
+// requestList back into memory.
+func readSpooled(index int) ([]byte, error) {
+	reader, err := spooledReader(index)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, spooledBodies[index].length)
+	_, err = io.ReadFull(reader, data)
+	return data, err
+}
+
+// Returns the spooled response body of the recording at the given index of
+// requestList, from bodyCache if it is there.
+func loadSpooled(index int) ([]byte, error) {
+	if bodyCache != nil {
+		if body, ok := bodyCache.get(index); ok {
+			return body, nil
+		}
+	}
+	body, err := readSpooled(index)
+	if err == nil && bodyCache != nil {
+		bodyCache.add(index, body)
+	}
+	return body, err
+}
+
+// Returns true if rewriters or validators were added, in which case the
+// response body has to be in memory before they are run.
+func hasReplayHooks() bool {
+	obfuscatorLock.Lock()
+	defer obfuscatorLock.Unlock()
+	return len(rewriterChain) > 0 || len(validatorChain) > 0
+}
+
+// A response body that is read from bodySpool. Like bodyWriter it returns
+// the error that was recorded (if any) rather than EOF.
+type spoolReader struct {
+	reader io.Reader
+	err    error
+}
+
+// io.Reader
+func (s *spoolReader) Read(input []byte) (int, error) {
+	n, err := s.reader.Read(input)
+	if err == io.EOF && s.err != nil {
+		err = s.err
+	}
+	return n, err
+}
+
+// io.Closer
+func (s *spoolReader) Close() error {
+	return nil
+}
@@ -0,0 +1,182 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvr
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"reflect"
+)
+
+// The errors that crypto/x509 returns for certificates that fail to verify
+// hold the certificates themselves, which gob is unable to encode, so they
+// are stored as this type instead and turned back into the original type
+// when they are decoded. The certificates are kept in their DER form.
+type gobCertificateError struct {
+	// The errorTypeID() of the original error.
+	Type string
+
+	// The message of the original error, used if the error can not be
+	// restored.
+	Message string
+
+	Certificates [][]byte
+	Host         string
+	Reason       int
+	Detail       string
+	Err          error
+}
+
+// Error() for gobCertificateError
+func (g *gobCertificateError) Error() string {
+	return g.Message
+}
+
+// Implemented by the types that gob stores in place of an error that it can
+// not encode, returning the original error.
+type restorableError interface {
+	restore() error
+}
+
+// Returns the gobCertificateError to store in place of err if it is one of
+// the certificate errors from crypto/x509 or crypto/tls.
+func certificateError(err error) (error, bool) {
+	var certs []*x509.Certificate
+	g := &gobCertificateError{
+		Type:    errorTypeID(reflect.TypeOf(err)),
+		Message: err.Error(),
+	}
+	switch e := err.(type) {
+	case x509.UnknownAuthorityError:
+		certs = []*x509.Certificate{e.Cert}
+	case x509.HostnameError:
+		certs = []*x509.Certificate{e.Certificate}
+		g.Host = e.Host
+	case x509.CertificateInvalidError:
+		certs = []*x509.Certificate{e.Cert}
+		g.Reason = int(e.Reason)
+		g.Detail = e.Detail
+	default:
+		var wrapped error
+		var ok bool
+		if certs, wrapped, ok = tlsVerificationError(err); !ok {
+			return nil, false
+		}
+		g.Err = encodableError(wrapped)
+	}
+	for _, cert := range certs {
+		if cert != nil {
+			g.Certificates = append(g.Certificates, cert.Raw)
+		}
+	}
+	return g, true
+}
+
+// Returns the error that g was made from. UnknownAuthorityError loses the
+// hint about why a candidate authority was rejected since it is held in
+// unexported fields. If the original can't be rebuilt then a gobSafeError
+// with the original message is returned.
+func (g *gobCertificateError) restore() error {
+	certs := make([]*x509.Certificate, len(g.Certificates))
+	for i, raw := range g.Certificates {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return gobSafeError(g.Message)
+		}
+		certs[i] = cert
+	}
+	var cert *x509.Certificate
+	if len(certs) > 0 {
+		cert = certs[0]
+	}
+
+	switch g.Type {
+	case "crypto/x509.UnknownAuthorityError":
+		return x509.UnknownAuthorityError{Cert: cert}
+	case "crypto/x509.HostnameError":
+		if cert != nil {
+			return x509.HostnameError{Certificate: cert, Host: g.Host}
+		}
+	case "crypto/x509.CertificateInvalidError":
+		return x509.CertificateInvalidError{
+			Cert:   cert,
+			Reason: x509.InvalidReason(g.Reason),
+			Detail: g.Detail,
+		}
+	default:
+		if err, ok := restoreVerificationError(g, certs); ok {
+			return err
+		}
+	}
+	return gobSafeError(g.Message)
+}
+
+// Replaces the restorableError values in a decoded error, and in the errors
+// it wraps, with the errors they were made from.
+func restoreErrors(err error) error {
+	if r, ok := err.(restorableError); ok {
+		return r.restore()
+	}
+	value := reflect.ValueOf(err)
+	if value.Kind() != reflect.Ptr || value.IsNil() ||
+		value.Elem().Kind() != reflect.Struct {
+		return err
+	}
+	fields := value.Elem()
+	for i := 0; i < fields.NumField(); i++ {
+		field := fields.Field(i)
+		if field.Type() == errorInterfaceType && !field.IsNil() &&
+			field.CanSet() {
+			restored := restoreErrors(field.Interface().(error))
+			field.Set(reflect.ValueOf(&restored).Elem())
+		}
+	}
+	return err
+}
+
+// The alerts sent by a server are returned by crypto/tls as an unexported
+// type that can't be registered with gob, so they are stored as the exported
+// tls.AlertError, which has the same message, instead.
+func tlsAlertError(value reflect.Value) (error, bool) {
+	typ := value.Type()
+	if typ.PkgPath() == "crypto/tls" && typ.Name() == "alert" &&
+		value.Kind() == reflect.Uint8 {
+		return tls.AlertError(value.Uint()), true
+	}
+	return nil, false
+}
+
+// Returns the certificates and wrapped error of a
+// *tls.CertificateVerificationError, which crypto/tls returns when the
+// server's certificates fail to verify.
+func tlsVerificationError(err error) ([]*x509.Certificate, error, bool) {
+	if e, ok := err.(*tls.CertificateVerificationError); ok {
+		return e.UnverifiedCertificates, e.Err, true
+	}
+	return nil, nil, false
+}
+
+// Rebuilds the *tls.CertificateVerificationError that g was made from.
+func restoreVerificationError(
+	g *gobCertificateError, certs []*x509.Certificate,
+) (error, bool) {
+	if g.Type != "crypto/tls.CertificateVerificationError" {
+		return nil, false
+	}
+	return &tls.CertificateVerificationError{
+		UnverifiedCertificates: certs,
+		Err:                    restoreErrors(g.Err),
+	}, true
+}
@@ -0,0 +1,87 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvr
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/gob"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/liquidgecka/testlib"
+)
+
+// Encodes and decodes err as gob would when storing it in an archive.
+func roundTripError(T *testlib.T, err error) error {
+	buffer := &bytes.Buffer{}
+	T.ExpectSuccess(gob.NewEncoder(buffer).Encode(&gobError{Error: err}))
+	g := new(gobError)
+	T.ExpectSuccess(gob.NewDecoder(buffer).Decode(g))
+	return g.Error
+}
+
+func TestCertificateErrors(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	// A real handshake with a server whose certificate isn't trusted.
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+	_, err := http.Get(server.URL)
+	T.ExpectError(err)
+	cert := server.Certificate()
+
+	replayed := roundTripError(T, err)
+	T.Equal(replayed.Error(), err.Error())
+	var unknown x509.UnknownAuthorityError
+	T.Equal(errors.As(replayed, &unknown), true)
+	T.Equal(unknown.Cert.Equal(cert), true)
+	var verification *tls.CertificateVerificationError
+	T.Equal(errors.As(replayed, &verification), true)
+	T.Equal(len(verification.UnverifiedCertificates), 1)
+
+	// Hostname mismatches.
+	hostErr := x509.HostnameError{Certificate: cert, Host: "example.com"}
+	replayed = roundTripError(T, hostErr)
+	T.Equal(replayed.Error(), hostErr.Error())
+	var restoredHost x509.HostnameError
+	T.Equal(errors.As(replayed, &restoredHost), true)
+	T.Equal(restoredHost.Host, "example.com")
+
+	// Expired certificates.
+	expired := x509.CertificateInvalidError{
+		Cert:   cert,
+		Reason: x509.Expired,
+		Detail: "current time " + time.Now().Format(time.RFC3339) + " is after",
+	}
+	replayed = roundTripError(T, expired)
+	T.Equal(replayed.Error(), expired.Error())
+	var invalid x509.CertificateInvalidError
+	T.Equal(errors.As(replayed, &invalid), true)
+	T.Equal(invalid.Reason, x509.Expired)
+
+	// Certificates that can't be parsed leave only the message.
+	g := &gobCertificateError{
+		Type:         "crypto/x509.HostnameError",
+		Message:      "bad",
+		Certificates: [][]byte{{1, 2, 3}},
+	}
+	T.Equal(g.restore(), gobSafeError("bad"))
+}
@@ -0,0 +1,91 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvr
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// The suffix added to the URL scheme of requests sent over a unix socket.
+const unixSchemeSuffix = "+unix"
+
+// Creates a RoundTripper that sends every request over the unix domain socket
+// at socketPath, for talking to local daemons such as the Docker API. It is
+// used in place of an http.Transport with a custom DialContext:
+//
+//	client := &http.Client{
+//		Transport: dvr.NewUnixRoundTripper("/var/run/docker.sock"),
+//	}
+//
+// Clients of these daemons use a placeholder host in their URLs (such as
+// "http://docker/containers/json") so the host can not tell two sockets
+// apart. Requests are therefore recorded and matched with the scheme set to
+// "http+unix" (or "https+unix") and the host set to the socket path escaped
+// with url.PathEscape(). The request returned in the Response keeps the
+// caller's URL.
+func NewUnixRoundTripper(socketPath string) http.RoundTripper {
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", socketPath)
+		},
+	}
+	return &unixRoundTripper{
+		socket: socketPath,
+		rt:     NewRoundTripper(&unixTransport{transport: transport}),
+	}
+}
+
+// Rewrites requests so that the socket path is part of the URL before they
+// are recorded or replayed.
+type unixRoundTripper struct {
+	socket string
+	rt     http.RoundTripper
+}
+
+// http.RoundTripper
+func (u *unixRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	out := req.Clone(req.Context())
+	if out.Host == "" {
+		out.Host = req.URL.Host
+	}
+	out.URL.Scheme = req.URL.Scheme + unixSchemeSuffix
+	out.URL.Host = url.PathEscape(u.socket)
+	resp, err := u.rt.RoundTrip(out)
+	if resp != nil {
+		resp.Request = req
+	}
+	return resp, err
+}
+
+// Undoes the rewriting done by unixRoundTripper so that requests which are
+// actually sent over the socket have a URL that net/http understands. The
+// socket is chosen by the dialer, so the host is only used to pool
+// connections.
+type unixTransport struct {
+	transport *http.Transport
+}
+
+// http.RoundTripper
+func (u *unixTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	out := req.Clone(req.Context())
+	out.URL.Scheme = strings.TrimSuffix(req.URL.Scheme, unixSchemeSuffix)
+	out.URL.Host = "localhost"
+	return u.transport.RoundTrip(out)
+}
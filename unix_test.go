@@ -0,0 +1,85 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvr
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/liquidgecka/testlib"
+)
+
+func TestNewUnixRoundTripper(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+	defer func() {
+		replay = false
+		passThrough = false
+		requestList = nil
+		isSetup = sync.Once{}
+	}()
+
+	// A daemon listening on a unix socket.
+	socket := filepath.Join(t.TempDir(), "daemon.sock")
+	listener, err := net.Listen("unix", socket)
+	T.ExpectSuccess(err)
+	defer listener.Close()
+	go http.Serve(listener, http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("live " + r.Host + r.URL.Path))
+		}))
+
+	get := func(client *http.Client) string {
+		resp, err := client.Get("http://docker/info")
+		T.ExpectSuccess(err)
+		T.Equal(resp.Request.URL.String(), "http://docker/info")
+		body, err := ioutil.ReadAll(resp.Body)
+		T.ExpectSuccess(err)
+		T.ExpectSuccess(resp.Body.Close())
+		return string(body)
+	}
+
+	// Passing through sends the request over the socket.
+	replay = false
+	passThrough = true
+	client := &http.Client{Transport: NewUnixRoundTripper(socket)}
+	T.Equal(get(client), "live docker/info")
+
+	// Replaying matches on the socket path.
+	passThrough = false
+	replay = true
+	isSetup = sync.Once{}
+	isSetup.Do(func() {})
+	unixURL := func(socket string) string {
+		u := &url.URL{
+			Scheme: "http+unix",
+			Host:   url.PathEscape(socket),
+			Path:   "/info",
+		}
+		return u.String()
+	}
+	requestList = []*RequestResponse{
+		testQuery("GET", unixURL("/other.sock"), "", 200,
+			"other").RequestResponse(),
+		testQuery("GET", unixURL(socket), "", 200,
+			"replayed").RequestResponse(),
+	}
+	T.Equal(get(client), "replayed")
+}
@@ -0,0 +1,53 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvr
+
+import (
+	"fmt"
+)
+
+// Functions that check each replayed request and response. These are
+// protected by obfuscatorLock.
+var validatorChain []*obfuscatorEntry
+
+// Adds a function that is called in replay mode for every request that
+// matched a recording, before the recorded response is returned. The
+// RequestResponse given contains the incoming request and the response that
+// is about to be served, and must not be modified. If the validator returns
+// an error then the request fails with that error rather than returning the
+// response. This allows fixtures to be checked against a contract, see the
+// dvropenapi package for example. The returned function removes the
+// validator.
+func AddReplayValidator(f func(*RequestResponse) error) (remove func()) {
+	return addToChain(&validatorChain, f)
+}
+
+// Runs each of the validators, returning the first error.
+func validateReplay(rr *RequestResponse) error {
+	obfuscatorLock.Lock()
+	fs := make([]func(*RequestResponse) error, 0, len(validatorChain))
+	for _, e := range validatorChain {
+		fs = append(fs, e.f)
+	}
+	obfuscatorLock.Unlock()
+
+	for _, f := range fs {
+		if err := f(rr); err != nil {
+			return fmt.Errorf("dvr: replayed %s %s failed validation: %s",
+				rr.Request.Method, rr.Request.URL, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,247 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvr
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A WireMock value matcher. Only exact matches can be converted into a
+// recording.
+type wireMockMatcher struct {
+	EqualTo     *string         `json:"equalTo"`
+	EqualToJSON json.RawMessage `json:"equalToJson"`
+}
+
+// The parts of a WireMock stub mapping that are understood by the importer.
+type wireMockMapping struct {
+	Name    string `json:"name"`
+	ID      string `json:"id"`
+	Request struct {
+		Method          string                     `json:"method"`
+		URL             string                     `json:"url"`
+		URLPath         string                     `json:"urlPath"`
+		URLPattern      string                     `json:"urlPattern"`
+		URLPathPattern  string                     `json:"urlPathPattern"`
+		QueryParameters map[string]wireMockMatcher `json:"queryParameters"`
+		Headers         map[string]wireMockMatcher `json:"headers"`
+		BodyPatterns    []wireMockMatcher          `json:"bodyPatterns"`
+	} `json:"request"`
+	Response struct {
+		Status        int               `json:"status"`
+		StatusMessage string            `json:"statusMessage"`
+		Headers       map[string]string `json:"headers"`
+		Body          *string           `json:"body"`
+		JSONBody      json.RawMessage   `json:"jsonBody"`
+		Base64Body    string            `json:"base64Body"`
+		Fault         string            `json:"fault"`
+	} `json:"response"`
+}
+
+// A file of WireMock mappings, which is either a single mapping or an
+// object containing a list of them.
+type wireMockFile struct {
+	wireMockMapping
+	Mappings []wireMockMapping `json:"mappings"`
+}
+
+// ImportWireMock converts WireMock JSON stub mappings into recordings that can
+// be written to an archive with WriteArchiveFile(). The reader may contain a
+// single mapping or an object with a "mappings" list, as found in WireMock's
+// mappings directory and admin API. Since WireMock URLs are relative, baseURL
+// (for example "https://api.example.com") provides the scheme and host.
+//
+// Only stubs that match exactly can be converted: "url" or "urlPath" with
+// "equalTo" query parameters, "equalTo" headers and "equalTo" or
+// "equalToJson" body patterns. Stubs using patterns, faults or any other
+// matcher are skipped, and their names (or ids) are returned in skipped.
+func ImportWireMock(
+	r io.Reader, baseURL string,
+) (rrs []*RequestResponse, skipped []string, err error) {
+	base, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var file wireMockFile
+	if err := json.NewDecoder(r).Decode(&file); err != nil {
+		return nil, nil, err
+	}
+	mappings := file.Mappings
+	if mappings == nil {
+		mappings = []wireMockMapping{file.wireMockMapping}
+	}
+
+	for i := range mappings {
+		rr, err := mappings[i].recording(base)
+		if err != nil {
+			name := mappings[i].Name
+			if name == "" {
+				name = mappings[i].ID
+			}
+			if name == "" {
+				name = fmt.Sprintf("mapping %d", i)
+			}
+			skipped = append(skipped, fmt.Sprintf("%s: %s", name, err))
+			continue
+		}
+		rrs = append(rrs, rr)
+	}
+	return rrs, skipped, nil
+}
+
+// Returns the exact value that the matcher matches.
+func (m *wireMockMatcher) value() (string, error) {
+	if m.EqualTo != nil {
+		return *m.EqualTo, nil
+	} else if len(m.EqualToJSON) > 0 {
+		// equalToJson may be given as a JSON document or a string that
+		// contains one.
+		var s string
+		if json.Unmarshal(m.EqualToJSON, &s) == nil {
+			return s, nil
+		}
+		buffer := &bytes.Buffer{}
+		if err := json.Compact(buffer, m.EqualToJSON); err != nil {
+			return "", err
+		}
+		return buffer.String(), nil
+	}
+	return "", fmt.Errorf("only equalTo and equalToJson are supported")
+}
+
+// Converts the mapping into a recording.
+func (m *wireMockMapping) recording(base *url.URL) (*RequestResponse, error) {
+	if m.Request.URLPattern != "" || m.Request.URLPathPattern != "" {
+		return nil, fmt.Errorf("URL patterns are not supported")
+	} else if m.Response.Fault != "" {
+		return nil, fmt.Errorf("faults are not supported")
+	} else if len(m.Request.BodyPatterns) > 1 {
+		return nil, fmt.Errorf("multiple body patterns are not supported")
+	}
+	method := strings.ToUpper(m.Request.Method)
+	if method == "" || method == "ANY" {
+		method = "GET"
+	}
+
+	// Build the URL.
+	target := m.Request.URL
+	if target == "" {
+		target = m.Request.URLPath
+	}
+	if target == "" {
+		target = "/"
+	}
+	ref, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	u := base.ResolveReference(ref)
+	if len(m.Request.QueryParameters) > 0 {
+		if m.Request.URL != "" {
+			return nil, fmt.Errorf(
+				"queryParameters can not be combined with url")
+		}
+		names := make([]string, 0, len(m.Request.QueryParameters))
+		for name := range m.Request.QueryParameters {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		query := url.Values{}
+		for _, name := range names {
+			matcher := m.Request.QueryParameters[name]
+			value, err := matcher.value()
+			if err != nil {
+				return nil, fmt.Errorf("query parameter %s: %s", name, err)
+			}
+			query.Set(name, value)
+		}
+		u.RawQuery = query.Encode()
+	}
+
+	req := &http.Request{
+		Method:     method,
+		URL:        u,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+		Host:       u.Host,
+	}
+	for name, matcher := range m.Request.Headers {
+		value, err := matcher.value()
+		if err != nil {
+			return nil, fmt.Errorf("header %s: %s", name, err)
+		}
+		req.Header.Set(name, value)
+	}
+	if len(req.Header) == 0 {
+		req.Header = nil
+	}
+	rr := &RequestResponse{Request: req}
+	if len(m.Request.BodyPatterns) == 1 {
+		value, err := m.Request.BodyPatterns[0].value()
+		if err != nil {
+			return nil, fmt.Errorf("body: %s", err)
+		}
+		rr.RequestBody = []byte(value)
+		req.ContentLength = int64(len(value))
+	}
+
+	// Build the response.
+	status := m.Response.Status
+	if status == 0 {
+		status = 200
+	}
+	statusText := m.Response.StatusMessage
+	if statusText == "" {
+		statusText = http.StatusText(status)
+	}
+	resp := &http.Response{
+		Status:     strconv.Itoa(status) + " " + statusText,
+		StatusCode: status,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+	}
+	for name, value := range m.Response.Headers {
+		resp.Header.Set(name, value)
+	}
+	switch {
+	case m.Response.Body != nil:
+		rr.ResponseBody = []byte(*m.Response.Body)
+	case len(m.Response.JSONBody) > 0:
+		rr.ResponseBody = []byte(m.Response.JSONBody)
+	case m.Response.Base64Body != "":
+		rr.ResponseBody, err = base64.StdEncoding.DecodeString(
+			m.Response.Base64Body)
+		if err != nil {
+			return nil, err
+		}
+	}
+	resp.ContentLength = int64(len(rr.ResponseBody))
+	rr.Response = resp
+	return rr, nil
+}
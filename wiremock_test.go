@@ -0,0 +1,107 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dvr
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/liquidgecka/testlib"
+)
+
+func TestImportWireMock(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	mappings := `{"mappings": [
+		{
+			"name": "get item",
+			"request": {
+				"method": "GET",
+				"urlPath": "/items/1",
+				"queryParameters": {"b": {"equalTo": "2"}, "a": {"equalTo": "1"}},
+				"headers": {"accept": {"equalTo": "application/json"}}
+			},
+			"response": {
+				"status": 200,
+				"jsonBody": {"id": 1},
+				"headers": {"Content-Type": "application/json"}
+			}
+		},
+		{
+			"request": {
+				"method": "POST",
+				"url": "/items",
+				"bodyPatterns": [{"equalToJson": {"name": "x"}}]
+			},
+			"response": {"status": 201, "body": "created"}
+		},
+		{
+			"name": "pattern",
+			"request": {"urlPattern": "/items/.*"},
+			"response": {"status": 200}
+		},
+		{
+			"id": "1234",
+			"request": {
+				"url": "/fuzzy",
+				"headers": {"X": {"contains": "y"}}
+			},
+			"response": {"status": 200}
+		}
+	]}`
+	rrs, skipped, err := ImportWireMock(strings.NewReader(mappings),
+		"https://api.example.com")
+	T.ExpectSuccess(err)
+	T.Equal(len(rrs), 2)
+	T.Equal(skipped, []string{
+		"pattern: URL patterns are not supported",
+		"1234: header X: only equalTo and equalToJson are supported",
+	})
+
+	T.Equal(rrs[0].Request.Method, "GET")
+	T.Equal(rrs[0].Request.URL.String(),
+		"https://api.example.com/items/1?a=1&b=2")
+	T.Equal(rrs[0].Request.Header,
+		http.Header{"Accept": {"application/json"}})
+	T.Equal(rrs[0].Response.StatusCode, 200)
+	T.Equal(rrs[0].Response.Status, "200 OK")
+	T.Equal(rrs[0].Response.Header.Get("Content-Type"), "application/json")
+	T.Equal(string(rrs[0].ResponseBody), `{"id": 1}`)
+
+	T.Equal(rrs[1].Request.Method, "POST")
+	T.Equal(rrs[1].Request.URL.String(), "https://api.example.com/items")
+	T.Equal(string(rrs[1].RequestBody), `{"name":"x"}`)
+	T.Equal(rrs[1].Response.StatusCode, 201)
+	T.Equal(string(rrs[1].ResponseBody), "created")
+
+	// The results can be written to an archive and read back.
+	name := T.TempFile().Name()
+	T.ExpectSuccess(WriteArchiveFile(name, rrs))
+	read, err := ReadArchiveFile(name)
+	T.ExpectSuccess(err)
+	T.Equal(len(read), 2)
+	T.Equal(read[1].Request.URL.String(), "https://api.example.com/items")
+	T.Equal(string(read[1].ResponseBody), "created")
+
+	// A single mapping file.
+	rrs, _, err = ImportWireMock(strings.NewReader(
+		`{"request": {"url": "/one"}, "response": {"status": 204}}`),
+		"http://host")
+	T.ExpectSuccess(err)
+	T.Equal(len(rrs), 1)
+	T.Equal(rrs[0].Request.URL.String(), "http://host/one")
+}